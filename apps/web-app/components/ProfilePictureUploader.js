@@ -55,7 +55,7 @@ export default function ProfilePictureUploader({ onUploadSuccess }) {
     <div>
       <h3>Upload New Profile Picture</h3>
       <form onSubmit={handleSubmit}>
-        <input type="file" accept="image/png, image/jpeg" onChange={handleFileChange} />
+        <input type="file" accept="image/png, image/jpeg, image/gif" onChange={handleFileChange} />
         <button type="submit" disabled={!file || isUploading}>
           {isUploading ? 'Uploading...' : 'Upload'}
         </button>
@@ -1,30 +1,71 @@
-import { createContext, useState, useEffect, useContext } from 'react';
+import { createContext, useState, useEffect, useContext, useRef } from 'react';
 import { useRouter } from 'next/router';
 
 export const AuthContext = createContext();
 
+// How long before the access token expires it is refreshed, in milliseconds.
+const REFRESH_MARGIN = 60 * 1000;
+
+const getCookie = (name) => document.cookie.split('; ').find(row => row.startsWith(`${name}=`))?.split('=')[1];
+
+// tokenExpiresAt returns when an access token expires, in milliseconds, or null if it cannot be read.
+const tokenExpiresAt = (token) => {
+  try {
+    const payload = JSON.parse(atob(token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')));
+    return payload.exp ? payload.exp * 1000 : null;
+  } catch (error) {
+    return null;
+  }
+};
+
 export const AuthProvider = ({ children }) => {
   const [user, setUser] = useState(null);
   const [stats, setStats] = useState({ score: 0 });
   const [loading, setLoading] = useState(true);
   const router = useRouter();
+  const refreshTimer = useRef(null);
 
-  const login = (token) => {
-    // In a real app, you'd use a library like js-cookie
-    document.cookie = `auth_token=${token}; path=/; max-age=86400`; // 1 day
+  // Access tokens are short-lived, so the session is refreshed shortly before the
+  // access token expires, and whenever the API reports it has expired.
+  const scheduleRefresh = (token) => {
+    clearTimeout(refreshTimer.current);
+    const expiresAt = tokenExpiresAt(token);
+    if (expiresAt) {
+      refreshTimer.current = setTimeout(refreshSession, Math.max(expiresAt - Date.now() - REFRESH_MARGIN, 0));
+    }
+  };
+
+  // refreshSession trades the refresh token for new tokens and returns whether it
+  // succeeded. The refresh token cookie is HttpOnly, so only the API route sees it.
+  const refreshSession = async () => {
+    try {
+      const res = await fetch('/api/token/refresh', { method: 'POST' }); // Sets the new cookies.
+      if (!res.ok) {
+        return false;
+      }
+      scheduleRefresh(getCookie('auth_token'));
+      return true;
+    } catch (error) {
+      return false;
+    }
+  };
+
+  // login loads the user once an API route has stored a new session in cookies.
+  const login = () => {
     checkUser();
   };
 
   const checkUser = async () => {
-    const token = document.cookie.split('; ').find(row => row.startsWith('auth_token='))?.split('=')[1];
-    if (!token) {
-      setUser(null);
-      setLoading(false);
-      return;
-    }
+    const token = getCookie('auth_token');
 
     try {
-      const userRes = await fetch('/api/me'); // This API route will now need to read the cookie
+      let userRes = await fetch('/api/me'); // This API route will now need to read the cookie
+      // The access token has expired: refresh it and try once more.
+      if (userRes.status === 401 && await refreshSession()) {
+        userRes = await fetch('/api/me');
+      } else if (userRes.ok) {
+        scheduleRefresh(token);
+      }
       if (userRes.ok) {
         const { user } = await userRes.json();
         setUser(user);
@@ -48,10 +89,12 @@ export const AuthProvider = ({ children }) => {
 
   useEffect(() => {
     checkUser();
+    return () => clearTimeout(refreshTimer.current);
   }, []);
 
-  const logout = () => {
-    document.cookie = 'auth_token=; path=/; expires=Thu, 01 Jan 1970 00:00:00 GMT';
+  const logout = async () => {
+    clearTimeout(refreshTimer.current);
+    await fetch('/api/logout', { method: 'POST' }).catch(() => {}); // Clears the cookies.
     setUser(null);
     setStats({ score: 0 });
     router.push('/'); // Redirect to homepage after logout
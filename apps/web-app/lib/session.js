@@ -0,0 +1,33 @@
+import { serialize } from 'cookie';
+
+// How long the browser keeps the refresh token; the user service's RefreshTokenTTL.
+const REFRESH_TOKEN_MAX_AGE = 30 * 24 * 60 * 60;
+// The refresh token is only sent to the API routes that use it.
+const REFRESH_TOKEN_PATH = '/api/token';
+
+/**
+ * Stores the tokens of a session the user service issued in cookies. The refresh
+ * token is HttpOnly, so only the API routes ever see it.
+ */
+export function setSessionCookies(res, session) {
+  res.setHeader('Set-Cookie', [
+    serialize('auth_token', session.token, { path: '/', maxAge: 86400, sameSite: 'lax' }),
+    serialize('refresh_token', session.refresh_token, {
+      path: REFRESH_TOKEN_PATH,
+      maxAge: REFRESH_TOKEN_MAX_AGE,
+      httpOnly: true,
+      secure: true,
+      sameSite: 'strict',
+    }),
+  ]);
+}
+
+/**
+ * Removes the session cookies set by setSessionCookies.
+ */
+export function clearSessionCookies(res) {
+  res.setHeader('Set-Cookie', [
+    serialize('auth_token', '', { path: '/', maxAge: 0 }),
+    serialize('refresh_token', '', { path: REFRESH_TOKEN_PATH, maxAge: 0, httpOnly: true, secure: true, sameSite: 'strict' }),
+  ]);
+}
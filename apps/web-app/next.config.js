@@ -4,6 +4,14 @@ const nextConfig = {
   // This enables the standalone output mode, which is optimized for Docker.
   // It creates a '.next/standalone' folder with a minimal server and dependencies.
   output: 'standalone',
+  // These pages are opened with a one-time code or token in the URL. Sessions are
+  // never put in URLs, but the codes must not leak to other sites either.
+  async headers() {
+    return ['/auth/callback', '/link-account', '/reset-password', '/settings'].map((source) => ({
+      source,
+      headers: [{ key: 'Referrer-Policy', value: 'no-referrer' }],
+    }));
+  },
 };
 
 module.exports = nextConfig;
@@ -0,0 +1,40 @@
+import cookie from 'cookie';
+
+/**
+ * Links an identity offered by an OAuth login to the signed-in user's account,
+ * using the token the user service redirected to /link-account with.
+ */
+export default async function handler(req, res) {
+  if (req.method !== 'POST') {
+    res.setHeader('Allow', ['POST']);
+    return res.status(405).json({ message: 'Method Not Allowed' });
+  }
+
+  const cookies = cookie.parse(req.headers.cookie || '');
+  const token = cookies.auth_token;
+  if (!token) {
+    return res.status(401).json({ message: 'Not authenticated' });
+  }
+
+  try {
+    const gatewayUrl = process.env.API_GATEWAY_URL || 'http://api-gateway:8080';
+    const apiRes = await fetch(`${gatewayUrl}/api/users/identities/confirm`, {
+      method: 'POST',
+      headers: {
+        'Authorization': `Bearer ${token}`,
+        'Content-Type': 'application/json',
+      },
+      body: JSON.stringify({ token: req.body.token }),
+    });
+
+    const data = await apiRes.json();
+    if (!apiRes.ok) {
+      return res.status(apiRes.status).json({ message: data.error || 'Failed to link the account.' });
+    }
+    res.status(200).json(data);
+
+  } catch (error) {
+    console.error('Confirm identity link API route error:', error);
+    res.status(500).json({ message: 'An internal server error occurred.' });
+  }
+}
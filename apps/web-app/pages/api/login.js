@@ -1,4 +1,4 @@
-import { serialize } from 'cookie';
+import { setSessionCookies } from '../../lib/session';
 
 export default async function handler(req, res) {
   if (req.method !== 'POST') {
@@ -31,8 +31,12 @@ export default async function handler(req, res) {
     const data = await apiRes.json();
 
     // The backend will either return a full token, or a temp_token if 2FA is needed.
-    // We just forward this response to the client.
-    res.status(200).json(data);
+    // The client only needs the temp_token; the session's tokens go into cookies.
+    if (data.temp_token) {
+      return res.status(200).json(data);
+    }
+    setSessionCookies(res, data);
+    res.status(200).json({ expires_in: data.expires_in });
 
   } catch (error) {
     console.error('Login API route error:', error);
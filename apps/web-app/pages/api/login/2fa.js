@@ -0,0 +1,39 @@
+import { setSessionCookies } from '../../../lib/session';
+
+/**
+ * Completes a login that needs a second factor, and stores the session's tokens
+ * in cookies.
+ */
+export default async function handler(req, res) {
+  if (req.method !== 'POST') {
+    res.setHeader('Allow', ['POST']);
+    return res.status(405).json({ message: 'Method Not Allowed' });
+  }
+
+  const { temp_token, token, recovery_code } = req.body;
+  if (!temp_token || (!token && !recovery_code)) {
+    return res.status(400).json({ message: 'The authentication code is required.' });
+  }
+
+  try {
+    const gatewayUrl = process.env.API_GATEWAY_URL || 'http://api-gateway:8080';
+    const apiRes = await fetch(`${gatewayUrl}/api/users/login/2fa`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ temp_token, token, recovery_code }),
+    });
+
+    if (!apiRes.ok) {
+      const errorData = await apiRes.json();
+      return res.status(apiRes.status).json({ message: errorData.error || 'Failed 2FA verification.' });
+    }
+
+    const data = await apiRes.json();
+    setSessionCookies(res, data);
+    res.status(200).json({ expires_in: data.expires_in });
+
+  } catch (error) {
+    console.error('2FA login API route error:', error);
+    res.status(500).json({ message: 'An internal server error occurred.' });
+  }
+}
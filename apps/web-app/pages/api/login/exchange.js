@@ -0,0 +1,47 @@
+import cookie, { serialize } from 'cookie';
+import { setSessionCookies } from '../../../lib/session';
+
+/**
+ * Trades the one-time code an OAuth login redirected back with for a session,
+ * and stores the session's tokens in cookies. The code is bound to the
+ * oauthstate cookie of the browser that started the login, which is passed on.
+ */
+export default async function handler(req, res) {
+  if (req.method !== 'POST') {
+    res.setHeader('Allow', ['POST']);
+    return res.status(405).json({ message: 'Method Not Allowed' });
+  }
+
+  const { code } = req.body;
+  const cookies = cookie.parse(req.headers.cookie || '');
+  if (!code || !cookies.oauthstate) {
+    return res.status(400).json({ message: 'Invalid or expired login code.' });
+  }
+
+  try {
+    const gatewayUrl = process.env.API_GATEWAY_URL || 'http://api-gateway:8080';
+    const apiRes = await fetch(`${gatewayUrl}/api/users/login/exchange`, {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json',
+        'Cookie': serialize('oauthstate', cookies.oauthstate),
+      },
+      body: JSON.stringify({ code }),
+    });
+
+    if (!apiRes.ok) {
+      const errorData = await apiRes.json();
+      return res.status(apiRes.status).json({ message: errorData.error || 'Authentication failed.' });
+    }
+
+    const data = await apiRes.json();
+    setSessionCookies(res, data);
+    // The login is complete; the state cookie is no longer needed.
+    res.appendHeader('Set-Cookie', serialize('oauthstate', '', { path: '/', maxAge: 0, httpOnly: true }));
+    res.status(200).json({ expires_in: data.expires_in });
+
+  } catch (error) {
+    console.error('Login code exchange API route error:', error);
+    res.status(500).json({ message: 'An internal server error occurred.' });
+  }
+}
@@ -1,6 +1,15 @@
+import { clearSessionCookies } from '../../lib/session';
+
+/**
+ * Ends the session in this browser by removing its cookies. The refresh token
+ * cookie is HttpOnly, so only an API route can remove it.
+ */
 export default async function handler(req, res) {
-  // The cookie is now managed on the client-side.
-  // This endpoint can be kept for future use (e.g., server-side session invalidation)
-  // but for now, it does nothing.
+  if (req.method !== 'POST') {
+    res.setHeader('Allow', ['POST']);
+    return res.status(405).json({ message: 'Method Not Allowed' });
+  }
+
+  clearSessionCookies(res);
   res.status(200).json({ success: true, message: 'Logged out successfully' });
 }
@@ -26,27 +26,28 @@ export default async function handler(req, res) {
     } catch (error) {
       res.status(500).json({ message: 'Internal Server Error' });
     }
-  } else if (req.method === 'PUT') {
+  } else if (req.method === 'PATCH' || req.method === 'PUT') {
     try {
       const response = await fetch(`${USER_SERVICE_URL}/api/v1/preferences`, {
-        method: 'PUT',
+        method: 'PATCH',
         headers: {
           'Authorization': `Bearer ${token}`,
-          'Content-Type': 'application/json',
+          'Content-Type': 'application/merge-patch+json',
         },
         body: JSON.stringify(req.body),
       });
 
+      const data = await response.json();
       if (!response.ok) {
-        return res.status(response.status).json({ message: 'Failed to update preferences' });
+        return res.status(response.status).json({ message: data.error || 'Failed to update preferences', problems: data.problems });
       }
 
-      res.status(204).end();
+      res.status(200).json(data);
     } catch (error) {
       res.status(500).json({ message: 'Internal Server Error' });
     }
   } else {
-    res.setHeader('Allow', ['GET', 'PUT']);
+    res.setHeader('Allow', ['GET', 'PATCH', 'PUT']);
     res.status(405).end(`Method ${req.method} Not Allowed`);
   }
 }
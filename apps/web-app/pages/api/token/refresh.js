@@ -0,0 +1,46 @@
+import cookie from 'cookie';
+import { clearSessionCookies, setSessionCookies } from '../../../lib/session';
+
+/**
+ * Exchanges the refresh token cookie for a new access token and stores both new
+ * tokens in cookies. The user service rotates the refresh token on every call.
+ * The refresh token is HttpOnly: the browser only ever sends it here.
+ */
+export default async function handler(req, res) {
+  if (req.method !== 'POST') {
+    res.setHeader('Allow', ['POST']);
+    return res.status(405).json({ message: 'Method Not Allowed' });
+  }
+
+  const cookies = cookie.parse(req.headers.cookie || '');
+  const refreshToken = cookies.refresh_token;
+  if (!refreshToken) {
+    return res.status(401).json({ message: 'Not authenticated' });
+  }
+
+  try {
+    const gatewayUrl = process.env.API_GATEWAY_URL || 'http://api-gateway:8080';
+    const apiRes = await fetch(`${gatewayUrl}/api/users/token/refresh`, {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify({ refresh_token: refreshToken }),
+    });
+
+    if (!apiRes.ok) {
+      const errorData = await apiRes.json();
+      if (apiRes.status === 401) {
+        // The refresh token was revoked or has expired: the session is over.
+        clearSessionCookies(res);
+      }
+      return res.status(apiRes.status).json({ message: errorData.error || 'Failed to refresh the session.' });
+    }
+
+    const data = await apiRes.json();
+    setSessionCookies(res, data);
+    res.status(200).json({ expires_in: data.expires_in });
+
+  } catch (error) {
+    console.error('Token refresh API route error:', error);
+    res.status(500).json({ message: 'An internal server error occurred.' });
+  }
+}
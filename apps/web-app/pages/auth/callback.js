@@ -8,15 +8,29 @@ export default function AuthCallbackPage() {
 
   useEffect(() => {
     if (router.isReady) {
-      const { token } = router.query;
-      if (token) {
-        login(token);
-        // Redirect to the profile page after successful login
-        router.push('/profile');
-      } else {
-        // Handle error or no token case
+      const { code } = router.query;
+      if (!code) {
+        // Handle error or no code case
         router.push('/login?error=Authentication failed');
+        return;
       }
+
+      // Trade the one-time code for a session. The browser sends along the
+      // oauthstate cookie the code is bound to, and the API route stores the
+      // session's tokens in cookies.
+      fetch('/api/login/exchange', {
+        method: 'POST',
+        credentials: 'same-origin',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ code }),
+      })
+        .then((res) => (res.ok ? res.json() : Promise.reject(res)))
+        .then(() => {
+          login();
+          // Redirect to the profile page after successful login
+          router.replace('/profile');
+        })
+        .catch(() => router.replace('/login?error=Authentication failed'));
     }
   }, [router.isReady, router.query, login, router]);
 
@@ -0,0 +1,86 @@
+import { useState, useEffect } from 'react';
+import Head from 'next/head';
+import Link from 'next/link';
+import { useRouter } from 'next/router';
+import { useAuth } from '../context/AuthContext';
+import styles from '../styles/Login.module.css'; // Reuse login styles
+
+// The user service redirects here when someone signs in with a provider using the
+// verified email of an existing account. The identity is only linked once the
+// owner of that account, signed in, confirms it.
+export default function LinkAccountPage() {
+  const router = useRouter();
+  const { user, loading } = useAuth();
+  const [token, setToken] = useState(null);
+  const [provider, setProvider] = useState('');
+  const [message, setMessage] = useState('');
+  const [error, setError] = useState('');
+  const [submitting, setSubmitting] = useState(false);
+
+  useEffect(() => {
+    if (router.isReady) {
+      setToken(router.query.token || null);
+      setProvider(router.query.provider || '');
+    }
+  }, [router.isReady, router.query.token, router.query.provider]);
+
+  const handleConfirm = async () => {
+    setSubmitting(true);
+    setError('');
+
+    try {
+      const res = await fetch('/api/identities/confirm', {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ token }),
+      });
+
+      const data = await res.json();
+      if (res.ok) {
+        setMessage(`Your ${provider} account is now linked. You can use it to log in.`);
+      } else {
+        setError(data.message || 'Failed to link the account.');
+      }
+    } catch (err) {
+      setError('An unexpected error occurred.');
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  if (loading || !router.isReady) {
+    return <div className={styles.container}>Loading...</div>;
+  }
+
+  if (!token) {
+    return <div className={styles.container}>This link is invalid.</div>;
+  }
+
+  return (
+    <div className={styles.container}>
+      <Head>
+        <title>Link Account</title>
+      </Head>
+
+      <h1 className={styles.title}>Link your {provider} account</h1>
+      {!user ? (
+        <p>
+          An account with this email already exists. <Link href={`/login?next=${encodeURIComponent(router.asPath)}`}>Log in</Link> to
+          it to link your {provider} account.
+        </p>
+      ) : message ? (
+        <p className={styles.message}>
+          {message} <Link href="/settings">Back to settings</Link>
+        </p>
+      ) : (
+        <>
+          <p>Do you want to log in to {user.email} with your {provider} account from now on?</p>
+          <button onClick={handleConfirm} disabled={submitting} className={styles.button}>
+            {submitting ? 'Linking...' : 'Link account'}
+          </button>
+        </>
+      )}
+      {error && <p className={styles.error}>{error}</p>}
+    </div>
+  );
+}
@@ -1,6 +1,7 @@
 import { useState } from 'react';
 import Head from 'next/head';
 import { useRouter } from 'next/router';
+import { useAuth } from '../context/AuthContext';
 import styles from '../styles/Login.module.css';
 
 export default function LoginPage() {
@@ -8,11 +9,16 @@ export default function LoginPage() {
   const [password, setPassword] = useState('');
   const [error, setError] = useState('');
   const router = useRouter();
+  const { login } = useAuth();
+  // Where to go after logging in. Only paths on this site are followed.
+  const { next: nextParam } = router.query;
+  const next = typeof nextParam === 'string' && /^\/(?![\/\\])/.test(nextParam) ? nextParam : '/';
 
   // State for 2FA flow
   const [needs2FA, setNeeds2FA] = useState(false);
   const [tempToken, setTempToken] = useState('');
   const [twoFactorToken, setTwoFactorToken] = useState('');
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false);
 
   const handlePasswordSubmit = async (e) => {
     e.preventDefault();
@@ -32,8 +38,9 @@ export default function LoginPage() {
           setTempToken(data.temp_token);
           setNeeds2FA(true);
         } else {
-          // Login was successful, the cookie is set by the API route.
-          router.push('/');
+          // Login was successful, the cookies are set by the API route.
+          login();
+          router.push(next);
         }
       } else {
         setError(data.message || 'Failed to login.');
@@ -48,18 +55,21 @@ export default function LoginPage() {
     setError('');
 
     try {
-      const res = await fetch('/api/users/login/2fa', {
+      const res = await fetch('/api/login/2fa', {
         method: 'POST',
         headers: { 'Content-Type': 'application/json' },
-        body: JSON.stringify({ temp_token: tempToken, token: twoFactorToken }),
+        body: JSON.stringify(useRecoveryCode
+          ? { temp_token: tempToken, recovery_code: twoFactorToken }
+          : { temp_token: tempToken, token: twoFactorToken }),
       });
 
       if (res.ok) {
-        // 2FA login successful, cookie is set.
-        router.push('/');
+        // 2FA login successful, the cookies are set by the API route.
+        login();
+        router.push(next);
       } else {
         const data = await res.json();
-        setError(data.error || 'Failed 2FA verification.');
+        setError(data.message || 'Failed 2FA verification.');
       }
     } catch (err) {
       setError('An error occurred. Please try again.');
@@ -101,19 +111,30 @@ export default function LoginPage() {
           </form>
         ) : (
           <form onSubmit={handle2FASubmit} className={styles.form}>
-            <p>Enter the code from your authenticator app.</p>
+            <p>{useRecoveryCode ? 'Enter one of your recovery codes.' : 'Enter the code from your authenticator app.'}</p>
             <div className={styles.inputGroup}>
-              <label htmlFor="2fa-token">Authentication Code</label>
+              <label htmlFor="2fa-token">{useRecoveryCode ? 'Recovery Code' : 'Authentication Code'}</label>
               <input
                 type="text"
                 id="2fa-token"
                 value={twoFactorToken}
                 onChange={(e) => setTwoFactorToken(e.target.value)}
                 required
-                maxLength="6"
+                maxLength={useRecoveryCode ? 32 : 6}
+                autoComplete="one-time-code"
               />
             </div>
             <button type="submit" className={styles.button}>Verify</button>
+            <button
+              type="button"
+              className={styles.linkButton}
+              onClick={() => {
+                setUseRecoveryCode(!useRecoveryCode);
+                setTwoFactorToken('');
+              }}
+            >
+              {useRecoveryCode ? 'Use your authenticator app instead' : 'Use a recovery code instead'}
+            </button>
           </form>
         )}
 
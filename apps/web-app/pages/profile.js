@@ -36,7 +36,7 @@ export default function ProfilePage() {
           }
           if (activitiesRes.ok) {
             const data = await activitiesRes.json();
-            setActivities(data);
+            setActivities(data.data);
           }
         } catch (error) {
           console.error("Failed to fetch profile data", error);
@@ -39,7 +39,7 @@ export default function SettingsPage() {
 
     try {
       await fetch('/api/profile/preferences', {
-        method: 'PUT',
+        method: 'PATCH',
         headers: { 'Content-Type': 'application/json' },
         body: JSON.stringify({ theme: newTheme }),
       });
@@ -135,7 +135,7 @@ export default function SettingsPage() {
           </button>
         </div>
         <div className={styles.dangerAction}>
-          <p>Permanently delete your account and all of your data. This action is irreversible.</p>
+          <p>Permanently delete your account and all of your data. You can log in to cancel within the grace period; after that, this cannot be undone.</p>
           <button
             onClick={() => setShowDeleteModal(true)}
             className={styles.dangerButton}
@@ -166,7 +166,7 @@ export default function SettingsPage() {
         onClose={() => setShowDeleteModal(false)}
         title="Permanently Delete Account"
       >
-        <p>Are you absolutely sure? This will permanently delete your account, profile, and all associated data. This action cannot be undone.</p>
+        <p>Are you absolutely sure? Your account will be deactivated now, and your account, profile, and all associated data will be permanently deleted once the grace period ends. Logging in before then lets you cancel.</p>
         <div className={styles.modalActions}>
           <button onClick={() => setShowDeleteModal(false)} className={styles.button}>
             Cancel
@@ -0,0 +1,224 @@
+package authz
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testSecret = []byte("gateway-secret")
+
+func generateKeyForTest(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return key
+}
+
+// tokenForTest signs an access token the way the user service does.
+func tokenForTest(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	base := jwt.MapClaims{
+		"user_id": 7,
+		"role":    RoleUser,
+		"type":    "full_auth",
+		"sid":     3,
+		"iss":     "user-service",
+		"exp":     time.Now().Add(time.Minute).Unix(),
+	}
+	for k, v := range claims {
+		base[k] = v
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, base)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func bearerRequestForTest(token string) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/users/7/progress", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+func TestJWTVerifier(t *testing.T) {
+	key := generateKeyForTest(t)
+	verifier := NewJWTVerifier(StaticKey(&key.PublicKey))
+
+	identity, err := verifier.Verify(bearerRequestForTest(tokenForTest(t, key, "", nil)))
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if *identity != (Identity{UserID: 7, Role: RoleUser, SessionID: 3}) {
+		t.Errorf("unexpected identity: %+v", identity)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Temporary 2FA token", tokenForTest(t, key, "", jwt.MapClaims{"type": "2fa_temp"})},
+		{"Expired", tokenForTest(t, key, "", jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})},
+		{"Other issuer", tokenForTest(t, key, "", jwt.MapClaims{"iss": "someone-else"})},
+		{"Signed with another key", tokenForTest(t, generateKeyForTest(t), "", nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.Verify(bearerRequestForTest(tt.token)); err == nil {
+				t.Error("expected the token to be rejected")
+			}
+		})
+	}
+
+	t.Run("No token", func(t *testing.T) {
+		if _, err := verifier.Verify(httptest.NewRequest(http.MethodGet, "/", nil)); err != ErrNoCredentials {
+			t.Errorf("expected ErrNoCredentials; got %v", err)
+		}
+	})
+}
+
+func TestJWKS(t *testing.T) {
+	key := generateKeyForTest(t)
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key-1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		}}})
+	}))
+	defer server.Close()
+
+	keys := NewJWKS(server.URL)
+	verifier := NewJWTVerifier(keys.Keyfunc)
+	for i := 0; i < 2; i++ {
+		if _, err := verifier.Verify(bearerRequestForTest(tokenForTest(t, key, "key-1", nil))); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+	}
+	if _, err := verifier.Verify(bearerRequestForTest(tokenForTest(t, key, "key-2", nil))); err == nil {
+		t.Error("expected a token for an unknown key to be rejected")
+	}
+	if fetches != 1 {
+		t.Errorf("expected the key set to be fetched once; got %d", fetches)
+	}
+}
+
+func TestHeaderVerifier(t *testing.T) {
+	verifier := &HeaderVerifier{Secret: testSecret, MaxAge: time.Minute}
+	identity := &Identity{UserID: 7, Role: RoleModerator, ImpersonatorID: 1}
+
+	signed := func(now time.Time) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/users/7/progress?limit=5", nil)
+		SignRequest(r, testSecret, identity, now)
+		return r
+	}
+
+	got, err := verifier.Verify(signed(time.Now()))
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if *got != *identity {
+		t.Errorf("expected %+v; got %+v", identity, got)
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(r *http.Request) *http.Request
+	}{
+		{"Role changed", func(r *http.Request) *http.Request { r.Header.Set(HeaderRole, RoleAdmin); return r }},
+		{"User changed", func(r *http.Request) *http.Request { r.Header.Set(HeaderUserID, "8"); return r }},
+		{"Impersonator removed", func(r *http.Request) *http.Request { r.Header.Del(HeaderImpersonatorID); return r }},
+		{"Moved to another request", func(r *http.Request) *http.Request {
+			other := httptest.NewRequest(http.MethodDelete, "/account", nil)
+			other.Header = r.Header
+			return other
+		}},
+		{"Expired", func(*http.Request) *http.Request { return signed(time.Now().Add(-2 * time.Minute)) }},
+		{"Signed with another secret", func(r *http.Request) *http.Request {
+			SignRequest(r, []byte("guess"), identity, time.Now())
+			return r
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := verifier.Verify(tt.tamper(signed(time.Now()))); err == nil {
+				t.Error("expected the headers to be rejected")
+			}
+		})
+	}
+
+	t.Run("Bare user ID header", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(HeaderUserID, "7")
+		if _, err := Chain(verifier).Verify(r); err != ErrNoCredentials {
+			t.Errorf("expected ErrNoCredentials; got %v", err)
+		}
+	})
+}
+
+// serveForTest runs a request through Authenticate and the given middleware.
+func serveForTest(verifier Verifier, path string, r *http.Request, middleware ...gin.HandlerFunc) int {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	handlers := append([]gin.HandlerFunc{Authenticate(verifier)}, middleware...)
+	handlers = append(handlers, func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.GET(path, handlers...)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestMiddleware(t *testing.T) {
+	verifier := Chain(&HeaderVerifier{Secret: testSecret, MaxAge: time.Minute})
+	requestAs := func(path string, identity *Identity) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if identity != nil {
+			SignRequest(r, testSecret, identity, time.Now())
+		}
+		return r
+	}
+	student := &Identity{UserID: 7, Role: RoleUser}
+	moderator := &Identity{UserID: 2, Role: RoleModerator}
+
+	tests := []struct {
+		name       string
+		path       string
+		identity   *Identity
+		middleware gin.HandlerFunc
+		want       int
+	}{
+		{"Unauthenticated", "/users/7/progress", nil, RequireSelfOrRole("userId", RoleModerator), http.StatusUnauthorized},
+		{"Own resource", "/users/7/progress", student, RequireSelfOrRole("userId", RoleModerator), http.StatusOK},
+		{"Someone else's resource", "/users/8/progress", student, RequireSelfOrRole("userId", RoleModerator), http.StatusForbidden},
+		{"Moderator on any user", "/users/8/progress", moderator, RequireSelfOrRole("userId", RoleModerator), http.StatusOK},
+		{"Own only", "/users/8/progress", moderator, RequireSelfOrRole("userId"), http.StatusForbidden},
+		{"Invalid user ID", "/users/me/progress", student, RequireSelfOrRole("userId"), http.StatusBadRequest},
+		{"Role allowed", "/users/8/progress", moderator, RequireRole(RoleModerator, RoleAdmin), http.StatusOK},
+		{"Role refused", "/users/7/progress", student, RequireRole(RoleModerator, RoleAdmin), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := serveForTest(verifier, "/users/:userId/progress", requestAs(tt.path, tt.identity), tt.middleware); got != tt.want {
+				t.Errorf("expected status %d; got %d", tt.want, got)
+			}
+		})
+	}
+}
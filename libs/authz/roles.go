@@ -0,0 +1,65 @@
+package authz
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+func hasRole(c *gin.Context, roles []string) bool {
+	role := c.GetString(RoleKey)
+	for _, allowed := range roles {
+		if role == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireRole creates a gin middleware that only lets users with one of the given
+// roles through. It must run after Authenticate.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !hasRole(c, roles) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "You do not have permission to perform this action."})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireSelfOrRole creates a gin middleware for routes about one user, named by
+// the param path parameter. It lets that user through ("Own" in the permission
+// matrix) as well as users with one of the given roles ("All"). It must run after
+// Authenticate.
+func RequireSelfOrRole(param string, roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		targetID, err := strconv.ParseInt(c.Param(param), 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			c.Abort()
+			return
+		}
+		if !AllowSelfOrRole(c, targetID, roles...) {
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// AllowSelfOrRole reports whether the authenticated user is targetID or has one of
+// the given roles. Otherwise it writes a 403 response. It is the check behind
+// RequireSelfOrRole, for handlers that enforce it themselves.
+func AllowSelfOrRole(c *gin.Context, targetID int64, roles ...string) bool {
+	if userID, ok := c.Get(UserIDKey); ok && userID.(int64) == targetID {
+		return true
+	}
+	if hasRole(c, roles) {
+		return true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "You can only access your own resources."})
+	return false
+}
@@ -0,0 +1,122 @@
+// Package erasure erases the data a service holds about users deleted in the user
+// service. The user service sends a `user_deleted` event to the queue of every
+// service that holds user data, and keeps asking until the service confirms the
+// erasure with a `user_data_erased` event.
+package erasure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/free-education/events"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RepliesQueue is where erasures are confirmed to the user service.
+const RepliesQueue = "user_deletion_replies"
+
+// Queue returns the queue a service receives `user_deleted` events on.
+func Queue(service string) string {
+	return service + "_user_deletions"
+}
+
+// Eraser erases everything a service holds about a user.
+type Eraser interface {
+	EraseUserData(ctx context.Context, userID int64) error
+}
+
+// Consume erases the data of every user the user service reports as deleted with
+// eraser and confirms each erasure. service is the name the user service knows the
+// service by, e.g. "content". Consume reconnects whenever the connection to
+// RabbitMQ is lost, and never returns.
+func Consume(url, service string, eraser Eraser) {
+	for {
+		err := run(url, service, eraser)
+		log.Printf("User deletion consumer stopped: %v. Reconnecting in 5 seconds...", err)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func run(url, service string, eraser Eraser) error {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	queue := Queue(service)
+	for _, name := range []string{queue, RepliesQueue} {
+		if _, err := ch.QueueDeclare(name, true, false, false, false, nil); err != nil {
+			return err
+		}
+	}
+	msgs, err := ch.Consume(queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+
+	log.Printf(" [*] Waiting for user deletions in %s", queue)
+	reply := func(body []byte) error {
+		return ch.Publish("", RepliesQueue, false, false, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Body:         body,
+		})
+	}
+	for d := range msgs {
+		if err := handleUserDeleted(context.Background(), service, eraser, reply, d.Body); err != nil {
+			// The user service asks again until the erasure is confirmed.
+			log.Printf("Error erasing user data: %v", err)
+			d.Nack(false, false)
+			continue
+		}
+		d.Ack(false)
+	}
+	return errors.New("channel closed")
+}
+
+// handleUserDeleted erases the data of the user named in a `user_deleted` event and
+// sends the confirmation with reply. Erasing is idempotent, so repeated requests
+// are confirmed again.
+func handleUserDeleted(ctx context.Context, service string, eraser Eraser, reply func(body []byte) error, body []byte) error {
+	envelope, err := events.Decode(body)
+	if err != nil {
+		return fmt.Errorf("malformed user deletion: %w", err)
+	}
+	payload, err := envelope.DecodePayload()
+	if err != nil {
+		return err
+	}
+	event, ok := payload.(*events.UserDeleted)
+	if !ok || event.UserID == 0 {
+		return fmt.Errorf("unexpected %s event %s", envelope.Type, envelope.ID)
+	}
+
+	if err := eraser.EraseUserData(ctx, event.UserID); err != nil {
+		return fmt.Errorf("erasing data of user %d: %w", event.UserID, err)
+	}
+	log.Printf("Erased the data of deleted user %d", event.UserID)
+
+	confirmation, err := events.New(service+"-service", &events.UserDataErased{
+		DeletionID: event.DeletionID,
+		UserID:     event.UserID,
+		Service:    service,
+	})
+	if err != nil {
+		return err
+	}
+	confirmationBody, err := events.Encode(confirmation)
+	if err != nil {
+		return err
+	}
+	return reply(confirmationBody)
+}
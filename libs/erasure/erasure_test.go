@@ -0,0 +1,59 @@
+package erasure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/free-education/events"
+)
+
+type mockEraser struct {
+	erased []int64
+}
+
+func (m *mockEraser) EraseUserData(ctx context.Context, userID int64) error {
+	m.erased = append(m.erased, userID)
+	return nil
+}
+
+func TestHandleUserDeleted(t *testing.T) {
+	store := &mockEraser{}
+	var replies [][]byte
+	reply := func(body []byte) error {
+		replies = append(replies, body)
+		return nil
+	}
+
+	event := []byte(`{"id":"e1","type":"user_deleted","version":1,"occurred_at":"2026-10-16T09:00:00Z","producer":"user-service","payload":{"deletion_id":4,"user_id":7}}`)
+	for i := 0; i < 2; i++ {
+		if err := handleUserDeleted(context.Background(), "content", store, reply, event); err != nil {
+			t.Fatalf("handleUserDeleted failed: %v", err)
+		}
+	}
+	if len(store.erased) != 2 || store.erased[0] != 7 {
+		t.Errorf("expected user 7 to be erased on every request; got %v", store.erased)
+	}
+
+	confirmation, err := events.Decode(replies[1])
+	if err != nil {
+		t.Fatalf("invalid confirmation %s: %v", replies[1], err)
+	}
+	payload, _ := confirmation.DecodePayload()
+	if erased, ok := payload.(*events.UserDataErased); !ok || erased.DeletionID != 4 || erased.UserID != 7 || erased.Service != "content" || confirmation.Producer != "content-service" {
+		t.Errorf("unexpected confirmation: %s", replies[1])
+	}
+
+	t.Run("Malformed event", func(t *testing.T) {
+		for _, body := range []string{
+			`not json`,
+			`{"eventType":"user_deleted","payload":{"deletion_id":4,"user_id":7}}`,
+			`{"id":"e2","type":"user_deleted","version":2,"payload":{"deletion_id":4,"user_id":7}}`,
+			`{"id":"e2","type":"user_sessions_revoked","version":1,"payload":{"user_id":7}}`,
+			`{"id":"e2","type":"user_deleted","version":1,"payload":{}}`,
+		} {
+			if err := handleUserDeleted(context.Background(), "content", store, reply, []byte(body)); err == nil {
+				t.Errorf("expected %s to be rejected", body)
+			}
+		}
+	})
+}
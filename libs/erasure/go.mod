@@ -0,0 +1,10 @@
+module github.com/free-education/erasure
+
+go 1.21
+
+require (
+	github.com/free-education/events v0.0.0
+	github.com/rabbitmq/amqp091-go v1.10.0
+)
+
+replace github.com/free-education/events => ../events
@@ -0,0 +1,144 @@
+// Package events defines the envelope the services wrap every message they send
+// through RabbitMQ in, and the typed payload of each event, so that producers and
+// consumers agree on the format.
+//
+// Every event type has a version. It is raised whenever the payload changes in a
+// way older consumers cannot read; Decode rejects versions it does not know, so
+// such events are dead-lettered instead of being misread. Consumers must be
+// deployed before the producers of a new version.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrUnknownType is returned for events whose type is not registered in this package.
+	ErrUnknownType = errors.New("unknown event type")
+	// ErrUnsupportedVersion is returned for events with a version of their type this
+	// package does not know.
+	ErrUnsupportedVersion = errors.New("unsupported event version")
+)
+
+// Envelope is the JSON object every event is sent in.
+type Envelope struct {
+	// ID identifies the event. Redeliveries and retries keep it, so consumers can
+	// recognise events they have already handled.
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Producer   string          `json:"producer"` // the service that sent the event
+	Payload    json.RawMessage `json:"payload"`
+}
+
+// Payload is the typed payload of an event, one of the structs in payloads.go.
+type Payload interface {
+	// EventType returns the type of the events the payload is sent in.
+	EventType() string
+}
+
+// schema describes the current version of an event type.
+type schema struct {
+	version    int
+	newPayload func() Payload
+}
+
+// New wraps payload in an envelope with a new ID and the current version of its
+// type, occurring now.
+func New(producer string, payload Payload) (*Envelope, error) {
+	s, err := lookup(payload.EventType())
+	if err != nil {
+		return nil, err
+	}
+	id, err := NewID()
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		ID:         id,
+		Type:       payload.EventType(),
+		Version:    s.version,
+		OccurredAt: time.Now().UTC(),
+		Producer:   producer,
+		Payload:    data,
+	}, nil
+}
+
+// Encode returns the JSON encoding of an envelope. It fails for envelopes without
+// an ID and for unknown types and versions.
+func Encode(envelope *Envelope) ([]byte, error) {
+	if err := envelope.validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// Decode parses an envelope. It fails for malformed envelopes and for unknown
+// types and versions; errors.Is tells the latter apart with ErrUnknownType and
+// ErrUnsupportedVersion.
+func Decode(body []byte) (*Envelope, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("malformed event: %w", err)
+	}
+	if err := envelope.validate(); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// DecodePayload parses the payload of an envelope into the struct of its type,
+// for example a *UserDeleted for a `user_deleted` event.
+func (e *Envelope) DecodePayload() (Payload, error) {
+	s, err := lookup(e.Type)
+	if err != nil {
+		return nil, err
+	}
+	payload := s.newPayload()
+	if err := json.Unmarshal(e.Payload, payload); err != nil {
+		return nil, fmt.Errorf("malformed payload of %s event %s: %w", e.Type, e.ID, err)
+	}
+	return payload, nil
+}
+
+func (e *Envelope) validate() error {
+	if e.ID == "" {
+		return errors.New("event without an ID")
+	}
+	s, err := lookup(e.Type)
+	if err != nil {
+		return err
+	}
+	if e.Version != s.version {
+		return fmt.Errorf("%w: %s event version %d", ErrUnsupportedVersion, e.Type, e.Version)
+	}
+	return nil
+}
+
+func lookup(eventType string) (schema, error) {
+	s, ok := schemas[eventType]
+	if !ok {
+		return schema{}, fmt.Errorf("%w %q", ErrUnknownType, eventType)
+	}
+	return s, nil
+}
+
+// NewID returns a new event ID, a random (version 4) UUID.
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,90 @@
+package events
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	envelope, err := New("user-service", &UserDeleted{DeletionID: 3, UserID: 7})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	body, err := Encode(envelope)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+
+	decoded, err := Decode(body)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if decoded.ID != envelope.ID || decoded.Type != TypeUserDeleted || decoded.Version != 1 || decoded.Producer != "user-service" || !decoded.OccurredAt.Equal(envelope.OccurredAt) {
+		t.Errorf("expected the envelope to survive encoding; got %+v", decoded)
+	}
+	payload, err := decoded.DecodePayload()
+	if err != nil {
+		t.Fatalf("DecodePayload failed: %v", err)
+	}
+	if deleted, ok := payload.(*UserDeleted); !ok || deleted.DeletionID != 3 || deleted.UserID != 7 {
+		t.Errorf("expected the user_deleted payload; got %#v", payload)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want error
+	}{
+		{"Unknown versions", `{"id":"e1","type":"user_deleted","version":2,"payload":{}}`, ErrUnsupportedVersion},
+		{"Envelopes without a version", `{"id":"e1","type":"user_deleted","payload":{}}`, ErrUnsupportedVersion},
+		{"Unknown types", `{"id":"e1","type":"user_promoted","version":1,"payload":{}}`, ErrUnknownType},
+		{"The old envelope", `{"eventId":"e1","eventType":"user_deleted","payload":{}}`, nil},
+		{"Malformed envelopes", `not json`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode([]byte(tt.body))
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Errorf("expected %v; got %v", tt.want, err)
+			}
+		})
+	}
+
+	t.Run("Malformed payloads", func(t *testing.T) {
+		envelope, err := Decode([]byte(`{"id":"e1","type":"user_deleted","version":1,"payload":"user 7"}`))
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if _, err := envelope.DecodePayload(); err == nil {
+			t.Errorf("expected the payload to be rejected")
+		}
+	})
+}
+
+func TestEncodeRejectsUnknownVersions(t *testing.T) {
+	envelope, _ := New("user-service", &TwoFactorReset{Email: "test@example.com"})
+	envelope.Version = 2
+	if _, err := Encode(envelope); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("expected ErrUnsupportedVersion; got %v", err)
+	}
+}
+
+func TestSchemas(t *testing.T) {
+	for eventType, s := range schemas {
+		if got := s.newPayload().EventType(); got != eventType {
+			t.Errorf("the payload registered for %s is for %s", eventType, got)
+		}
+	}
+}
+
+func TestNewID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, _ := NewID()
+	second, _ := NewID()
+	if !uuid.MatchString(first) || first == second {
+		t.Errorf("expected two different UUIDs; got %s and %s", first, second)
+	}
+}
@@ -0,0 +1,3 @@
+module github.com/free-education/events
+
+go 1.21
@@ -0,0 +1,198 @@
+package events
+
+import "time"
+
+// Event types.
+const (
+	TypeUserRegistered             = "user_registered"
+	TypeEmailVerificationRequested = "email_verification_requested"
+	TypeEmailChangeRequested       = "email_change_requested"
+	TypeEmailChangeNotice          = "email_change_notice"
+	TypePasswordResetRequested     = "password_reset_requested"
+	TypeAccountLocked              = "account_locked"
+	TypeAccountDeletionScheduled   = "account_deletion_scheduled"
+	TypeAccountReactivated         = "account_reactivated"
+	TypeTwoFactorReset             = "two_factor_reset"
+	TypePasskeyAdded               = "passkey_added"
+	TypeIdentityLinked             = "identity_linked"
+	TypeDataExportReady            = "data_export_ready"
+	TypeUserSessionsRevoked        = "user_sessions_revoked"
+	TypeUserDeleted                = "user_deleted"
+	TypeUserDataErased             = "user_data_erased"
+	TypeUserActivity               = "user_activity"
+	TypeLessonCompleted            = "lesson_completed"
+)
+
+// schemas registers the current version and payload of every event type.
+var schemas = map[string]schema{
+	TypeUserRegistered:             {1, func() Payload { return &UserRegistered{} }},
+	TypeEmailVerificationRequested: {1, func() Payload { return &EmailVerificationRequested{} }},
+	TypeEmailChangeRequested:       {1, func() Payload { return &EmailChangeRequested{} }},
+	TypeEmailChangeNotice:          {1, func() Payload { return &EmailChangeNotice{} }},
+	TypePasswordResetRequested:     {1, func() Payload { return &PasswordResetRequested{} }},
+	TypeAccountLocked:              {1, func() Payload { return &AccountLocked{} }},
+	TypeAccountDeletionScheduled:   {1, func() Payload { return &AccountDeletionScheduled{} }},
+	TypeAccountReactivated:         {1, func() Payload { return &AccountReactivated{} }},
+	TypeTwoFactorReset:             {1, func() Payload { return &TwoFactorReset{} }},
+	TypePasskeyAdded:               {1, func() Payload { return &PasskeyAdded{} }},
+	TypeIdentityLinked:             {1, func() Payload { return &IdentityLinked{} }},
+	TypeDataExportReady:            {1, func() Payload { return &DataExportReady{} }},
+	TypeUserSessionsRevoked:        {1, func() Payload { return &UserSessionsRevoked{} }},
+	TypeUserDeleted:                {1, func() Payload { return &UserDeleted{} }},
+	TypeUserDataErased:             {1, func() Payload { return &UserDataErased{} }},
+	TypeUserActivity:               {1, func() Payload { return &UserActivity{} }},
+	TypeLessonCompleted:            {1, func() Payload { return &LessonCompleted{} }},
+}
+
+// --- Notifications ---
+// The user service sends these to the notifications service, which emails the user
+// at Email, addressing them by Name.
+
+// VerificationEmail asks the user to verify their email address by following
+// VerificationLink.
+type VerificationEmail struct {
+	Email            string `json:"email"`
+	Name             string `json:"name"`
+	VerificationLink string `json:"verificationLink"`
+}
+
+// UserRegistered welcomes a new user and asks them to verify their email address.
+type UserRegistered struct {
+	VerificationEmail
+}
+
+// EmailVerificationRequested sends a new verification link to an unverified user.
+type EmailVerificationRequested struct {
+	VerificationEmail
+}
+
+// EmailChangeRequested asks the new address of a user to confirm an email change.
+type EmailChangeRequested struct {
+	Email            string `json:"email"` // the new address
+	Name             string `json:"name"`
+	ConfirmationLink string `json:"confirmationLink"`
+}
+
+// EmailChangeNotice tells the current address of a user that an email change was
+// requested.
+type EmailChangeNotice struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	NewEmail string `json:"newEmail"`
+}
+
+// PasswordResetRequested sends a user the link to reset their password.
+type PasswordResetRequested struct {
+	Email     string `json:"email"`
+	Name      string `json:"name"`
+	ResetLink string `json:"resetLink"`
+}
+
+// AccountLocked tells a user their account is locked after too many failed logins.
+type AccountLocked struct {
+	Email       string    `json:"email"`
+	Name        string    `json:"name"`
+	LockedUntil time.Time `json:"lockedUntil"`
+}
+
+// AccountDeletionScheduled tells a user when their account will be deleted.
+type AccountDeletionScheduled struct {
+	Email        string    `json:"email"`
+	Name         string    `json:"name"`
+	DeletionDate time.Time `json:"deletionDate"`
+}
+
+// AccountReactivated tells a user their deactivated account was reactivated, and
+// whether that cancelled its scheduled deletion.
+type AccountReactivated struct {
+	Email             string `json:"email"`
+	Name              string `json:"name"`
+	DeletionCancelled bool   `json:"deletionCancelled"`
+}
+
+// TwoFactorReset tells a user an admin reset their two-factor authentication.
+type TwoFactorReset struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// PasskeyAdded tells a user a passkey was added to their account.
+type PasskeyAdded struct {
+	Email       string `json:"email"`
+	Name        string `json:"name"`
+	PasskeyName string `json:"passkeyName"`
+}
+
+// IdentityLinked tells a user an external identity was linked to their account.
+type IdentityLinked struct {
+	Email    string `json:"email"`
+	Name     string `json:"name"`
+	Provider string `json:"provider"`
+}
+
+// DataExportReady tells a user their data export can be downloaded until ExpiresAt.
+type DataExportReady struct {
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	ExportURL string    `json:"exportURL"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// --- Users ---
+
+// UserSessionsRevoked reports that all sessions of a user were revoked, for
+// example because they changed their password.
+type UserSessionsRevoked struct {
+	UserID    int64     `json:"user_id"`
+	Reason    string    `json:"reason"`
+	RevokedAt time.Time `json:"revoked_at"`
+}
+
+// UserDeleted asks a service to erase the data of a deleted user. The service
+// confirms with UserDataErased.
+type UserDeleted struct {
+	DeletionID int64 `json:"deletion_id"`
+	UserID     int64 `json:"user_id"`
+}
+
+// UserDataErased confirms that Service erased the data of a deleted user.
+type UserDataErased struct {
+	DeletionID int64  `json:"deletion_id"`
+	UserID     int64  `json:"user_id"`
+	Service    string `json:"service"`
+}
+
+// UserActivity is something a user did in another service, recorded in their
+// activity feed by the user service.
+type UserActivity struct {
+	UserID       int64                  `json:"user_id"`
+	ActivityType string                 `json:"activity_type"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// --- Learning ---
+
+// LessonCompleted reports that a user completed a lesson of a course.
+type LessonCompleted struct {
+	UserID   int64 `json:"user_id"`
+	LessonID int64 `json:"lesson_id"`
+	CourseID int64 `json:"course_id"`
+}
+
+func (*UserRegistered) EventType() string             { return TypeUserRegistered }
+func (*EmailVerificationRequested) EventType() string { return TypeEmailVerificationRequested }
+func (*EmailChangeRequested) EventType() string       { return TypeEmailChangeRequested }
+func (*EmailChangeNotice) EventType() string          { return TypeEmailChangeNotice }
+func (*PasswordResetRequested) EventType() string     { return TypePasswordResetRequested }
+func (*AccountLocked) EventType() string              { return TypeAccountLocked }
+func (*AccountDeletionScheduled) EventType() string   { return TypeAccountDeletionScheduled }
+func (*AccountReactivated) EventType() string         { return TypeAccountReactivated }
+func (*TwoFactorReset) EventType() string             { return TypeTwoFactorReset }
+func (*PasskeyAdded) EventType() string               { return TypePasskeyAdded }
+func (*IdentityLinked) EventType() string             { return TypeIdentityLinked }
+func (*DataExportReady) EventType() string            { return TypeDataExportReady }
+func (*UserSessionsRevoked) EventType() string        { return TypeUserSessionsRevoked }
+func (*UserDeleted) EventType() string                { return TypeUserDeleted }
+func (*UserDataErased) EventType() string             { return TypeUserDataErased }
+func (*UserActivity) EventType() string               { return TypeUserActivity }
+func (*LessonCompleted) EventType() string            { return TypeLessonCompleted }
@@ -1,3 +1,4 @@
+const crypto = require('crypto');
 const express = require('express');
 const { createProxyMiddleware } = require('http-proxy-middleware');
 const helmet = require('helmet');
@@ -11,6 +12,14 @@ const rbacMiddleware = require('./middleware/rbac');
 const app = express();
 const PORT = process.env.PORT || 8080;
 
+// req.ip is the address of the client. When the gateway runs behind a load
+// balancer, TRUST_PROXY (a hop count such as "1", or the balancer's addresses)
+// lets Express take it from the balancer's X-Forwarded-For instead.
+const trustProxy = process.env.TRUST_PROXY;
+if (trustProxy) {
+    app.set('trust proxy', /^\d+$/.test(trustProxy) ? Number(trustProxy) : trustProxy);
+}
+
 // --- Core Middleware ---
 app.use(helmet()); // Set various HTTP headers for security
 app.use(cors());   // Enable Cross-Origin Resource Sharing for all routes
@@ -20,6 +29,41 @@ app.use(express.json()); // Parse incoming JSON requests
 app.use(authMiddleware);
 app.use(rbacMiddleware);
 
+// --- Identity Forwarding ---
+// Identity headers are only ever set by the gateway. With GATEWAY_SIGNING_SECRET,
+// they are signed so that services can trust them (see libs/authz/headers.go).
+const identityHeaders = ['x-user-id', 'x-user-role', 'x-session-id', 'x-impersonator-id', 'x-auth-timestamp', 'x-auth-signature'];
+const signingSecret = process.env.GATEWAY_SIGNING_SECRET;
+
+/**
+ * Sets the identity of the authenticated user on a proxied request, signing it if
+ * a secret is configured.
+ * @param {http.ClientRequest} proxyReq - The request to the downstream service.
+ * @param {object} user - The verified token payload.
+ */
+const forwardIdentity = (proxyReq, user) => {
+    const userId = String(user.user_id);
+    const role = user.role || '';
+    const sessionId = user.sid ? String(user.sid) : '';
+    const impersonatorId = user.impersonator_id ? String(user.impersonator_id) : '';
+
+    proxyReq.setHeader('X-User-Id', userId);
+    proxyReq.setHeader('X-User-Role', role);
+    if (sessionId) {
+        proxyReq.setHeader('X-Session-Id', sessionId);
+    }
+    if (impersonatorId) {
+        proxyReq.setHeader('X-Impersonator-Id', impersonatorId);
+    }
+
+    if (signingSecret) {
+        const timestamp = String(Math.floor(Date.now() / 1000));
+        const payload = ['v1', userId, role, sessionId, impersonatorId, timestamp, proxyReq.method, proxyReq.path].join('\n');
+        proxyReq.setHeader('X-Auth-Timestamp', timestamp);
+        proxyReq.setHeader('X-Auth-Signature', crypto.createHmac('sha256', signingSecret).update(payload).digest('hex'));
+    }
+};
+
 // --- Service Routes ---
 const services = [
     {
@@ -50,10 +94,14 @@ services.forEach(({ route, target }) => {
             [`^${route}`]: '', // Rewrite path to remove the gateway-specific route prefix
         },
         onProxyReq: (proxyReq, req, res) => {
+            // Never pass on identity headers sent by the client.
+            identityHeaders.forEach(header => proxyReq.removeHeader(header));
+            // Services count failed logins per client IP and believe this header from
+            // the gateway, so it is replaced rather than appended to.
+            proxyReq.setHeader('X-Forwarded-For', req.ip);
             // Forward user identity to downstream services
             if (req.user) {
-                proxyReq.setHeader('X-User-Id', req.user.user_id);
-                proxyReq.setHeader('X-User-Role', req.user.role);
+                forwardIdentity(proxyReq, req.user);
             }
             console.log(`Proxying request for user ${req.user ? req.user.user_id : 'Guest'} to: ${target}${req.originalUrl}`);
         },
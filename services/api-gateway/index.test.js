@@ -1,34 +1,41 @@
 const jwt = require('jsonwebtoken');
-const fs = require('fs');
-const path = require('path');
 const { generateKeyPairSync } = require('crypto');
 
+// generateKeyForTest returns a signing key and its entry in a JWKS document.
+const generateKeyForTest = (kid) => {
+  const { privateKey, publicKey } = generateKeyPairSync('rsa', { modulusLength: 2048 });
+  return { kid, privateKey, jwk: { ...publicKey.export({ format: 'jwk' }), kid, use: 'sig', alg: 'RS256' } };
+};
+
+// tokenForTest signs an access token the way the user service does.
+const tokenForTest = (key, claims = {}) => jwt.sign(
+  { user_id: 1, role: 'user', type: 'full_auth', ...claims },
+  key.privateKey,
+  { algorithm: 'RS256', keyid: key.kid, issuer: 'user-service', expiresIn: '15m' },
+);
+
 describe('API Gateway Middlewares', () => {
   let mockRequest;
   let mockResponse;
   let authMiddleware;
   let rbacMiddleware;
   let nextFunction;
-  let privateKey;
-  const keyPath = path.join(__dirname, 'test_key.pub');
+  let signingKey;
+  // The keys the mocked user service publishes in its JWKS.
+  let publishedKeys;
+  const originalFetch = global.fetch;
 
   beforeAll(() => {
-    const { privateKey: genPrivateKey, publicKey } = generateKeyPairSync('rsa', {
-      modulusLength: 2048,
-      publicKeyEncoding: { type: 'spki', format: 'pem' },
-      privateKeyEncoding: { type: 'pkcs8', format: 'pem' },
-    });
-    privateKey = genPrivateKey;
-    fs.writeFileSync(keyPath, publicKey);
-    process.env.JWT_PUBLIC_KEY_PATH = keyPath;
+    signingKey = generateKeyForTest('key-1');
+    publishedKeys = [signingKey.jwk];
+    global.fetch = jest.fn(async () => ({ ok: true, status: 200, json: async () => ({ keys: publishedKeys }) }));
 
-    // Load modules after setting the environment variable
     authMiddleware = require('./middleware/auth');
     rbacMiddleware = require('./middleware/rbac');
   });
 
   afterAll(() => {
-    fs.unlinkSync(keyPath);
+    global.fetch = originalFetch;
   });
 
   beforeEach(() => {
@@ -55,34 +62,55 @@ describe('API Gateway Middlewares', () => {
       expect(nextFunction).toHaveBeenCalled();
     });
 
-    it('should return 401 if no token is provided for a protected route', () => {
+    it('should return 401 if no token is provided for a protected route', async () => {
       mockRequest.path = '/api/users/profile';
       mockRequest.method = 'GET';
-      authMiddleware(mockRequest, mockResponse, nextFunction);
+      await authMiddleware(mockRequest, mockResponse, nextFunction);
       expect(mockResponse.status).toHaveBeenCalledWith(401);
     });
 
-    it('should return 401 for an invalid token', () => {
+    it('should return 401 for an invalid token', async () => {
       mockRequest.path = '/api/users/profile';
       mockRequest.method = 'GET';
       mockRequest.headers.authorization = 'Bearer invalid-token';
-      authMiddleware(mockRequest, mockResponse, nextFunction);
+      await authMiddleware(mockRequest, mockResponse, nextFunction);
       expect(mockResponse.status).toHaveBeenCalledWith(401);
     });
 
-    it('should call next() and attach user for a valid token', () => {
-        const user = { user_id: 1, role: 'user' };
-        const token = jwt.sign(user, privateKey, { algorithm: 'RS256' });
+    it('should call next() and attach user for a valid token', async () => {
         mockRequest.path = '/api/users/profile';
         mockRequest.method = 'GET';
-        mockRequest.headers.authorization = `Bearer ${token}`;
+        mockRequest.headers.authorization = `Bearer ${tokenForTest(signingKey)}`;
 
-        authMiddleware(mockRequest, mockResponse, nextFunction);
+        await authMiddleware(mockRequest, mockResponse, nextFunction);
 
         expect(nextFunction).toHaveBeenCalled();
         expect(mockRequest.user).toBeDefined();
         expect(mockRequest.user.user_id).toBe(1);
     });
+
+    it('should return 401 for a token that is not a full_auth token', async () => {
+      mockRequest.path = '/api/users/profile';
+      mockRequest.method = 'GET';
+      mockRequest.headers.authorization = `Bearer ${tokenForTest(signingKey, { type: '2fa_temp' })}`;
+      await authMiddleware(mockRequest, mockResponse, nextFunction);
+      expect(mockResponse.status).toHaveBeenCalledWith(401);
+      expect(nextFunction).not.toHaveBeenCalled();
+    });
+
+    it('should fetch the key set again for a token signed with a rotated key', async () => {
+      const rotatedKey = generateKeyForTest('key-2');
+      publishedKeys = [signingKey.jwk, rotatedKey.jwk];
+      authMiddleware.keySet.lastFetched = 0; // Skip the wait between fetches.
+
+      mockRequest.path = '/api/users/profile';
+      mockRequest.method = 'GET';
+      mockRequest.headers.authorization = `Bearer ${tokenForTest(rotatedKey, { user_id: 2 })}`;
+      await authMiddleware(mockRequest, mockResponse, nextFunction);
+
+      expect(nextFunction).toHaveBeenCalled();
+      expect(mockRequest.user.user_id).toBe(2);
+    });
   });
 
   describe('rbacMiddleware', () => {
@@ -1,21 +1,50 @@
 const jwt = require('jsonwebtoken');
-const fs = require('fs');
 const { publicRoutes } = require('../rbac_config');
+const { JWKS } = require('./jwks');
 
-// --- Optimization: Pre-compile routes and read key on startup ---
-const publicKey = fs.readFileSync(process.env.JWT_PUBLIC_KEY_PATH || '../secrets/jwtRS256.key.pub');
+// Tokens are verified with the user service's current signing keys, looked up by
+// the token's `kid`, so that keys can be rotated without restarting the gateway.
+const jwksUrl = process.env.JWKS_URL
+    || `${process.env.USER_SERVICE_URL || 'http://user-service:3000'}/.well-known/jwks.json`;
+const keySet = new JWKS(jwksUrl);
+
+// --- Optimization: Pre-compile routes on startup ---
 const publicRouteMatchers = publicRoutes.map(route => ({
     method: route.method,
     regex: new RegExp(`^${route.path.replace(/:\w+/g, '[^/]+')}$`),
 }));
 // --- End Optimization ---
 
+/**
+ * Verifies an access token issued by the user service. Revocation is not checked
+ * here: a token revoked by a security event (password reset, deactivation, ...)
+ * is accepted until it expires, which the user service keeps short. Only the user
+ * service itself rejects revoked tokens.
+ * @param {string} token - The bearer token.
+ * @returns {Promise<object>} The token's payload.
+ */
+const verifyToken = (token) => new Promise((resolve, reject) => {
+    const getKey = (header, callback) => {
+        keySet.getKey(header.kid).then(key => callback(null, key), callback);
+    };
+    jwt.verify(token, getKey, { algorithms: ['RS256'], issuer: 'user-service' }, (err, decoded) => {
+        if (err) {
+            return reject(err);
+        }
+        // Temporary tokens, such as those for the second login step, cannot be used for API access.
+        if (decoded.type !== 'full_auth') {
+            return reject(new Error(`"${decoded.type}" token cannot be used for API access`));
+        }
+        resolve(decoded);
+    });
+});
+
 /**
  * Middleware to handle JWT-based authentication.
  * It verifies the token from the Authorization header and attaches the decoded payload to req.user.
  * It also identifies public routes and skips authentication for them.
  */
-const authMiddleware = (req, res, next) => {
+const authMiddleware = async (req, res, next) => {
     // Check if the request path matches any of the pre-compiled public routes.
     const isPublic = publicRouteMatchers.some(route =>
         route.method === req.method && route.regex.test(req.path)
@@ -34,15 +63,16 @@ const authMiddleware = (req, res, next) => {
     }
 
     const token = authHeader.split(' ')[1];
+    let decoded;
     try {
-        // Verify the token using the pre-loaded public key.
-        const decoded = jwt.verify(token, publicKey, { algorithms: ['RS256'] });
-        req.user = decoded; // Attach decoded user info (id, role) to the request object.
-        next();
+        decoded = await verifyToken(token);
     } catch (err) {
-        // Handle errors like expired tokens or invalid signatures.
+        // Handle errors like expired tokens, invalid signatures or unknown keys.
         return res.status(401).json({ error: 'Invalid or expired token' });
     }
+    req.user = decoded; // Attach decoded user info (id, role) to the request object.
+    next();
 };
 
 module.exports = authMiddleware;
+module.exports.keySet = keySet;
@@ -0,0 +1,66 @@
+const crypto = require('crypto');
+
+/**
+ * Fetches the user service's signing keys from its JSON Web Key Set and looks up
+ * a token's key by its `kid` header, like JWKS in libs/authz/jwt.go. Keys are
+ * fetched on first use and again when a token names an unknown key, so rotated
+ * keys are picked up without restarting the gateway.
+ */
+class JWKS {
+    /**
+     * @param {string} url - The URL of the JWKS document.
+     * @param {object} [options]
+     * @param {number} [options.minRefreshInterval] - How often, in milliseconds, unknown key IDs can trigger a fetch.
+     * @param {number} [options.timeout] - How long, in milliseconds, a fetch may take.
+     */
+    constructor(url, { minRefreshInterval = 60 * 1000, timeout = 5000 } = {}) {
+        this.url = url;
+        this.minRefreshInterval = minRefreshInterval;
+        this.timeout = timeout;
+        this.keys = new Map();
+        this.lastFetched = 0;
+        this.pending = null; // The fetch in progress, shared by concurrent lookups.
+    }
+
+    /**
+     * Returns the public key with the given ID.
+     * @param {string} kid - The `kid` header of the token.
+     * @returns {Promise<crypto.KeyObject>}
+     */
+    async getKey(kid) {
+        if (this.keys.has(kid)) {
+            return this.keys.get(kid);
+        }
+        if (!this.pending) {
+            if (Date.now() - this.lastFetched < this.minRefreshInterval) {
+                throw new Error(`Unknown signing key "${kid}"`);
+            }
+            this.pending = this.fetch().finally(() => { this.pending = null; });
+        }
+        await this.pending;
+        if (this.keys.has(kid)) {
+            return this.keys.get(kid);
+        }
+        throw new Error(`Unknown signing key "${kid}"`);
+    }
+
+    async fetch() {
+        this.lastFetched = Date.now();
+        const res = await fetch(this.url, { signal: AbortSignal.timeout(this.timeout) });
+        if (!res.ok) {
+            throw new Error(`Fetching JWKS: status ${res.status}`);
+        }
+        const { keys = [] } = await res.json();
+
+        const fetched = new Map();
+        for (const jwk of keys) {
+            if (jwk.kty !== 'RSA') {
+                continue;
+            }
+            fetched.set(jwk.kid, crypto.createPublicKey({ key: { kty: jwk.kty, n: jwk.n, e: jwk.e }, format: 'jwk' }));
+        }
+        this.keys = fetched;
+    }
+}
+
+module.exports = { JWKS };
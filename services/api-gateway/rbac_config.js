@@ -24,7 +24,15 @@ const permissions = {
     // Moderators can view other users' profiles and progress.
     { path: '/api/users/:userId/progress', method: 'GET', own: false },
     { path: '/api/users/:userId/full-profile', method: 'GET', own: false },
+    { path: '/api/users/:userId/quiz-attempts', method: 'GET', own: false },
+    { path: '/api/users/:userId/activity', method: 'GET', own: false },
+    { path: '/api/users/:userId/activity/summary', method: 'GET', own: false },
     { path: '/api/gamification/users/:userId/stats', method: 'GET', own: false },
+    // Moderators can find and suspend abusive accounts. The user service only lets them act on regular users.
+    { path: '/api/users/admin/users', method: 'GET' },
+    { path: '/api/users/admin/users/:userId', method: 'GET' },
+    { path: '/api/users/admin/users/:userId/deactivate', method: 'POST' },
+    { path: '/api/users/admin/users/:userId/reactivate', method: 'POST' },
     // General content creation permissions
     { path: '/api/content/reviews', method: 'POST' },
     { path: '/api/ugc/submit', method: 'POST' },
@@ -35,9 +43,39 @@ const permissions = {
   [roles.USER]: [
     // Users can access their own profile and progress.
     { path: '/api/users/profile', method: 'GET', own: true }, // No param needed, tied to the user's own token.
+    { path: '/api/users/sessions', method: 'GET', own: true },
+    { path: '/api/users/sessions/:sessionId', method: 'DELETE', own: true }, // Ownership is checked by the user service.
+    { path: '/api/users/reauth', method: 'POST', own: true },
+    { path: '/api/users/reauth/webauthn/begin', method: 'POST', own: true },
+    { path: '/api/users/reauth/webauthn/finish', method: 'POST', own: true },
+    { path: '/api/users/reauth/:provider', method: 'POST', own: true },
+    { path: '/api/users/profile/email', method: 'POST', own: true },
+    { path: '/api/users/profile/picture', method: 'POST', own: true },
+    { path: '/api/users/profile/picture', method: 'DELETE', own: true },
+    { path: '/api/users/preferences', method: 'GET', own: true },
+    { path: '/api/users/preferences', method: 'PATCH', own: true }, // JSON Merge Patch
+    { path: '/api/users/preferences', method: 'PUT', own: true }, // Deprecated alias of PATCH
+    { path: '/api/users/password', method: 'PUT', own: true },
+    { path: '/api/users/2fa/recovery-codes', method: 'GET', own: true }, // How many recovery codes are left.
+    { path: '/api/users/2fa/recovery-codes', method: 'POST', own: true }, // Regenerates them; requires recent authentication.
+    { path: '/api/users/identities', method: 'GET', own: true },
+    { path: '/api/users/identities/confirm', method: 'POST', own: true },
+    { path: '/api/users/identities/:provider', method: 'POST', own: true },
+    { path: '/api/users/identities/:identityId', method: 'DELETE', own: true }, // Ownership is checked by the user service.
+    { path: '/api/users/webauthn/register/begin', method: 'POST', own: true },
+    { path: '/api/users/webauthn/register/finish', method: 'POST', own: true },
+    { path: '/api/users/webauthn/credentials', method: 'GET', own: true },
+    { path: '/api/users/webauthn/credentials/:credentialId', method: 'PATCH', own: true }, // Ownership is checked by the user service.
+    { path: '/api/users/webauthn/credentials/:credentialId', method: 'DELETE', own: true },
+    { path: '/api/users/account/exports', method: 'POST', own: true },
+    { path: '/api/users/account/exports/:exportId', method: 'GET', own: true }, // Ownership is checked by the user service.
+    { path: '/api/users/account/exports/:exportId/download-token', method: 'POST', own: true },
     { path: '/api/users/:userId/progress', method: 'GET', own: true, param: 'userId' },
     { path: '/api/users/:userId/progress', method: 'POST', own: true, param: 'userId' },
     { path: '/api/users/:userId/full-profile', method: 'GET', own: true, param: 'userId' },
+    { path: '/api/users/:userId/quiz-attempts', method: 'GET', own: true, param: 'userId' },
+    { path: '/api/users/:userId/activity', method: 'GET', own: true, param: 'userId' },
+    { path: '/api/users/:userId/activity/summary', method: 'GET', own: true, param: 'userId' },
     { path: '/api/gamification/users/:userId/stats', method: 'GET', own: true, param: 'userId' },
     // General content creation permissions
     { path: '/api/content/reviews', method: 'POST' },
@@ -55,6 +93,21 @@ const publicRoutes = [
   { path: '/api/users/register', method: 'POST' },
   { path: '/api/users/login', method: 'POST' },
   { path: '/api/users/login/2fa', method: 'POST' },
+  { path: '/api/users/login/exchange', method: 'POST' },
+  { path: '/api/users/login/webauthn/begin', method: 'POST' },
+  { path: '/api/users/login/webauthn/finish', method: 'POST' },
+  { path: '/api/users/login/2fa/webauthn/begin', method: 'POST' },
+  { path: '/api/users/login/2fa/webauthn/finish', method: 'POST' },
+  { path: '/api/users/login/:provider', method: 'GET' },
+  { path: '/api/users/login/:provider/callback', method: 'GET' },
+  { path: '/api/users/token/refresh', method: 'POST' },
+  { path: '/api/users/email/verify', method: 'POST' },
+  { path: '/api/users/email/resend', method: 'POST' },
+  { path: '/api/users/email/change/confirm', method: 'POST' },
+  { path: '/api/users/account/reactivate', method: 'POST' },
+  { path: '/api/users/account/exports/download', method: 'GET' }, // Authenticated by a single-use download token.
+  { path: '/api/users/media/profile-pictures/:userId/:file', method: 'GET' }, // Profile pictures in a filesystem blob store.
+  { path: '/api/users/preferences/schema', method: 'GET' },
   { path: '/api/content/courses', method: 'GET' },
   { path: '/api/content/courses/featured', method: 'GET' },
   { path: '/api/content/courses/:courseId', method: 'GET' },
@@ -14,7 +14,7 @@ CREATE TABLE IF NOT EXISTS courses (
     id BIGSERIAL PRIMARY KEY,
     title VARCHAR(255) NOT NULL,
     description TEXT,
-    author_id BIGINT NOT NULL, -- This would be a foreign key in a real setup, but for microservices, we just store the ID.
+    author_id BIGINT NOT NULL, -- This would be a foreign key in a real setup, but for microservices, we just store the ID. 0 once the author is deleted.
     is_featured BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
@@ -422,3 +422,20 @@ func (s *ContentStore) GetCoursesForUser(ctx context.Context, userID int64) ([]m
 	}
 	return courses, nil
 }
+
+// DeletedUserID replaces the ID of a deleted user on content that outlives them.
+const DeletedUserID = 0
+
+// EraseUserData removes what the content service holds about a deleted user: their
+// reviews are deleted and the courses they authored, which other learners may be
+// taking, no longer name them. Erasing the same user again does nothing.
+func (s *ContentStore) EraseUserData(ctx context.Context, userID int64) error {
+	query := `
+		WITH reviews AS (
+			DELETE FROM course_reviews WHERE user_id = $1
+		)
+		UPDATE courses SET author_id = $2, updated_at = NOW() WHERE author_id = $1
+	`
+	_, err := s.db.Exec(ctx, query, userID, DeletedUserID)
+	return err
+}
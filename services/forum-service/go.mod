@@ -3,6 +3,16 @@ module github.com/free-education/forum-service
 go 1.21
 
 require (
+	github.com/free-education/erasure v0.0.0
 	github.com/gin-gonic/gin v1.9.1
 	github.com/jackc/pgx/v4 v4.18.1
 )
+
+require (
+	github.com/free-education/events v0.0.0 // indirect
+	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+)
+
+replace github.com/free-education/erasure => ../../libs/erasure
+
+replace github.com/free-education/events => ../../libs/events
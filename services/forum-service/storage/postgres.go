@@ -12,7 +12,7 @@ Expected Database Schema:
 CREATE TABLE IF NOT EXISTS threads (
     id BIGSERIAL PRIMARY KEY,
     course_id BIGINT NOT NULL,
-    user_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL, -- 0 once the author is deleted.
     title VARCHAR(255) NOT NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
@@ -20,7 +20,7 @@ CREATE TABLE IF NOT EXISTS threads (
 CREATE TABLE IF NOT EXISTS posts (
     id BIGSERIAL PRIMARY KEY,
     thread_id BIGINT NOT NULL REFERENCES threads(id) ON DELETE CASCADE,
-    user_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL, -- 0 once the author is deleted.
     content TEXT NOT NULL,
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
@@ -100,3 +100,23 @@ func (s *ForumStore) GetPostsForThread(ctx context.Context, threadID int64) ([]m
 	}
 	return posts, nil
 }
+
+// DeletedUserID replaces the ID of a deleted user on threads and posts.
+const DeletedUserID = 0
+
+// DeletedPostContent replaces the content of a deleted user's posts.
+const DeletedPostContent = "[deleted]"
+
+// EraseUserData removes what the forum holds about a deleted user. Their posts are
+// blanked and their threads no longer name them, so the replies of other users
+// keep their context. Erasing the same user again does nothing.
+func (s *ForumStore) EraseUserData(ctx context.Context, userID int64) error {
+	query := `
+		WITH posts AS (
+			UPDATE posts SET user_id = $2, content = $3 WHERE user_id = $1
+		)
+		UPDATE threads SET user_id = $2 WHERE user_id = $1
+	`
+	_, err := s.db.Exec(ctx, query, userID, DeletedUserID, DeletedPostContent)
+	return err
+}
@@ -2,10 +2,11 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 
+	"github.com/free-education/events"
 	"github.com/free-education/gamification-service/storage"
 )
 
@@ -22,46 +23,36 @@ func NewEventHandler(store *storage.GamificationStore) *EventHandler {
 	return &EventHandler{store: store}
 }
 
-// Event represents a generic event received from the message queue.
-type Event struct {
-	Type    string          `json:"type"`
-	Payload json.RawMessage `json:"payload"`
-}
-
-// LessonCompletedPayload is the specific structure for the 'lesson_completed' event.
-type LessonCompletedPayload struct {
-	UserID   int64 `json:"user_id"`
-	LessonID int64 `json:"lesson_id"`
-	CourseID int64 `json:"course_id"`
-}
-
 // HandleEvent parses the event and routes it to the appropriate handler.
 func (h *EventHandler) HandleEvent(ctx context.Context, eventBody []byte) error {
-	var event Event
-	if err := json.Unmarshal(eventBody, &event); err != nil {
-		log.Printf("Error unmarshalling event: %v", err)
-		return err // Malformed message, don't requeue
+	envelope, err := events.Decode(eventBody)
+	if errors.Is(err, events.ErrUnknownType) {
+		log.Printf("Ignoring event: %v", err)
+		return nil // Ignore unknown event types
+	}
+	if err != nil {
+		log.Printf("Error decoding event: %v", err)
+		return err // Malformed message or unsupported version, don't requeue
+	}
+	payload, err := envelope.DecodePayload()
+	if err != nil {
+		log.Printf("Error decoding event: %v", err)
+		return err
 	}
 
-	log.Printf("Handling event of type: %s", event.Type)
+	log.Printf("Handling %s event %s from %s", envelope.Type, envelope.ID, envelope.Producer)
 
-	switch event.Type {
-	case "lesson_completed":
-		return h.handleLessonCompleted(ctx, event.Payload)
+	switch p := payload.(type) {
+	case *events.LessonCompleted:
+		return h.handleLessonCompleted(ctx, p)
 	// Add cases for other events like "course_completed", "user_registered", etc.
 	default:
-		log.Printf("Unknown event type: %s", event.Type)
-		return nil // Ignore unknown event types
+		log.Printf("No handler for event type: %s", envelope.Type)
+		return nil // Ignore events this service does not act on
 	}
 }
 
-func (h *EventHandler) handleLessonCompleted(ctx context.Context, payload json.RawMessage) error {
-	var p LessonCompletedPayload
-	if err := json.Unmarshal(payload, &p); err != nil {
-		log.Printf("Error unmarshalling lesson_completed payload: %v", err)
-		return err
-	}
-
+func (h *EventHandler) handleLessonCompleted(ctx context.Context, p *events.LessonCompleted) error {
 	log.Printf("Awarding %d points to user %d for completing lesson %d", pointsForLessonCompleted, p.UserID, p.LessonID)
 
 	// Add points to the user
@@ -3,6 +3,8 @@ module github.com/free-education/gamification-service
 go 1.21
 
 require (
+	github.com/free-education/erasure v0.0.0
+	github.com/free-education/events v0.0.0
 	github.com/gin-gonic/gin v1.9.1
 	github.com/go-redis/redis/v8 v8.11.5
 	github.com/streadway/amqp v1.1.0
@@ -11,4 +13,9 @@ require (
 require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
 )
+
+replace github.com/free-education/erasure => ../../libs/erasure
+
+replace github.com/free-education/events => ../../libs/events
@@ -64,3 +64,15 @@ func (s *GamificationStore) GetUserStats(ctx context.Context, userID int64) (map
 	userKey := fmt.Sprintf("%s%d", userProfileKeyPrefix, userID)
 	return s.client.HGetAll(ctx, userKey).Result()
 }
+
+// EraseUserData removes a deleted user's stats and their place on the leaderboard.
+// Erasing the same user again does nothing.
+func (s *GamificationStore) EraseUserData(ctx context.Context, userID int64) error {
+	userKey := fmt.Sprintf("%s%d", userProfileKeyPrefix, userID)
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, userKey)
+		pipe.ZRem(ctx, leaderboardKey, fmt.Sprintf("%d", userID))
+		return nil
+	})
+	return err
+}
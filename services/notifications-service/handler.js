@@ -12,6 +12,15 @@ async function handleEvent(eventType, payload) {
     case 'user_registered':
       return handleUserRegistered(payload);
 
+    case 'email_verification_requested':
+      return handleEmailVerificationRequested(payload);
+
+    case 'email_change_requested':
+      return handleEmailChangeRequested(payload);
+
+    case 'email_change_notice':
+      return handleEmailChangeNotice(payload);
+
     case 'content_approved':
       return handleContentApproved(payload);
 
@@ -21,6 +30,22 @@ async function handleEvent(eventType, payload) {
     case 'password_reset_requested':
       return handlePasswordResetRequested(payload);
 
+    case 'account_locked':
+      return handleAccountLocked(payload);
+
+    case 'identity_linked':
+      return handleIdentityLinked(payload);
+    case 'passkey_added':
+      return handlePasskeyAdded(payload);
+    case 'two_factor_reset':
+      return handleTwoFactorReset(payload);
+    case 'account_deletion_scheduled':
+      return handleAccountDeletionScheduled(payload);
+    case 'account_reactivated':
+      return handleAccountReactivated(payload);
+    case 'data_export_ready':
+      return handleDataExportReady(payload);
+
     default:
       console.log(`No handler for event type: ${eventType}`);
       return Promise.resolve();
@@ -31,19 +56,77 @@ async function handleEvent(eventType, payload) {
 
 /**
  * Handles the 'user_registered' event.
- * @param {object} payload - Expected to contain { email, name }.
+ * @param {object} payload - Expected to contain { email, name, verificationLink }.
  */
 function handleUserRegistered(payload) {
-  const { email, name } = payload;
+  const { email, name, verificationLink } = payload;
   if (!email || !name) {
     console.error('Invalid payload for user_registered:', payload);
     return;
   }
 
+  const verifyHtml = verificationLink
+    ? `<p>Please confirm your email address by clicking the link below:</p><a href="${verificationLink}">${verificationLink}</a>`
+    : '';
+
   return sendEmail({
     to: email,
     subject: 'Welcome to the Free Education Platform!',
-    html: `<strong>Hi ${name},</strong><p>Welcome! We're excited to have you on board.</p>`,
+    html: `<strong>Hi ${name},</strong><p>Welcome! We're excited to have you on board.</p>${verifyHtml}`,
+  });
+}
+
+/**
+ * Handles the 'email_verification_requested' event.
+ * @param {object} payload - Expected to contain { email, name, verificationLink }.
+ */
+function handleEmailVerificationRequested(payload) {
+  const { email, name, verificationLink } = payload;
+  if (!email || !name || !verificationLink) {
+    console.error('Invalid payload for email_verification_requested:', payload);
+    return;
+  }
+
+  return sendEmail({
+    to: email,
+    subject: 'Verify Your Email Address',
+    html: `<strong>Hi ${name},</strong><p>Please confirm your email address by clicking the link below:</p><a href="${verificationLink}">${verificationLink}</a><p>If you did not create an account, please ignore this email.</p>`,
+  });
+}
+
+/**
+ * Handles the 'email_change_requested' event, sent to the new address.
+ * @param {object} payload - Expected to contain { email, name, confirmationLink }.
+ */
+function handleEmailChangeRequested(payload) {
+  const { email, name, confirmationLink } = payload;
+  if (!email || !name || !confirmationLink) {
+    console.error('Invalid payload for email_change_requested:', payload);
+    return;
+  }
+
+  return sendEmail({
+    to: email,
+    subject: 'Confirm Your New Email Address',
+    html: `<strong>Hi ${name},</strong><p>Please confirm that you want to use this address for your account by clicking the link below:</p><a href="${confirmationLink}">${confirmationLink}</a><p>If you did not request this, please ignore this email.</p>`,
+  });
+}
+
+/**
+ * Handles the 'email_change_notice' event, sent to the current address.
+ * @param {object} payload - Expected to contain { email, name, newEmail }.
+ */
+function handleEmailChangeNotice(payload) {
+  const { email, name, newEmail } = payload;
+  if (!email || !name || !newEmail) {
+    console.error('Invalid payload for email_change_notice:', payload);
+    return;
+  }
+
+  return sendEmail({
+    to: email,
+    subject: 'Was this you? Email change requested',
+    html: `<strong>Hi ${name},</strong><p>Someone asked to change the email address of your account to ${newEmail}. The change only takes effect once the new address is confirmed.</p><p>If this wasn't you, please change your password right away.</p>`,
   });
 }
 
@@ -101,4 +184,134 @@ function handlePasswordResetRequested(payload) {
   });
 }
 
+/**
+ * Handles the 'account_locked' event.
+ * @param {object} payload - Expected to contain { email, name, lockedUntil }.
+ */
+function handleAccountLocked(payload) {
+  const { email, name, lockedUntil } = payload;
+  if (!email || !name) {
+    console.error('Invalid payload for account_locked:', payload);
+    return;
+  }
+
+  return sendEmail({
+    to: email,
+    subject: 'Your account has been temporarily locked',
+    html: `<strong>Hi ${name},</strong><p>We temporarily locked your account after too many failed sign-in attempts. You can try again after ${lockedUntil || 'a few minutes'}.</p><p>If this wasn't you, we recommend resetting your password.</p>`,
+  });
+}
+
+/**
+ * Handles the 'identity_linked' event, sent when a sign-in provider is linked to an account.
+ * @param {object} payload - Expected to contain { email, name, provider }.
+ */
+function handleIdentityLinked(payload) {
+  const { email, name, provider } = payload;
+  if (!email || !provider) {
+    console.error('Invalid payload for identity_linked:', payload);
+    return;
+  }
+
+  return sendEmail({
+    to: email,
+    subject: `You can now sign in with ${provider}`,
+    html: `<strong>Hi ${name || 'there'},</strong><p>Your ${provider} account was linked to your account and can now be used to sign in.</p><p>If this wasn't you, unlink it in your account settings and change your password right away.</p>`,
+  });
+}
+
+/**
+ * Handles the 'passkey_added' event, sent when a passkey or security key is registered.
+ * @param {object} payload - Expected to contain { email, name, passkeyName }.
+ */
+function handlePasskeyAdded(payload) {
+  const { email, name, passkeyName } = payload;
+  if (!email) {
+    console.error('Invalid payload for passkey_added:', payload);
+    return;
+  }
+
+  return sendEmail({
+    to: email,
+    subject: 'A passkey was added to your account',
+    html: `<strong>Hi ${name || 'there'},</strong><p>The passkey "${passkeyName || 'Passkey'}" was added to your account and can now be used to sign in.</p><p>If this wasn't you, remove it in your account settings and change your password right away.</p>`,
+  });
+}
+
+/**
+ * Handles the 'two_factor_reset' event, sent when an admin turns off a user's 2FA.
+ * @param {object} payload - Expected to contain { email, name }.
+ */
+function handleTwoFactorReset(payload) {
+  const { email, name } = payload;
+  if (!email) {
+    console.error('Invalid payload for two_factor_reset:', payload);
+    return;
+  }
+
+  return sendEmail({
+    to: email,
+    subject: 'Two-factor authentication was turned off',
+    html: `<strong>Hi ${name || 'there'},</strong><p>At your request, our support team turned off two-factor authentication for your account. You can now log in with your password and set it up again in your account settings.</p><p>If you did not contact support, please change your password right away and let us know.</p>`,
+  });
+}
+
+/**
+ * Handles the 'account_deletion_scheduled' event, sent when a user deletes their account.
+ * The account can still be restored until the deletion date.
+ * @param {object} payload - Expected to contain { email, name, deletionDate }.
+ */
+function handleAccountDeletionScheduled(payload) {
+  const { email, name, deletionDate } = payload;
+  if (!email) {
+    console.error('Invalid payload for account_deletion_scheduled:', payload);
+    return;
+  }
+
+  const when = deletionDate ? new Date(deletionDate).toDateString() : 'soon';
+  return sendEmail({
+    to: email,
+    subject: 'Your account will be deleted',
+    html: `<strong>Hi ${name || 'there'},</strong><p>Your account and all its data will be permanently deleted on ${when}.</p><p>Changed your mind? Log in before then and confirm to keep your account.</p>`,
+  });
+}
+
+/**
+ * Handles the 'account_reactivated' event, sent when a user reactivates their deactivated account.
+ * @param {object} payload - Expected to contain { email, name, deletionCancelled }.
+ */
+function handleAccountReactivated(payload) {
+  const { email, name, deletionCancelled } = payload;
+  if (!email) {
+    console.error('Invalid payload for account_reactivated:', payload);
+    return;
+  }
+
+  const detail = deletionCancelled ? ' Its scheduled deletion has been cancelled.' : '';
+  return sendEmail({
+    to: email,
+    subject: 'Your account has been reactivated',
+    html: `<strong>Hi ${name || 'there'},</strong><p>Your account is active again.${detail}</p><p>If this wasn't you, change your password right away.</p>`,
+  });
+}
+
+/**
+ * Handles the 'data_export_ready' event, sent when the archive of a user's personal data is ready.
+ * @param {object} payload - Expected to contain { email, name, exportURL, expiresAt }.
+ */
+function handleDataExportReady(payload) {
+  const { email, name, exportURL, expiresAt } = payload;
+  if (!email || !exportURL) {
+    console.error('Invalid payload for data_export_ready:', payload);
+    return;
+  }
+
+  const until = expiresAt ? ` until ${new Date(expiresAt).toDateString()}` : '';
+  return sendEmail({
+    to: email,
+    subject: 'Your data export is ready',
+    html: `<strong>Hi ${name || 'there'},</strong><p>The copy of your data you asked for is ready. You can download it from your account settings${until}:</p><a href="${exportURL}">${exportURL}</a><p>If you didn't ask for this, change your password right away.</p>`,
+  });
+}
+
 module.exports = { handleEvent };
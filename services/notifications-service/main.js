@@ -23,9 +23,10 @@ async function main() {
           const messageContent = msg.content.toString();
           console.log(`[x] Received: ${messageContent}`);
 
-          const { eventType, payload } = JSON.parse(messageContent);
+          // The envelope of libs/events: { id, type, version, occurred_at, producer, payload }.
+          const { type, payload } = JSON.parse(messageContent);
 
-          await handleEvent(eventType, payload);
+          await handleEvent(type, payload);
 
           // Acknowledge the message
           channel.ack(msg);
@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// DefaultDeletionGracePeriod is how long a deleted account can still be reactivated
+	// before it is purged.
+	DefaultDeletionGracePeriod = 30 * 24 * time.Hour
+	// purgeBatchSize is how many accounts PurgeScheduledDeletions deletes per query.
+	purgeBatchSize = 100
+)
+
+// checkAccountActive writes a response and returns false if the user's account is
+// deactivated. Login handlers call it once the user has proven who they are, so the
+// response does not reveal anything to someone who only knows the email address.
+// Users who deactivated their account themselves, or asked for it to be deleted,
+// get a token to confirm its reactivation with.
+func (a *API) checkAccountActive(c *gin.Context, user *model.User) bool {
+	if user.DeactivatedAt == nil {
+		return true
+	}
+	if user.DeactivatedByAdmin {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "This account has been deactivated."})
+		return false
+	}
+
+	token, err := auth.GenerateReactivationToken(user.ID)
+	if err != nil {
+		log.Printf("Error generating reactivation token for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process login."})
+		return false
+	}
+	resp := gin.H{
+		"error":                 "This account is deactivated. Confirm to reactivate it.",
+		"reactivation_required": true,
+		"reactivation_token":    token,
+	}
+	if user.DeletionScheduledAt != nil {
+		resp["deletion_scheduled_at"] = user.DeletionScheduledAt
+	}
+	c.JSON(http.StatusForbidden, resp)
+	return false
+}
+
+// ReactivateAccountHandler reactivates a deactivated account, cancelling its
+// scheduled deletion if there is one, and signs the user in. It takes the token a
+// login to the account returned, so it needs both the user's credentials and their
+// explicit confirmation.
+func (a *API) ReactivateAccountHandler(c *gin.Context) {
+	var req model.ReactivateAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	claims, err := auth.ValidateToken(req.ReactivationToken)
+	if err != nil || claims.Type != "reactivation" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reactivation token."})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired reactivation token."})
+		return
+	}
+	// A replayed token must not become another way to sign in.
+	if user.DeactivatedAt == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "This account is already active."})
+		return
+	}
+
+	deletionCancelled := user.DeletionScheduledAt != nil
+	if err := a.UserStore.ReactivateUser(c.Request.Context(), user.ID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This account cannot be reactivated."})
+			return
+		}
+		log.Printf("Error reactivating user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reactivate account."})
+		return
+	}
+	user.DeactivatedAt, user.DeletionScheduledAt = nil, nil
+
+	activity := &model.UserActivity{UserID: user.ID, ActivityType: "account_reactivated", Metadata: map[string]interface{}{"deletion_cancelled": deletionCancelled}}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording reactivation of user %d: %v", user.ID, err)
+	}
+	payload := &events.AccountReactivated{
+		Email:             user.Email,
+		Name:              user.FirstName,
+		DeletionCancelled: deletionCancelled,
+	}
+	if err := a.MessageBroker.Publish(c.Request.Context(), "notifications_events", payload); err != nil {
+		log.Printf("Error publishing reactivation notice for user %d: %v", user.ID, err)
+	}
+
+	resp, err := a.issueSession(c, user)
+	if err != nil {
+		log.Printf("Error issuing session for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Account reactivated, but failed to sign you in."})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// scheduleDeletion deactivates the user's account and schedules it to be purged
+// once the deletion grace period has passed.
+func (a *API) scheduleDeletion(c *gin.Context, user *model.User) {
+	deleteAt := time.Now().Add(a.DeletionGracePeriod)
+	ctx := c.Request.Context()
+	// Revoke the tokens first: it updates the user row, which the transaction locks.
+	revokedAt, err := auth.RevokeUserTokens(ctx, user.ID)
+	if err != nil {
+		log.Printf("Error revoking tokens for user %d before scheduling deletion: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account."})
+		return
+	}
+
+	payload := &events.AccountDeletionScheduled{
+		Email:        user.Email,
+		Name:         user.FirstName,
+		DeletionDate: deleteAt,
+	}
+	err = a.UserStore.InTx(ctx, func(store storage.UserStore) error {
+		if err := store.ScheduleUserDeletion(ctx, user.ID, deleteAt); err != nil {
+			return err
+		}
+		if err := revokeSessions(ctx, store, user.ID, "account_deletion_scheduled", revokedAt); err != nil {
+			return err
+		}
+		return enqueueEvent(ctx, store, "notifications_events", payload)
+	})
+	if err != nil {
+		log.Printf("Error scheduling deletion of user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account."})
+		return
+	}
+	a.relayOutboxNow(ctx)
+
+	activity := &model.UserActivity{UserID: user.ID, ActivityType: "account_deletion_scheduled", Metadata: map[string]interface{}{"deletion_scheduled_at": deleteAt}}
+	if err := a.UserStore.CreateUserActivity(ctx, activity); err != nil {
+		log.Printf("Error recording scheduled deletion of user %d: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":               "Your account will be deleted. Log in again before then to cancel.",
+		"deletion_scheduled_at": deleteAt,
+	})
+}
+
+// PurgeScheduledDeletions permanently deletes every account whose deletion grace
+// period has ended and asks the other services to erase their data. It returns the
+// number of accounts deleted. main runs it periodically.
+func (a *API) PurgeScheduledDeletions(ctx context.Context) (int, error) {
+	purged := 0
+	for {
+		userIDs, profilePictureKeys, err := a.UserStore.PurgeScheduledDeletions(ctx, purgeBatchSize, a.ErasureServices)
+		if err != nil {
+			return purged, err
+		}
+		for _, userID := range userIDs {
+			log.Printf("Permanently deleted user %d after the deletion grace period", userID)
+		}
+		for _, key := range profilePictureKeys {
+			a.deleteProfilePicture(ctx, key)
+		}
+		if len(userIDs) > 0 {
+			a.sendErasureRequestsNow(ctx)
+		}
+		purged += len(userIDs)
+		if len(userIDs) < purgeBatchSize {
+			return purged, nil
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+func TestScheduledAccountDeletion(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password", FirstName: "Test"})
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
+	login := loginForTest(t, apiHandler, "test@example.com", "password")
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", user.ID)
+	c.Request, _ = http.NewRequest(http.MethodDelete, "/account", nil)
+	apiHandler.DeleteUserHandler(c)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d; got %d", http.StatusAccepted, w.Code)
+	}
+	if user.DeletionScheduledAt == nil || user.DeletionScheduledAt.Before(time.Now().Add(DefaultDeletionGracePeriod-time.Minute)) {
+		t.Fatalf("expected deletion to be scheduled after the grace period; got %v", user.DeletionScheduledAt)
+	}
+	if w := refreshForTest(apiHandler, login.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the session to be revoked; got status %d", w.Code)
+	}
+	if len(mockMessageBroker.EventsOfType("account_deletion_scheduled")) != 1 {
+		t.Error("expected an account_deletion_scheduled event to be published")
+	}
+
+	t.Run("Wrong password reveals nothing", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.LoginUserHandler, "/login", model.LoginRequest{Email: "test@example.com", Password: "wrong"})
+		if w.Code != http.StatusUnauthorized || bytes.Contains(w.Body.Bytes(), []byte("reactivation")) {
+			t.Errorf("expected a plain 401; got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	// Logging in offers reactivation instead of a session.
+	w = postJSONForTest(apiHandler.LoginUserHandler, "/login", model.LoginRequest{Email: "test@example.com", Password: "password"})
+	var loginResp struct {
+		ReactivationRequired bool       `json:"reactivation_required"`
+		ReactivationToken    string     `json:"reactivation_token"`
+		DeletionScheduledAt  *time.Time `json:"deletion_scheduled_at"`
+		Token                string     `json:"token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &loginResp)
+	if w.Code != http.StatusForbidden || !loginResp.ReactivationRequired || loginResp.ReactivationToken == "" || loginResp.DeletionScheduledAt == nil || loginResp.Token != "" {
+		t.Fatalf("expected a reactivation prompt; got %d %s", w.Code, w.Body.String())
+	}
+
+	t.Run("Token of another kind", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.ReactivateAccountHandler, "/account/reactivate", model.ReactivateAccountRequest{ReactivationToken: login.Token})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	// Confirming reactivates the account, cancels the deletion and signs the user in.
+	w = postJSONForTest(apiHandler.ReactivateAccountHandler, "/account/reactivate", model.ReactivateAccountRequest{ReactivationToken: loginResp.ReactivationToken})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp model.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Token == "" || resp.RefreshToken == "" {
+		t.Error("expected a new session")
+	}
+	if user.DeactivatedAt != nil || user.DeletionScheduledAt != nil {
+		t.Error("expected the account to be active with no deletion scheduled")
+	}
+	reactivations := mockMessageBroker.EventsOfType("account_reactivated")
+	if len(reactivations) != 1 || !reactivations[0].Payload.(*events.AccountReactivated).DeletionCancelled {
+		t.Errorf("expected an account_reactivated event for the cancelled deletion; got %+v", reactivations)
+	}
+
+	t.Run("Replayed token", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.ReactivateAccountHandler, "/account/reactivate", model.ReactivateAccountRequest{ReactivationToken: loginResp.ReactivationToken})
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status %d; got %d", http.StatusConflict, w.Code)
+		}
+	})
+}
+
+func TestReactivateSuspendedAccount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	userStore.SetUserDeactivated(context.Background(), user.ID, true, &model.AdminAuditEntry{ActorID: 99, Action: "user_deactivated"})
+
+	w := postJSONForTest(apiHandler.LoginUserHandler, "/login", model.LoginRequest{Email: "test@example.com", Password: "password"})
+	if w.Code != http.StatusUnauthorized || bytes.Contains(w.Body.Bytes(), []byte("reactivation_token")) {
+		t.Errorf("expected staff-suspended accounts not to be offered reactivation; got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPurgeScheduledDeletions(t *testing.T) {
+	userStore := NewMockUserStore()
+	due, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "due@example.com", Password: "password"})
+	pending, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "pending@example.com", Password: "password"})
+	active, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "active@example.com", Password: "password"})
+	userStore.ScheduleUserDeletion(context.Background(), due.ID, time.Now().Add(-time.Minute))
+	userStore.ScheduleUserDeletion(context.Background(), pending.ID, time.Now().Add(time.Hour))
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
+
+	purged, err := apiHandler.PurgeScheduledDeletions(context.Background())
+	if err != nil || purged != 1 {
+		t.Fatalf("expected 1 account to be purged; got %d, %v", purged, err)
+	}
+	for _, user := range []*model.User{pending, active} {
+		if _, err := userStore.GetUserByID(context.Background(), user.ID); err != nil {
+			t.Errorf("expected user %s to be kept", user.Email)
+		}
+	}
+	deletions := mockMessageBroker.EventsOfType("user_deleted")
+	if len(deletions) != len(DefaultErasureServices) || deletions[0].Payload.(*events.UserDeleted).UserID != due.ID {
+		t.Errorf("expected every service to be asked to erase the purged user's data; got %+v", deletions)
+	}
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/free-education/authz"
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/messaging"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/preferences"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+)
+
+const (
+	// ActivityQueue is where other services report user activities.
+	ActivityQueue = "user_activity_events"
+	// defaultActivityPageSize is how many activities a page of the feed holds unless
+	// the client asks for another number.
+	defaultActivityPageSize = 20
+	// maxActivitySummaryDays is how many days the activity summary can cover.
+	maxActivitySummaryDays = 365
+	// activityPruneBatchSize is how many activities PruneUserActivities deletes per query.
+	activityPruneBatchSize = 1000
+)
+
+// ActivityRetention is how long user activities are kept before they are pruned.
+// A retention period of zero keeps activities forever.
+type ActivityRetention struct {
+	// Default applies to the activity types not in ByType.
+	Default time.Duration
+	ByType  map[string]time.Duration
+}
+
+// defaultActivityRetention keeps activities for 180 days, and the activities users
+// and staff need to investigate account security for two years.
+func defaultActivityRetention() ActivityRetention {
+	retention := ActivityRetention{Default: 180 * 24 * time.Hour, ByType: map[string]time.Duration{}}
+	for _, activityType := range []string{
+		"password_changed", "email_changed", "account_locked", "account_reactivated", "account_deletion_scheduled",
+		"2fa_recovery_code_used", "2fa_reset_by_admin", "passkey_added", "passkey_removed",
+		"identity_linked", "identity_unlinked", "data_export_requested", "data_export_downloaded",
+	} {
+		retention.ByType[activityType] = 2 * 365 * 24 * time.Hour
+	}
+	return retention
+}
+
+// getPaginationParams is a helper function to parse cursor and limit from query params.
+// It sets default values and enforces a maximum limit to prevent abuse.
+func getPaginationParams(c *gin.Context, defaultLimit int) (int64, int) {
+	cursor, _ := strconv.ParseInt(c.Query("cursor"), 10, 64)
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultLimit
+	}
+	// Enforce a maximum limit to prevent clients from requesting too much data.
+	if limit > 100 {
+		limit = 100
+	}
+	return cursor, limit
+}
+
+// --- User Activity Handlers ---
+
+// GetUserActivityHandler returns a page of a user's activities, newest first. The
+// feed can be filtered by activity type (`type`, repeated or comma-separated) and
+// by time range (`since` and `until`, RFC 3339). `next_cursor` is 0 on the last page.
+func (a *API) GetUserActivityHandler(c *gin.Context) {
+	targetUserID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
+		return
+	}
+
+	// Users can see their own activity log; moderators and admins anyone's.
+	if !authz.AllowSelfOrRole(c, targetUserID, authz.RoleModerator, authz.RoleAdmin) {
+		return
+	}
+
+	search := model.UserActivitySearch{UserID: targetUserID}
+	search.Cursor, search.Limit = getPaginationParams(c, defaultActivityPageSize)
+	for _, types := range c.QueryArray("type") {
+		for _, activityType := range strings.Split(types, ",") {
+			if activityType = strings.TrimSpace(activityType); activityType != "" {
+				search.Types = append(search.Types, activityType)
+			}
+		}
+	}
+	for param, t := range map[string]*time.Time{"since": &search.Since, "until": &search.Until} {
+		if value := c.Query(param); value != "" {
+			if *t, err = time.Parse(time.RFC3339, value); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": param + " must be a time such as 2024-05-31T00:00:00Z"})
+				return
+			}
+		}
+	}
+
+	// Fetch one more activity than asked for to know whether there is another page.
+	limit := search.Limit
+	search.Limit++
+	activities, err := a.UserStore.SearchUserActivities(c.Request.Context(), search)
+	if err != nil {
+		log.Printf("Error getting activities for user %d: %v", targetUserID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user activities."})
+		return
+	}
+
+	var nextCursor int64 = 0
+	if len(activities) > limit {
+		activities = activities[:limit]
+		nextCursor = activities[limit-1].ID
+	}
+	if activities == nil {
+		activities = []*model.UserActivity{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"data":        activities,
+		"next_cursor": nextCursor,
+	})
+}
+
+// GetUserActivitySummaryHandler counts a user's activities per day and type over
+// the last `days` days (30 unless given), including today, for profile pages. Days
+// are calendar days in the user's time zone preference unless `timezone` is given.
+// Every day of the range is listed, oldest first.
+func (a *API) GetUserActivitySummaryHandler(c *gin.Context) {
+	targetUserID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
+		return
+	}
+
+	// Users can see their own activity log; moderators and admins anyone's.
+	if !authz.AllowSelfOrRole(c, targetUserID, authz.RoleModerator, authz.RoleAdmin) {
+		return
+	}
+
+	days := 30
+	if value := c.Query("days"); value != "" {
+		days, err = strconv.Atoi(value)
+		if err != nil || days < 1 || days > maxActivitySummaryDays {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "days must be a number from 1 to " + strconv.Itoa(maxActivitySummaryDays)})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	timezone := c.Query("timezone")
+	if timezone == "" {
+		user, err := a.UserStore.GetUserByID(ctx, targetUserID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		timezone = preferences.Resolve(user.Preferences).Timezone
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil || timezone == "" || timezone == "Local" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "timezone must be an IANA time zone such as Europe/Berlin"})
+		return
+	}
+
+	now := time.Now().In(location)
+	since := time.Date(now.Year(), now.Month(), now.Day()-(days-1), 0, 0, 0, 0, location)
+	active, err := a.UserStore.GetUserActivityDays(ctx, targetUserID, since, timezone)
+	if err != nil {
+		log.Printf("Error summarizing activities of user %d: %v", targetUserID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user activities."})
+		return
+	}
+
+	byDate := make(map[string]*model.UserActivityDay, len(active))
+	for _, day := range active {
+		byDate[day.Date] = day
+	}
+	summary := make([]*model.UserActivityDay, 0, days)
+	for i := 0; i < days; i++ {
+		date := since.AddDate(0, 0, i).Format("2006-01-02")
+		day, ok := byDate[date]
+		if !ok {
+			day = &model.UserActivityDay{Date: date, Counts: map[string]int{}}
+		}
+		summary = append(summary, day)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"timezone": timezone, "days": summary})
+}
+
+// HandleActivityEvent records the activity in an event from another service. It is
+// the consumer of ActivityQueue. Each event is recorded once, however often it is
+// delivered.
+func (a *API) HandleActivityEvent(body []byte) error {
+	envelope, err := events.Decode(body)
+	if err != nil {
+		return messaging.Permanent(fmt.Errorf("malformed activity event: %w", err))
+	}
+	payload, err := envelope.DecodePayload()
+	if err != nil {
+		return messaging.Permanent(err)
+	}
+	event, ok := payload.(*events.UserActivity)
+	if !ok || event.UserID == 0 || event.ActivityType == "" {
+		return messaging.Permanent(fmt.Errorf("invalid activity in %s event %s", envelope.Type, envelope.ID))
+	}
+	activity := model.UserActivity{
+		UserID:       event.UserID,
+		ActivityType: event.ActivityType,
+		Metadata:     event.Metadata,
+		EventID:      envelope.ID,
+	}
+
+	if err := a.UserStore.CreateUserActivity(context.Background(), &activity); err != nil {
+		var pgErr *pgconn.PgError
+		// The user does not exist (anymore).
+		if errors.As(err, &pgErr) && pgErr.Code == "23503" {
+			err = messaging.Permanent(err)
+		}
+		return fmt.Errorf("recording activity of user %d: %w", activity.UserID, err)
+	}
+	return nil
+}
+
+// PruneUserActivities deletes activities older than their ActivityRetention and
+// returns how many it deleted. Several instances can run it at the same time.
+func (a *API) PruneUserActivities(ctx context.Context) (int64, error) {
+	var pruned int64
+	for {
+		deleted, err := a.UserStore.DeleteExpiredUserActivities(ctx, a.ActivityRetention.Default, a.ActivityRetention.ByType, activityPruneBatchSize)
+		pruned += deleted
+		if err != nil {
+			return pruned, err
+		}
+		if deleted < activityPruneBatchSize {
+			return pruned, nil
+		}
+	}
+}
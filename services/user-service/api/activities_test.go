@@ -0,0 +1,234 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/free-education/authz"
+	"github.com/free-education/user-service/messaging"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// getActivitiesForTest requests a user's activity feed or summary as the user.
+func getActivitiesForTest(apiHandler *API, userID int64, path string, handler func(*API, *gin.Context)) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{gin.Param{Key: "userId", Value: strconv.FormatInt(userID, 10)}}
+	c.Set("userID", userID)
+	c.Set(authz.RoleKey, model.RoleUser)
+	c.Request, _ = http.NewRequest(http.MethodGet, path, nil)
+
+	handler(apiHandler, c)
+	return w
+}
+
+func TestUserActivityFeed(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "feed@example.com", Password: "password123"})
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, activityType := range []string{"lesson_completed", "password_changed", "lesson_completed", "quiz_passed", "lesson_completed"} {
+		userStore.CreateUserActivity(context.Background(), &model.UserActivity{UserID: user.ID, ActivityType: activityType, CreatedAt: start.AddDate(0, 0, i)})
+	}
+	userStore.CreateUserActivity(context.Background(), &model.UserActivity{UserID: user.ID + 100, ActivityType: "lesson_completed"})
+
+	type page struct {
+		Data       []*model.UserActivity `json:"data"`
+		NextCursor int64                 `json:"next_cursor"`
+	}
+	get := func(t *testing.T, query string) page {
+		t.Helper()
+		w := getActivitiesForTest(apiHandler, user.ID, "/users/1/activity?"+query, (*API).GetUserActivityHandler)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var p page
+		json.Unmarshal(w.Body.Bytes(), &p)
+		return p
+	}
+
+	t.Run("Pages follow the cursor, newest first", func(t *testing.T) {
+		var days []int
+		cursor := int64(0)
+		for pages := 0; pages < 5; pages++ {
+			p := get(t, "limit=2&cursor="+strconv.FormatInt(cursor, 10))
+			for _, activity := range p.Data {
+				days = append(days, activity.CreatedAt.Day())
+			}
+			if cursor = p.NextCursor; cursor == 0 {
+				break
+			}
+		}
+		if len(days) != 5 || days[0] != 5 || days[4] != 1 {
+			t.Errorf("expected the user's five activities, newest first; got days %v", days)
+		}
+	})
+
+	t.Run("Activities are filtered by type", func(t *testing.T) {
+		p := get(t, "type=password_changed&type=quiz_passed,unknown")
+		if len(p.Data) != 2 || p.Data[0].ActivityType != "quiz_passed" || p.Data[1].ActivityType != "password_changed" {
+			t.Errorf("unexpected activities %+v", p.Data)
+		}
+	})
+
+	t.Run("Activities are filtered by time", func(t *testing.T) {
+		p := get(t, "since=2024-05-02T12:00:00Z&until=2024-05-04T12:00:00Z")
+		if len(p.Data) != 2 || p.NextCursor != 0 {
+			t.Errorf("expected the activities of May 2 and 3; got %+v", p.Data)
+		}
+	})
+
+	t.Run("Invalid times are rejected", func(t *testing.T) {
+		w := getActivitiesForTest(apiHandler, user.ID, "/users/1/activity?since=yesterday", (*API).GetUserActivityHandler)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+func TestUserActivitySummary(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "summary@example.com", Password: "password123"})
+	user.Preferences = map[string]interface{}{"timezone": "Pacific/Kiritimati"}
+	for _, activityType := range []string{"lesson_completed", "lesson_completed", "quiz_passed"} {
+		userStore.CreateUserActivity(context.Background(), &model.UserActivity{UserID: user.ID, ActivityType: activityType})
+	}
+	userStore.CreateUserActivity(context.Background(), &model.UserActivity{UserID: user.ID, ActivityType: "lesson_completed", CreatedAt: time.Now().AddDate(0, 0, -10)})
+
+	type summary struct {
+		Timezone string                   `json:"timezone"`
+		Days     []*model.UserActivityDay `json:"days"`
+	}
+	get := func(t *testing.T, query string) summary {
+		t.Helper()
+		w := getActivitiesForTest(apiHandler, user.ID, "/users/1/activity/summary?"+query, (*API).GetUserActivitySummaryHandler)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var s summary
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return s
+	}
+
+	t.Run("Days are counted in the user's time zone", func(t *testing.T) {
+		s := get(t, "days=7")
+		location, _ := time.LoadLocation("Pacific/Kiritimati")
+		today := time.Now().In(location).Format("2006-01-02")
+		if s.Timezone != "Pacific/Kiritimati" || len(s.Days) != 7 {
+			t.Fatalf("expected 7 days in Pacific/Kiritimati; got %d in %s", len(s.Days), s.Timezone)
+		}
+		last := s.Days[6]
+		if last.Date != today || last.Total != 3 || last.Counts["lesson_completed"] != 2 || last.Counts["quiz_passed"] != 1 {
+			t.Errorf("unexpected summary of today (%s): %+v", today, last)
+		}
+		for _, day := range s.Days[:6] {
+			if day.Total != 0 {
+				t.Errorf("expected no activities on %s; got %+v", day.Date, day)
+			}
+		}
+	})
+
+	t.Run("The time range defaults to 30 days", func(t *testing.T) {
+		s := get(t, "timezone=UTC")
+		total := 0
+		for _, day := range s.Days {
+			total += day.Total
+		}
+		if len(s.Days) != 30 || total != 4 || s.Timezone != "UTC" {
+			t.Errorf("expected 4 activities over 30 days in UTC; got %d over %d days in %s", total, len(s.Days), s.Timezone)
+		}
+	})
+
+	t.Run("Invalid parameters are rejected", func(t *testing.T) {
+		for _, query := range []string{"days=0", "days=366", "days=week", "timezone=Mars/Olympus_Mons"} {
+			w := getActivitiesForTest(apiHandler, user.ID, "/users/1/activity/summary?"+query, (*API).GetUserActivitySummaryHandler)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d; got %d", query, http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+}
+
+func TestPruneUserActivities(t *testing.T) {
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	apiHandler.ActivityRetention.ByType["certificate_earned"] = 0
+
+	old := time.Now().AddDate(-1, 0, 0)
+	for _, activityType := range []string{"lesson_completed", "password_changed", "certificate_earned"} {
+		userStore.CreateUserActivity(context.Background(), &model.UserActivity{UserID: 1, ActivityType: activityType, CreatedAt: old})
+	}
+	userStore.CreateUserActivity(context.Background(), &model.UserActivity{UserID: 1, ActivityType: "lesson_completed"})
+
+	pruned, err := apiHandler.PruneUserActivities(context.Background())
+	if err != nil || pruned != 1 {
+		t.Fatalf("expected one activity to be pruned; got %d, %v", pruned, err)
+	}
+	var kept []string
+	for _, activity := range userStore.activities {
+		kept = append(kept, activity.ActivityType)
+	}
+	if len(kept) != 3 || kept[0] != "password_changed" || kept[1] != "certificate_earned" {
+		t.Errorf("expected the old lesson to be pruned and everything else kept; got %v", kept)
+	}
+}
+
+// failingActivityStore fails to record activities, as an unavailable database would.
+type failingActivityStore struct {
+	*MockUserStore
+}
+
+func (s *failingActivityStore) CreateUserActivity(ctx context.Context, activity *model.UserActivity) error {
+	return errors.New("connection refused")
+}
+
+func TestHandleActivityEvent(t *testing.T) {
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	event := []byte(`{"id":"2b7c1c6e-7f0e-4d8a-9a53-0c2f5e1b9d11","type":"user_activity","version":1,"occurred_at":"2026-10-16T09:00:00Z","producer":"content-service","payload":{"user_id":7,"activity_type":"lesson_completed","metadata":{"lesson_id":3}}}`)
+
+	t.Run("Redelivered events are recorded once", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if err := apiHandler.HandleActivityEvent(event); err != nil {
+				t.Fatalf("HandleActivityEvent failed: %v", err)
+			}
+		}
+		activities, _ := userStore.GetUserActivities(context.Background(), 7)
+		if len(activities) != 1 || activities[0].ActivityType != "lesson_completed" || activities[0].Metadata["lesson_id"] != float64(3) {
+			t.Errorf("expected the activity to be recorded once; got %+v", activities)
+		}
+	})
+
+	t.Run("Invalid events are not retried", func(t *testing.T) {
+		for _, body := range []string{
+			`not json`,
+			`{"id":"x","type":"user_activity","version":1,"payload":{"activity_type":"lesson_completed"}}`,
+			`{"id":"x","type":"user_activity","version":1,"payload":"lesson"}`,
+			`{"id":"x","type":"user_activity","version":2,"payload":{"user_id":7,"activity_type":"lesson_completed"}}`,
+			`{"id":"x","type":"lesson_completed","version":1,"payload":{"user_id":7,"lesson_id":3}}`,
+		} {
+			if err := apiHandler.HandleActivityEvent([]byte(body)); !messaging.IsPermanent(err) {
+				t.Errorf("%s: expected a permanent error; got %v", body, err)
+			}
+		}
+	})
+
+	t.Run("Events are retried when they cannot be recorded", func(t *testing.T) {
+		failing := NewAPI(&failingActivityStore{userStore}, &MockMessageBroker{}, "", "", "", nil)
+		if err := failing.HandleActivityEvent(event); err == nil || messaging.IsPermanent(err) {
+			t.Errorf("expected an error worth retrying; got %v", err)
+		}
+	})
+}
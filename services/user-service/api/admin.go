@@ -0,0 +1,320 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+// defaultAdminPageSize is the page size of the admin lists when none is requested.
+const defaultAdminPageSize = 20
+
+// auditEntry starts an audit log entry for an action taken by the current user.
+func auditEntry(c *gin.Context, action, reason string, details map[string]interface{}) *model.AdminAuditEntry {
+	return &model.AdminAuditEntry{
+		ActorID:   c.MustGet("userID").(int64),
+		Action:    action,
+		Reason:    reason,
+		Details:   details,
+		IPAddress: c.ClientIP(),
+	}
+}
+
+// adminTarget loads the user named by the :userId parameter. It writes an error
+// response and returns nil if the ID is invalid or the user does not exist.
+func (a *API) adminTarget(c *gin.Context) *model.User {
+	targetID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return nil
+	}
+	target, err := a.UserStore.GetUserByID(c.Request.Context(), targetID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil
+	}
+	return target
+}
+
+// checkCanManage writes a 403 response and returns false unless the current user
+// may act on the target's account: nobody can act on their own account this way,
+// and moderators can only act on regular users.
+func checkCanManage(c *gin.Context, target *model.User) bool {
+	if target.ID == c.MustGet("userID").(int64) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "You cannot perform this action on your own account."})
+		return false
+	}
+	if c.GetString("userRole") != model.RoleAdmin && target.Role != model.RoleUser {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can manage moderator and admin accounts."})
+		return false
+	}
+	return true
+}
+
+// ListUsersHandler searches and pages through all users. It is available to moderators and admins.
+func (a *API) ListUsersHandler(c *gin.Context) {
+	var search model.UserSearch
+	if err := c.ShouldBindQuery(&search); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+		return
+	}
+	if search.Page == 0 {
+		search.Page = 1
+	}
+	if search.PageSize == 0 {
+		search.PageSize = defaultAdminPageSize
+	}
+
+	users, total, err := a.UserStore.SearchUsers(c.Request.Context(), search)
+	if err != nil {
+		log.Printf("Error searching users: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users."})
+		return
+	}
+	if users == nil {
+		users = []*model.User{}
+	}
+
+	entry := auditEntry(c, "users_searched", "", map[string]interface{}{
+		"q": search.Query, "role": search.Role, "status": search.Status, "page": search.Page,
+	})
+	if err := a.UserStore.CreateAdminAuditEntry(c.Request.Context(), entry); err != nil {
+		log.Printf("Error writing audit log entry: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search users."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users":     users,
+		"total":     total,
+		"page":      search.Page,
+		"page_size": search.PageSize,
+	})
+}
+
+// GetUserHandler returns one user's account details. It is available to moderators and admins.
+func (a *API) GetUserHandler(c *gin.Context) {
+	target := a.adminTarget(c)
+	if target == nil {
+		return
+	}
+
+	entry := auditEntry(c, "user_viewed", "", nil)
+	entry.TargetUserID = &target.ID
+	if err := a.UserStore.CreateAdminAuditEntry(c.Request.Context(), entry); err != nil {
+		log.Printf("Error writing audit log entry: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user."})
+		return
+	}
+
+	c.JSON(http.StatusOK, target)
+}
+
+// ChangeUserRoleHandler changes a user's role. It is available to admins only.
+// The user's existing tokens are revoked, since they carry the old role.
+func (a *API) ChangeUserRoleHandler(c *gin.Context) {
+	var req model.ChangeRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	target := a.adminTarget(c)
+	if target == nil || !checkCanManage(c, target) {
+		return
+	}
+
+	previousRole, err := a.UserStore.SetUserRole(c.Request.Context(), target.ID, req.Role, auditEntry(c, "role_changed", req.Reason, nil))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Printf("Error changing role of user %d: %v", target.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change role."})
+		return
+	}
+
+	if err := a.revokeUserSessions(c.Request.Context(), target.ID, "role_changed"); err != nil {
+		log.Printf("Error revoking sessions for user %d after role change: %v", target.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Role changed.", "previous_role": previousRole, "role": req.Role})
+}
+
+// AdminDeactivateUserHandler suspends an account and signs it out everywhere. It is
+// available to moderators, for regular users, and to admins.
+func (a *API) AdminDeactivateUserHandler(c *gin.Context) {
+	var req model.AdminActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	target := a.adminTarget(c)
+	if target == nil || !checkCanManage(c, target) {
+		return
+	}
+
+	if err := a.UserStore.SetUserDeactivated(c.Request.Context(), target.ID, true, auditEntry(c, "user_deactivated", req.Reason, nil)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Printf("Error deactivating user %d: %v", target.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate account."})
+		return
+	}
+
+	if err := a.revokeUserSessions(c.Request.Context(), target.ID, "account_suspended"); err != nil {
+		log.Printf("Error revoking sessions for suspended user %d: %v", target.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Account deactivated, but failed to sign it out."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deactivated."})
+}
+
+// AdminReactivateUserHandler lifts a deactivation. It is available to moderators,
+// for regular users, and to admins.
+func (a *API) AdminReactivateUserHandler(c *gin.Context) {
+	var req model.AdminActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	target := a.adminTarget(c)
+	if target == nil || !checkCanManage(c, target) {
+		return
+	}
+
+	if err := a.UserStore.SetUserDeactivated(c.Request.Context(), target.ID, false, auditEntry(c, "user_reactivated", req.Reason, nil)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Printf("Error reactivating user %d: %v", target.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reactivate account."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account reactivated."})
+}
+
+// AdminReset2FAHandler turns off 2FA for a user who lost their device, so they can
+// log in with their password and set it up again. It is available to admins only.
+func (a *API) AdminReset2FAHandler(c *gin.Context) {
+	var req model.AdminActionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	target := a.adminTarget(c)
+	if target == nil || !checkCanManage(c, target) {
+		return
+	}
+
+	if err := a.UserStore.Reset2FA(c.Request.Context(), target.ID, auditEntry(c, "2fa_reset", req.Reason, nil)); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		log.Printf("Error resetting 2FA for user %d: %v", target.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset 2FA."})
+		return
+	}
+
+	activity := &model.UserActivity{UserID: target.ID, ActivityType: "2fa_reset_by_admin"}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording 2FA reset for user %d: %v", target.ID, err)
+	}
+	// Tell the user, in case the request to support did not come from them.
+	payload := &events.TwoFactorReset{Email: target.Email, Name: target.FirstName}
+	if err := a.MessageBroker.Publish(c.Request.Context(), "notifications_events", payload); err != nil {
+		log.Printf("Error publishing 2FA reset notice for user %d: %v", target.ID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication has been reset."})
+}
+
+// ImpersonateUserHandler returns a short-lived token that acts as a regular user,
+// for reproducing support issues. It is available to admins only. The token cannot
+// be refreshed or used for actions that need recent authentication.
+func (a *API) ImpersonateUserHandler(c *gin.Context) {
+	var req model.ImpersonateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	target := a.adminTarget(c)
+	if target == nil || !checkCanManage(c, target) {
+		return
+	}
+	if target.Role != model.RoleUser {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only regular users can be impersonated."})
+		return
+	}
+	if target.DeactivatedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Deactivated accounts cannot be impersonated."})
+		return
+	}
+
+	// The entry is written first: no token is handed out unless it is on record.
+	entry := auditEntry(c, "impersonation_started", req.Reason, nil)
+	entry.TargetUserID = &target.ID
+	if err := a.UserStore.CreateAdminAuditEntry(c.Request.Context(), entry); err != nil {
+		log.Printf("Error writing audit log entry: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start impersonation."})
+		return
+	}
+
+	token, err := auth.GenerateImpersonationToken(target.ID, target.Role, entry.ActorID)
+	if err != nil {
+		log.Printf("Error generating impersonation token for user %d: %v", target.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start impersonation."})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.ImpersonationResponse{
+		Token:     token,
+		ExpiresIn: int64(auth.ImpersonationTokenTTL.Seconds()),
+	})
+}
+
+// ListAdminAuditLogHandler pages through the admin audit log, newest first. It is
+// available to admins only.
+func (a *API) ListAdminAuditLogHandler(c *gin.Context) {
+	var search model.AdminAuditSearch
+	if err := c.ShouldBindQuery(&search); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid query: " + err.Error()})
+		return
+	}
+	if search.Page == 0 {
+		search.Page = 1
+	}
+	if search.PageSize == 0 {
+		search.PageSize = defaultAdminPageSize
+	}
+
+	entries, total, err := a.UserStore.GetAdminAuditLog(c.Request.Context(), search)
+	if err != nil {
+		log.Printf("Error reading admin audit log: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve the audit log."})
+		return
+	}
+	if entries == nil {
+		entries = []*model.AdminAuditEntry{}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"entries":   entries,
+		"total":     total,
+		"page":      search.Page,
+		"page_size": search.PageSize,
+	})
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/free-education/authz"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// newAdminRouterForTest routes the admin API the way main does.
+func newAdminRouterForTest(apiHandler *API) *gin.Engine {
+	router := gin.New()
+	admin := router.Group("/admin")
+	admin.Use(authz.Authenticate(TokenVerifier()), authz.RequireRole(model.RoleModerator, model.RoleAdmin))
+	admin.GET("/users", apiHandler.ListUsersHandler)
+	admin.GET("/users/:userId", apiHandler.GetUserHandler)
+	admin.POST("/users/:userId/deactivate", apiHandler.AdminDeactivateUserHandler)
+	admin.POST("/users/:userId/reactivate", apiHandler.AdminReactivateUserHandler)
+
+	adminOnly := admin.Group("/")
+	adminOnly.Use(authz.RequireRole(model.RoleAdmin))
+	adminOnly.GET("/audit-log", apiHandler.ListAdminAuditLogHandler)
+	adminRecentAuth := adminOnly.Group("/")
+	adminRecentAuth.Use(RequireRecentAuth())
+	adminRecentAuth.PUT("/users/:userId/role", apiHandler.ChangeUserRoleHandler)
+	adminRecentAuth.POST("/users/:userId/2fa/reset", apiHandler.AdminReset2FAHandler)
+	adminRecentAuth.POST("/users/:userId/impersonate", apiHandler.ImpersonateUserHandler)
+	return router
+}
+
+// adminRequestForTest sends a request with an access token for the given user.
+// A reauth token is attached if reauth is true.
+func adminRequestForTest(t *testing.T, router *gin.Engine, method, path string, actor *model.User, reauth bool, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader *bytes.Buffer
+	if body != nil {
+		jsonBody, _ := json.Marshal(body)
+		reader = bytes.NewBuffer(jsonBody)
+	} else {
+		reader = bytes.NewBuffer([]byte("{}"))
+	}
+	req, _ := http.NewRequest(method, path, reader)
+	req.Header.Set("Content-Type", "application/json")
+	token, err := auth.GenerateToken(actor.ID, actor.Role, 0)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if reauth {
+		token, err := auth.GenerateReauthToken(actor.ID)
+		if err != nil {
+			t.Fatalf("Failed to generate reauth token: %v", err)
+		}
+		req.Header.Set("X-Reauth-Token", token)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// createUserWithRoleForTest registers a user and gives them a role.
+func createUserWithRoleForTest(userStore *MockUserStore, email, firstName, role string) *model.User {
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: email, Password: "password", FirstName: firstName})
+	user.Role = role
+	return user
+}
+
+func TestAdminUserManagement(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	admin := createUserWithRoleForTest(userStore, "admin@example.com", "Ada", model.RoleAdmin)
+	moderator := createUserWithRoleForTest(userStore, "moderator@example.com", "Mo", model.RoleModerator)
+	student := createUserWithRoleForTest(userStore, "student@example.com", "Sam", model.RoleUser)
+	createUserWithRoleForTest(userStore, "other-admin@example.com", "Otto", model.RoleAdmin)
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
+	router := newAdminRouterForTest(apiHandler)
+	studentPath := "/admin/users/" + strconv.FormatInt(student.ID, 10)
+
+	t.Run("Regular users are refused", func(t *testing.T) {
+		if w := adminRequestForTest(t, router, http.MethodGet, "/admin/users", student, false, nil); w.Code != http.StatusForbidden {
+			t.Errorf("expected status %d; got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("Search", func(t *testing.T) {
+		var resp struct {
+			Users []*model.User `json:"users"`
+			Total int64         `json:"total"`
+		}
+		w := adminRequestForTest(t, router, http.MethodGet, "/admin/users?q=SAM", moderator, false, nil)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if w.Code != http.StatusOK || resp.Total != 1 || resp.Users[0].ID != student.ID {
+			t.Fatalf("expected to find the student; got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = adminRequestForTest(t, router, http.MethodGet, "/admin/users?role=admin&page_size=1", moderator, false, nil)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Total != 2 || len(resp.Users) != 1 {
+			t.Errorf("expected 1 of 2 admins; got %d of %d", len(resp.Users), resp.Total)
+		}
+
+		if w := adminRequestForTest(t, router, http.MethodGet, "/admin/users?role=owner", moderator, false, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for an unknown role; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Moderator suspends a student", func(t *testing.T) {
+		body := map[string]string{"reason": "Spam in course reviews"}
+		if w := adminRequestForTest(t, router, http.MethodPost, "/admin/users/"+strconv.FormatInt(admin.ID, 10)+"/deactivate", moderator, false, body); w.Code != http.StatusForbidden {
+			t.Errorf("expected a moderator not to suspend an admin; got %d", w.Code)
+		}
+
+		w := adminRequestForTest(t, router, http.MethodPost, studentPath+"/deactivate", moderator, false, body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if student.DeactivatedAt == nil {
+			t.Error("expected the student to be deactivated")
+		}
+		last := userStore.auditLog[len(userStore.auditLog)-1]
+		if last.Action != "user_deactivated" || last.ActorID != moderator.ID || *last.TargetUserID != student.ID || last.Reason != "Spam in course reviews" {
+			t.Errorf("unexpected audit log entry: %+v", last)
+		}
+		login := model.LoginRequest{Email: "student@example.com", Password: "password"}
+		if w := postJSONForTest(apiHandler.LoginUserHandler, "/login", login); w.Code != http.StatusUnauthorized || bytes.Contains(w.Body.Bytes(), []byte(`"token"`)) {
+			t.Errorf("expected the suspended student not to log in; got %d %s", w.Code, w.Body.String())
+		}
+
+		if w := adminRequestForTest(t, router, http.MethodPost, studentPath+"/reactivate", moderator, false, nil); w.Code != http.StatusOK || student.DeactivatedAt != nil {
+			t.Errorf("expected the student to be reactivated; got %d", w.Code)
+		}
+		if w := postJSONForTest(apiHandler.LoginUserHandler, "/login", login); w.Code != http.StatusOK {
+			t.Errorf("expected the reactivated student to log in; got %d %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Change role", func(t *testing.T) {
+		body := map[string]string{"role": model.RoleModerator}
+		if w := adminRequestForTest(t, router, http.MethodPut, studentPath+"/role", moderator, true, body); w.Code != http.StatusForbidden {
+			t.Errorf("expected a moderator not to change roles; got %d", w.Code)
+		}
+		if w := adminRequestForTest(t, router, http.MethodPut, studentPath+"/role", admin, false, body); w.Code != http.StatusForbidden {
+			t.Errorf("expected recent authentication to be required; got %d", w.Code)
+		}
+		if w := adminRequestForTest(t, router, http.MethodPut, "/admin/users/"+strconv.FormatInt(admin.ID, 10)+"/role", admin, true, body); w.Code != http.StatusForbidden {
+			t.Errorf("expected an admin not to change their own role; got %d", w.Code)
+		}
+
+		w := adminRequestForTest(t, router, http.MethodPut, studentPath+"/role", admin, true, body)
+		if w.Code != http.StatusOK || student.Role != model.RoleModerator {
+			t.Fatalf("expected the student to become a moderator; got %d: %s", w.Code, w.Body.String())
+		}
+		last := userStore.auditLog[len(userStore.auditLog)-1]
+		if last.Action != "role_changed" || last.Details["previous_role"] != model.RoleUser {
+			t.Errorf("unexpected audit log entry: %+v", last)
+		}
+		student.Role = model.RoleUser
+	})
+
+	t.Run("Reset 2FA", func(t *testing.T) {
+		student.TwoFactorEnabled = true
+		student.TwoFactorSecret = "JBSWY3DPEHPK3PXP"
+		w := adminRequestForTest(t, router, http.MethodPost, studentPath+"/2fa/reset", admin, true, map[string]string{"reason": "Lost phone, ticket #123"})
+		if w.Code != http.StatusOK || student.TwoFactorEnabled {
+			t.Fatalf("expected 2FA to be reset; got %d: %s", w.Code, w.Body.String())
+		}
+		if notices := mockMessageBroker.EventsOfType("two_factor_reset"); len(notices) != 1 {
+			t.Errorf("expected 1 two_factor_reset event; got %d", len(notices))
+		}
+	})
+
+	t.Run("Audit log", func(t *testing.T) {
+		if w := adminRequestForTest(t, router, http.MethodGet, "/admin/audit-log", moderator, false, nil); w.Code != http.StatusForbidden {
+			t.Errorf("expected moderators not to read the audit log; got %d", w.Code)
+		}
+		var resp struct {
+			Entries []*model.AdminAuditEntry `json:"entries"`
+		}
+		w := adminRequestForTest(t, router, http.MethodGet, "/admin/audit-log?target_user_id="+strconv.FormatInt(student.ID, 10), admin, false, nil)
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		want := []string{"2fa_reset", "role_changed", "user_reactivated", "user_deactivated"}
+		if len(resp.Entries) != len(want) {
+			t.Fatalf("expected %d entries for the student; got %s", len(want), w.Body.String())
+		}
+		for i, action := range want {
+			if resp.Entries[i].Action != action {
+				t.Errorf("entry %d: expected action %q; got %q", i, action, resp.Entries[i].Action)
+			}
+		}
+	})
+}
+
+func TestImpersonateUser(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	admin := createUserWithRoleForTest(userStore, "admin@example.com", "Ada", model.RoleAdmin)
+	otherAdmin := createUserWithRoleForTest(userStore, "other-admin@example.com", "Otto", model.RoleAdmin)
+	student := createUserWithRoleForTest(userStore, "student@example.com", "Sam", model.RoleUser)
+	router := newAdminRouterForTest(NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil))
+	studentPath := "/admin/users/" + strconv.FormatInt(student.ID, 10)
+
+	if w := adminRequestForTest(t, router, http.MethodPost, studentPath+"/impersonate", admin, true, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected a reason to be required; got %d", w.Code)
+	}
+	if w := adminRequestForTest(t, router, http.MethodPost, "/admin/users/"+strconv.FormatInt(otherAdmin.ID, 10)+"/impersonate", admin, true, map[string]string{"reason": "curious"}); w.Code != http.StatusForbidden {
+		t.Errorf("expected admins not to be impersonated; got %d", w.Code)
+	}
+
+	w := adminRequestForTest(t, router, http.MethodPost, studentPath+"/impersonate", admin, true, map[string]string{"reason": "Ticket #456: quiz won't submit"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp model.ImpersonationResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	claims, err := auth.ValidateToken(resp.Token)
+	if err != nil || claims.UserID != student.ID || claims.ImpersonatorID != admin.ID || claims.SessionID != 0 {
+		t.Fatalf("expected a sessionless token for the student naming the admin; got %+v, %v", claims, err)
+	}
+	last := userStore.auditLog[len(userStore.auditLog)-1]
+	if last.Action != "impersonation_started" || last.ActorID != admin.ID || *last.TargetUserID != student.ID {
+		t.Errorf("unexpected audit log entry: %+v", last)
+	}
+
+	t.Run("No sensitive actions while impersonating", func(t *testing.T) {
+		router := gin.New()
+		router.DELETE("/account", authz.Authenticate(TokenVerifier()), RequireRecentAuth(), func(c *gin.Context) { c.Status(http.StatusNoContent) })
+		reauthToken, _ := auth.GenerateReauthToken(student.ID)
+		req, _ := http.NewRequest(http.MethodDelete, "/account", nil)
+		req.Header.Set("Authorization", "Bearer "+resp.Token)
+		req.Header.Set("X-Reauth-Token", reauthToken)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected status %d; got %d", http.StatusForbidden, w.Code)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/free-education/erasure"
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/messaging"
+)
+
+const (
+	// erasureRetryAfter is how long a service has to confirm an erasure before it is
+	// asked again. The wait doubles with every attempt, up to erasureMaxRetryAfter.
+	erasureRetryAfter    = time.Minute
+	erasureMaxRetryAfter = 6 * time.Hour
+	// erasureAlertAttempts is the attempt from which a missing confirmation is logged
+	// as critical.
+	erasureAlertAttempts = 10
+	// erasureBatchSize is how many erasure requests are claimed per query.
+	erasureBatchSize = 100
+)
+
+// DefaultErasureServices are the services that hold data about users and must erase
+// it when a user is deleted.
+var DefaultErasureServices = []string{"content", "forum", "gamification"}
+
+// SendErasureRequests publishes a `user_deleted` event to every service that has yet
+// to confirm the erasure of a deleted user's data and is due to be asked (again).
+// It returns how many requests were sent. main runs it periodically, and it also
+// runs right after a deletion; several instances can run it at the same time.
+func (a *API) SendErasureRequests(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		requests, err := a.UserStore.ClaimErasureRequests(ctx, erasureRetryAfter, erasureMaxRetryAfter, erasureBatchSize)
+		if err != nil {
+			return sent, err
+		}
+		for _, request := range requests {
+			if request.Attempts >= erasureAlertAttempts {
+				log.Printf("CRITICAL: %s service has not confirmed erasing the data of deleted user %d after %d attempts", request.Service, request.UserID, request.Attempts-1)
+			}
+			payload := &events.UserDeleted{DeletionID: request.DeletionID, UserID: request.UserID}
+			if err := a.MessageBroker.Publish(ctx, erasure.Queue(request.Service), payload); err != nil {
+				// The attempt is counted either way, so the request is retried later.
+				log.Printf("Error asking %s service to erase the data of user %d: %v", request.Service, request.UserID, err)
+				continue
+			}
+			sent++
+		}
+		if len(requests) < erasureBatchSize {
+			return sent, nil
+		}
+	}
+}
+
+// sendErasureRequestsNow sends the erasure requests of a deletion that just happened
+// without waiting for the next run of SendErasureRequests.
+func (a *API) sendErasureRequestsNow(ctx context.Context) {
+	if _, err := a.SendErasureRequests(ctx); err != nil {
+		// The requests stay recorded and are sent by the next periodic run.
+		log.Printf("Error sending erasure requests: %v", err)
+	}
+}
+
+// HandleErasureReply records a service's `user_data_erased` confirmation. It is the
+// consumer of erasure.RepliesQueue.
+func (a *API) HandleErasureReply(body []byte) error {
+	envelope, err := events.Decode(body)
+	if err != nil {
+		return messaging.Permanent(fmt.Errorf("malformed erasure reply: %w", err))
+	}
+	if envelope.Type != events.TypeUserDataErased {
+		log.Printf("Ignoring unexpected event %q on %s", envelope.Type, erasure.RepliesQueue)
+		return nil
+	}
+	payload, err := envelope.DecodePayload()
+	if err != nil {
+		return messaging.Permanent(err)
+	}
+
+	reply := payload.(*events.UserDataErased)
+	completed, err := a.UserStore.ConfirmUserDataErased(context.Background(), reply.DeletionID, reply.Service)
+	if err != nil {
+		return fmt.Errorf("recording erasure of user %d by %s service: %w", reply.UserID, reply.Service, err)
+	}
+	if completed {
+		log.Printf("All services have erased the data of deleted user %d", reply.UserID)
+	}
+	return nil
+}
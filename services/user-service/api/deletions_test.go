@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/free-education/erasure"
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// erasureReplyForTest builds the confirmation a service sends after erasing a user's data.
+func erasureReplyForTest(deletionID, userID int64, service string) []byte {
+	envelope, _ := events.New(service, &events.UserDataErased{DeletionID: deletionID, UserID: userID, Service: service})
+	body, _ := events.Encode(envelope)
+	return body
+}
+
+func TestUserDeletionSaga(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
+	apiHandler.DeletionGracePeriod = 0
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", user.ID)
+	c.Request, _ = http.NewRequest(http.MethodDelete, "/account", nil)
+	apiHandler.DeleteUserHandler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+	}
+
+	// Every service is asked on its own queue.
+	queues := map[string]bool{}
+	var deletionID int64
+	for _, event := range mockMessageBroker.EventsOfType("user_deleted") {
+		queues[event.QueueName] = true
+		payload := event.Payload.(*events.UserDeleted)
+		deletionID = payload.DeletionID
+		if payload.UserID != user.ID {
+			t.Errorf("expected the event to name user %d; got %v", user.ID, payload.UserID)
+		}
+	}
+	for _, service := range DefaultErasureServices {
+		if !queues[erasure.Queue(service)] {
+			t.Errorf("expected a user_deleted event on %s", erasure.Queue(service))
+		}
+	}
+
+	apiHandler.HandleErasureReply(erasureReplyForTest(deletionID, user.ID, "content"))
+	apiHandler.HandleErasureReply(erasureReplyForTest(deletionID, user.ID, "forum"))
+
+	if sent, _ := apiHandler.SendErasureRequests(context.Background()); sent != 0 {
+		t.Errorf("expected no requests to be resent before the retry interval; got %d", sent)
+	}
+
+	// Once the retry interval has passed, only the service that has not confirmed is asked again.
+	for _, erasure := range userStore.erasures {
+		erasure.lastAttempt = time.Now().Add(-2 * erasureRetryAfter)
+	}
+	mockMessageBroker.Published = nil
+	if sent, _ := apiHandler.SendErasureRequests(context.Background()); sent != 1 {
+		t.Fatalf("expected 1 request to be resent; got %d", sent)
+	}
+	if events := mockMessageBroker.EventsOfType("user_deleted"); events[0].QueueName != erasure.Queue("gamification") {
+		t.Errorf("expected the gamification service to be asked again; got %+v", events)
+	}
+
+	t.Run("Retries back off", func(t *testing.T) {
+		for _, erasure := range userStore.erasures {
+			erasure.lastAttempt = time.Now().Add(-3 * erasureRetryAfter / 2)
+		}
+		if sent, _ := apiHandler.SendErasureRequests(context.Background()); sent != 0 {
+			t.Errorf("expected the second retry to wait longer; got %d requests sent", sent)
+		}
+	})
+
+	apiHandler.HandleErasureReply(erasureReplyForTest(deletionID, user.ID, "gamification"))
+	for _, erasure := range userStore.erasures {
+		if !erasure.confirmed {
+			t.Errorf("expected %s to be confirmed", erasure.Service)
+		}
+	}
+	for _, erasure := range userStore.erasures {
+		erasure.lastAttempt = time.Time{}
+	}
+	if sent, _ := apiHandler.SendErasureRequests(context.Background()); sent != 0 {
+		t.Errorf("expected no requests once every service has confirmed; got %d", sent)
+	}
+}
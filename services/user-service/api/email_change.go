@@ -0,0 +1,119 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+)
+
+// EmailChangeTokenTTL is how long a link confirming a new email address stays valid.
+const EmailChangeTokenTTL = 24 * time.Hour
+
+// ChangeEmailHandler starts a change of the authenticated user's email address.
+// A confirmation link is sent to the new address and a "was this you?" notice to
+// the current one. Nothing changes until the link is followed.
+func (a *API) ChangeEmailHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	var req model.ChangeEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if strings.EqualFold(user.Email, req.NewEmail) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The new email address is the same as the current one."})
+		return
+	}
+	if existing, err := a.UserStore.GetUserByEmail(c.Request.Context(), req.NewEmail); err == nil && existing != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists."})
+		return
+	}
+
+	token, err := auth.GenerateSecureToken(32)
+	if err != nil {
+		log.Printf("Error generating token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request."})
+		return
+	}
+
+	expiresAt := time.Now().Add(EmailChangeTokenTTL)
+	if err := a.UserStore.CreateEmailChangeToken(c.Request.Context(), userID, req.NewEmail, token, expiresAt); err != nil {
+		log.Printf("Error creating email change token for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request."})
+		return
+	}
+
+	confirmationLink := fmt.Sprintf("%s/confirm-email-change?token=%s", a.FrontendBaseURL, token)
+	confirmPayload := &events.EmailChangeRequested{
+		Email:            req.NewEmail,
+		Name:             user.FirstName,
+		ConfirmationLink: confirmationLink,
+	}
+	if err := a.MessageBroker.Publish(c.Request.Context(), "notifications_events", confirmPayload); err != nil {
+		log.Printf("Error publishing email change confirmation for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send confirmation email."})
+		return
+	}
+
+	noticePayload := &events.EmailChangeNotice{
+		Email:    user.Email,
+		Name:     user.FirstName,
+		NewEmail: req.NewEmail,
+	}
+	if err := a.MessageBroker.Publish(c.Request.Context(), "notifications_events", noticePayload); err != nil {
+		// The change cannot complete without the new address confirming it, so this is not fatal.
+		log.Printf("Error publishing email change notice for user %d: %v", userID, err)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"message": "A confirmation link has been sent to the new email address."})
+}
+
+// ConfirmEmailChangeHandler applies a pending email change.
+// It expects the token from the confirmation link sent to the new address.
+func (a *API) ConfirmEmailChangeHandler(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	change, err := a.UserStore.ConfirmEmailChange(c.Request.Context(), req.Token)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		// The address may have been registered by someone else after the change was requested.
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "An account with this email already exists."})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token."})
+		return
+	}
+
+	activity := &model.UserActivity{
+		UserID:       change.UserID,
+		ActivityType: "email_changed",
+		Metadata:     map[string]interface{}{"old_email": change.OldEmail, "new_email": change.NewEmail},
+	}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording email change for user %d: %v", change.UserID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address changed successfully."})
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+func changeEmailForTest(apiHandler *API, userID int64, newEmail string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	jsonBody, _ := json.Marshal(map[string]string{"new_email": newEmail})
+	c.Request, _ = http.NewRequest(http.MethodPost, "/profile/email", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.ChangeEmailHandler(c)
+	return w
+}
+
+func TestChangeEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "old@example.com", Password: "password", FirstName: "Test"})
+	userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "taken@example.com", Password: "password"})
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "https://example.com", "", "", nil)
+
+	t.Run("Address already in use", func(t *testing.T) {
+		if w := changeEmailForTest(apiHandler, user.ID, "taken@example.com"); w.Code != http.StatusConflict {
+			t.Errorf("expected status %d; got %d", http.StatusConflict, w.Code)
+		}
+	})
+
+	t.Run("Same address", func(t *testing.T) {
+		if w := changeEmailForTest(apiHandler, user.ID, "OLD@example.com"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	w := changeEmailForTest(apiHandler, user.ID, "new@example.com")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d; got %d", http.StatusAccepted, w.Code)
+	}
+
+	confirmations := mockMessageBroker.EventsOfType("email_change_requested")
+	if len(confirmations) != 1 || confirmations[0].Payload.(*events.EmailChangeRequested).Email != "new@example.com" {
+		t.Fatalf("expected a confirmation to the new address; got %v", confirmations)
+	}
+	notices := mockMessageBroker.EventsOfType("email_change_notice")
+	if len(notices) != 1 || notices[0].Payload.(*events.EmailChangeNotice).Email != "old@example.com" {
+		t.Fatalf("expected a notice to the old address; got %v", notices)
+	}
+	if user.Email != "old@example.com" {
+		t.Fatal("expected the email to stay unchanged until confirmed")
+	}
+
+	link, _ := url.Parse(confirmations[0].Payload.(*events.EmailChangeRequested).ConfirmationLink)
+	token := link.Query().Get("token")
+
+	t.Run("Confirm", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.ConfirmEmailChangeHandler, "/email/change/confirm", map[string]string{"token": token})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		if user.Email != "new@example.com" {
+			t.Errorf("expected email to be changed; got %s", user.Email)
+		}
+		if _, err := userStore.GetUserByEmail(context.Background(), "old@example.com"); err == nil {
+			t.Error("expected the old address to be released")
+		}
+	})
+
+	t.Run("Token is single-use", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.ConfirmEmailChangeHandler, "/email/change/confirm", map[string]string{"token": token})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Address taken before confirmation", func(t *testing.T) {
+		changeEmailForTest(apiHandler, user.ID, "later@example.com")
+		confirmations := mockMessageBroker.EventsOfType("email_change_requested")
+		link, _ := url.Parse(confirmations[len(confirmations)-1].Payload.(*events.EmailChangeRequested).ConfirmationLink)
+		userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "later@example.com", Password: "password"})
+
+		w := postJSONForTest(apiHandler.ConfirmEmailChangeHandler, "/email/change/confirm", map[string]string{"token": link.Query().Get("token")})
+		if w.Code != http.StatusConflict {
+			t.Errorf("expected status %d; got %d", http.StatusConflict, w.Code)
+		}
+	})
+}
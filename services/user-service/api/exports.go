@@ -0,0 +1,287 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// DataExportTTL is how long a finished export can be downloaded before it is deleted.
+	DataExportTTL = 7 * 24 * time.Hour
+	// ExportDownloadTokenTTL is how long a download token for an export stays valid.
+	ExportDownloadTokenTTL = 15 * time.Minute
+	// exportStaleAfter is how long an export may stay in processing before another
+	// worker picks it up again.
+	exportStaleAfter = 15 * time.Minute
+)
+
+// serviceClient calls the other services when building exports.
+var serviceClient = &http.Client{Timeout: 10 * time.Second}
+
+// RequestDataExportHandler starts building an archive of the authenticated user's
+// personal data and returns the export to poll with GetDataExportHandler. If an
+// export is already in progress, that one is returned.
+func (a *API) RequestDataExportHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	export, created, err := a.UserStore.CreateDataExport(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error creating data export for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start the data export."})
+		return
+	}
+
+	if created {
+		activity := &model.UserActivity{UserID: userID, ActivityType: "data_export_requested", Metadata: map[string]interface{}{"export_id": export.ID}}
+		if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+			log.Printf("Error recording data export request of user %d: %v", userID, err)
+		}
+	}
+
+	c.JSON(http.StatusAccepted, export)
+}
+
+// GetDataExportHandler returns the status of one of the authenticated user's exports.
+func (a *API) GetDataExportHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+	export, ok := a.getDataExport(c, userID)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, export)
+}
+
+// CreateExportDownloadTokenHandler issues a single-use token for downloading a
+// ready export with DownloadDataExportHandler. Issuing a new token invalidates
+// the previous one.
+func (a *API) CreateExportDownloadTokenHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+	export, ok := a.getDataExport(c, userID)
+	if !ok {
+		return
+	}
+	if export.Status != model.DataExportReady {
+		c.JSON(http.StatusConflict, gin.H{"error": "The export is not ready.", "status": export.Status})
+		return
+	}
+
+	token, err := auth.GenerateSecureToken(32)
+	if err != nil {
+		log.Printf("Error generating download token for export %d: %v", export.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create download token."})
+		return
+	}
+	expiresAt := time.Now().Add(ExportDownloadTokenTTL)
+	if err := a.UserStore.SetDataExportDownloadToken(c.Request.Context(), userID, export.ID, auth.HashToken(token), expiresAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusConflict, gin.H{"error": "The export has expired."})
+			return
+		}
+		log.Printf("Error storing download token for export %d: %v", export.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create download token."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"download_token": token, "expires_at": expiresAt})
+}
+
+// DownloadDataExportHandler serves the archive a download token is for. It needs
+// no other authentication, so browsers can follow a plain link, and each token
+// works only once.
+func (a *API) DownloadDataExportHandler(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Missing download token."})
+		return
+	}
+
+	export, archive, err := a.UserStore.ConsumeDataExportDownloadToken(c.Request.Context(), auth.HashToken(token))
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Invalid or expired download token."})
+			return
+		}
+		log.Printf("Error consuming export download token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to download the export."})
+		return
+	}
+
+	activity := &model.UserActivity{UserID: export.UserID, ActivityType: "data_export_downloaded", Metadata: map[string]interface{}{"export_id": export.ID}}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording data export download of user %d: %v", export.UserID, err)
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="data-export-%d.zip"`, export.ID))
+	c.Header("Cache-Control", "no-store")
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// getDataExport loads the export named by the `exportId` parameter, writing an
+// error response and returning false if the user has no such export.
+func (a *API) getDataExport(c *gin.Context, userID int64) (*model.DataExport, bool) {
+	exportID, err := strconv.ParseInt(c.Param("exportId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid export ID"})
+		return nil, false
+	}
+
+	export, err := a.UserStore.GetDataExport(c.Request.Context(), userID, exportID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+			return nil, false
+		}
+		log.Printf("Error fetching export %d for user %d: %v", exportID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch the export."})
+		return nil, false
+	}
+	return export, true
+}
+
+// ProcessDataExports builds the archives of all pending exports, one at a time,
+// and returns how many it handled. main runs it periodically; several instances
+// can run it at the same time.
+func (a *API) ProcessDataExports(ctx context.Context) (int, error) {
+	processed := 0
+	for {
+		export, err := a.UserStore.ClaimDataExport(ctx, exportStaleAfter)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return processed, nil
+		}
+		if err != nil {
+			return processed, err
+		}
+		a.processDataExport(ctx, export)
+		processed++
+	}
+}
+
+func (a *API) processDataExport(ctx context.Context, export *model.DataExport) {
+	expiresAt := time.Now().Add(DataExportTTL)
+	user, archive, err := a.buildDataExport(ctx, export.UserID)
+	if err != nil {
+		log.Printf("Error building data export %d for user %d: %v", export.ID, export.UserID, err)
+		if err := a.UserStore.FailDataExport(ctx, export.ID, "Some of your data could not be collected. Please request a new export.", expiresAt); err != nil {
+			log.Printf("Error marking data export %d as failed: %v", export.ID, err)
+		}
+		return
+	}
+
+	if err := a.UserStore.CompleteDataExport(ctx, export.ID, archive, expiresAt); err != nil {
+		log.Printf("Error storing data export %d: %v", export.ID, err)
+		return
+	}
+
+	payload := &events.DataExportReady{
+		Email:     user.Email,
+		Name:      user.FirstName,
+		ExportURL: fmt.Sprintf("%s/settings?export=%d", a.FrontendBaseURL, export.ID),
+		ExpiresAt: expiresAt,
+	}
+	if err := a.MessageBroker.Publish(ctx, "notifications_events", payload); err != nil {
+		log.Printf("Error publishing data export notice for user %d: %v", export.UserID, err)
+	}
+}
+
+// buildDataExport collects everything stored about a user, here and in the
+// content and gamification services, into a zip archive of JSON files.
+func (a *API) buildDataExport(ctx context.Context, userID int64) (*model.User, []byte, error) {
+	user, err := a.UserStore.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("user: %w", err)
+	}
+	progress, err := a.UserStore.GetLessonProgressForUser(ctx, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("lesson progress: %w", err)
+	}
+	attempts, err := a.UserStore.GetQuizAttemptsForUser(ctx, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("quiz attempts: %w", err)
+	}
+	activities, err := a.UserStore.GetUserActivities(ctx, userID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("activities: %w", err)
+	}
+	var courses, stats json.RawMessage
+	if err := fetchServiceJSON(ctx, fmt.Sprintf("%s/users/%d/courses", a.ContentServiceURL, userID), &courses); err != nil {
+		return nil, nil, fmt.Errorf("content service: %w", err)
+	}
+	if err := fetchServiceJSON(ctx, fmt.Sprintf("%s/users/%d/stats", a.GamificationServiceURL, userID), &stats); err != nil {
+		return nil, nil, fmt.Errorf("gamification service: %w", err)
+	}
+
+	// Empty lists are written as [] rather than null.
+	if progress == nil {
+		progress = []model.LessonProgress{}
+	}
+	if attempts == nil {
+		attempts = []model.QuizAttempt{}
+	}
+	if activities == nil {
+		activities = []*model.UserActivity{}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		// model.User leaves out password hashes, 2FA secrets and other credentials.
+		{"profile.json", user},
+		{"preferences.json", user.Preferences},
+		{"lesson_progress.json", progress},
+		{"quiz_attempts.json", attempts},
+		{"activities.json", activities},
+		{"courses.json", courses},
+		{"gamification_stats.json", stats},
+	}
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.data, "", "  ")
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", file.name, err)
+		}
+		w, err := zw.Create(file.name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return user, buf.Bytes(), nil
+}
+
+// fetchServiceJSON GETs a URL from another service and decodes its JSON response into v.
+func fetchServiceJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := serviceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d from %s", resp.StatusCode, url)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
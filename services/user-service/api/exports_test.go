@@ -0,0 +1,182 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// exportRequestForTest calls one of the handlers for an existing export as the given user.
+func exportRequestForTest(handler gin.HandlerFunc, method string, userID, exportID int64) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Params = gin.Params{{Key: "exportId", Value: strconv.FormatInt(exportID, 10)}}
+	c.Request, _ = http.NewRequest(method, "/account/exports/"+strconv.FormatInt(exportID, 10), nil)
+
+	handler(c)
+	return w
+}
+
+func requestDataExportForTest(apiHandler *API, userID int64) (*httptest.ResponseRecorder, model.DataExport) {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/account/exports", nil)
+
+	apiHandler.RequestDataExportHandler(c)
+	var export model.DataExport
+	json.Unmarshal(w.Body.Bytes(), &export)
+	return w, export
+}
+
+func downloadDataExportForTest(apiHandler *API, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodGet, "/account/exports/download?token="+token, nil)
+
+	apiHandler.DownloadDataExportHandler(c)
+	return w
+}
+
+// newServiceForTest serves a fixed JSON body on path, standing in for another service.
+func newServiceForTest(t *testing.T, path string, status int, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDataExport(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password", FirstName: "Test"})
+	other, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "other@example.com", Password: "password"})
+	userStore.Store2FASecrets(context.Background(), user.ID, "TOTPSECRET", []string{"recovery-hash"})
+	content := newServiceForTest(t, "/users/1/courses", http.StatusOK, `[{"id":5,"title":"Go"}]`)
+	gamification := newServiceForTest(t, "/users/1/stats", http.StatusOK, `{"points":"120"}`)
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "", content.URL, gamification.URL, nil)
+
+	w, export := requestDataExportForTest(apiHandler, user.ID)
+	if w.Code != http.StatusAccepted || export.Status != model.DataExportPending {
+		t.Fatalf("expected a pending export; got %d %s", w.Code, w.Body.String())
+	}
+	if _, again := requestDataExportForTest(apiHandler, user.ID); again.ID != export.ID {
+		t.Errorf("expected the export in progress to be returned; got export %d", again.ID)
+	}
+	if w := exportRequestForTest(apiHandler.CreateExportDownloadTokenHandler, http.MethodPost, user.ID, export.ID); w.Code != http.StatusConflict {
+		t.Errorf("expected no download token before the export is ready; got status %d", w.Code)
+	}
+
+	if processed, err := apiHandler.ProcessDataExports(context.Background()); err != nil || processed != 1 {
+		t.Fatalf("expected 1 export to be processed; got %d, %v", processed, err)
+	}
+	w = exportRequestForTest(apiHandler.GetDataExportHandler, http.MethodGet, user.ID, export.ID)
+	json.Unmarshal(w.Body.Bytes(), &export)
+	if w.Code != http.StatusOK || export.Status != model.DataExportReady || export.ExpiresAt == nil {
+		t.Fatalf("expected the export to be ready; got %d %s", w.Code, w.Body.String())
+	}
+	if len(mockMessageBroker.EventsOfType("data_export_ready")) != 1 {
+		t.Error("expected a data_export_ready event to be published")
+	}
+
+	t.Run("Someone else's export", func(t *testing.T) {
+		for _, handler := range []gin.HandlerFunc{apiHandler.GetDataExportHandler, apiHandler.CreateExportDownloadTokenHandler} {
+			if w := exportRequestForTest(handler, http.MethodGet, other.ID, export.ID); w.Code != http.StatusNotFound {
+				t.Errorf("expected status %d; got %d", http.StatusNotFound, w.Code)
+			}
+		}
+	})
+
+	w = exportRequestForTest(apiHandler.CreateExportDownloadTokenHandler, http.MethodPost, user.ID, export.ID)
+	var tokenResp struct {
+		DownloadToken string `json:"download_token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &tokenResp)
+	if w.Code != http.StatusOK || tokenResp.DownloadToken == "" {
+		t.Fatalf("expected a download token; got %d %s", w.Code, w.Body.String())
+	}
+
+	w = downloadDataExportForTest(apiHandler, tokenResp.DownloadToken)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("expected the archive; got %d %s", w.Code, w.Body.String())
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatalf("Failed to open the archive: %v", err)
+	}
+	files := map[string]string{}
+	for _, f := range archive.File {
+		r, _ := f.Open()
+		data, _ := io.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(data)
+	}
+	for _, name := range []string{"profile.json", "preferences.json", "lesson_progress.json", "quiz_attempts.json", "activities.json", "courses.json", "gamification_stats.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %s in the archive", name)
+		}
+	}
+	if !bytes.Contains([]byte(files["profile.json"]), []byte("test@example.com")) {
+		t.Errorf("expected the profile in profile.json; got %s", files["profile.json"])
+	}
+	for _, secret := range []string{user.PasswordHash, "TOTPSECRET", "recovery-hash"} {
+		if bytes.Contains([]byte(files["profile.json"]), []byte(secret)) {
+			t.Errorf("expected profile.json not to contain %q", secret)
+		}
+	}
+	if !bytes.Contains([]byte(files["courses.json"]), []byte(`"title": "Go"`)) || !bytes.Contains([]byte(files["gamification_stats.json"]), []byte(`"points": "120"`)) {
+		t.Errorf("expected the data from the other services; got %s and %s", files["courses.json"], files["gamification_stats.json"])
+	}
+	if files["lesson_progress.json"] != "[]" {
+		t.Errorf("expected an empty list of lesson progress; got %s", files["lesson_progress.json"])
+	}
+
+	t.Run("Token reused", func(t *testing.T) {
+		if w := downloadDataExportForTest(apiHandler, tokenResp.DownloadToken); w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d; got %d", http.StatusNotFound, w.Code)
+		}
+	})
+}
+
+func TestDataExportWithServiceDown(t *testing.T) {
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	content := newServiceForTest(t, "/users/1/courses", http.StatusOK, `[]`)
+	gamification := newServiceForTest(t, "/users/1/stats", http.StatusInternalServerError, `{"error":"down"}`)
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "", content.URL, gamification.URL, nil)
+
+	_, export := requestDataExportForTest(apiHandler, user.ID)
+	apiHandler.ProcessDataExports(context.Background())
+
+	w := exportRequestForTest(apiHandler.GetDataExportHandler, http.MethodGet, user.ID, export.ID)
+	json.Unmarshal(w.Body.Bytes(), &export)
+	if export.Status != model.DataExportFailed || export.Error == "" {
+		t.Errorf("expected the export to fail; got %s", w.Body.String())
+	}
+	if len(mockMessageBroker.EventsOfType("data_export_ready")) != 0 {
+		t.Error("expected no data_export_ready event")
+	}
+	if _, retry := requestDataExportForTest(apiHandler, user.ID); retry.ID == export.ID {
+		t.Error("expected a new export to be started after a failure")
+	}
+}
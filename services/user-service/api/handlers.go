@@ -3,27 +3,32 @@ package api
 import (
 	"context"
 	"crypto/rand"
+	"crypto/subtle"
 	"encoding/base32"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"mime/multipart"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/pquerna/otp/totp"
-	"golang.org/x/oauth2"
 
+	"github.com/free-education/authz"
+	"github.com/free-education/events"
 	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/blobstore"
 	"github.com/free-education/user-service/messaging"
 	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/oauth"
+	"github.com/free-education/user-service/passkey"
 	"github.com/free-education/user-service/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 )
 
 // API holds the dependencies for the API handlers, like the user store.
@@ -33,7 +38,34 @@ type API struct {
 	FrontendBaseURL        string
 	ContentServiceURL      string
 	GamificationServiceURL string
-	GoogleOAuthConfig      *oauth2.Config
+	// Providers holds the external identity providers users can log in with.
+	Providers *oauth.Registry
+	// LoginThrottle slows down and locks out repeated failed logins. NewAPI sets
+	// an in-memory throttle; main replaces it with one backed by the database.
+	LoginThrottle *auth.LoginThrottle
+	// EmailThrottle spaces out the emails sent on request to an account or for a
+	// client IP. NewAPI sets an in-memory throttle; main replaces it with one backed
+	// by the database.
+	EmailThrottle *auth.LoginThrottle
+	// UnverifiedLogin decides whether accounts with an unverified email may log in.
+	// The zero value lets them.
+	UnverifiedLogin UnverifiedLoginPolicy
+	// PasswordPolicy is enforced on every new password.
+	PasswordPolicy *auth.PasswordPolicy
+	// Passkeys runs WebAuthn ceremonies. NewAPI configures it for FrontendBaseURL;
+	// nil disables passkeys.
+	Passkeys *passkey.Service
+	// DeletionGracePeriod is how long an account deleted by its user can still be
+	// reactivated before it is purged. Zero deletes accounts immediately.
+	DeletionGracePeriod time.Duration
+	// ErasureServices are the services that must confirm they have erased a deleted
+	// user's data. Each receives `user_deleted` events on its erasure.Queue.
+	ErasureServices []string
+	// Blobs stores profile pictures. NewAPI sets a store in a temporary directory;
+	// main replaces it with the configured one.
+	Blobs blobstore.BlobStore
+	// ActivityRetention is how long user activities are kept by PruneUserActivities.
+	ActivityRetention ActivityRetention
 }
 
 // MarkCompleteRequest defines the payload for marking a lesson as complete.
@@ -42,20 +74,29 @@ type MarkCompleteRequest struct {
 }
 
 // NewAPI creates a new API struct with its dependencies.
-func NewAPI(userStore storage.UserStore, messageBroker messaging.MessageBroker, frontendBaseURL, contentServiceURL, gamificationServiceURL string, googleOAuthConfig *oauth2.Config) *API {
+func NewAPI(userStore storage.UserStore, messageBroker messaging.MessageBroker, frontendBaseURL, contentServiceURL, gamificationServiceURL string, providers *oauth.Registry) *API {
 	return &API{
 		UserStore:              userStore,
 		MessageBroker:          messageBroker,
 		FrontendBaseURL:        frontendBaseURL,
 		ContentServiceURL:      contentServiceURL,
 		GamificationServiceURL: gamificationServiceURL,
-		GoogleOAuthConfig:      googleOAuthConfig,
+		Providers:              providers,
+		LoginThrottle:          auth.NewLoginThrottle(auth.NewMemoryAttemptStore(), auth.DefaultAccountPolicy, auth.DefaultIPPolicy),
+		EmailThrottle:          auth.NewThrottle("email", auth.NewMemoryAttemptStore(), auth.DefaultEmailPolicy, auth.DefaultEmailIPPolicy),
+		PasswordPolicy:         auth.DefaultPasswordPolicy(),
+		Passkeys:               defaultPasskeys(frontendBaseURL),
+		DeletionGracePeriod:    DefaultDeletionGracePeriod,
+		ErasureServices:        DefaultErasureServices,
+		Blobs:                  defaultBlobStore(),
+		ActivityRetention:      defaultActivityRetention(),
 	}
 }
 
 // RegisterUserHandler handles new user registration.
 // It expects a JSON payload with the user's email, password, and name.
-// On success, it returns the newly created user object with a 201 status code.
+// On success, it publishes a `user_registered` event carrying the email
+// verification link and returns the newly created user object with a 201 status code.
 // If the email already exists, it returns a 409 Conflict error.
 func (a *API) RegisterUserHandler(c *gin.Context) {
 	var req model.RegistrationRequest
@@ -64,6 +105,10 @@ func (a *API) RegisterUserHandler(c *gin.Context) {
 		return
 	}
 
+	if !a.checkNewPassword(c, 0, req.Email, req.Password) {
+		return
+	}
+
 	newUser, err := a.UserStore.CreateUser(c.Request.Context(), &req)
 	if err != nil {
 		var pgErr *pgconn.PgError
@@ -77,12 +122,17 @@ func (a *API) RegisterUserHandler(c *gin.Context) {
 		return
 	}
 
+	if err := a.sendVerificationEmail(c.Request.Context(), newUser, events.TypeUserRegistered); err != nil {
+		// The account exists either way; the user can ask for a new link via /email/resend.
+		log.Printf("Error sending verification email to user %d: %v", newUser.ID, err)
+	}
+
 	c.JSON(http.StatusCreated, newUser)
 }
 
 // LoginUserHandler handles user authentication.
 // It expects an email and password, and upon successful validation,
-// returns a JWT token for use in subsequent authenticated requests.
+// starts a new session and returns a short-lived JWT plus a refresh token.
 // Returns a 401 Unauthorized error for invalid credentials.
 func (a *API) LoginUserHandler(c *gin.Context) {
 	var req model.LoginRequest
@@ -91,25 +141,37 @@ func (a *API) LoginUserHandler(c *gin.Context) {
 		return
 	}
 
+	if !a.checkLoginThrottle(c, 0) {
+		return
+	}
+
 	user, err := a.UserStore.GetUserByEmail(c.Request.Context(), req.Email)
 	if err != nil {
 		// User not found. Return a generic error to avoid revealing user existence.
+		a.recordLoginFailure(c, 0)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
-	// Check if the account is deactivated.
-	if user.DeactivatedAt != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "This account has been deactivated."})
+	if !a.checkLoginThrottle(c, user.ID) {
 		return
 	}
 
 	if !storage.CheckPassword(user.PasswordHash, req.Password) {
 		// Incorrect password.
+		a.recordLoginFailure(c, user.ID)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
 
+	if !a.UnverifiedLogin.allowsLogin(user) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":                       "Please verify your email address before logging in.",
+			"email_verification_required": true,
+		})
+		return
+	}
+
 	// Check if 2FA is enabled for the user.
 	_, twoFactorEnabled, err := a.UserStore.Get2FAData(c.Request.Context(), user.ID)
 	if err != nil {
@@ -126,31 +188,44 @@ func (a *API) LoginUserHandler(c *gin.Context) {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate 2FA token."})
 			return
 		}
+		// Registered passkeys can be used in place of a TOTP code.
+		methods := []string{"totp"}
+		if credentials, err := a.UserStore.GetWebAuthnCredentials(c.Request.Context(), user.ID); err == nil && len(credentials) > 0 && a.Passkeys != nil {
+			methods = append(methods, "webauthn")
+		}
 		c.JSON(http.StatusOK, gin.H{
-			"message":    "2FA token required",
-			"temp_token": tempToken,
+			"message":            "2FA token required",
+			"temp_token":         tempToken,
+			"two_factor_methods": methods,
 		})
 		return
 	}
 
-	// If 2FA is not enabled, issue a full-access token.
-	token, err := auth.GenerateToken(user.ID, user.Role)
+	// If 2FA is not enabled, start a session and issue a full-access token.
+	a.recordLoginSuccess(c, user.ID)
+	if !a.checkAccountActive(c, user) {
+		return
+	}
+	resp, err := a.issueSession(c, user)
 	if err != nil {
-		log.Printf("Error generating JWT: %v", err)
+		log.Printf("Error issuing session for user %d: %v", user.ID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
-	c.JSON(http.StatusOK, model.LoginResponse{Token: token})
+	c.JSON(http.StatusOK, resp)
 }
 
 // Login2FARequest represents the payload for the 2FA login request.
+// Either a TOTP token or one of the user's recovery codes must be provided.
 type Login2FARequest struct {
-	TempToken string `json:"temp_token" binding:"required"`
-	Token     string `json:"token" binding:"required"`
+	TempToken    string `json:"temp_token" binding:"required"`
+	Token        string `json:"token" binding:"required_without=RecoveryCode"`
+	RecoveryCode string `json:"recovery_code" binding:"required_without=Token"`
 }
 
 // Login2FAHandler handles the second step of the 2FA login process.
+// A recovery code can be used in place of the TOTP token; it is burned on use.
 func (a *API) Login2FAHandler(c *gin.Context) {
 	var req Login2FARequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -172,9 +247,30 @@ func (a *API) Login2FAHandler(c *gin.Context) {
 		return
 	}
 
-	// Validate the TOTP token
-	valid := totp.Validate(req.Token, secret)
-	if !valid {
+	if !a.checkLoginThrottle(c, claims.UserID) {
+		return
+	}
+
+	if req.RecoveryCode != "" {
+		// Validate and burn the recovery code in one step
+		used, err := a.UserStore.ConsumeRecoveryCode(c.Request.Context(), claims.UserID, normalizeRecoveryCode(req.RecoveryCode))
+		if err != nil {
+			log.Printf("Error checking recovery code for user %d: %v", claims.UserID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process login."})
+			return
+		}
+		if !used {
+			a.recordLoginFailure(c, claims.UserID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid recovery code."})
+			return
+		}
+		activity := &model.UserActivity{UserID: claims.UserID, ActivityType: "2fa_recovery_code_used"}
+		if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+			log.Printf("Error recording recovery code use for user %d: %v", claims.UserID, err)
+		}
+	} else if !totp.Validate(req.Token, secret) {
+		// Validate the TOTP token
+		a.recordLoginFailure(c, claims.UserID)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid 2FA token."})
 		return
 	}
@@ -185,16 +281,20 @@ func (a *API) Login2FAHandler(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user details."})
 		return
 	}
+	a.recordLoginSuccess(c, user.ID)
+	if !a.checkAccountActive(c, user) {
+		return
+	}
 
-	// If everything is valid, issue a full-access token
-	token, err := auth.GenerateToken(user.ID, user.Role)
+	// If everything is valid, start a session and issue a full-access token
+	resp, err := a.issueSession(c, user)
 	if err != nil {
-		log.Printf("Error generating JWT for user %d: %v", user.ID, err)
+		log.Printf("Error issuing session for user %d: %v", user.ID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token."})
 		return
 	}
 
-	c.JSON(http.StatusOK, model.LoginResponse{Token: token})
+	c.JSON(http.StatusOK, resp)
 }
 
 // ForgotPasswordHandler initiates the password reset process.
@@ -225,37 +325,41 @@ func (a *API) ForgotPasswordHandler(c *gin.Context) {
 	}
 
 	expiresAt := time.Now().Add(time.Hour * 1) // Token valid for 1 hour
-	if err := a.UserStore.CreatePasswordResetToken(c.Request.Context(), user.ID, token, expiresAt); err != nil {
-		log.Printf("Error creating password reset token: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request."})
-		return
-	}
-
 	resetLink := fmt.Sprintf("%s/reset-password?token=%s", a.FrontendBaseURL, token)
 
 	// Publish an event to the message broker. The notifications service will consume this
-	// and send the actual email. This decouples the services.
-	payload := map[string]interface{}{
-		"email":     user.Email,
-		"name":      user.FirstName,
-		"resetLink": resetLink,
-	}
-	if err := a.MessageBroker.Publish(c.Request.Context(), "notifications_events", "password_reset_requested", payload); err != nil {
-		log.Printf("Error publishing password reset event: %v", err)
-		// We still return a success response to the user even if the notification fails.
-		// The operation should be idempotent and can be retried by the user.
+	// and send the actual email. This decouples the services. The event is enqueued
+	// with the token, so the email is sent if and only if the token was stored.
+	payload := &events.PasswordResetRequested{
+		Email:     user.Email,
+		Name:      user.FirstName,
+		ResetLink: resetLink,
+	}
+	ctx := c.Request.Context()
+	err = a.UserStore.InTx(ctx, func(store storage.UserStore) error {
+		if err := store.CreatePasswordResetToken(ctx, user.ID, token, expiresAt); err != nil {
+			return err
+		}
+		return enqueueEvent(ctx, store, "notifications_events", payload)
+	})
+	if err != nil {
+		log.Printf("Error creating password reset token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request."})
+		return
 	}
+	a.relayOutboxNow(ctx)
 
 	c.JSON(http.StatusOK, gin.H{"message": "If a user with that email exists, a password reset link has been sent."})
 }
 
 // ResetPasswordHandler completes the password reset process.
 // It requires a valid, non-expired token and a new password.
-// Upon success, it updates the user's password and deletes the token to prevent reuse.
+// Upon success, it updates the user's password, signs the user out everywhere,
+// and deletes the token to prevent reuse.
 func (a *API) ResetPasswordHandler(c *gin.Context) {
 	var req struct {
 		Token       string `json:"token" binding:"required"`
-		NewPassword string `json:"new_password" binding:"required,min=8"`
+		NewPassword string `json:"new_password" binding:"required"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
@@ -268,12 +372,23 @@ func (a *API) ResetPasswordHandler(c *gin.Context) {
 		return
 	}
 
+	if !a.checkNewPassword(c, user.ID, user.Email, req.NewPassword) {
+		return
+	}
+
 	if err := a.UserStore.UpdatePassword(c.Request.Context(), user.ID, req.NewPassword); err != nil {
 		log.Printf("Error updating password: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password."})
 		return
 	}
 
+	// Whoever knew the old password may still hold a session; sign everything out.
+	if err := a.revokeUserSessions(c.Request.Context(), user.ID, "password_reset"); err != nil {
+		log.Printf("Error revoking sessions for user %d after password reset: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password."})
+		return
+	}
+
 	// Clean up the used token to ensure it cannot be used again.
 	if err := a.UserStore.DeletePasswordResetToken(c.Request.Context(), req.Token); err != nil {
 		log.Printf("Error deleting password reset token: %v", err)
@@ -284,7 +399,7 @@ func (a *API) ResetPasswordHandler(c *gin.Context) {
 }
 
 // GetProfileHandler retrieves the profile for the currently authenticated user.
-// The user ID is injected by the AuthMiddleware.
+// The user ID is injected by authz.Authenticate.
 func (a *API) GetProfileHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(int64)
 
@@ -299,196 +414,289 @@ func (a *API) GetProfileHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, user)
 }
 
-// GetUserPreferencesHandler retrieves the preferences for the currently authenticated user.
-// The user ID is injected by the AuthMiddleware.
-func (a *API) GetUserPreferencesHandler(c *gin.Context) {
-	userID := c.MustGet("userID").(int64)
+// --- 2FA Handlers ---
 
-	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
-	if err != nil {
-		log.Printf("Error fetching preferences for user %d: %v", userID, err)
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
-		return
+// generateRecoveryCodes creates a set of random strings to be used as single-use recovery codes.
+func generateRecoveryCodes(count int, length int) ([]string, error) {
+	codes := make([]string, count)
+	for i := 0; i < count; i++ {
+		bytes := make([]byte, length)
+		if _, err := rand.Read(bytes); err != nil {
+			return nil, err
+		}
+		codes[i] = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(bytes)
 	}
+	return codes, nil
+}
 
-	c.JSON(http.StatusOK, user.Preferences)
+// normalizeRecoveryCode strips the formatting users tend to add when typing a
+// recovery code back in, so "abcd-efgh ijkl" matches the issued "ABCDEFGHIJKL".
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.NewReplacer(" ", "", "-", "").Replace(code))
 }
 
-// UpdateUserPreferencesHandler updates the preferences for the currently authenticated user.
-// The user ID is injected by the AuthMiddleware. It expects a JSON object
-// containing the preferences to be updated.
-func (a *API) UpdateUserPreferencesHandler(c *gin.Context) {
+// GetRecoveryCodesStatusHandler reports how many unused recovery codes the user has left.
+func (a *API) GetRecoveryCodesStatusHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(int64)
 
-	var prefs map[string]interface{}
-	if err := c.ShouldBindJSON(&prefs); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
-		return
-	}
-
-	if err := a.UserStore.UpdateUserPreferences(c.Request.Context(), userID, prefs); err != nil {
-		log.Printf("Error updating preferences for user %d: %v", userID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update preferences"})
+	remaining, err := a.UserStore.CountRecoveryCodes(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error counting recovery codes for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve recovery codes."})
 		return
 	}
 
-	c.Status(http.StatusNoContent)
-}
-
-// uploadToCloudStorage is a placeholder for a real cloud storage upload function.
-// In a real application, this would use the AWS, GCS, or Azure SDK to upload the file
-// and would require proper error handling and configuration.
-func uploadToCloudStorage(fileHeader *multipart.FileHeader) (string, error) {
-	// For this example, we'll just simulate an upload and return a fake URL.
-	// We'll use the filename to make the URL unique.
-	// In a real app, you would generate a unique ID (e.g., a UUID) for the filename
-	// to prevent collisions.
-	log.Printf("Simulating upload for file: %s", fileHeader.Filename)
-	fakeURL := fmt.Sprintf("https://storage.example.com/profiles/%d-%s", time.Now().UnixNano(), fileHeader.Filename)
-	return fakeURL, nil
+	c.JSON(http.StatusOK, gin.H{"remaining": remaining})
 }
 
-// UploadProfilePictureHandler handles the profile picture upload process.
-func (a *API) UploadProfilePictureHandler(c *gin.Context) {
+// RegenerateRecoveryCodesHandler replaces the user's recovery codes with a fresh set.
+// Any codes left from the previous set stop working. The new codes are only ever
+// shown in this response.
+func (a *API) RegenerateRecoveryCodesHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(int64)
 
-	file, err := c.FormFile("picture")
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "File not provided or invalid."})
+	_, enabled, err := a.UserStore.Get2FAData(c.Request.Context(), userID)
+	if err != nil || !enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "2FA is not enabled."})
 		return
 	}
 
-	// In a real application, you would add more validation here:
-	// - Check file size
-	// - Check file type (e.g., only allow jpeg, png)
-
-	// Upload the file to cloud storage (using our mock function)
-	url, err := uploadToCloudStorage(file)
+	recoveryCodes, err := generateRecoveryCodes(10, 10) // 10 codes, 10 chars each
 	if err != nil {
-		log.Printf("Error uploading file for user %d: %v", userID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file."})
+		log.Printf("Error generating recovery codes for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate recovery codes."})
 		return
 	}
 
-	// Update the user's profile picture URL in the database
-	if err := a.UserStore.UpdateProfilePictureURL(c.Request.Context(), userID, url); err != nil {
-		log.Printf("Error updating profile picture URL for user %d: %v", userID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile picture URL."})
+	if err := a.UserStore.ReplaceRecoveryCodes(c.Request.Context(), userID, recoveryCodes); err != nil {
+		log.Printf("Error storing recovery codes for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save recovery codes."})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Profile picture updated successfully.", "url": url})
+	c.JSON(http.StatusOK, gin.H{
+		"recovery_codes": recoveryCodes,
+		"remaining":      len(recoveryCodes),
+	})
 }
 
-// --- 2FA Handlers ---
+// --- OAuth Handlers ---
 
-// generateRecoveryCodes creates a set of random strings to be used as single-use recovery codes.
-func generateRecoveryCodes(count int, length int) ([]string, error) {
-	codes := make([]string, count)
-	for i := 0; i < count; i++ {
-		bytes := make([]byte, length)
-		if _, err := rand.Read(bytes); err != nil {
-			return nil, err
-		}
-		codes[i] = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(bytes)
-	}
-	return codes, nil
-}
+// oauthStateTTL is how long a user has to complete a login at an external provider.
+const oauthStateTTL = 10 * time.Minute
 
-// --- OAuth Handlers ---
+// LoginCodeTTL is how long the front end has to exchange the code from an OAuth login for tokens.
+const LoginCodeTTL = time.Minute
 
 func (a *API) generateStateOauthCookie(c *gin.Context) string {
 	b := make([]byte, 16)
 	rand.Read(b)
 	state := base64.URLEncoding.EncodeToString(b)
-	c.SetCookie("oauthstate", state, 3600, "/", "", false, true)
+	c.SetCookie("oauthstate", state, int(oauthStateTTL.Seconds()), "/", "", false, true)
 	return state
 }
 
-func (a *API) GoogleLoginHandler(c *gin.Context) {
+// startOAuthFlow stores the server-side state for a new authorization request and
+// returns the provider URL to send the user to. userID is set when a signed-in
+// user is linking an identity instead of logging in, or reauthenticating if reauth is set.
+// The PKCE code verifier and the nonce are kept server-side with the state; only
+// the state travels through the browser, in the redirect and the `oauthstate` cookie.
+func (a *API) startOAuthFlow(c *gin.Context, providerName string, provider oauth.Provider, userID int64, reauth bool) (string, error) {
+	codeVerifier, err := oauth.RandomString(32)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := oauth.RandomString(16)
+	if err != nil {
+		return "", err
+	}
+
 	state := a.generateStateOauthCookie(c)
-	url := a.GoogleOAuthConfig.AuthCodeURL(state)
-	c.Redirect(http.StatusTemporaryRedirect, url)
+	err = a.UserStore.CreateOAuthState(c.Request.Context(), &model.OAuthState{
+		State:        state,
+		Provider:     providerName,
+		CodeVerifier: codeVerifier,
+		Nonce:        nonce,
+		UserID:       userID,
+		Reauth:       reauth,
+		ExpiresAt:    time.Now().Add(oauthStateTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return provider.AuthCodeURL(state, nonce, codeVerifier), nil
 }
 
-func (a *API) GoogleCallbackHandler(c *gin.Context) {
+// OAuthLoginHandler starts a login with the external provider named in the URL.
+func (a *API) OAuthLoginHandler(c *gin.Context) {
+	providerName := c.Param("provider")
+	provider, ok := a.Providers.Get(providerName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	authURL, err := a.startOAuthFlow(c, providerName, provider, 0, false)
+	if err != nil {
+		log.Printf("Error starting %s login: %v", providerName, err)
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=oauth_failed", a.FrontendBaseURL))
+		return
+	}
+
+	c.Redirect(http.StatusTemporaryRedirect, authURL)
+}
+
+// OAuthCallbackHandler completes a login with an external provider. The state
+// must match the `oauthstate` cookie and a stored, unused state for the same
+// provider; the provider's answer is verified before the user is signed in.
+func (a *API) OAuthCallbackHandler(c *gin.Context) {
+	providerName := c.Param("provider")
+	provider, ok := a.Providers.Get(providerName)
+	if !ok {
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=unknown_provider", a.FrontendBaseURL))
+		return
+	}
+
 	// Read oauthState from Cookie
 	oauthState, _ := c.Cookie("oauthstate")
-	if c.Request.FormValue("state") != oauthState {
-		log.Println("invalid oauth google state")
+	state := c.Request.FormValue("state")
+	if state == "" || state != oauthState {
+		log.Printf("invalid oauth %s state", providerName)
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=invalid_state", a.FrontendBaseURL))
+		return
+	}
+	saved, err := a.UserStore.ConsumeOAuthState(c.Request.Context(), state)
+	if err != nil || saved.Provider != providerName {
+		log.Printf("unknown or expired oauth %s state", providerName)
 		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=invalid_state", a.FrontendBaseURL))
 		return
 	}
 
-	data, err := a.getUserDataFromGoogle(c.Request.FormValue("code"))
+	identity, err := provider.Exchange(c.Request.Context(), c.Request.FormValue("code"), saved.CodeVerifier, saved.Nonce)
 	if err != nil {
-		log.Println(err.Error())
+		log.Printf("Error completing %s login: %v", providerName, err)
 		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=oauth_failed", a.FrontendBaseURL))
 		return
 	}
+	if identity.Email == "" {
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=email_required", a.FrontendBaseURL))
+		return
+	}
 
-	// Get user info
-	var userInfo struct {
-		ID    string `json:"id"`
-		Email string `json:"email"`
-		Name  string `json:"name"`
+	if saved.Reauth {
+		a.reauthFromCallback(c, saved.UserID, providerName, identity, oauthState)
+		return
 	}
-	if err := json.Unmarshal(data, &userInfo); err != nil {
-		log.Println(err.Error())
-		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=oauth_failed", a.FrontendBaseURL))
+	if saved.UserID != 0 {
+		a.linkIdentityFromCallback(c, saved.UserID, providerName, identity)
 		return
 	}
 
 	// Check if user already exists
-	user, err := a.UserStore.GetUserByOAuthID(c.Request.Context(), "google", userInfo.ID)
+	user, err := a.UserStore.GetUserByOAuthID(c.Request.Context(), providerName, identity.Subject)
 	if err != nil {
-		// User does not exist, check by email
-		user, err = a.UserStore.GetUserByEmail(c.Request.Context(), userInfo.Email)
+		// Never sign into an existing account just because the email matches: the
+		// owner has to sign in the usual way and confirm the link first.
+		if existing, err := a.UserStore.GetUserByEmail(c.Request.Context(), identity.Email); err == nil {
+			a.offerIdentityLink(c, existing, providerName, identity)
+			return
+		}
+
+		// User does not exist, create new user
+		newUser := &model.User{
+			Email:           identity.Email,
+			FirstName:       identity.Name,
+			OAuthProvider:   providerName,
+			OAuthProviderID: identity.Subject,
+		}
+		if identity.EmailVerified {
+			now := time.Now()
+			newUser.EmailVerifiedAt = &now
+		}
+		user, err = a.UserStore.CreateOAuthUser(c.Request.Context(), newUser)
 		if err != nil {
-			// User does not exist, create new user
-			newUser := &model.User{
-				Email:           userInfo.Email,
-				FirstName:       userInfo.Name,
-				OAuthProvider:   "google",
-				OAuthProviderID: userInfo.ID,
-			}
-			user, err = a.UserStore.CreateOAuthUser(c.Request.Context(), newUser)
-			if err != nil {
-				log.Printf("Error creating OAuth user: %v", err)
-				c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=creation_failed", a.FrontendBaseURL))
-				return
-			}
+			log.Printf("Error creating OAuth user: %v", err)
+			c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=creation_failed", a.FrontendBaseURL))
+			return
 		}
 	}
 
-	// Generate JWT
-	token, err := auth.GenerateToken(user.ID, user.Role)
+	// Tokens never go into the URL, where they would end up in browser history and
+	// referrer logs. The front end trades this code for them with ExchangeLoginCodeHandler.
+	code, err := a.createLoginCode(c.Request.Context(), user.ID, oauthState)
 	if err != nil {
-		log.Printf("Error generating JWT for user %d: %v", user.ID, err)
+		log.Printf("Error storing login code for user %d: %v", user.ID, err)
 		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=token_failed", a.FrontendBaseURL))
 		return
 	}
 
-	// For simplicity, we'll redirect with the token in the query string.
-	// In a real app, you might use a more secure method.
-	c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/auth/callback?token=%s", a.FrontendBaseURL, token))
+	c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/auth/callback?code=%s", a.FrontendBaseURL, code))
 }
 
-func (a *API) getUserDataFromGoogle(code string) ([]byte, error) {
-	token, err := a.GoogleOAuthConfig.Exchange(context.Background(), code)
+// createLoginCode stores a login code for the user, bound to the browser's
+// `oauthstate` cookie, and returns it.
+func (a *API) createLoginCode(ctx context.Context, userID int64, oauthState string) (string, error) {
+	code, err := auth.GenerateSecureToken(32)
 	if err != nil {
-		return nil, fmt.Errorf("code exchange wrong: %s", err.Error())
+		return "", err
+	}
+	err = a.UserStore.CreateLoginCode(ctx, &model.LoginCode{
+		CodeHash:  auth.HashToken(code),
+		UserID:    userID,
+		StateHash: auth.HashToken(oauthState),
+		ExpiresAt: time.Now().Add(LoginCodeTTL),
+	})
+	return code, err
+}
+
+// consumeLoginCode burns a login code and returns the user it was issued for. It
+// fails unless the code is valid and presented with the `oauthstate` cookie of the
+// browser it was issued to. The code is consumed even if the cookie does not
+// match, so a leaked code cannot be tried again.
+func (a *API) consumeLoginCode(c *gin.Context, code string) (int64, bool) {
+	oauthState, _ := c.Cookie("oauthstate")
+	loginCode, err := a.UserStore.ConsumeLoginCode(c.Request.Context(), auth.HashToken(code))
+	if err != nil || oauthState == "" || subtle.ConstantTimeCompare([]byte(loginCode.StateHash), []byte(auth.HashToken(oauthState))) != 1 {
+		return 0, false
 	}
-	response, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+	return loginCode.UserID, true
+}
+
+// ExchangeLoginCodeHandler trades a login code from OAuthCallbackHandler for a
+// token pair. The code works once, for a short time, and only from the browser
+// that completed the login, i.e. together with the same `oauthstate` cookie.
+func (a *API) ExchangeLoginCodeHandler(c *gin.Context) {
+	var req model.ExchangeLoginCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	userID, ok := a.consumeLoginCode(c, req.Code)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login code."})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
 	if err != nil {
-		return nil, fmt.Errorf("failed getting user info: %s", err.Error())
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired login code."})
+		return
 	}
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
+	if !a.checkAccountActive(c, user) {
+		return
+	}
+
+	resp, err := a.issueSession(c, user)
 	if err != nil {
-		return nil, fmt.Errorf("failed read response: %s", err.Error())
+		log.Printf("Error issuing session for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token."})
+		return
 	}
-	return contents, nil
+
+	// The login is complete; the state cookie is no longer needed.
+	c.SetCookie("oauthstate", "", -1, "/", "", false, true)
+	c.JSON(http.StatusOK, resp)
 }
 
 // Enable2FAHandler begins the process of enabling two-factor authentication.
@@ -519,6 +727,11 @@ func (a *API) Enable2FAHandler(c *gin.Context) {
 	}
 
 	if err := a.UserStore.Store2FASecrets(c.Request.Context(), userID, key.Secret(), recoveryCodes); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Changing the second factor needs a recent login: disable 2FA first.
+			c.JSON(http.StatusConflict, gin.H{"error": "2FA is already enabled."})
+			return
+		}
 		log.Printf("Error storing 2FA secrets for user %d: %v", userID, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save 2FA configuration."})
 		return
@@ -568,6 +781,7 @@ func (a *API) Verify2FAHandler(c *gin.Context) {
 }
 
 // Disable2FAHandler handles disabling 2FA for a user.
+// All of the user's existing sessions are revoked afterwards.
 func (a *API) Disable2FAHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(int64)
 
@@ -577,12 +791,19 @@ func (a *API) Disable2FAHandler(c *gin.Context) {
 		return
 	}
 
+	if err := a.revokeUserSessions(c.Request.Context(), userID, "2fa_disabled"); err != nil {
+		log.Printf("Error revoking sessions for user %d after disabling 2FA: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable 2FA."})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "2FA disabled successfully."})
 }
 
 // --- Account Deactivation ---
 
 // DeactivateUserHandler handles a user's request to deactivate their own account.
+// The next login to the account offers to reactivate it.
 func (a *API) DeactivateUserHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(int64)
 
@@ -592,64 +813,74 @@ func (a *API) DeactivateUserHandler(c *gin.Context) {
 		return
 	}
 
-	// Here you might also want to publish an event to a message queue
-	// to invalidate all active sessions/tokens for this user.
+	// Invalidate all active sessions/tokens for this user.
+	if err := a.revokeUserSessions(c.Request.Context(), userID, "account_deactivated"); err != nil {
+		log.Printf("Error revoking sessions for deactivated user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to deactivate account."})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Account deactivated successfully."})
 }
 
 // DeleteUserHandler handles a user's request to permanently delete their own account.
+// With a deletion grace period, the account is only deactivated and scheduled for
+// deletion, which the user can cancel by reactivating it. Otherwise it is deleted
+// right away.
 func (a *API) DeleteUserHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(int64)
 
-	// It's good practice to log this significant event.
-	log.Printf("Attempting to permanently delete user %d", userID)
-
-	if err := a.UserStore.DeleteUser(c.Request.Context(), userID); err != nil {
-		log.Printf("Error permanently deleting user %d: %v", userID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account."})
+	if a.DeletionGracePeriod > 0 {
+		user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		a.scheduleDeletion(c, user)
 		return
 	}
 
-	// Publish an event to notify other services that this user has been deleted.
-	// This is crucial for data consistency across the microservices ecosystem.
-	payload := map[string]interface{}{"user_id": userID}
-	if err := a.MessageBroker.Publish(c.Request.Context(), "user_events", "user_deleted", payload); err != nil {
-		// Log the error, but don't fail the request. The primary operation (DB deletion) was successful.
-		// A monitoring system should alert on these kinds of failures.
-		log.Printf("CRITICAL: Failed to publish user_deleted event for user %d: %v", userID, err)
-	}
-
-	c.JSON(http.StatusOK, gin.H{"message": "Account permanently deleted."})
-}
-
-// --- User Activity Handlers ---
+	// It's good practice to log this significant event.
+	log.Printf("Attempting to permanently delete user %d", userID)
 
-// GetUserActivityHandler retrieves a log of recent activities for a user.
-func (a *API) GetUserActivityHandler(c *gin.Context) {
-	targetUserID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	// Revoke while the user row still exists so the revocation is recorded;
+	// once the row is gone, any token that slipped through fails the lookup anyway.
+	ctx := c.Request.Context()
+	revokedAt, err := auth.RevokeUserTokens(ctx, userID)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
+		log.Printf("Error revoking tokens for user %d before deletion: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account."})
 		return
 	}
 
-	// In a real app, you'd add authorization logic here to ensure the requesting user
-	// is allowed to see this activity log (e.g., they are the user themselves, or an admin).
-
-	activities, err := a.UserStore.GetUserActivities(c.Request.Context(), targetUserID)
+	var profilePictureKey string
+	err = a.UserStore.InTx(ctx, func(store storage.UserStore) error {
+		if err := revokeSessions(ctx, store, userID, "account_deleted", revokedAt); err != nil {
+			return err
+		}
+		key, err := store.DeleteUser(ctx, userID, a.ErasureServices)
+		profilePictureKey = key
+		return err
+	})
 	if err != nil {
-		log.Printf("Error getting activities for user %d: %v", targetUserID, err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user activities."})
+		log.Printf("Error permanently deleting user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account."})
 		return
 	}
+	a.relayOutboxNow(ctx)
+	a.deleteProfilePicture(ctx, profilePictureKey)
+
+	// Ask the other services to erase the user's data. The deletion was recorded
+	// together with the user's removal, so they are asked until they confirm.
+	a.sendErasureRequestsNow(c.Request.Context())
 
-	c.JSON(http.StatusOK, activities)
+	c.JSON(http.StatusOK, gin.H{"message": "Account permanently deleted."})
 }
 
 // --- Quiz Attempt Handlers ---
 
 // CreateQuizAttemptHandler handles saving a user's quiz attempt.
-// The user ID is injected by the AuthMiddleware.
+// The user ID is injected by authz.Authenticate.
 func (a *API) CreateQuizAttemptHandler(c *gin.Context) {
 	userID := c.MustGet("userID").(int64)
 
@@ -670,14 +901,16 @@ func (a *API) CreateQuizAttemptHandler(c *gin.Context) {
 }
 
 // GetQuizAttemptsForUserHandler retrieves all quiz attempts for a specific user.
-// Authorization should be handled by the API Gateway to ensure only the user
-// themselves or an authorized role (e.g., admin) can access this.
+// Only the user themselves, moderators and admins can access them.
 func (a *API) GetQuizAttemptsForUserHandler(c *gin.Context) {
 	targetUserID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
 		return
 	}
+	if !authz.AllowSelfOrRole(c, targetUserID, authz.RoleModerator, authz.RoleAdmin) {
+		return
+	}
 
 	attempts, err := a.UserStore.GetQuizAttemptsForUser(c.Request.Context(), targetUserID)
 	if err != nil {
@@ -690,13 +923,16 @@ func (a *API) GetQuizAttemptsForUserHandler(c *gin.Context) {
 }
 
 // GetProgressHandler retrieves the list of completed lesson IDs for a user.
-// Authorization should be handled by the API Gateway.
+// Only the user themselves, moderators and admins can access it.
 func (a *API) GetProgressHandler(c *gin.Context) {
 	targetUserID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
 		return
 	}
+	if !authz.AllowSelfOrRole(c, targetUserID, authz.RoleModerator, authz.RoleAdmin) {
+		return
+	}
 
 	completed, err := a.UserStore.GetCompletedLessonsForUser(c.Request.Context(), targetUserID)
 	if err != nil {
@@ -708,13 +944,16 @@ func (a *API) GetProgressHandler(c *gin.Context) {
 }
 
 // MarkLessonCompleteHandler marks a lesson as complete for a user.
-// Authorization should be handled by the API Gateway.
+// Users can only update their own progress.
 func (a *API) MarkLessonCompleteHandler(c *gin.Context) {
 	targetUserID, err := strconv.ParseInt(c.Param("userId"), 10, 64)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid target user ID"})
 		return
 	}
+	if !authz.AllowSelfOrRole(c, targetUserID) {
+		return
+	}
 
 	var req MarkCompleteRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -752,6 +991,9 @@ func (a *API) GetFullProfileHandler(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
 		return
 	}
+	if !authz.AllowSelfOrRole(c, userID, authz.RoleModerator, authz.RoleAdmin) {
+		return
+	}
 
 	// 1. Get base user data from our own DB
 	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
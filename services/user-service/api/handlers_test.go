@@ -8,19 +8,26 @@ import (
 	"encoding/json"
 	"encoding/pem"
 	"errors"
-	"io"
-	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/free-education/authz"
+	"github.com/free-education/events"
 	"github.com/free-education/user-service/auth"
 	"github.com/free-education/user-service/messaging"
 	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/storage"
 	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/net/context"
 )
@@ -31,15 +38,65 @@ type MockUserStore struct {
 	emailToID           map[string]int64
 	oauthIDToUserID     map[string]int64 // provider-id -> userID
 	passwordResetTokens map[string]int64 // token -> userID
+	verificationTokens  map[string]int64 // token -> userID
+	emailChangeTokens   map[string]*model.EmailChange
+	sessions            map[int64]*model.Session
+	sessionTokens       map[string]int64 // refresh token hash -> sessionID
+	activities          []*model.UserActivity
+	passwordHistory     map[int64][]string // userID -> previous hashes, newest first
+	oauthStates         map[string]*model.OAuthState
+	loginCodes          map[string]*model.LoginCode
+	identities          []*model.UserIdentity
+	backfilled          bool                           // Whether BackfillIdentities has run
+	pendingLinks        map[string]*model.UserIdentity // token -> identity
+	webauthnCredentials []*model.WebAuthnCredential
+	webauthnSessions    map[string]*model.WebAuthnSession
+	auditLog            []*model.AdminAuditEntry
+	dataExports         []*mockDataExport
+	erasures            []*mockErasure
+	outbox              []*mockOutboxEvent
+	profilePictureKeys  map[int64]string
 	nextID              int64
 }
 
+// mockErasure is an erasure request and whether the service has confirmed it.
+type mockErasure struct {
+	model.ErasureRequest
+	lastAttempt time.Time
+	confirmed   bool
+}
+
+// mockOutboxEvent is an outbox event and when it was last attempted and sent.
+type mockOutboxEvent struct {
+	model.OutboxEvent
+	lastAttempt time.Time
+	sent        time.Time
+}
+
+// mockDataExport is a data export together with the columns the model leaves out.
+type mockDataExport struct {
+	*model.DataExport
+	archive        []byte
+	tokenHash      string
+	tokenExpiresAt time.Time
+}
+
 func NewMockUserStore() *MockUserStore {
 	return &MockUserStore{
 		users:               make(map[int64]*model.User),
 		emailToID:           make(map[string]int64),
 		oauthIDToUserID:     make(map[string]int64),
 		passwordResetTokens: make(map[string]int64),
+		verificationTokens:  make(map[string]int64),
+		emailChangeTokens:   make(map[string]*model.EmailChange),
+		passwordHistory:     make(map[int64][]string),
+		oauthStates:         make(map[string]*model.OAuthState),
+		loginCodes:          make(map[string]*model.LoginCode),
+		pendingLinks:        make(map[string]*model.UserIdentity),
+		webauthnSessions:    make(map[string]*model.WebAuthnSession),
+		sessions:            make(map[int64]*model.Session),
+		sessionTokens:       make(map[string]int64),
+		profilePictureKeys:  make(map[int64]string),
 		nextID:              1,
 	}
 }
@@ -69,11 +126,12 @@ func (m *MockUserStore) CreateOAuthUser(ctx context.Context, user *model.User) (
 		LastName:        user.LastName,
 		OAuthProvider:   user.OAuthProvider,
 		OAuthProviderID: user.OAuthProviderID,
+		EmailVerifiedAt: user.EmailVerifiedAt,
 	}
 	m.users[newUser.ID] = newUser
 	m.emailToID[newUser.Email] = newUser.ID
-	m.oauthIDToUserID[user.OAuthProvider+"-"+user.OAuthProviderID] = newUser.ID
 	m.nextID++
+	m.LinkIdentity(ctx, &model.UserIdentity{UserID: newUser.ID, Provider: user.OAuthProvider, Subject: user.OAuthProviderID, Email: user.Email})
 	return newUser, nil
 }
 
@@ -94,6 +152,177 @@ func (m *MockUserStore) GetUserByOAuthID(ctx context.Context, provider string, p
 	return m.GetUserByID(ctx, userID)
 }
 
+func (m *MockUserStore) CreateOAuthState(ctx context.Context, state *model.OAuthState) error {
+	m.oauthStates[state.State] = state
+	return nil
+}
+
+func (m *MockUserStore) ConsumeOAuthState(ctx context.Context, state string) (*model.OAuthState, error) {
+	saved, ok := m.oauthStates[state]
+	delete(m.oauthStates, state)
+	if !ok || time.Now().After(saved.ExpiresAt) {
+		return nil, errors.New("state not found")
+	}
+	return saved, nil
+}
+
+func (m *MockUserStore) CreateLoginCode(ctx context.Context, code *model.LoginCode) error {
+	m.loginCodes[code.CodeHash] = code
+	return nil
+}
+
+func (m *MockUserStore) ConsumeLoginCode(ctx context.Context, codeHash string) (*model.LoginCode, error) {
+	code, ok := m.loginCodes[codeHash]
+	delete(m.loginCodes, codeHash)
+	if !ok || time.Now().After(code.ExpiresAt) {
+		return nil, pgx.ErrNoRows
+	}
+	return code, nil
+}
+
+func (m *MockUserStore) GetUserIdentities(ctx context.Context, userID int64) ([]*model.UserIdentity, error) {
+	var identities []*model.UserIdentity
+	for _, identity := range m.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	return identities, nil
+}
+
+func (m *MockUserStore) LinkIdentity(ctx context.Context, identity *model.UserIdentity) error {
+	key := identity.Provider + "-" + identity.Subject
+	if _, ok := m.oauthIDToUserID[key]; ok {
+		return &pgconn.PgError{Code: "23505"}
+	}
+	identity.ID = int64(len(m.identities) + 1)
+	identity.CreatedAt = time.Now()
+	m.identities = append(m.identities, identity)
+	m.oauthIDToUserID[key] = identity.UserID
+	return nil
+}
+
+func (m *MockUserStore) UnlinkIdentity(ctx context.Context, userID, identityID int64) error {
+	for i, identity := range m.identities {
+		if identity.ID == identityID && identity.UserID == userID {
+			m.identities = append(m.identities[:i], m.identities[i+1:]...)
+			delete(m.oauthIDToUserID, identity.Provider+"-"+identity.Subject)
+			return nil
+		}
+	}
+	return pgx.ErrNoRows
+}
+
+func (m *MockUserStore) BackfillIdentities(ctx context.Context) (int64, error) {
+	if m.backfilled {
+		return 0, nil
+	}
+	m.backfilled = true
+	var created int64
+	for _, user := range m.users {
+		if user.OAuthProvider == "" {
+			continue
+		}
+		if err := m.LinkIdentity(ctx, &model.UserIdentity{UserID: user.ID, Provider: user.OAuthProvider, Subject: user.OAuthProviderID, Email: user.Email}); err == nil {
+			created++
+		}
+	}
+	return created, nil
+}
+
+func (m *MockUserStore) CreatePendingIdentityLink(ctx context.Context, token string, identity *model.UserIdentity, expiresAt time.Time) error {
+	m.pendingLinks[token] = identity
+	return nil
+}
+
+func (m *MockUserStore) ConfirmPendingIdentityLink(ctx context.Context, token string, userID int64) (*model.UserIdentity, error) {
+	identity, ok := m.pendingLinks[token]
+	if !ok || identity.UserID != userID {
+		return nil, pgx.ErrNoRows
+	}
+	delete(m.pendingLinks, token)
+	if err := m.LinkIdentity(ctx, identity); err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func (m *MockUserStore) CreateWebAuthnCredential(ctx context.Context, credential *model.WebAuthnCredential) error {
+	for _, c := range m.webauthnCredentials {
+		if bytes.Equal(c.CredentialID, credential.CredentialID) {
+			return &pgconn.PgError{Code: "23505"}
+		}
+	}
+	credential.ID = int64(len(m.webauthnCredentials) + 1)
+	credential.CreatedAt = time.Now()
+	m.webauthnCredentials = append(m.webauthnCredentials, credential)
+	return nil
+}
+
+func (m *MockUserStore) GetWebAuthnCredentials(ctx context.Context, userID int64) ([]*model.WebAuthnCredential, error) {
+	var credentials []*model.WebAuthnCredential
+	for _, c := range m.webauthnCredentials {
+		if c.UserID == userID {
+			// Copy, as the database would, so handlers can't change stored state by accident.
+			copied := *c
+			credentials = append(credentials, &copied)
+		}
+	}
+	return credentials, nil
+}
+
+func (m *MockUserStore) UpdateWebAuthnCredentialUsage(ctx context.Context, credential *model.WebAuthnCredential) error {
+	for _, c := range m.webauthnCredentials {
+		if c.ID == credential.ID {
+			now := time.Now()
+			c.SignCount = credential.SignCount
+			c.BackupState = credential.BackupState
+			c.LastUsedAt = &now
+		}
+	}
+	return nil
+}
+
+func (m *MockUserStore) RenameWebAuthnCredential(ctx context.Context, userID, credentialID int64, name string) error {
+	for _, c := range m.webauthnCredentials {
+		if c.ID == credentialID && c.UserID == userID {
+			c.Name = name
+			return nil
+		}
+	}
+	return pgx.ErrNoRows
+}
+
+func (m *MockUserStore) DeleteWebAuthnCredential(ctx context.Context, userID, credentialID int64) error {
+	credentials, _ := m.GetWebAuthnCredentials(ctx, userID)
+	identities, _ := m.GetUserIdentities(ctx, userID)
+	user, ok := m.users[userID]
+	if !ok || (user.PasswordHash == "" && len(identities) == 0 && len(credentials) <= 1) {
+		return pgx.ErrNoRows
+	}
+	for i, c := range m.webauthnCredentials {
+		if c.ID == credentialID && c.UserID == userID {
+			m.webauthnCredentials = append(m.webauthnCredentials[:i], m.webauthnCredentials[i+1:]...)
+			return nil
+		}
+	}
+	return pgx.ErrNoRows
+}
+
+func (m *MockUserStore) CreateWebAuthnSession(ctx context.Context, session *model.WebAuthnSession) error {
+	m.webauthnSessions[session.ID] = session
+	return nil
+}
+
+func (m *MockUserStore) ConsumeWebAuthnSession(ctx context.Context, id string) (*model.WebAuthnSession, error) {
+	session, ok := m.webauthnSessions[id]
+	delete(m.webauthnSessions, id)
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return nil, pgx.ErrNoRows
+	}
+	return session, nil
+}
+
 func (m *MockUserStore) GetUserByID(ctx context.Context, userID int64) (*model.User, error) {
 	user, ok := m.users[userID]
 	if !ok {
@@ -101,24 +330,81 @@ func (m *MockUserStore) GetUserByID(ctx context.Context, userID int64) (*model.U
 	}
 	return user, nil
 }
-func (m *MockUserStore) UpdateUserPreferences(ctx context.Context, userID int64, prefs map[string]interface{}) error {
-	return nil
+func (m *MockUserStore) ReplaceUserPreferences(ctx context.Context, userID int64, previous, prefs map[string]interface{}) (bool, error) {
+	user, ok := m.users[userID]
+	if !ok || !reflect.DeepEqual(user.Preferences, previous) {
+		return false, nil
+	}
+	user.Preferences = prefs
+	return true, nil
 }
-func (m *MockUserStore) UpdateProfilePictureURL(ctx context.Context, userID int64, url string) error {
-	return nil
+func (m *MockUserStore) SetProfilePicture(ctx context.Context, userID int64, key, url string) (string, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return "", pgx.ErrNoRows
+	}
+	previous := m.profilePictureKeys[userID]
+	m.profilePictureKeys[userID] = key
+	user.ProfilePictureURL = url
+	return previous, nil
 }
 func (m *MockUserStore) Store2FASecrets(ctx context.Context, userID int64, secret string, recoveryCodes []string) error {
-	return nil
+	user, ok := m.users[userID]
+	if !ok || user.TwoFactorEnabled {
+		return pgx.ErrNoRows
+	}
+	user.TwoFactorSecret = secret
+	return m.ReplaceRecoveryCodes(ctx, userID, recoveryCodes)
 }
 func (m *MockUserStore) Activate2FA(ctx context.Context, userID int64) error {
+	user, ok := m.users[userID]
+	if ok {
+		user.TwoFactorEnabled = true
+	}
+	return nil
+}
+
+func (m *MockUserStore) ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryCodes []string) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return errors.New("user not found")
+	}
+	user.TwoFactorRecoveryCodes = nil
+	for _, code := range recoveryCodes {
+		hash, _ := bcrypt.GenerateFromPassword([]byte(code), bcrypt.MinCost)
+		user.TwoFactorRecoveryCodes = append(user.TwoFactorRecoveryCodes, string(hash))
+	}
 	return nil
 }
 
+func (m *MockUserStore) ConsumeRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return false, errors.New("user not found")
+	}
+	for i, hash := range user.TwoFactorRecoveryCodes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			user.TwoFactorRecoveryCodes = append(user.TwoFactorRecoveryCodes[:i], user.TwoFactorRecoveryCodes[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (m *MockUserStore) CountRecoveryCodes(ctx context.Context, userID int64) (int, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return 0, errors.New("user not found")
+	}
+	return len(user.TwoFactorRecoveryCodes), nil
+}
+
 func (m *MockUserStore) Disable2FA(ctx context.Context, userID int64) error {
 	user, ok := m.users[userID]
 	if ok {
 		user.TwoFactorEnabled = false
 		user.TwoFactorSecret = ""
+		user.TwoFactorRecoveryCodes = nil
 	}
 	return nil
 }
@@ -132,18 +418,254 @@ func (m *MockUserStore) DeactivateUser(ctx context.Context, userID int64) error
 	return nil
 }
 
-func (m *MockUserStore) DeleteUser(ctx context.Context, userID int64) error {
+func (m *MockUserStore) DeleteUser(ctx context.Context, userID int64, services []string) (string, error) {
 	user, ok := m.users[userID]
 	if !ok {
-		return errors.New("user not found")
+		return "", errors.New("user not found")
 	}
+	profilePictureKey := m.profilePictureKeys[userID]
 	delete(m.emailToID, user.Email)
 	delete(m.users, userID)
+	delete(m.profilePictureKeys, userID)
+	deletionID := m.nextID
+	m.nextID++
+	for _, service := range services {
+		m.erasures = append(m.erasures, &mockErasure{ErasureRequest: model.ErasureRequest{DeletionID: deletionID, UserID: userID, Service: service}})
+	}
+	return profilePictureKey, nil
+}
+
+func (m *MockUserStore) ScheduleUserDeletion(ctx context.Context, userID int64, deleteAt time.Time) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return errors.New("user not found")
+	}
+	if user.DeactivatedAt == nil {
+		now := time.Now()
+		user.DeactivatedAt = &now
+	}
+	user.DeletionScheduledAt = &deleteAt
+	return nil
+}
+
+func (m *MockUserStore) ReactivateUser(ctx context.Context, userID int64) error {
+	user, ok := m.users[userID]
+	if !ok || user.DeactivatedAt == nil || user.DeactivatedByAdmin {
+		return pgx.ErrNoRows
+	}
+	user.DeactivatedAt, user.DeletionScheduledAt = nil, nil
 	return nil
 }
 
+func (m *MockUserStore) PurgeScheduledDeletions(ctx context.Context, limit int, services []string) ([]int64, []string, error) {
+	var userIDs []int64
+	for id, user := range m.users {
+		if len(userIDs) < limit && user.DeletionScheduledAt != nil && !user.DeletionScheduledAt.After(time.Now()) {
+			userIDs = append(userIDs, id)
+		}
+	}
+	var profilePictureKeys []string
+	for _, id := range userIDs {
+		if key, _ := m.DeleteUser(ctx, id, services); key != "" {
+			profilePictureKeys = append(profilePictureKeys, key)
+		}
+	}
+	return userIDs, profilePictureKeys, nil
+}
+
+// InTx runs fn on the mock itself: changes are not rolled back if fn fails.
+func (m *MockUserStore) InTx(ctx context.Context, fn func(store storage.UserStore) error) error {
+	return fn(m)
+}
+func (m *MockUserStore) EnqueueEvent(ctx context.Context, event *model.OutboxEvent) error {
+	event.ID = m.nextID
+	m.nextID++
+	event.CreatedAt = time.Now()
+	m.outbox = append(m.outbox, &mockOutboxEvent{OutboxEvent: *event})
+	return nil
+}
+func (m *MockUserStore) ClaimOutboxEvents(ctx context.Context, retryAfter, maxRetryAfter time.Duration, limit int) ([]*model.OutboxEvent, error) {
+	var events []*model.OutboxEvent
+	for _, event := range m.outbox {
+		if len(events) == limit {
+			break
+		}
+		wait := time.Duration(0)
+		if event.Attempts > 0 {
+			wait = retryAfter
+			for i := 1; i < event.Attempts && wait < maxRetryAfter; i++ {
+				wait *= 2
+			}
+		}
+		if wait > maxRetryAfter {
+			wait = maxRetryAfter
+		}
+		if !event.sent.IsZero() || time.Since(event.lastAttempt) < wait {
+			continue
+		}
+		event.Attempts++
+		event.lastAttempt = time.Now()
+		claimed := event.OutboxEvent
+		events = append(events, &claimed)
+	}
+	return events, nil
+}
+func (m *MockUserStore) MarkOutboxEventSent(ctx context.Context, id int64) error {
+	for _, event := range m.outbox {
+		if event.ID == id {
+			event.sent = time.Now()
+		}
+	}
+	return nil
+}
+func (m *MockUserStore) DeleteSentOutboxEvents(ctx context.Context, sentBefore time.Time) (int64, error) {
+	var kept []*mockOutboxEvent
+	for _, event := range m.outbox {
+		if event.sent.IsZero() || !event.sent.Before(sentBefore) {
+			kept = append(kept, event)
+		}
+	}
+	deleted := int64(len(m.outbox) - len(kept))
+	m.outbox = kept
+	return deleted, nil
+}
+func (m *MockUserStore) ClaimErasureRequests(ctx context.Context, retryAfter, maxRetryAfter time.Duration, limit int) ([]*model.ErasureRequest, error) {
+	var requests []*model.ErasureRequest
+	for _, erasure := range m.erasures {
+		if len(requests) == limit {
+			break
+		}
+		wait := time.Duration(0)
+		if erasure.Attempts > 0 {
+			wait = retryAfter
+			for i := 1; i < erasure.Attempts && wait < maxRetryAfter; i++ {
+				wait *= 2
+			}
+		}
+		if wait > maxRetryAfter {
+			wait = maxRetryAfter
+		}
+		if erasure.confirmed || time.Since(erasure.lastAttempt) < wait {
+			continue
+		}
+		erasure.Attempts++
+		erasure.lastAttempt = time.Now()
+		request := erasure.ErasureRequest
+		requests = append(requests, &request)
+	}
+	return requests, nil
+}
+
+func (m *MockUserStore) ConfirmUserDataErased(ctx context.Context, deletionID int64, service string) (bool, error) {
+	confirmedNow, pending := false, false
+	for _, erasure := range m.erasures {
+		if erasure.DeletionID != deletionID {
+			continue
+		}
+		if erasure.Service == service && !erasure.confirmed {
+			erasure.confirmed, confirmedNow = true, true
+		} else if !erasure.confirmed {
+			pending = true
+		}
+	}
+	return confirmedNow && !pending, nil
+}
+
+func (m *MockUserStore) SearchUsers(ctx context.Context, search model.UserSearch) ([]*model.User, int64, error) {
+	var matches []*model.User
+	query := strings.ToLower(search.Query)
+	for _, user := range m.users {
+		name := strings.ToLower(user.Email + " " + user.FirstName + " " + user.LastName)
+		if (query != "" && !strings.Contains(name, query)) ||
+			(search.Role != "" && user.Role != search.Role) ||
+			(search.Status == "active" && user.DeactivatedAt != nil) ||
+			(search.Status == "deactivated" && user.DeactivatedAt == nil) {
+			continue
+		}
+		matches = append(matches, user)
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].ID < matches[j].ID })
+
+	start := (search.Page - 1) * search.PageSize
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := start + search.PageSize
+	if end > len(matches) {
+		end = len(matches)
+	}
+	return matches[start:end], int64(len(matches)), nil
+}
+
+// audit records an entry for an action on targetID, as the store does in the same statement.
+func (m *MockUserStore) audit(targetID int64, entry *model.AdminAuditEntry) {
+	entry.TargetUserID = &targetID
+	m.CreateAdminAuditEntry(context.Background(), entry)
+}
+
+func (m *MockUserStore) SetUserRole(ctx context.Context, userID int64, role string, entry *model.AdminAuditEntry) (string, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return "", pgx.ErrNoRows
+	}
+	previousRole := user.Role
+	user.Role = role
+	entry.Details = map[string]interface{}{"previous_role": previousRole, "new_role": role}
+	m.audit(userID, entry)
+	return previousRole, nil
+}
+
+func (m *MockUserStore) SetUserDeactivated(ctx context.Context, userID int64, deactivated bool, entry *model.AdminAuditEntry) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return pgx.ErrNoRows
+	}
+	if !deactivated {
+		user.DeactivatedAt, user.DeletionScheduledAt = nil, nil
+	} else if user.DeactivatedAt == nil {
+		now := time.Now()
+		user.DeactivatedAt = &now
+	}
+	user.DeactivatedByAdmin = deactivated
+	m.audit(userID, entry)
+	return nil
+}
+
+func (m *MockUserStore) Reset2FA(ctx context.Context, userID int64, entry *model.AdminAuditEntry) error {
+	if _, ok := m.users[userID]; !ok {
+		return pgx.ErrNoRows
+	}
+	m.Disable2FA(ctx, userID)
+	m.audit(userID, entry)
+	return nil
+}
+
+func (m *MockUserStore) CreateAdminAuditEntry(ctx context.Context, entry *model.AdminAuditEntry) error {
+	entry.ID = int64(len(m.auditLog) + 1)
+	entry.CreatedAt = time.Now()
+	m.auditLog = append(m.auditLog, entry)
+	return nil
+}
+
+func (m *MockUserStore) GetAdminAuditLog(ctx context.Context, search model.AdminAuditSearch) ([]*model.AdminAuditEntry, int64, error) {
+	var entries []*model.AdminAuditEntry
+	for i := len(m.auditLog) - 1; i >= 0; i-- {
+		entry := m.auditLog[i]
+		if (search.ActorID == 0 || entry.ActorID == search.ActorID) &&
+			(search.TargetUserID == 0 || (entry.TargetUserID != nil && *entry.TargetUserID == search.TargetUserID)) &&
+			(search.Action == "" || entry.Action == search.Action) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, int64(len(entries)), nil
+}
+
 func (m *MockUserStore) Get2FAData(ctx context.Context, userID int64) (string, bool, error) {
-	return "", false, nil
+	user, ok := m.users[userID]
+	if !ok {
+		return "", false, errors.New("user not found")
+	}
+	return user.TwoFactorSecret, user.TwoFactorEnabled, nil
 }
 func (m *MockUserStore) CreatePasswordResetToken(ctx context.Context, userID int64, token string, expiresAt time.Time) error {
 	m.passwordResetTokens[token] = userID
@@ -160,9 +682,71 @@ func (m *MockUserStore) DeletePasswordResetToken(ctx context.Context, token stri
 	delete(m.passwordResetTokens, token)
 	return nil
 }
+func (m *MockUserStore) CreateEmailVerificationToken(ctx context.Context, userID int64, token string, expiresAt time.Time) error {
+	m.verificationTokens[token] = userID
+	return nil
+}
+func (m *MockUserStore) VerifyEmailWithToken(ctx context.Context, token string) (int64, error) {
+	userID, ok := m.verificationTokens[token]
+	if !ok {
+		return 0, errors.New("token not found")
+	}
+	for t, id := range m.verificationTokens {
+		if id == userID {
+			delete(m.verificationTokens, t)
+		}
+	}
+	now := time.Now()
+	m.users[userID].EmailVerifiedAt = &now
+	return userID, nil
+}
+func (m *MockUserStore) CreateEmailChangeToken(ctx context.Context, userID int64, newEmail string, token string, expiresAt time.Time) error {
+	m.emailChangeTokens[token] = &model.EmailChange{UserID: userID, NewEmail: newEmail}
+	return nil
+}
+func (m *MockUserStore) ConfirmEmailChange(ctx context.Context, token string) (*model.EmailChange, error) {
+	pending, ok := m.emailChangeTokens[token]
+	if !ok {
+		return nil, errors.New("token not found")
+	}
+	if _, taken := m.emailToID[pending.NewEmail]; taken {
+		return nil, &pgconn.PgError{Code: "23505"}
+	}
+	for t, change := range m.emailChangeTokens {
+		if change.UserID == pending.UserID {
+			delete(m.emailChangeTokens, t)
+		}
+	}
+	user := m.users[pending.UserID]
+	change := &model.EmailChange{UserID: user.ID, OldEmail: user.Email, NewEmail: pending.NewEmail}
+	delete(m.emailToID, user.Email)
+	user.Email = pending.NewEmail
+	m.emailToID[user.Email] = user.ID
+	now := time.Now()
+	user.EmailVerifiedAt = &now
+	return change, nil
+}
 func (m *MockUserStore) UpdatePassword(ctx context.Context, userID int64, newPassword string) error {
+	user, ok := m.users[userID]
+	if !ok {
+		return errors.New("user not found")
+	}
+	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.MinCost)
+	m.passwordHistory[userID] = append([]string{user.PasswordHash}, m.passwordHistory[userID]...)
+	user.PasswordHash = string(hashedPassword)
 	return nil
 }
+func (m *MockUserStore) GetPasswordHistory(ctx context.Context, userID int64, limit int) ([]string, error) {
+	user, ok := m.users[userID]
+	if !ok {
+		return nil, errors.New("user not found")
+	}
+	hashes := append([]string{user.PasswordHash}, m.passwordHistory[userID]...)
+	if len(hashes) > limit {
+		hashes = hashes[:limit]
+	}
+	return hashes, nil
+}
 func (m *MockUserStore) GetCompletedLessonsForUser(ctx context.Context, userID int64) ([]int64, error) {
 	return nil, nil
 }
@@ -177,20 +761,277 @@ func (m *MockUserStore) CreateQuizAttempt(ctx context.Context, attempt *model.Cr
 func (m *MockUserStore) GetQuizAttemptsForUser(ctx context.Context, userID int64) ([]model.QuizAttempt, error) {
 	return nil, nil
 }
+
+func (m *MockUserStore) GetLessonProgressForUser(ctx context.Context, userID int64) ([]model.LessonProgress, error) {
+	return nil, nil
+}
+
+func (m *MockUserStore) CreateDataExport(ctx context.Context, userID int64) (*model.DataExport, bool, error) {
+	for _, export := range m.dataExports {
+		if export.UserID == userID && (export.Status == model.DataExportPending || export.Status == model.DataExportProcessing) {
+			return export.DataExport, false, nil
+		}
+	}
+	export := &model.DataExport{ID: m.nextID, UserID: userID, Status: model.DataExportPending, CreatedAt: time.Now()}
+	m.nextID++
+	m.dataExports = append(m.dataExports, &mockDataExport{DataExport: export})
+	return export, true, nil
+}
+
+func (m *MockUserStore) findDataExport(exportID int64) *mockDataExport {
+	for _, export := range m.dataExports {
+		if export.ID == exportID {
+			return export
+		}
+	}
+	return nil
+}
+
+func (m *MockUserStore) GetDataExport(ctx context.Context, userID, exportID int64) (*model.DataExport, error) {
+	export := m.findDataExport(exportID)
+	if export == nil || export.UserID != userID {
+		return nil, pgx.ErrNoRows
+	}
+	return export.DataExport, nil
+}
+
+func (m *MockUserStore) ClaimDataExport(ctx context.Context, staleAfter time.Duration) (*model.DataExport, error) {
+	for _, export := range m.dataExports {
+		if export.Status == model.DataExportPending || (export.Status == model.DataExportProcessing && time.Since(*export.StartedAt) > staleAfter) {
+			now := time.Now()
+			export.Status, export.StartedAt = model.DataExportProcessing, &now
+			return export.DataExport, nil
+		}
+	}
+	return nil, pgx.ErrNoRows
+}
+
+func (m *MockUserStore) CompleteDataExport(ctx context.Context, exportID int64, archive []byte, expiresAt time.Time) error {
+	export := m.findDataExport(exportID)
+	now := time.Now()
+	export.Status, export.CompletedAt, export.ExpiresAt = model.DataExportReady, &now, &expiresAt
+	export.archive, export.SizeBytes = archive, int64(len(archive))
+	return nil
+}
+
+func (m *MockUserStore) FailDataExport(ctx context.Context, exportID int64, reason string, expiresAt time.Time) error {
+	export := m.findDataExport(exportID)
+	now := time.Now()
+	export.Status, export.Error, export.CompletedAt, export.ExpiresAt = model.DataExportFailed, reason, &now, &expiresAt
+	return nil
+}
+
+func (m *MockUserStore) SetDataExportDownloadToken(ctx context.Context, userID, exportID int64, tokenHash string, expiresAt time.Time) error {
+	export := m.findDataExport(exportID)
+	if export == nil || export.UserID != userID || export.Status != model.DataExportReady || !export.ExpiresAt.After(time.Now()) {
+		return pgx.ErrNoRows
+	}
+	export.tokenHash, export.tokenExpiresAt = tokenHash, expiresAt
+	return nil
+}
+
+func (m *MockUserStore) ConsumeDataExportDownloadToken(ctx context.Context, tokenHash string) (*model.DataExport, []byte, error) {
+	for _, export := range m.dataExports {
+		if export.tokenHash != "" && export.tokenHash == tokenHash {
+			export.tokenHash = ""
+			if !export.tokenExpiresAt.After(time.Now()) || !export.ExpiresAt.After(time.Now()) {
+				break
+			}
+			return export.DataExport, export.archive, nil
+		}
+	}
+	return nil, nil, pgx.ErrNoRows
+}
+
+func (m *MockUserStore) DeleteExpiredDataExports(ctx context.Context) (int64, error) {
+	var kept []*mockDataExport
+	for _, export := range m.dataExports {
+		if export.ExpiresAt == nil || export.ExpiresAt.After(time.Now()) {
+			kept = append(kept, export)
+		}
+	}
+	deleted := int64(len(m.dataExports) - len(kept))
+	m.dataExports = kept
+	return deleted, nil
+}
 func (m *MockUserStore) CreateUserActivity(ctx context.Context, activity *model.UserActivity) error {
+	for _, recorded := range m.activities {
+		if activity.EventID != "" && recorded.EventID == activity.EventID {
+			return nil
+		}
+	}
+	activity.ID = m.nextID
+	m.nextID++
+	if activity.CreatedAt.IsZero() {
+		activity.CreatedAt = time.Now()
+	}
+	m.activities = append(m.activities, activity)
 	return nil
 }
 func (m *MockUserStore) GetUserActivities(ctx context.Context, userID int64) ([]*model.UserActivity, error) {
-	return []*model.UserActivity{}, nil
+	activities := []*model.UserActivity{}
+	for _, activity := range m.activities {
+		if activity.UserID == userID {
+			activities = append(activities, activity)
+		}
+	}
+	return activities, nil
+}
+func (m *MockUserStore) SearchUserActivities(ctx context.Context, search model.UserActivitySearch) ([]*model.UserActivity, error) {
+	var activities []*model.UserActivity
+	for i := len(m.activities) - 1; i >= 0 && len(activities) < search.Limit; i-- {
+		activity := m.activities[i]
+		if activity.UserID != search.UserID || (search.Cursor != 0 && activity.ID >= search.Cursor) ||
+			(search.Types != nil && !slices.Contains(search.Types, activity.ActivityType)) ||
+			(!search.Since.IsZero() && activity.CreatedAt.Before(search.Since)) ||
+			(!search.Until.IsZero() && !activity.CreatedAt.Before(search.Until)) {
+			continue
+		}
+		activities = append(activities, activity)
+	}
+	return activities, nil
+}
+func (m *MockUserStore) GetUserActivityDays(ctx context.Context, userID int64, since time.Time, timezone string) ([]*model.UserActivityDay, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	byDate := map[string]*model.UserActivityDay{}
+	for _, activity := range m.activities {
+		if activity.UserID != userID || activity.CreatedAt.Before(since) {
+			continue
+		}
+		date := activity.CreatedAt.In(location).Format("2006-01-02")
+		if byDate[date] == nil {
+			byDate[date] = &model.UserActivityDay{Date: date, Counts: map[string]int{}}
+		}
+		byDate[date].Counts[activity.ActivityType]++
+		byDate[date].Total++
+	}
+	var days []*model.UserActivityDay
+	for _, day := range byDate {
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Date < days[j].Date })
+	return days, nil
+}
+func (m *MockUserStore) DeleteExpiredUserActivities(ctx context.Context, defaultRetention time.Duration, retention map[string]time.Duration, limit int) (int64, error) {
+	var kept []*model.UserActivity
+	var deleted int64
+	for _, activity := range m.activities {
+		period, ok := retention[activity.ActivityType]
+		if !ok {
+			period = defaultRetention
+		}
+		if period > 0 && time.Since(activity.CreatedAt) > period && deleted < int64(limit) {
+			deleted++
+			continue
+		}
+		kept = append(kept, activity)
+	}
+	m.activities = kept
+	return deleted, nil
+}
+
+func (m *MockUserStore) CreateSession(ctx context.Context, session *model.Session, refreshTokenHash string) (*model.Session, error) {
+	newSession := *session
+	newSession.ID = m.nextID
+	newSession.CreatedAt = time.Now()
+	newSession.LastUsedAt = newSession.CreatedAt
+	m.sessions[newSession.ID] = &newSession
+	m.sessionTokens[refreshTokenHash] = newSession.ID
+	m.nextID++
+	return &newSession, nil
+}
+
+func (m *MockUserStore) RotateSessionRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*model.Session, error) {
+	sessionID, ok := m.sessionTokens[oldHash]
+	if !ok {
+		return nil, pgx.ErrNoRows
+	}
+	session := m.sessions[sessionID]
+	if session.RevokedAt != nil || time.Now().After(session.ExpiresAt) {
+		return nil, pgx.ErrNoRows
+	}
+	delete(m.sessionTokens, oldHash)
+	m.sessionTokens[newHash] = sessionID
+	session.ExpiresAt = expiresAt
+	session.LastUsedAt = time.Now()
+	return session, nil
+}
+
+func (m *MockUserStore) GetActiveSessionsForUser(ctx context.Context, userID int64) ([]*model.Session, error) {
+	var sessions []*model.Session
+	for _, session := range m.sessions {
+		if session.UserID == userID && session.RevokedAt == nil && time.Now().Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func (m *MockUserStore) RevokeSession(ctx context.Context, userID int64, sessionID int64) error {
+	session, ok := m.sessions[sessionID]
+	if !ok || session.UserID != userID || session.RevokedAt != nil {
+		return pgx.ErrNoRows
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	return nil
+}
+
+func (m *MockUserStore) RevokeAllSessionsForUser(ctx context.Context, userID int64) error {
+	now := time.Now()
+	for _, session := range m.sessions {
+		if session.UserID == userID && session.RevokedAt == nil {
+			session.RevokedAt = &now
+		}
+	}
+	return nil
 }
 
 // MockMessageBroker is a mock implementation of the MessageBroker.
-type MockMessageBroker struct{}
+// It records published events so tests can assert on them.
+type MockMessageBroker struct {
+	Published []PublishedEvent
+}
 
-func (m *MockMessageBroker) Publish(ctx context.Context, queueName string, eventType string, payload interface{}) error {
+// PublishedEvent is a message recorded by MockMessageBroker.
+type PublishedEvent struct {
+	QueueName string
+	EventID   string
+	EventType string
+	Payload   events.Payload
+}
+
+func (m *MockMessageBroker) Publish(ctx context.Context, queueName string, payload events.Payload) error {
+	m.Published = append(m.Published, PublishedEvent{QueueName: queueName, EventType: payload.EventType(), Payload: payload})
+	return nil
+}
+
+func (m *MockMessageBroker) PublishEnvelope(ctx context.Context, queueName string, envelope *events.Envelope) error {
+	if _, err := events.Encode(envelope); err != nil {
+		return err
+	}
+	payload, err := envelope.DecodePayload()
+	if err != nil {
+		return err
+	}
+	m.Published = append(m.Published, PublishedEvent{QueueName: queueName, EventID: envelope.ID, EventType: envelope.Type, Payload: payload})
 	return nil
 }
 
+// EventsOfType returns the recorded events with the given type.
+func (m *MockMessageBroker) EventsOfType(eventType string) []PublishedEvent {
+	var events []PublishedEvent
+	for _, e := range m.Published {
+		if e.EventType == eventType {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
 func (m *MockMessageBroker) Consume(ctx context.Context, queueName string, handler messaging.MessageHandler) error {
 	return nil
 }
@@ -275,6 +1116,7 @@ func TestGetUserActivityHandler(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
 	c.Params = gin.Params{gin.Param{Key: "userId", Value: "1"}}
+	c.Set("userID", int64(1))
 
 	c.Request, _ = http.NewRequest(http.MethodGet, "/users/1/activity", nil)
 
@@ -285,16 +1127,83 @@ func TestGetUserActivityHandler(t *testing.T) {
 	}
 }
 
+func TestUserResourceOwnership(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	student := createUserWithRoleForTest(userStore, "student@example.com", "Student", model.RoleUser)
+	other := createUserWithRoleForTest(userStore, "other@example.com", "Other", model.RoleUser)
+	moderator := createUserWithRoleForTest(userStore, "mod@example.com", "Mod", model.RoleModerator)
+
+	router := gin.New()
+	users := router.Group("/users", authz.Authenticate(TokenVerifier()))
+	users.GET("/:userId/progress", apiHandler.GetProgressHandler)
+	users.POST("/:userId/progress", apiHandler.MarkLessonCompleteHandler)
+	users.GET("/:userId/quiz-attempts", apiHandler.GetQuizAttemptsForUserHandler)
+	users.GET("/:userId/activity", apiHandler.GetUserActivityHandler)
+	users.GET("/:userId/activity/summary", apiHandler.GetUserActivitySummaryHandler)
+
+	path := func(user *model.User, resource string) string {
+		return "/users/" + strconv.FormatInt(user.ID, 10) + "/" + resource
+	}
+	lesson := map[string]int64{"lesson_id": 1}
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		actor  *model.User
+		body   interface{}
+		want   int
+	}{
+		{"Own progress", http.MethodGet, path(student, "progress"), student, nil, http.StatusOK},
+		{"Another user's progress", http.MethodGet, path(other, "progress"), student, nil, http.StatusForbidden},
+		{"Moderator views progress", http.MethodGet, path(student, "progress"), moderator, nil, http.StatusOK},
+		{"Complete own lesson", http.MethodPost, path(student, "progress"), student, lesson, http.StatusNoContent},
+		{"Moderator completes a lesson for a user", http.MethodPost, path(student, "progress"), moderator, lesson, http.StatusForbidden},
+		{"Another user's quiz attempts", http.MethodGet, path(other, "quiz-attempts"), student, nil, http.StatusForbidden},
+		{"Moderator views quiz attempts", http.MethodGet, path(student, "quiz-attempts"), moderator, nil, http.StatusOK},
+		{"Another user's activity", http.MethodGet, path(other, "activity"), student, nil, http.StatusForbidden},
+		{"Moderator views activity", http.MethodGet, path(student, "activity"), moderator, nil, http.StatusOK},
+		{"Another user's activity summary", http.MethodGet, path(other, "activity/summary"), student, nil, http.StatusForbidden},
+		{"Moderator views activity summary", http.MethodGet, path(student, "activity/summary"), moderator, nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := adminRequestForTest(t, router, tt.method, tt.path, tt.actor, false, tt.body)
+			if w.Code != tt.want {
+				t.Errorf("expected status %d; got %d", tt.want, w.Code)
+			}
+		})
+	}
+
+	t.Run("Unsigned identity headers", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, path(other, "progress"), nil)
+		req.Header.Set("X-User-Id", strconv.FormatInt(other.ID, 10))
+		req.Header.Set("X-User-Role", model.RoleAdmin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+}
+
 func TestDeactivateUserHandler(t *testing.T) {
 	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
 
 	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
 	mockMessageBroker := &MockMessageBroker{}
 	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
+	login := loginForTest(t, apiHandler, "test@example.com", "password")
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
-	c.Set("userID", int64(1)) // Set user ID in context
+	c.Set("userID", user.ID) // Set user ID in context
 
 	c.Request, _ = http.NewRequest(http.MethodDelete, "/profile", nil)
 
@@ -303,6 +1212,14 @@ func TestDeactivateUserHandler(t *testing.T) {
 	if w.Code != http.StatusOK {
 		t.Errorf("expected status %d; got %d", http.StatusOK, w.Code)
 	}
+
+	// Deactivation must end every existing session.
+	if w := refreshForTest(apiHandler, login.RefreshToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected refresh token to be revoked; got status %d", w.Code)
+	}
+	if len(mockMessageBroker.EventsOfType("user_sessions_revoked")) != 1 {
+		t.Error("expected a user_sessions_revoked event to be published")
+	}
 }
 
 func TestLoginUserHandler(t *testing.T) {
@@ -349,8 +1266,9 @@ func TestLoginUserHandler(t *testing.T) {
 
 		apiHandler.LoginUserHandler(c)
 
-		if w.Code != http.StatusUnauthorized {
-			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		// Instead of a session, the user is offered to reactivate the account.
+		if w.Code != http.StatusForbidden || !bytes.Contains(w.Body.Bytes(), []byte(`"reactivation_required":true`)) {
+			t.Errorf("expected status %d with a reactivation prompt; got %d %s", http.StatusForbidden, w.Code, w.Body.String())
 		}
 	})
 }
@@ -413,57 +1331,6 @@ func TestVerify2FAHandler(t *testing.T) {
 	})
 }
 
-func TestUploadProfilePictureHandler(t *testing.T) {
-	gin.SetMode(gin.TestMode)
-
-	userStore := NewMockUserStore()
-	mockMessageBroker := &MockMessageBroker{}
-	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
-
-	// Create a buffer to store our request body
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-
-	// Create a new form-data header
-	part, err := writer.CreateFormFile("picture", "test.jpg")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	// Write a fake file to the form-data header
-	_, err = io.Copy(part, strings.NewReader("fake image data"))
-	if err != nil {
-		t.Fatal(err)
-	}
-	writer.Close()
-
-	w := httptest.NewRecorder()
-	c, _ := gin.CreateTestContext(w)
-	c.Set("userID", int64(1)) // Set user ID in context
-
-	c.Request, _ = http.NewRequest(http.MethodPost, "/profile/picture", body)
-	c.Request.Header.Set("Content-Type", writer.FormDataContentType())
-
-	apiHandler.UploadProfilePictureHandler(c)
-
-	if w.Code != http.StatusOK {
-		t.Errorf("expected status %d; got %d", http.StatusOK, w.Code)
-	}
-
-	var responseBody map[string]string
-	if err := json.Unmarshal(w.Body.Bytes(), &responseBody); err != nil {
-		t.Fatalf("Failed to decode response body: %v", err)
-	}
-
-	if responseBody["message"] != "Profile picture updated successfully." {
-		t.Errorf("expected success message; got '%s'", responseBody["message"])
-	}
-
-	if !strings.HasPrefix(responseBody["url"], "https://storage.example.com/profiles/") {
-		t.Errorf("expected URL with prefix; got '%s'", responseBody["url"])
-	}
-}
-
 func TestGetFullProfileHandler(t *testing.T) {
 	gin.SetMode(gin.TestMode)
 
@@ -488,6 +1355,7 @@ func TestGetFullProfileHandler(t *testing.T) {
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
 	c.Params = gin.Params{gin.Param{Key: "userId", Value: "1"}}
+	c.Set("userID", int64(1))
 
 	c.Request, _ = http.NewRequest(http.MethodGet, "/users/1/full-profile", nil)
 
@@ -516,6 +1384,7 @@ func TestDeleteUserHandler(t *testing.T) {
 
 	mockMessageBroker := &MockMessageBroker{}
 	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
+	apiHandler.DeletionGracePeriod = 0 // Delete immediately; see TestScheduledAccountDeletion.
 
 	w := httptest.NewRecorder()
 	c, _ := gin.CreateTestContext(w)
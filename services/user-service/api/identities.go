@@ -0,0 +1,230 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/oauth"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// PendingIdentityLinkTTL is how long a user has to sign in and confirm linking
+// an identity whose email matches their account.
+const PendingIdentityLinkTTL = 15 * time.Minute
+
+// offerIdentityLink handles a provider login whose email belongs to an existing
+// account that does not have the identity linked yet. Only an email the provider
+// has verified is trusted; the identity is then parked until the account owner
+// signs in and confirms it, and the browser is sent to the confirmation page.
+func (a *API) offerIdentityLink(c *gin.Context, user *model.User, providerName string, identity *oauth.Identity) {
+	if !identity.EmailVerified {
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=account_exists", a.FrontendBaseURL))
+		return
+	}
+
+	token, err := auth.GenerateSecureToken(32)
+	if err != nil {
+		log.Printf("Error generating token: %v", err)
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=oauth_failed", a.FrontendBaseURL))
+		return
+	}
+	pending := &model.UserIdentity{UserID: user.ID, Provider: providerName, Subject: identity.Subject, Email: identity.Email}
+	if err := a.UserStore.CreatePendingIdentityLink(c.Request.Context(), token, pending, time.Now().Add(PendingIdentityLinkTTL)); err != nil {
+		log.Printf("Error creating pending %s link for user %d: %v", providerName, user.ID, err)
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/login?error=oauth_failed", a.FrontendBaseURL))
+		return
+	}
+
+	c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/link-account?token=%s&provider=%s", a.FrontendBaseURL, token, url.QueryEscape(providerName)))
+}
+
+// linkIdentityFromCallback completes a link started by a signed-in user with
+// StartIdentityLinkHandler and sends the browser back to the settings page.
+func (a *API) linkIdentityFromCallback(c *gin.Context, userID int64, providerName string, identity *oauth.Identity) {
+	linked := &model.UserIdentity{UserID: userID, Provider: providerName, Subject: identity.Subject, Email: identity.Email}
+	if err := a.UserStore.LinkIdentity(c.Request.Context(), linked); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/settings?error=identity_in_use", a.FrontendBaseURL))
+			return
+		}
+		log.Printf("Error linking %s identity to user %d: %v", providerName, userID, err)
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/settings?error=link_failed", a.FrontendBaseURL))
+		return
+	}
+
+	a.recordIdentityLinked(c.Request.Context(), linked)
+	c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/settings?linked=%s", a.FrontendBaseURL, url.QueryEscape(providerName)))
+}
+
+// recordIdentityLinked logs a newly linked identity in the user's activity and
+// tells the user by email, in case someone else linked it.
+func (a *API) recordIdentityLinked(ctx context.Context, identity *model.UserIdentity) {
+	activity := &model.UserActivity{UserID: identity.UserID, ActivityType: "identity_linked", Metadata: map[string]interface{}{"provider": identity.Provider}}
+	if err := a.UserStore.CreateUserActivity(ctx, activity); err != nil {
+		log.Printf("Error recording linked identity for user %d: %v", identity.UserID, err)
+	}
+
+	user, err := a.UserStore.GetUserByID(ctx, identity.UserID)
+	if err != nil {
+		log.Printf("Error getting user %d for identity link notice: %v", identity.UserID, err)
+		return
+	}
+	payload := &events.IdentityLinked{
+		Email:    user.Email,
+		Name:     user.FirstName,
+		Provider: identity.Provider,
+	}
+	if err := a.MessageBroker.Publish(ctx, "notifications_events", payload); err != nil {
+		log.Printf("Error publishing identity link notice for user %d: %v", identity.UserID, err)
+	}
+}
+
+// ListIdentitiesHandler lists the external identities linked to the authenticated user.
+func (a *API) ListIdentitiesHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	identities, err := a.UserStore.GetUserIdentities(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing identities for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve linked accounts."})
+		return
+	}
+	if identities == nil {
+		identities = []*model.UserIdentity{}
+	}
+
+	c.JSON(http.StatusOK, identities)
+}
+
+// StartIdentityLinkHandler starts linking an account at the provider named in the
+// URL to the authenticated user. It returns the provider URL the client should
+// navigate to; the provider redirects back to the login callback, which links
+// the identity instead of logging in.
+func (a *API) StartIdentityLinkHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	providerName := c.Param("provider")
+	provider, ok := a.Providers.Get(providerName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	authURL, err := a.startOAuthFlow(c, providerName, provider, userID, false)
+	if err != nil {
+		log.Printf("Error starting %s link for user %d: %v", providerName, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start linking the account."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+// ConfirmIdentityLinkHandler links an identity that was offered when someone
+// signed in with a provider using the authenticated user's verified email.
+// The token only works for the account it was issued for.
+func (a *API) ConfirmIdentityLinkHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	var req model.ConfirmIdentityLinkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	identity, err := a.UserStore.ConfirmPendingIdentityLink(c.Request.Context(), req.Token, userID)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired link token."})
+			return
+		}
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "This account is already linked to another user."})
+			return
+		}
+		log.Printf("Error confirming identity link for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to link the account."})
+		return
+	}
+
+	a.recordIdentityLinked(c.Request.Context(), identity)
+	c.JSON(http.StatusOK, identity)
+}
+
+// UnlinkIdentityHandler removes one of the authenticated user's linked identities.
+// The last way to sign in cannot be removed: a user without a password must keep
+// at least one identity.
+func (a *API) UnlinkIdentityHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	identityID, err := strconv.ParseInt(c.Param("identityId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid identity ID"})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	identities, err := a.UserStore.GetUserIdentities(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing identities for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink the account."})
+		return
+	}
+	var identity *model.UserIdentity
+	for _, i := range identities {
+		if i.ID == identityID {
+			identity = i
+		}
+	}
+	if identity == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Linked account not found"})
+		return
+	}
+	if user.PasswordHash == "" && len(identities) == 1 {
+		credentials, err := a.UserStore.GetWebAuthnCredentials(c.Request.Context(), userID)
+		if err != nil {
+			log.Printf("Error listing WebAuthn credentials for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink the account."})
+			return
+		}
+		if len(credentials) == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "This is your only way to sign in. Set a password or link another account first."})
+			return
+		}
+	}
+
+	if err := a.UserStore.UnlinkIdentity(c.Request.Context(), userID, identityID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Another sign-in method went away since the check above.
+			c.JSON(http.StatusConflict, gin.H{"error": "This is your only way to sign in. Set a password or link another account first."})
+			return
+		}
+		log.Printf("Error unlinking identity %d for user %d: %v", identityID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlink the account."})
+		return
+	}
+
+	activity := &model.UserActivity{UserID: userID, ActivityType: "identity_unlinked", Metadata: map[string]interface{}{"provider": identity.Provider}}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording unlinked identity for user %d: %v", userID, err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
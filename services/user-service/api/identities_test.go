@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/oauth/oauthtest"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+func confirmIdentityLinkForTest(apiHandler *API, userID int64, token string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	jsonBody, _ := json.Marshal(map[string]string{"token": token})
+	c.Request, _ = http.NewRequest(http.MethodPost, "/identities/confirm", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.ConfirmIdentityLinkHandler(c)
+	return w
+}
+
+// unlinkIdentityForTest returns the response status; a 204 is never flushed to the recorder.
+func unlinkIdentityForTest(apiHandler *API, userID, identityID int64) int {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Params = gin.Params{{Key: "identityId", Value: strconv.FormatInt(identityID, 10)}}
+	c.Request, _ = http.NewRequest(http.MethodDelete, "/identities/"+strconv.FormatInt(identityID, 10), nil)
+
+	apiHandler.UnlinkIdentityHandler(c)
+	return c.Writer.Status()
+}
+
+func TestOAuthLoginWithExistingEmail(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	server := oauthtest.NewServer(oauthtest.User{Subject: "subject-1", Email: "existing@example.com", EmailVerified: false})
+	defer server.Close()
+
+	userStore := NewMockUserStore()
+	owner, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "existing@example.com", Password: "password"})
+	other, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "other@example.com", Password: "password"})
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := newOAuthTestAPI(t, server, userStore, mockMessageBroker)
+
+	t.Run("Unverified email", func(t *testing.T) {
+		query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+		w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		if location := w.Header().Get("Location"); location != "https://example.com/login?error=account_exists" {
+			t.Errorf("expected the login to be refused; got %q", location)
+		}
+		if len(userStore.pendingLinks) != 0 {
+			t.Errorf("expected no link to be offered; got %d", len(userStore.pendingLinks))
+		}
+	})
+
+	server.SetUser(oauthtest.User{Subject: "subject-1", Email: "existing@example.com", EmailVerified: true})
+	query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+	w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if !strings.HasPrefix(location.String(), "https://example.com/link-account?") {
+		t.Fatalf("expected a redirect to the link confirmation; got %q", location)
+	}
+	token := location.Query().Get("token")
+	if _, err := userStore.GetUserByOAuthID(context.Background(), "test", "subject-1"); err == nil {
+		t.Fatal("expected the identity not to be linked before confirmation")
+	}
+
+	t.Run("Confirmed by another user", func(t *testing.T) {
+		if w := confirmIdentityLinkForTest(apiHandler, other.ID, token); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	if w := confirmIdentityLinkForTest(apiHandler, owner.ID, token); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if user, err := userStore.GetUserByOAuthID(context.Background(), "test", "subject-1"); err != nil || user.ID != owner.ID {
+		t.Fatalf("expected the identity to be linked to the owner; got %v, %v", user, err)
+	}
+	if notices := mockMessageBroker.EventsOfType("identity_linked"); len(notices) != 1 {
+		t.Errorf("expected 1 identity_linked event; got %d", len(notices))
+	}
+
+	t.Run("Token reused", func(t *testing.T) {
+		if w := confirmIdentityLinkForTest(apiHandler, owner.ID, token); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Login after linking", func(t *testing.T) {
+		query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+		w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		if location := w.Header().Get("Location"); !strings.HasPrefix(location, "https://example.com/auth/callback?code=") {
+			t.Errorf("expected a redirect with a login code; got %q", location)
+		}
+	})
+}
+
+func TestLinkAndUnlinkIdentity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	server := oauthtest.NewServer(oauthtest.User{Subject: "subject-2", Email: "someone-else@example.com", EmailVerified: true})
+	defer server.Close()
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	oauthOnly, _ := userStore.CreateOAuthUser(context.Background(), &model.User{Email: "oauth@example.com", OAuthProvider: "test", OAuthProviderID: "subject-3"})
+	apiHandler := newOAuthTestAPI(t, server, userStore, &MockMessageBroker{})
+
+	// Start linking as the signed-in user.
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", user.ID)
+	c.Params = gin.Params{{Key: "provider", Value: "test"}}
+	c.Request, _ = http.NewRequest(http.MethodPost, "/identities/test", nil)
+	apiHandler.StartIdentityLinkHandler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	query := signInAtProviderForTest(t, resp["authorization_url"])
+	callback := oauthCallbackForTest(apiHandler, "test", query, stateCookieForTest(w))
+	if location := callback.Header().Get("Location"); location != "https://example.com/settings?linked=test" {
+		t.Fatalf("expected a redirect to the settings page; got %q", location)
+	}
+
+	identities, _ := userStore.GetUserIdentities(context.Background(), user.ID)
+	if len(identities) != 1 || identities[0].Subject != "subject-2" {
+		t.Fatalf("expected the identity to be linked; got %v", identities)
+	}
+
+	t.Run("Unlink someone else's identity", func(t *testing.T) {
+		others, _ := userStore.GetUserIdentities(context.Background(), oauthOnly.ID)
+		if status := unlinkIdentityForTest(apiHandler, user.ID, others[0].ID); status != http.StatusNotFound {
+			t.Errorf("expected status %d; got %d", http.StatusNotFound, status)
+		}
+	})
+
+	t.Run("Unlink last sign-in method", func(t *testing.T) {
+		others, _ := userStore.GetUserIdentities(context.Background(), oauthOnly.ID)
+		if status := unlinkIdentityForTest(apiHandler, oauthOnly.ID, others[0].ID); status != http.StatusConflict {
+			t.Errorf("expected status %d; got %d", http.StatusConflict, status)
+		}
+	})
+
+	if status := unlinkIdentityForTest(apiHandler, user.ID, identities[0].ID); status != http.StatusNoContent {
+		t.Fatalf("expected status %d; got %d", http.StatusNoContent, status)
+	}
+	if identities, _ := userStore.GetUserIdentities(context.Background(), user.ID); len(identities) != 0 {
+		t.Errorf("expected no linked identities; got %v", identities)
+	}
+}
+
+func TestOAuthLoginWithLegacyAccount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	server := oauthtest.NewServer(oauthtest.User{Subject: "subject-1", Email: "legacy@example.com", EmailVerified: true})
+	defer server.Close()
+
+	// An account created before user_identities existed: only users.oauth_provider is set.
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateOAuthUser(context.Background(), &model.User{Email: "legacy@example.com", OAuthProvider: "test", OAuthProviderID: "subject-1"})
+	userStore.identities = nil
+	delete(userStore.oauthIDToUserID, "test-subject-1")
+	apiHandler := newOAuthTestAPI(t, server, userStore, &MockMessageBroker{})
+
+	if n, err := userStore.BackfillIdentities(context.Background()); err != nil || n != 1 {
+		t.Fatalf("expected 1 identity to be backfilled; got %d, %v", n, err)
+	}
+
+	query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+	w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, "https://example.com/auth/callback?code=") {
+		t.Fatalf("expected a redirect with a login code; got %q", location)
+	}
+	if found, err := userStore.GetUserByOAuthID(context.Background(), "test", "subject-1"); err != nil || found.ID != user.ID {
+		t.Errorf("expected the legacy account to sign in; got %v, %v", found, err)
+	}
+}
@@ -0,0 +1,17 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// JWKSHandler serves the public keys used to sign access tokens as a JSON Web Key Set.
+// Other services use it to verify tokens without sharing key files out of band.
+// Newly added keys appear here before they are used for signing, so a short cache
+// lifetime is enough for consumers to pick them up during a rotation.
+func (a *API) JWKSHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, auth.Keys().JWKS())
+}
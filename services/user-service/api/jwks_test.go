@@ -0,0 +1,42 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestJWKSHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	apiHandler := NewAPI(NewMockUserStore(), &MockMessageBroker{}, "", "", "", nil)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil)
+
+	apiHandler.JWKSHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	var set auth.JWKS
+	if err := json.Unmarshal(w.Body.Bytes(), &set); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	activeKID := auth.Keys().ActiveKeyID()
+	found := false
+	for _, key := range set.Keys {
+		if key.Kid == activeKID && key.Kty == "RSA" && key.N != "" && key.E != "" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected the active key %q to be published", activeKID)
+	}
+}
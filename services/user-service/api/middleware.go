@@ -1,32 +1,60 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
-	"strconv"
 
+	"github.com/free-education/authz"
+	"github.com/free-education/user-service/auth"
 	"github.com/gin-gonic/gin"
 )
 
-// AuthMiddleware creates a gin middleware for authenticating users.
-func AuthMiddleware() gin.HandlerFunc {
+// TokenVerifier returns an authz.Verifier for the access tokens this service
+// issues. Unlike authz.NewJWTVerifier, it checks tokens against the local key ring
+// and rejects those revoked by a security event.
+func TokenVerifier() authz.Verifier {
+	return authz.BearerVerifier(func(token string) (*authz.Identity, error) {
+		claims, err := auth.ValidateToken(token)
+		if err != nil {
+			return nil, err
+		}
+		if claims.Type != "full_auth" {
+			return nil, fmt.Errorf("%q token cannot be used for API access", claims.Type)
+		}
+		return &authz.Identity{
+			UserID:         claims.UserID,
+			Role:           claims.Role,
+			SessionID:      claims.SessionID,
+			ImpersonatorID: claims.ImpersonatorID,
+		}, nil
+	})
+}
+
+// RequireRecentAuth creates a gin middleware for sensitive actions. On top of the
+// normal authentication, it requires an "X-Reauth-Token" header holding a token
+// from POST /reauth that was issued to the same user within auth.ReauthTokenTTL.
+// It must run after authz.Authenticate.
+func RequireRecentAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userIDHeader := c.GetHeader("X-User-Id")
-		if userIDHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID header not provided"})
+		userID := c.MustGet("userID").(int64)
+
+		// An admin impersonating the user cannot prove to be them.
+		if _, impersonated := c.Get("impersonatorID"); impersonated {
+			c.JSON(http.StatusForbidden, gin.H{"error": "This action is not available while impersonating a user."})
 			c.Abort()
 			return
 		}
 
-		id, err := strconv.ParseInt(userIDHeader, 10, 64)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID format"})
+		claims, err := auth.ValidateToken(c.GetHeader("X-Reauth-Token"))
+		if err != nil || claims.Type != "reauth" || claims.UserID != userID {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":           "Recent authentication required. Confirm your password or 2FA code first.",
+				"reauth_required": true,
+			})
 			c.Abort()
 			return
 		}
 
-		// Set the user ID in the context for downstream handlers to use.
-		c.Set("userID", id)
-
 		c.Next()
 	}
 }
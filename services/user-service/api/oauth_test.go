@@ -0,0 +1,222 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/oauth"
+	"github.com/free-education/user-service/oauth/oauthtest"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+const oauthRedirectURLForTest = "http://localhost/api/users/login/test/callback"
+
+func oauthLoginForTest(apiHandler *API, provider string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "provider", Value: provider}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/login/"+provider, nil)
+
+	apiHandler.OAuthLoginHandler(c)
+	return w
+}
+
+func oauthCallbackForTest(apiHandler *API, provider, query, stateCookie string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Params = gin.Params{{Key: "provider", Value: provider}}
+	c.Request, _ = http.NewRequest(http.MethodGet, "/login/"+provider+"/callback?"+query, nil)
+	c.Request.AddCookie(&http.Cookie{Name: "oauthstate", Value: stateCookie})
+
+	apiHandler.OAuthCallbackHandler(c)
+	return w
+}
+
+func exchangeLoginCodeForTest(apiHandler *API, code, stateCookie string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	jsonBody, _ := json.Marshal(map[string]string{"code": code})
+	c.Request, _ = http.NewRequest(http.MethodPost, "/login/exchange", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Request.AddCookie(&http.Cookie{Name: "oauthstate", Value: stateCookie})
+
+	apiHandler.ExchangeLoginCodeHandler(c)
+	return w
+}
+
+// signInAtProviderForTest lets the stub issuer sign the user in at authURL and
+// returns the query string it redirects back to the callback with.
+func signInAtProviderForTest(t *testing.T, authURL string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || !strings.HasPrefix(callback.String(), oauthRedirectURLForTest) {
+		t.Fatalf("expected a redirect to the callback; got %q", resp.Header.Get("Location"))
+	}
+	return callback.RawQuery
+}
+
+func stateCookieForTest(w *httptest.ResponseRecorder) string {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "oauthstate" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// authorizeAtProviderForTest starts a login, lets the stub issuer sign the user in and
+// returns the callback query string together with the state cookie that was set.
+func authorizeAtProviderForTest(t *testing.T, apiHandler *API) (string, string) {
+	t.Helper()
+	w := oauthLoginForTest(apiHandler, "test")
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected status %d; got %d", http.StatusTemporaryRedirect, w.Code)
+	}
+	return signInAtProviderForTest(t, w.Header().Get("Location")), stateCookieForTest(w)
+}
+
+// newOAuthTestAPI returns an API with the stub issuer registered as provider "test".
+func newOAuthTestAPI(t *testing.T, server *oauthtest.Server, userStore *MockUserStore, broker *MockMessageBroker) *API {
+	t.Helper()
+	provider, err := oauth.NewOIDCProvider(context.Background(), server.URL, oauth.Config{ClientID: "client", ClientSecret: "secret", RedirectURL: oauthRedirectURLForTest})
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+	providers := oauth.NewRegistry()
+	providers.Register("test", provider)
+	return NewAPI(userStore, broker, "https://example.com", "", "", providers)
+}
+
+func TestOAuthLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	server := oauthtest.NewServer(oauthtest.User{Subject: "subject-1", Email: "oauth@example.com", EmailVerified: true, Name: "OAuth User"})
+	defer server.Close()
+	userStore := NewMockUserStore()
+	apiHandler := newOAuthTestAPI(t, server, userStore, &MockMessageBroker{})
+
+	t.Run("Unknown provider", func(t *testing.T) {
+		if w := oauthLoginForTest(apiHandler, "nope"); w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d; got %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("New user", func(t *testing.T) {
+		query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+		w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		if location := w.Header().Get("Location"); !strings.HasPrefix(location, "https://example.com/auth/callback?code=") {
+			t.Fatalf("expected a redirect with a login code; got %q", location)
+		}
+
+		user, err := userStore.GetUserByOAuthID(context.Background(), "test", "subject-1")
+		if err != nil {
+			t.Fatalf("expected the user to be created: %v", err)
+		}
+		if user.Email != "oauth@example.com" || user.EmailVerifiedAt == nil {
+			t.Errorf("unexpected user: %+v", user)
+		}
+	})
+
+	t.Run("Existing identity", func(t *testing.T) {
+		before := len(userStore.users)
+		query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+		w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		if location := w.Header().Get("Location"); !strings.HasPrefix(location, "https://example.com/auth/callback?code=") {
+			t.Fatalf("expected a redirect with a login code; got %q", location)
+		}
+		if len(userStore.users) != before {
+			t.Errorf("expected no new user; got %d users", len(userStore.users))
+		}
+	})
+
+	t.Run("State reused", func(t *testing.T) {
+		query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+		oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		if location := w.Header().Get("Location"); location != "https://example.com/login?error=invalid_state" {
+			t.Errorf("expected the reused state to be rejected; got %q", location)
+		}
+	})
+
+	t.Run("State cookie mismatch", func(t *testing.T) {
+		query, _ := authorizeAtProviderForTest(t, apiHandler)
+		w := oauthCallbackForTest(apiHandler, "test", query, "other-state")
+		if location := w.Header().Get("Location"); location != "https://example.com/login?error=invalid_state" {
+			t.Errorf("expected the state to be rejected; got %q", location)
+		}
+	})
+
+	t.Run("Expired state", func(t *testing.T) {
+		query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+		state, _ := url.ParseQuery(query)
+		userStore.oauthStates[state.Get("state")].ExpiresAt = time.Now().Add(-time.Minute)
+		w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		if location := w.Header().Get("Location"); location != "https://example.com/login?error=invalid_state" {
+			t.Errorf("expected the expired state to be rejected; got %q", location)
+		}
+	})
+}
+
+func TestExchangeLoginCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	server := oauthtest.NewServer(oauthtest.User{Subject: "subject-1", Email: "oauth@example.com", EmailVerified: true})
+	defer server.Close()
+	apiHandler := newOAuthTestAPI(t, server, NewMockUserStore(), &MockMessageBroker{})
+
+	// loginCodeForTest completes a provider login and returns the login code and state cookie.
+	loginCodeForTest := func(t *testing.T) (string, string) {
+		t.Helper()
+		query, stateCookie := authorizeAtProviderForTest(t, apiHandler)
+		w := oauthCallbackForTest(apiHandler, "test", query, stateCookie)
+		location, _ := url.Parse(w.Header().Get("Location"))
+		if location.Query().Get("code") == "" || location.Query().Get("token") != "" {
+			t.Fatalf("expected a redirect with only a login code; got %q", location)
+		}
+		return location.Query().Get("code"), stateCookie
+	}
+
+	t.Run("Successful exchange", func(t *testing.T) {
+		code, stateCookie := loginCodeForTest(t)
+		w := exchangeLoginCodeForTest(apiHandler, code, stateCookie)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		var resp model.LoginResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Token == "" || resp.RefreshToken == "" {
+			t.Errorf("expected a token pair; got %+v", resp)
+		}
+
+		if w := exchangeLoginCodeForTest(apiHandler, code, stateCookie); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected a reused code to be rejected with %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Different browser", func(t *testing.T) {
+		code, stateCookie := loginCodeForTest(t)
+		if w := exchangeLoginCodeForTest(apiHandler, code, "other-state"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+		// A failed attempt burns the code.
+		if w := exchangeLoginCodeForTest(apiHandler, code, stateCookie); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/messaging"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/storage"
+)
+
+const (
+	// outboxRetryAfter is how long the relay waits before publishing an event again
+	// after it failed. The wait doubles with every attempt, up to outboxMaxRetryAfter.
+	outboxRetryAfter    = 5 * time.Second
+	outboxMaxRetryAfter = 10 * time.Minute
+	// outboxBatchSize is how many outbox events are claimed per query.
+	outboxBatchSize = 100
+	// OutboxRetention is how long published events are kept in the outbox.
+	OutboxRetention = 7 * 24 * time.Hour
+)
+
+// enqueueEvent adds an event to the outbox of store, which is usually a
+// transaction, so it is published if and only if the transaction commits.
+// RelayOutbox publishes it.
+func enqueueEvent(ctx context.Context, store storage.UserStore, queueName string, payload events.Payload) error {
+	envelope, err := events.New(messaging.Producer, payload)
+	if err != nil {
+		return err
+	}
+	return store.EnqueueEvent(ctx, &model.OutboxEvent{
+		EventID:      envelope.ID,
+		Queue:        queueName,
+		EventType:    envelope.Type,
+		EventVersion: envelope.Version,
+		Payload:      envelope.Payload,
+	})
+}
+
+// RelayOutbox publishes the events waiting in the outbox, oldest first, and returns
+// how many it published. An event that cannot be published is retried later with
+// the same event ID. main runs it periodically, and it also runs right after events
+// are enqueued; several instances can run it at the same time.
+func (a *API) RelayOutbox(ctx context.Context) (int, error) {
+	sent := 0
+	for {
+		pending, err := a.UserStore.ClaimOutboxEvents(ctx, outboxRetryAfter, outboxMaxRetryAfter, outboxBatchSize)
+		if err != nil {
+			return sent, err
+		}
+		for _, event := range pending {
+			envelope := &events.Envelope{
+				ID:         event.EventID,
+				Type:       event.EventType,
+				Version:    event.EventVersion,
+				OccurredAt: event.CreatedAt,
+				Producer:   messaging.Producer,
+				Payload:    event.Payload,
+			}
+			if err := a.MessageBroker.PublishEnvelope(ctx, event.Queue, envelope); err != nil {
+				// The attempt is counted either way, so the event is retried later.
+				log.Printf("Error publishing %s event %s (attempt %d): %v", event.EventType, event.EventID, event.Attempts, err)
+				continue
+			}
+			if err := a.UserStore.MarkOutboxEventSent(ctx, event.ID); err != nil {
+				// The event is published again, and consumers ignore the duplicate.
+				log.Printf("Error marking %s event %s as sent: %v", event.EventType, event.EventID, err)
+				continue
+			}
+			sent++
+		}
+		if len(pending) < outboxBatchSize {
+			return sent, nil
+		}
+	}
+}
+
+// relayOutboxNow publishes events that were just enqueued without waiting for the
+// next run of RelayOutbox.
+func (a *API) relayOutboxNow(ctx context.Context) {
+	if _, err := a.RelayOutbox(ctx); err != nil {
+		// The events stay in the outbox and are published by the next periodic run.
+		log.Printf("Error relaying outbox events: %v", err)
+	}
+}
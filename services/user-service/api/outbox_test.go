@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// unavailableMessageBroker fails to publish while down, as RabbitMQ does during a restart.
+type unavailableMessageBroker struct {
+	MockMessageBroker
+	down bool
+}
+
+func (b *unavailableMessageBroker) PublishEnvelope(ctx context.Context, queueName string, envelope *events.Envelope) error {
+	if b.down {
+		return errors.New("connection refused")
+	}
+	return b.MockMessageBroker.PublishEnvelope(ctx, queueName, envelope)
+}
+
+func TestOutbox(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "outbox@example.com", Password: "password123"})
+	broker := &unavailableMessageBroker{down: true}
+	apiHandler := NewAPI(userStore, broker, "", "", "", nil)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/password/forgot", bytes.NewBufferString(`{"email": "outbox@example.com"}`))
+	c.Request.Header.Set("Content-Type", "application/json")
+	apiHandler.ForgotPasswordHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	if len(userStore.outbox) != 1 || userStore.outbox[0].EventType != "password_reset_requested" || !userStore.outbox[0].sent.IsZero() {
+		t.Fatalf("expected the event to wait in the outbox; got %+v", userStore.outbox)
+	}
+	if len(userStore.passwordResetTokens) != 1 {
+		t.Errorf("expected the reset token to be stored with the event")
+	}
+
+	t.Run("Failed events are retried after a while", func(t *testing.T) {
+		broker.down = false
+		if sent, _ := apiHandler.RelayOutbox(context.Background()); sent != 0 {
+			t.Errorf("expected no events to be published before the retry interval; got %d", sent)
+		}
+
+		userStore.outbox[0].lastAttempt = time.Now().Add(-2 * outboxRetryAfter)
+		if sent, err := apiHandler.RelayOutbox(context.Background()); sent != 1 || err != nil {
+			t.Fatalf("expected the event to be published; got %d, %v", sent, err)
+		}
+		events := broker.EventsOfType("password_reset_requested")
+		if len(events) != 1 || events[0].EventID != userStore.outbox[0].EventID || events[0].QueueName != "notifications_events" {
+			t.Errorf("expected the event to be published with its ID; got %+v", events)
+		}
+	})
+
+	t.Run("Sent events are published once", func(t *testing.T) {
+		userStore.outbox[0].lastAttempt = time.Time{}
+		if sent, _ := apiHandler.RelayOutbox(context.Background()); sent != 0 {
+			t.Errorf("expected no events to be published again; got %d", sent)
+		}
+	})
+
+	t.Run("Old sent events are deleted", func(t *testing.T) {
+		if deleted, _ := userStore.DeleteSentOutboxEvents(context.Background(), time.Now().Add(time.Minute)); deleted != 1 {
+			t.Errorf("expected the sent event to be deleted; got %d", deleted)
+		}
+	})
+
+	t.Run("Revoking sessions enqueues the event with the revocation", func(t *testing.T) {
+		if err := apiHandler.revokeUserSessions(context.Background(), user.ID, "password_changed"); err != nil {
+			t.Fatalf("revokeUserSessions failed: %v", err)
+		}
+		if events := broker.EventsOfType("user_sessions_revoked"); len(events) != 1 || events[0].EventID == "" {
+			t.Errorf("expected the user_sessions_revoked event to be relayed; got %+v", events)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// checkNewPassword validates a new password against the password policy and,
+// for existing users (userID not zero), against their recent passwords.
+// It writes a 400 or 500 response and returns false if the password is refused.
+func (a *API) checkNewPassword(c *gin.Context, userID int64, email, password string) bool {
+	if err := a.PasswordPolicy.Validate(password, email); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	if userID == 0 || a.PasswordPolicy.HistorySize <= 0 {
+		return true
+	}
+
+	history, err := a.UserStore.GetPasswordHistory(c.Request.Context(), userID, a.PasswordPolicy.HistorySize)
+	if err != nil {
+		log.Printf("Error getting password history for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password."})
+		return false
+	}
+	if err := a.PasswordPolicy.CheckHistory(password, history); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+// ChangePasswordHandler changes the authenticated user's password.
+// It requires the current password. All existing sessions are signed out and
+// a new session is returned for the device that made the change.
+func (a *API) ChangePasswordHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	var req model.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.PasswordHash == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This account has no password. Use the forgot-password flow to set one."})
+		return
+	}
+
+	if !a.checkLoginThrottle(c, userID) {
+		return
+	}
+	if !storage.CheckPassword(user.PasswordHash, req.CurrentPassword) {
+		a.recordLoginFailure(c, userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect."})
+		return
+	}
+
+	if !a.checkNewPassword(c, userID, user.Email, req.NewPassword) {
+		return
+	}
+
+	if err := a.UserStore.UpdatePassword(c.Request.Context(), userID, req.NewPassword); err != nil {
+		log.Printf("Error updating password for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password."})
+		return
+	}
+
+	if err := a.revokeUserSessions(c.Request.Context(), userID, "password_changed"); err != nil {
+		log.Printf("Error revoking sessions for user %d after password change: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update password."})
+		return
+	}
+
+	activity := &model.UserActivity{UserID: userID, ActivityType: "password_changed"}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording password change for user %d: %v", userID, err)
+	}
+
+	resp, err := a.issueSession(c, user)
+	if err != nil {
+		log.Printf("Error issuing session for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Password changed, but failed to sign you in again."})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+func changePasswordForTest(apiHandler *API, userID int64, current, newPassword string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	jsonBody, _ := json.Marshal(map[string]string{"current_password": current, "new_password": newPassword})
+	c.Request, _ = http.NewRequest(http.MethodPut, "/password", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.ChangePasswordHandler(c)
+	return w
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "first-password"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	apiHandler.PasswordPolicy.HistorySize = 2
+	oldLogin := loginForTest(t, apiHandler, "test@example.com", "first-password")
+
+	t.Run("Wrong current password", func(t *testing.T) {
+		if w := changePasswordForTest(apiHandler, user.ID, "wrong", "second-password"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Policy violation", func(t *testing.T) {
+		if w := changePasswordForTest(apiHandler, user.ID, "first-password", "short"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Same as current", func(t *testing.T) {
+		if w := changePasswordForTest(apiHandler, user.ID, "first-password", "first-password"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Change", func(t *testing.T) {
+		w := changePasswordForTest(apiHandler, user.ID, "first-password", "second-password")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		var resp model.LoginResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if _, err := auth.ValidateToken(resp.Token); err != nil {
+			t.Errorf("expected a fresh access token; got %v", err)
+		}
+		if w := refreshForTest(apiHandler, oldLogin.RefreshToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected other sessions to be signed out; got %d", w.Code)
+		}
+		loginForTest(t, apiHandler, "test@example.com", "second-password")
+	})
+
+	t.Run("Recently used", func(t *testing.T) {
+		if w := changePasswordForTest(apiHandler, user.ID, "second-password", "first-password"); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+func TestRegisterUsesPasswordPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	apiHandler := NewAPI(NewMockUserStore(), &MockMessageBroker{}, "", "", "", nil)
+
+	w := postJSONForTest(apiHandler.RegisterUserHandler, "/register", model.RegistrationRequest{
+		Email: "test@example.com", Password: "test@example.com", FirstName: "Test", LastName: "User",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+	}
+}
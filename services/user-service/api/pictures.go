@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/blobstore"
+	"github.com/free-education/user-service/picture"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// MaxProfilePictureSize is the largest profile picture upload accepted, in bytes.
+	MaxProfilePictureSize = 5 << 20
+	// multipartOverhead allows for the multipart headers and boundaries around the
+	// uploaded file.
+	multipartOverhead = 64 << 10
+	// profilePictureURLSize is the size whose URL is stored as the user's profile
+	// picture URL. The other sizes are at the same URL with its size replaced.
+	profilePictureURLSize = "medium"
+
+	// MediaPath is where main serves the blobs of a filesystem blob store.
+	MediaPath = "/media"
+	// DefaultBlobBaseURL is the public URL of MediaPath behind the API gateway.
+	DefaultBlobBaseURL = "/api/users" + MediaPath
+)
+
+// defaultBlobStore keeps blobs in a temporary directory. main replaces it with
+// the configured store.
+func defaultBlobStore() blobstore.BlobStore {
+	return blobstore.NewFileSystem(filepath.Join(os.TempDir(), "user-service-blobs"), DefaultBlobBaseURL)
+}
+
+// profilePictureKey returns the blob key of one size of the profile picture
+// stored under prefix.
+func profilePictureKey(prefix, size string) string {
+	return fmt.Sprintf("%s-%s.jpg", prefix, size)
+}
+
+// UploadProfilePictureHandler replaces the authenticated user's profile picture.
+// The upload must be a JPEG, PNG or GIF image of at most MaxProfilePictureSize
+// bytes, which is checked by its content rather than its file name. It is stored
+// in each of picture.Sizes, and the previous picture is deleted.
+func (a *API) UploadProfilePictureHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, MaxProfilePictureSize+multipartOverhead)
+	file, err := c.FormFile("picture")
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Profile pictures must be at most 5 MB."})
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File not provided or invalid."})
+		return
+	}
+	if file.Size > MaxProfilePictureSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "Profile pictures must be at most 5 MB."})
+		return
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File not provided or invalid."})
+		return
+	}
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File not provided or invalid."})
+		return
+	}
+
+	variants, err := picture.Process(data)
+	if errors.Is(err, picture.ErrUnsupportedFormat) {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Profile pictures must be JPEG, PNG or GIF images."})
+		return
+	}
+	if errors.Is(err, picture.ErrTooManyPixels) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "The image's dimensions are too large."})
+		return
+	}
+	if err != nil {
+		log.Printf("Error processing profile picture of user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process the picture."})
+		return
+	}
+
+	// Every upload gets new keys, so caches never serve a replaced picture.
+	token, err := auth.GenerateSecureToken(16)
+	if err != nil {
+		log.Printf("Error generating profile picture key for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file."})
+		return
+	}
+	prefix := fmt.Sprintf("profile-pictures/%d/%s", userID, token)
+
+	ctx := c.Request.Context()
+	urls := make(map[string]string, len(variants))
+	for _, variant := range variants {
+		key := profilePictureKey(prefix, variant.Size.Name)
+		if err := a.Blobs.Put(ctx, key, variant.Data, picture.ContentType); err != nil {
+			log.Printf("Error uploading profile picture of user %d: %v", userID, err)
+			a.deleteProfilePicture(context.Background(), prefix)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to upload file."})
+			return
+		}
+		urls[variant.Size.Name] = a.Blobs.URL(key)
+	}
+
+	previous, err := a.UserStore.SetProfilePicture(ctx, userID, prefix, urls[profilePictureURLSize])
+	if err != nil {
+		log.Printf("Error updating profile picture URL for user %d: %v", userID, err)
+		a.deleteProfilePicture(context.Background(), prefix)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile picture URL."})
+		return
+	}
+	a.deleteProfilePicture(ctx, previous)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Profile picture updated successfully.", "url": urls[profilePictureURLSize], "urls": urls})
+}
+
+// DeleteProfilePictureHandler removes the authenticated user's profile picture.
+func (a *API) DeleteProfilePictureHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	previous, err := a.UserStore.SetProfilePicture(c.Request.Context(), userID, "", "")
+	if err != nil {
+		log.Printf("Error removing profile picture of user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove the profile picture."})
+		return
+	}
+	a.deleteProfilePicture(c.Request.Context(), previous)
+
+	c.Status(http.StatusNoContent)
+}
+
+// deleteProfilePicture deletes every size of the profile picture stored under
+// prefix, if any. Failures are only logged: the picture is no longer referenced.
+func (a *API) deleteProfilePicture(ctx context.Context, prefix string) {
+	if prefix == "" {
+		return
+	}
+	for _, size := range picture.Sizes {
+		if err := a.Blobs.Delete(ctx, profilePictureKey(prefix, size.Name)); err != nil {
+			log.Printf("Error deleting profile picture %s: %v", profilePictureKey(prefix, size.Name), err)
+		}
+	}
+}
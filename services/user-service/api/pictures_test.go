@@ -0,0 +1,235 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/free-education/user-service/blobstore"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/picture"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// uploadProfilePictureForTest uploads data as the given user's profile picture.
+func uploadProfilePictureForTest(apiHandler *API, userID int64, data []byte) *httptest.ResponseRecorder {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("picture", "photo.jpg")
+	part.Write(data)
+	writer.Close()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/profile/picture", body)
+	c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	apiHandler.UploadProfilePictureHandler(c)
+	return w
+}
+
+// pngForTest returns a w×h PNG image.
+func pngForTest(w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	return buf.Bytes()
+}
+
+// storedBlobsForTest lists the keys of the blobs in a filesystem blob store.
+func storedBlobsForTest(t *testing.T, dir string) []string {
+	t.Helper()
+	var keys []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			keys = append(keys, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	return keys
+}
+
+func TestProfilePicture(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	dir := t.TempDir()
+	apiHandler.Blobs = blobstore.NewFileSystem(dir, "https://cdn.example.com/")
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "picture@example.com", Password: "password123"})
+
+	var first struct {
+		URL  string            `json:"url"`
+		URLs map[string]string `json:"urls"`
+	}
+
+	t.Run("An image is stored in every size", func(t *testing.T) {
+		w := uploadProfilePictureForTest(apiHandler, user.ID, pngForTest(600, 400))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		json.Unmarshal(w.Body.Bytes(), &first)
+
+		if len(first.URLs) != len(picture.Sizes) {
+			t.Fatalf("expected a URL for each of %d sizes; got %v", len(picture.Sizes), first.URLs)
+		}
+		if !strings.HasPrefix(first.URL, "https://cdn.example.com/profile-pictures/") || first.URL != first.URLs["medium"] {
+			t.Errorf("expected the URL of the medium size; got %s", first.URL)
+		}
+		if userStore.users[user.ID].ProfilePictureURL != first.URL {
+			t.Errorf("expected the user's profile picture URL to be %s; got %s", first.URL, userStore.users[user.ID].ProfilePictureURL)
+		}
+		if blobs := storedBlobsForTest(t, dir); len(blobs) != len(picture.Sizes) {
+			t.Fatalf("expected %d stored blobs; got %v", len(picture.Sizes), blobs)
+		}
+		small, err := os.ReadFile(filepath.Join(dir, strings.TrimPrefix(first.URLs["small"], "https://cdn.example.com/")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config, err := jpeg.DecodeConfig(bytes.NewReader(small)); err != nil || config.Width != 64 || config.Height != 64 {
+			t.Errorf("expected a 64x64 JPEG; got %+v (%v)", config, err)
+		}
+	})
+
+	t.Run("Replacing the picture deletes the previous one", func(t *testing.T) {
+		w := uploadProfilePictureForTest(apiHandler, user.ID, pngForTest(300, 300))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var second struct {
+			URL string `json:"url"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &second)
+		if second.URL == first.URL {
+			t.Error("expected the new picture to get a new URL")
+		}
+
+		blobs := storedBlobsForTest(t, dir)
+		if len(blobs) != len(picture.Sizes) {
+			t.Fatalf("expected only the %d blobs of the new picture; got %v", len(picture.Sizes), blobs)
+		}
+		for _, url := range first.URLs {
+			if _, err := os.Stat(filepath.Join(dir, strings.TrimPrefix(url, "https://cdn.example.com/"))); !os.IsNotExist(err) {
+				t.Errorf("expected %s to be deleted", url)
+			}
+		}
+	})
+
+	t.Run("Files that are not images are rejected", func(t *testing.T) {
+		before := userStore.users[user.ID].ProfilePictureURL
+		w := uploadProfilePictureForTest(apiHandler, user.ID, []byte("<svg onload=\"alert(1)\"></svg>"))
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("expected status %d; got %d", http.StatusUnsupportedMediaType, w.Code)
+		}
+		if userStore.users[user.ID].ProfilePictureURL != before {
+			t.Error("expected the profile picture to be unchanged")
+		}
+		if blobs := storedBlobsForTest(t, dir); len(blobs) != len(picture.Sizes) {
+			t.Errorf("expected nothing to be stored; got %v", blobs)
+		}
+	})
+
+	t.Run("Files over the size limit are rejected", func(t *testing.T) {
+		w := uploadProfilePictureForTest(apiHandler, user.ID, make([]byte, MaxProfilePictureSize+1))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status %d; got %d", http.StatusRequestEntityTooLarge, w.Code)
+		}
+	})
+
+	t.Run("A request without a file is rejected", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Request, _ = http.NewRequest(http.MethodPost, "/profile/picture", nil)
+
+		apiHandler.UploadProfilePictureHandler(c)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Deleting the picture removes it", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Request, _ = http.NewRequest(http.MethodDelete, "/profile/picture", nil)
+
+		apiHandler.DeleteProfilePictureHandler(c)
+		if status := c.Writer.Status(); status != http.StatusNoContent {
+			t.Fatalf("expected status %d; got %d", http.StatusNoContent, status)
+		}
+		if userStore.users[user.ID].ProfilePictureURL != "" {
+			t.Errorf("expected no profile picture URL; got %s", userStore.users[user.ID].ProfilePictureURL)
+		}
+		if blobs := storedBlobsForTest(t, dir); len(blobs) != 0 {
+			t.Errorf("expected every blob to be deleted; got %v", blobs)
+		}
+	})
+}
+
+func TestProfilePictureDeletedWithAccount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	dir := t.TempDir()
+	apiHandler.Blobs = blobstore.NewFileSystem(dir, "https://cdn.example.com/")
+	kept, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "kept@example.com", Password: "password123"})
+	if w := uploadProfilePictureForTest(apiHandler, kept.ID, pngForTest(600, 400)); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	t.Run("Deleting the account right away", func(t *testing.T) {
+		apiHandler.DeletionGracePeriod = 0
+		user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "deleted@example.com", Password: "password123"})
+		if w := uploadProfilePictureForTest(apiHandler, user.ID, pngForTest(600, 400)); w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Request, _ = http.NewRequest(http.MethodDelete, "/account", nil)
+		apiHandler.DeleteUserHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if blobs := storedBlobsForTest(t, dir); len(blobs) != len(picture.Sizes) {
+			t.Errorf("expected only the other user's %d blobs to be left; got %v", len(picture.Sizes), blobs)
+		}
+	})
+
+	t.Run("Purging the account after the grace period", func(t *testing.T) {
+		user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "purged@example.com", Password: "password123"})
+		if w := uploadProfilePictureForTest(apiHandler, user.ID, pngForTest(600, 400)); w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		userStore.ScheduleUserDeletion(context.Background(), user.ID, time.Now().Add(-time.Minute))
+
+		if purged, err := apiHandler.PurgeScheduledDeletions(context.Background()); err != nil || purged != 1 {
+			t.Fatalf("expected 1 account to be purged; got %d, %v", purged, err)
+		}
+		if blobs := storedBlobsForTest(t, dir); len(blobs) != len(picture.Sizes) {
+			t.Errorf("expected only the other user's %d blobs to be left; got %v", len(picture.Sizes), blobs)
+		}
+	})
+}
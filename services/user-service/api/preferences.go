@@ -0,0 +1,85 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/free-education/user-service/preferences"
+	"github.com/gin-gonic/gin"
+)
+
+// preferencesUpdateAttempts is how often an update of the preferences is retried
+// when they change concurrently.
+const preferencesUpdateAttempts = 3
+
+// GetPreferencesSchemaHandler returns the JSON Schema user preferences must match.
+func (a *API) GetPreferencesSchemaHandler(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=3600")
+	c.Data(http.StatusOK, "application/schema+json", preferences.Schema)
+}
+
+// GetUserPreferencesHandler retrieves the preferences for the currently authenticated user,
+// with the defaults filled in. The user ID is injected by authz.Authenticate.
+func (a *API) GetUserPreferencesHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error fetching preferences for user %d: %v", userID, err)
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, preferences.Resolve(user.Preferences))
+}
+
+// UpdateUserPreferencesHandler applies a JSON Merge Patch (RFC 7396) to the preferences
+// of the currently authenticated user and returns the updated preferences. Setting
+// a preference to null restores its default. The result must match the schema
+// served by GetPreferencesSchemaHandler. The user ID is injected by authz.Authenticate.
+func (a *API) UpdateUserPreferencesHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	var patch map[string]interface{}
+	if err := json.NewDecoder(c.Request.Body).Decode(&patch); err != nil || patch == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The request body must be a JSON object."})
+		return
+	}
+
+	ctx := c.Request.Context()
+	for attempt := 0; attempt < preferencesUpdateAttempts; attempt++ {
+		user, err := a.UserStore.GetUserByID(ctx, userID)
+		if err != nil {
+			log.Printf("Error fetching preferences for user %d: %v", userID, err)
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+
+		updated, err := preferences.Apply(user.Preferences, patch)
+		var validationErr *preferences.ValidationError
+		if errors.As(err, &validationErr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid preferences.", "problems": validationErr.Problems})
+			return
+		}
+		if err != nil {
+			log.Printf("Error applying preferences of user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update preferences"})
+			return
+		}
+
+		replaced, err := a.UserStore.ReplaceUserPreferences(ctx, userID, user.Preferences, updated)
+		if err != nil {
+			log.Printf("Error updating preferences for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update preferences"})
+			return
+		}
+		if replaced {
+			c.JSON(http.StatusOK, preferences.Resolve(updated))
+			return
+		}
+	}
+
+	c.JSON(http.StatusConflict, gin.H{"error": "The preferences were changed at the same time. Please try again."})
+}
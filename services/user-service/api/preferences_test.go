@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/preferences"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// patchPreferencesForTest sends a JSON Merge Patch of the given user's preferences.
+func patchPreferencesForTest(apiHandler *API, userID int64, patch string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Request, _ = http.NewRequest(http.MethodPatch, "/preferences", bytes.NewBufferString(patch))
+	c.Request.Header.Set("Content-Type", "application/merge-patch+json")
+
+	apiHandler.UpdateUserPreferencesHandler(c)
+	return w
+}
+
+// racingPreferencesStore changes a user's preferences right before the first
+// `races` updates of them, as a concurrent request would.
+type racingPreferencesStore struct {
+	*MockUserStore
+	races int
+}
+
+func (s *racingPreferencesStore) ReplaceUserPreferences(ctx context.Context, userID int64, previous, prefs map[string]interface{}) (bool, error) {
+	if s.races > 0 {
+		s.races--
+		s.users[userID].Preferences = map[string]interface{}{"version": 1, "theme": "dark", "playback_speed": 0.5 + 0.25*float64(s.races)}
+	}
+	return s.MockUserStore.ReplaceUserPreferences(ctx, userID, previous, prefs)
+}
+
+func TestUserPreferences(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "prefs@example.com", Password: "password123"})
+	// Preferences as clients could store them before there was a schema.
+	user.Preferences = map[string]interface{}{"theme": "dark", "favourite_color": "green"}
+
+	t.Run("Preferences are returned with defaults", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Request, _ = http.NewRequest(http.MethodGet, "/preferences", nil)
+
+		apiHandler.GetUserPreferencesHandler(c)
+		var prefs preferences.Preferences
+		json.Unmarshal(w.Body.Bytes(), &prefs)
+		if w.Code != http.StatusOK || prefs.Theme != "dark" || prefs.Timezone != "UTC" || prefs.Version != preferences.Version {
+			t.Errorf("unexpected response %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("A merge patch updates and removes preferences", func(t *testing.T) {
+		w := patchPreferencesForTest(apiHandler, user.ID, `{"theme": null, "timezone": "Asia/Kolkata", "notifications": {"email": {"content_approved": false}}}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		var prefs preferences.Preferences
+		json.Unmarshal(w.Body.Bytes(), &prefs)
+		if prefs.Theme != "light" || prefs.Timezone != "Asia/Kolkata" || prefs.Notifications.Email["content_approved"] {
+			t.Errorf("unexpected preferences %+v", prefs)
+		}
+
+		stored := userStore.users[user.ID].Preferences
+		if _, ok := stored["theme"]; ok {
+			t.Error("expected the removed theme not to be stored")
+		}
+		if _, ok := stored["favourite_color"]; ok {
+			t.Error("expected keys outside the schema to be dropped")
+		}
+	})
+
+	t.Run("Invalid preferences are rejected", func(t *testing.T) {
+		before := userStore.users[user.ID].Preferences
+		w := patchPreferencesForTest(apiHandler, user.ID, `{"theme": "neon", "junk": 1}`)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+		var body struct {
+			Problems []string `json:"problems"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		if len(body.Problems) != 2 {
+			t.Errorf("expected two problems; got %v", body.Problems)
+		}
+		if userStore.users[user.ID].Preferences["timezone"] != before["timezone"] {
+			t.Error("expected the preferences to be unchanged")
+		}
+	})
+
+	t.Run("Bodies that are not JSON objects are rejected", func(t *testing.T) {
+		for _, body := range []string{`["theme"]`, `null`, `not json`} {
+			if w := patchPreferencesForTest(apiHandler, user.ID, body); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d; got %d", body, http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
+	t.Run("Concurrent changes are not lost", func(t *testing.T) {
+		racing := &racingPreferencesStore{MockUserStore: userStore, races: 1}
+		racingAPI := NewAPI(racing, &MockMessageBroker{}, "", "", "", nil)
+
+		w := patchPreferencesForTest(racingAPI, user.ID, `{"language": "hi"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		stored := userStore.users[user.ID].Preferences
+		if stored["theme"] != "dark" || stored["language"] != "hi" {
+			t.Errorf("expected both changes to be kept; got %v", stored)
+		}
+
+		racing.races = preferencesUpdateAttempts
+		if w := patchPreferencesForTest(racingAPI, user.ID, `{"language": "en"}`); w.Code != http.StatusConflict {
+			t.Errorf("expected status %d when the preferences keep changing; got %d", http.StatusConflict, w.Code)
+		}
+	})
+
+	t.Run("The schema is public", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request, _ = http.NewRequest(http.MethodGet, "/preferences/schema", nil)
+
+		apiHandler.GetPreferencesSchemaHandler(c)
+		var schema map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil || schema["$schema"] == nil {
+			t.Errorf("expected a JSON Schema; got %s", w.Body.String())
+		}
+		if w.Header().Get("Content-Type") != "application/schema+json" {
+			t.Errorf("unexpected content type %s", w.Header().Get("Content-Type"))
+		}
+	})
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/oauth"
+	"github.com/free-education/user-service/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+)
+
+// ReauthRequest represents the payload for re-authenticating before a sensitive action.
+// Exactly one of the current password, a current TOTP code or the code from a
+// fresh login at a linked provider (see StartOAuthReauthHandler) must be provided.
+type ReauthRequest struct {
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	Code     string `json:"code"`
+}
+
+// ReauthHandler confirms that the person holding the session still knows the
+// account's password, has its 2FA device or can sign in at a linked provider, and
+// returns a short-lived reauth token. Accounts with a passkey can also use
+// FinishWebAuthnReauthHandler. Endpoints guarded by RequireRecentAuth expect the
+// token in the X-Reauth-Token header.
+func (a *API) ReauthHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	var req ReauthRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	if req.Password == "" && req.Token == "" && req.Code == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: a password, token or code is required"})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if !a.checkLoginThrottle(c, userID) {
+		return
+	}
+
+	verified := false
+	if req.Password != "" && user.PasswordHash != "" {
+		verified = storage.CheckPassword(user.PasswordHash, req.Password)
+	} else if req.Token != "" {
+		secret, enabled, err := a.UserStore.Get2FAData(c.Request.Context(), userID)
+		if err != nil {
+			log.Printf("Error getting 2FA data for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify credentials."})
+			return
+		}
+		verified = enabled && secret != "" && totp.Validate(req.Token, secret)
+	} else if req.Code != "" {
+		codeUserID, ok := a.consumeLoginCode(c, req.Code)
+		verified = ok && codeUserID == userID
+	}
+	if !verified {
+		a.recordLoginFailure(c, userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+
+	a.issueReauthToken(c, userID)
+}
+
+// issueReauthToken responds with a new reauth token for the user.
+func (a *API) issueReauthToken(c *gin.Context, userID int64) {
+	reauthToken, err := auth.GenerateReauthToken(userID)
+	if err != nil {
+		log.Printf("Error generating reauth token for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"reauth_token": reauthToken,
+		"expires_in":   int64(auth.ReauthTokenTTL.Seconds()),
+	})
+}
+
+// StartOAuthReauthHandler starts a fresh login at the provider named in the URL,
+// for users who sign in with it rather than with a password. It returns the
+// provider URL the client should navigate to. If the user signs in there with an
+// identity linked to their account, the login callback sends the browser to the
+// settings page with a code, which ReauthHandler trades for a reauth token.
+func (a *API) StartOAuthReauthHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	providerName := c.Param("provider")
+	provider, ok := a.Providers.Get(providerName)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown login provider"})
+		return
+	}
+
+	authURL, err := a.startOAuthFlow(c, providerName, provider, userID, true)
+	if err != nil {
+		log.Printf("Error starting %s reauthentication for user %d: %v", providerName, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start reauthentication."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"authorization_url": authURL})
+}
+
+// reauthFromCallback completes a reauthentication started with
+// StartOAuthReauthHandler. The identity the user signed in with must be linked to
+// their account; signing in as someone else at the provider proves nothing.
+func (a *API) reauthFromCallback(c *gin.Context, userID int64, providerName string, identity *oauth.Identity, oauthState string) {
+	user, err := a.UserStore.GetUserByOAuthID(c.Request.Context(), providerName, identity.Subject)
+	if err != nil || user.ID != userID {
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/settings?error=reauth_failed", a.FrontendBaseURL))
+		return
+	}
+
+	code, err := a.createLoginCode(c.Request.Context(), userID, oauthState)
+	if err != nil {
+		log.Printf("Error storing reauth code for user %d: %v", userID, err)
+		c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/settings?error=reauth_failed", a.FrontendBaseURL))
+		return
+	}
+
+	c.Redirect(http.StatusTemporaryRedirect, fmt.Sprintf("%s/settings?reauth_code=%s", a.FrontendBaseURL, code))
+}
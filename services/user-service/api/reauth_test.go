@@ -0,0 +1,225 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/oauth/oauthtest"
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/net/context"
+)
+
+func reauthForTest(apiHandler *API, userID int64, body map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	jsonBody, _ := json.Marshal(body)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/reauth", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.ReauthHandler(c)
+	return w
+}
+
+func TestReauthHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+
+	t.Run("Correct password", func(t *testing.T) {
+		w := reauthForTest(apiHandler, user.ID, map[string]string{"password": "password"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		var resp struct {
+			ReauthToken string `json:"reauth_token"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		claims, err := auth.ValidateToken(resp.ReauthToken)
+		if err != nil {
+			t.Fatalf("expected a valid reauth token: %v", err)
+		}
+		if claims.Type != "reauth" || claims.UserID != user.ID {
+			t.Errorf("unexpected claims: type=%q user=%d", claims.Type, claims.UserID)
+		}
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		w := reauthForTest(apiHandler, user.ID, map[string]string{"password": "wrong"})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("TOTP code without 2FA enabled", func(t *testing.T) {
+		w := reauthForTest(apiHandler, user.ID, map[string]string{"token": "123456"})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Correct TOTP code", func(t *testing.T) {
+		enable2FAForTest(t, apiHandler, userStore, user.ID)
+		secret, _, _ := userStore.Get2FAData(context.Background(), user.ID)
+		code, _ := totp.GenerateCode(secret, time.Now())
+
+		w := reauthForTest(apiHandler, user.ID, map[string]string{"token": code})
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("Missing credentials", func(t *testing.T) {
+		w := reauthForTest(apiHandler, user.ID, map[string]string{})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
+
+// startOAuthReauthForTest starts a reauthentication at the stub issuer, lets it sign
+// the user in and returns the callback's response.
+func startOAuthReauthForTest(t *testing.T, apiHandler *API, userID int64) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Params = gin.Params{{Key: "provider", Value: "test"}}
+	c.Request, _ = http.NewRequest(http.MethodPost, "/reauth/test", nil)
+	apiHandler.StartOAuthReauthHandler(c)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	var resp map[string]string
+	json.Unmarshal(w.Body.Bytes(), &resp)
+
+	stateCookie := stateCookieForTest(w)
+	query := signInAtProviderForTest(t, resp["authorization_url"])
+	return oauthCallbackForTest(apiHandler, "test", query, stateCookie), stateCookie
+}
+
+func TestReauthWithProvider(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	server := oauthtest.NewServer(oauthtest.User{Subject: "subject-1", Email: "oauth@example.com", EmailVerified: true})
+	defer server.Close()
+
+	// An account without a password cannot reauthenticate with one.
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateOAuthUser(context.Background(), &model.User{Email: "oauth@example.com", OAuthProvider: "test", OAuthProviderID: "subject-1"})
+	apiHandler := newOAuthTestAPI(t, server, userStore, &MockMessageBroker{})
+
+	callback, stateCookie := startOAuthReauthForTest(t, apiHandler, user.ID)
+	location, _ := url.Parse(callback.Header().Get("Location"))
+	if !strings.HasPrefix(location.String(), "https://example.com/settings?reauth_code=") {
+		t.Fatalf("expected a redirect to the settings page with a code; got %q", location)
+	}
+	code := location.Query().Get("reauth_code")
+
+	reauth := func(userID int64) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", userID)
+		jsonBody, _ := json.Marshal(map[string]string{"code": code})
+		c.Request, _ = http.NewRequest(http.MethodPost, "/reauth", bytes.NewBuffer(jsonBody))
+		c.Request.Header.Set("Content-Type", "application/json")
+		c.Request.AddCookie(&http.Cookie{Name: "oauthstate", Value: stateCookie})
+		apiHandler.ReauthHandler(c)
+		return w
+	}
+
+	w := reauth(user.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp struct {
+		ReauthToken string `json:"reauth_token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if claims, err := auth.ValidateToken(resp.ReauthToken); err != nil || claims.Type != "reauth" || claims.UserID != user.ID {
+		t.Errorf("expected a reauth token for the user; got %s", w.Body.String())
+	}
+
+	t.Run("Code reused", func(t *testing.T) {
+		if w := reauth(user.ID); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Signed in as someone else at the provider", func(t *testing.T) {
+		server.SetUser(oauthtest.User{Subject: "subject-2", Email: "someone-else@example.com", EmailVerified: true})
+		defer server.SetUser(oauthtest.User{Subject: "subject-1", Email: "oauth@example.com", EmailVerified: true})
+
+		callback, _ := startOAuthReauthForTest(t, apiHandler, user.ID)
+		if location := callback.Header().Get("Location"); location != "https://example.com/settings?error=reauth_failed" {
+			t.Errorf("expected the reauthentication to fail; got %q", location)
+		}
+	})
+
+	t.Run("Code issued to another user", func(t *testing.T) {
+		other, _ := userStore.CreateOAuthUser(context.Background(), &model.User{Email: "other@example.com", OAuthProvider: "other", OAuthProviderID: "subject-3"})
+		callback, cookie := startOAuthReauthForTest(t, apiHandler, user.ID)
+		location, _ := url.Parse(callback.Header().Get("Location"))
+		code, stateCookie = location.Query().Get("reauth_code"), cookie
+		if w := reauth(other.ID); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+}
+
+func TestRequireRecentAuth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	const userID int64 = 1
+	reauthToken, _ := auth.GenerateReauthToken(userID)
+	accessToken, _ := auth.GenerateToken(userID, "user", 0)
+
+	tests := []struct {
+		name         string
+		userID       int64
+		header       string
+		expectedCode int
+	}{
+		{"Valid reauth token", userID, reauthToken, http.StatusOK},
+		{"Missing header", userID, "", http.StatusForbidden},
+		{"Access token instead of reauth token", userID, accessToken, http.StatusForbidden},
+		{"Token issued to another user", userID + 1, reauthToken, http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			_, router := gin.CreateTestContext(w)
+			router.DELETE("/account", func(c *gin.Context) {
+				c.Set("userID", tc.userID)
+				c.Next()
+			}, RequireRecentAuth(), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req, _ := http.NewRequest(http.MethodDelete, "/account", nil)
+			if tc.header != "" {
+				req.Header.Set("X-Reauth-Token", tc.header)
+			}
+			router.ServeHTTP(w, req)
+
+			if w.Code != tc.expectedCode {
+				t.Errorf("expected status %d; got %d", tc.expectedCode, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/storage"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v4"
+)
+
+// issueSession starts a new server-side session for the user and returns the
+// access/refresh token pair for it. Every login path goes through here so that
+// each device shows up in the session list and can be revoked individually.
+func (a *API) issueSession(c *gin.Context, user *model.User) (*model.LoginResponse, error) {
+	refreshToken, err := auth.GenerateSecureToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := a.UserStore.CreateSession(c.Request.Context(), &model.Session{
+		UserID:    user.ID,
+		UserAgent: c.Request.UserAgent(),
+		IPAddress: c.ClientIP(),
+		ExpiresAt: time.Now().Add(auth.RefreshTokenTTL),
+	}, auth.HashToken(refreshToken))
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := auth.GenerateToken(user.ID, user.Role, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &model.LoginResponse{
+		Token:        token,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+	}, nil
+}
+
+// RefreshTokenHandler exchanges a refresh token for a new access token.
+// The refresh token is rotated on every call: the one presented becomes invalid
+// and a new one is returned alongside the access token.
+func (a *API) RefreshTokenHandler(c *gin.Context) {
+	var req model.RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	newRefreshToken, err := auth.GenerateSecureToken(32)
+	if err != nil {
+		log.Printf("Error generating refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token."})
+		return
+	}
+
+	session, err := a.UserStore.RotateSessionRefreshToken(c.Request.Context(), auth.HashToken(req.RefreshToken), auth.HashToken(newRefreshToken), time.Now().Add(auth.RefreshTokenTTL))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token."})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), session.UserID)
+	if err != nil || user.DeactivatedAt != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired refresh token."})
+		return
+	}
+
+	token, err := auth.GenerateToken(user.ID, user.Role, session.ID)
+	if err != nil {
+		log.Printf("Error generating JWT for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token."})
+		return
+	}
+
+	c.JSON(http.StatusOK, model.LoginResponse{
+		Token:        token,
+		RefreshToken: newRefreshToken,
+		ExpiresIn:    int64(auth.AccessTokenTTL.Seconds()),
+	})
+}
+
+// ListSessionsHandler lists the active sessions of the currently authenticated user.
+// The session the request was made with, if known, is flagged as current.
+func (a *API) ListSessionsHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	sessions, err := a.UserStore.GetActiveSessionsForUser(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing sessions for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve sessions."})
+		return
+	}
+
+	currentSessionID := c.GetInt64("sessionID")
+	for _, session := range sessions {
+		session.Current = currentSessionID != 0 && session.ID == currentSessionID
+	}
+	if sessions == nil {
+		sessions = []*model.Session{}
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+// RevokeSessionHandler revokes one of the currently authenticated user's sessions.
+// The session's refresh token stops working immediately; access tokens already
+// issued for it expire on their own within auth.AccessTokenTTL.
+func (a *API) RevokeSessionHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	sessionID, err := strconv.ParseInt(c.Param("sessionId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	if err := a.UserStore.RevokeSession(c.Request.Context(), userID, sessionID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+			return
+		}
+		log.Printf("Error revoking session %d for user %d: %v", sessionID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session."})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// revokeUserSessions ends everything a user is signed in with after a security event:
+// all access tokens issued so far are rejected by auth.ValidateToken and every
+// session's refresh token stops working. Other services are told through a
+// `user_sessions_revoked` event so they can drop any cached credentials.
+func (a *API) revokeUserSessions(ctx context.Context, userID int64, reason string) error {
+	revokedAt, err := auth.RevokeUserTokens(ctx, userID)
+	if err != nil {
+		return err
+	}
+	err = a.UserStore.InTx(ctx, func(store storage.UserStore) error {
+		return revokeSessions(ctx, store, userID, reason, revokedAt)
+	})
+	if err != nil {
+		return err
+	}
+	a.relayOutboxNow(ctx)
+	return nil
+}
+
+// revokeSessions revokes every session of a user whose tokens were revoked at
+// revokedAt, and enqueues the `user_sessions_revoked` event in the same store, so
+// callers can make it part of a larger transaction.
+func revokeSessions(ctx context.Context, store storage.UserStore, userID int64, reason string, revokedAt time.Time) error {
+	if err := store.RevokeAllSessionsForUser(ctx, userID); err != nil {
+		return err
+	}
+	payload := &events.UserSessionsRevoked{
+		UserID:    userID,
+		Reason:    reason,
+		RevokedAt: revokedAt,
+	}
+	return enqueueEvent(ctx, store, "user_events", payload)
+}
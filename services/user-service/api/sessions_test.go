@@ -0,0 +1,177 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// loginForTest logs the given user in through LoginUserHandler and returns the token pair.
+func loginForTest(t *testing.T, apiHandler *API, email, password string) model.LoginResponse {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	body := map[string]string{"email": email, "password": password}
+	jsonBody, _ := json.Marshal(body)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.LoginUserHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("login: expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	var resp model.LoginResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode login response: %v", err)
+	}
+	return resp
+}
+
+func refreshForTest(apiHandler *API, refreshToken string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	body := map[string]string{"refresh_token": refreshToken}
+	jsonBody, _ := json.Marshal(body)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/token/refresh", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.RefreshTokenHandler(c)
+	return w
+}
+
+func TestRefreshTokenHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+
+	login := loginForTest(t, apiHandler, "test@example.com", "password")
+	if login.RefreshToken == "" {
+		t.Fatal("expected a refresh token in the login response")
+	}
+	claims, err := auth.ValidateToken(login.Token)
+	if err != nil {
+		t.Fatalf("login returned an invalid access token: %v", err)
+	}
+	if claims.SessionID == 0 {
+		t.Error("expected the access token to carry a session ID")
+	}
+
+	t.Run("Refresh rotates the token", func(t *testing.T) {
+		w := refreshForTest(apiHandler, login.RefreshToken)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		var refreshed model.LoginResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &refreshed); err != nil {
+			t.Fatalf("Failed to decode response body: %v", err)
+		}
+		if refreshed.RefreshToken == "" || refreshed.RefreshToken == login.RefreshToken {
+			t.Error("expected a new refresh token")
+		}
+		newClaims, err := auth.ValidateToken(refreshed.Token)
+		if err != nil {
+			t.Fatalf("refresh returned an invalid access token: %v", err)
+		}
+		if newClaims.SessionID != claims.SessionID {
+			t.Errorf("expected session %d to be kept; got %d", claims.SessionID, newClaims.SessionID)
+		}
+
+		// The old refresh token must not be usable a second time.
+		if w := refreshForTest(apiHandler, login.RefreshToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d for reused token; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Unknown refresh token", func(t *testing.T) {
+		if w := refreshForTest(apiHandler, "not-a-real-token"); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+}
+
+func TestSessionHandlers(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+
+	first := loginForTest(t, apiHandler, "test@example.com", "password")
+	second := loginForTest(t, apiHandler, "test@example.com", "password")
+	firstClaims, _ := auth.ValidateToken(first.Token)
+
+	t.Run("List sessions", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Set("sessionID", firstClaims.SessionID)
+		c.Request, _ = http.NewRequest(http.MethodGet, "/sessions", nil)
+
+		apiHandler.ListSessionsHandler(c)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		var sessions []model.Session
+		if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+			t.Fatalf("Failed to decode response body: %v", err)
+		}
+		if len(sessions) != 2 {
+			t.Fatalf("expected 2 sessions; got %d", len(sessions))
+		}
+		for _, s := range sessions {
+			if s.Current != (s.ID == firstClaims.SessionID) {
+				t.Errorf("session %d: expected current=%v", s.ID, !s.Current)
+			}
+		}
+	})
+
+	t.Run("Revoke another user's session", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID+100)
+		c.Params = gin.Params{gin.Param{Key: "sessionId", Value: "2"}}
+		c.Request, _ = http.NewRequest(http.MethodDelete, "/sessions/2", nil)
+
+		apiHandler.RevokeSessionHandler(c)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected status %d; got %d", http.StatusNotFound, w.Code)
+		}
+	})
+
+	t.Run("Revoke session", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Params = gin.Params{gin.Param{Key: "sessionId", Value: "2"}}
+		c.Request, _ = http.NewRequest(http.MethodDelete, "/sessions/2", nil)
+
+		apiHandler.RevokeSessionHandler(c)
+
+		if c.Writer.Status() != http.StatusNoContent {
+			t.Fatalf("expected status %d; got %d", http.StatusNoContent, c.Writer.Status())
+		}
+		if w := refreshForTest(apiHandler, first.RefreshToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected revoked session's refresh token to be rejected; got %d", w.Code)
+		}
+		if w := refreshForTest(apiHandler, second.RefreshToken); w.Code != http.StatusOK {
+			t.Errorf("expected other session to keep working; got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package api
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultTrustedProxies are the networks whose X-Forwarded-For header is believed
+// when working out the client IP the login throttle counts against: the private
+// networks the API gateway runs in. Requests from anywhere else are counted
+// against their own address, whatever header they send.
+var DefaultTrustedProxies = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "127.0.0.0/8", "::1/128", "fc00::/7"}
+
+// checkLoginThrottle rejects the request with 429 Too Many Requests if the client IP
+// or the account (when userID is not zero) has to wait before trying again.
+// It returns false if the request was rejected. If the attempt counters cannot be
+// read, the login is allowed through rather than locking everybody out.
+func (a *API) checkLoginThrottle(c *gin.Context, userID int64) bool {
+	wait, err := a.LoginThrottle.RetryAfter(c.Request.Context(), userID, c.ClientIP())
+	if err != nil {
+		log.Printf("Error checking login throttle for user %d: %v", userID, err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int64(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many failed login attempts. Please try again later.",
+		"retry_after": seconds,
+	})
+	return false
+}
+
+// recordLoginFailure counts a failed password or 2FA attempt against the client IP
+// and, when userID is not zero, the account. If this failure locks the account,
+// the lockout is recorded as a user activity and the user is notified.
+func (a *API) recordLoginFailure(c *gin.Context, userID int64) {
+	ctx := c.Request.Context()
+
+	lockedUntil, err := a.LoginThrottle.RecordFailure(ctx, userID, c.ClientIP())
+	if err != nil {
+		log.Printf("Error recording failed login for user %d: %v", userID, err)
+		return
+	}
+	if lockedUntil.IsZero() {
+		return
+	}
+
+	activity := &model.UserActivity{
+		UserID:       userID,
+		ActivityType: "account_locked",
+		Metadata: map[string]interface{}{
+			"ip_address":   c.ClientIP(),
+			"locked_until": lockedUntil.UTC().Format(time.RFC3339),
+		},
+	}
+	if err := a.UserStore.CreateUserActivity(ctx, activity); err != nil {
+		log.Printf("Error recording account lockout for user %d: %v", userID, err)
+	}
+
+	user, err := a.UserStore.GetUserByID(ctx, userID)
+	if err != nil {
+		log.Printf("Error getting user %d for lockout notification: %v", userID, err)
+		return
+	}
+	payload := &events.AccountLocked{
+		Email:       user.Email,
+		Name:        user.FirstName,
+		LockedUntil: lockedUntil.UTC().Truncate(time.Second),
+	}
+	if err := a.MessageBroker.Publish(ctx, "notifications_events", payload); err != nil {
+		log.Printf("Error publishing account_locked event for user %d: %v", userID, err)
+	}
+}
+
+// recordLoginSuccess resets the account's failed-attempt count after a successful login.
+func (a *API) recordLoginSuccess(c *gin.Context, userID int64) {
+	if err := a.LoginThrottle.RecordSuccess(c.Request.Context(), userID); err != nil {
+		log.Printf("Error clearing failed logins for user %d: %v", userID, err)
+	}
+}
+
+// checkEmailThrottle rejects the request with 429 Too Many Requests if the client IP
+// has requested too many emails. It returns false if the request was rejected. If
+// the counters cannot be read, the request is allowed through.
+func (a *API) checkEmailThrottle(c *gin.Context) bool {
+	wait, err := a.EmailThrottle.RetryAfter(c.Request.Context(), 0, c.ClientIP())
+	if err != nil {
+		log.Printf("Error checking email throttle for %s: %v", c.ClientIP(), err)
+		return true
+	}
+	if wait <= 0 {
+		return true
+	}
+
+	seconds := int64(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.FormatInt(seconds, 10))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many requests. Please try again later.",
+		"retry_after": seconds,
+	})
+	return false
+}
+
+// emailCooledDown reports whether the account may be sent another email on request.
+// The caller must not tell the client when it may not, so that the response does
+// not reveal whether the account exists.
+func (a *API) emailCooledDown(c *gin.Context, userID int64) bool {
+	wait, err := a.EmailThrottle.RetryAfter(c.Request.Context(), userID, c.ClientIP())
+	if err != nil {
+		log.Printf("Error checking email throttle for user %d: %v", userID, err)
+		return true
+	}
+	return wait <= 0
+}
+
+// recordEmailRequest counts a request for an email against the client IP and, when
+// userID is not zero, the account it was sent to.
+func (a *API) recordEmailRequest(c *gin.Context, userID int64) {
+	if _, err := a.EmailThrottle.RecordFailure(c.Request.Context(), userID, c.ClientIP()); err != nil {
+		log.Printf("Error recording email request for user %d: %v", userID, err)
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+func loginAttemptForTest(apiHandler *API, email, password string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	jsonBody, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	c.Request, _ = http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.LoginUserHandler(c)
+	return w
+}
+
+func TestLoginLockout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password", FirstName: "Test"})
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "", "", "", nil)
+	apiHandler.LoginThrottle = auth.NewLoginThrottle(auth.NewMemoryAttemptStore(), auth.ThrottlePolicy{
+		FreeAttempts:    10,
+		LockoutAfter:    3,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	}, auth.DefaultIPPolicy)
+
+	for i := 0; i < 3; i++ {
+		if w := loginAttemptForTest(apiHandler, "test@example.com", "wrong"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected status %d; got %d", i+1, http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	// Even the correct password is refused while the account is locked.
+	w := loginAttemptForTest(apiHandler, "test@example.com", "password")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d; got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	activities, _ := userStore.GetUserActivities(context.Background(), user.ID)
+	if len(activities) != 1 || activities[0].ActivityType != "account_locked" {
+		t.Errorf("expected an account_locked activity; got %v", activities)
+	}
+	notifications := mockMessageBroker.EventsOfType("account_locked")
+	if len(notifications) != 1 || notifications[0].QueueName != "notifications_events" {
+		t.Fatalf("expected one account_locked notification; got %v", notifications)
+	}
+	if payload := notifications[0].Payload.(*events.AccountLocked); payload.Email != "test@example.com" {
+		t.Errorf("expected the notification to go to the user; got %v", payload.Email)
+	}
+}
+
+func TestLogin2FALockout(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password", FirstName: "Test"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	apiHandler.LoginThrottle = auth.NewLoginThrottle(auth.NewMemoryAttemptStore(), auth.ThrottlePolicy{
+		FreeAttempts:    10,
+		LockoutAfter:    3,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	}, auth.DefaultIPPolicy)
+	enable2FAForTest(t, apiHandler, userStore, user.ID)
+	tempToken := tempTokenForTest(t, apiHandler, "test@example.com", "password")
+
+	for i := 0; i < 3; i++ {
+		if w := login2FAForTest(apiHandler, map[string]string{"temp_token": tempToken, "token": "000000"}); w.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected status %d; got %d", i+1, http.StatusUnauthorized, w.Code)
+		}
+	}
+
+	if w := login2FAForTest(apiHandler, map[string]string{"temp_token": tempToken, "token": "000000"}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d; got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestLoginThrottleIgnoresSpoofedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	apiHandler.LoginThrottle = auth.NewLoginThrottle(auth.NewMemoryAttemptStore(), auth.DefaultAccountPolicy, auth.ThrottlePolicy{
+		FreeAttempts:    10,
+		LockoutAfter:    3,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	})
+	router := gin.New()
+	router.SetTrustedProxies(DefaultTrustedProxies)
+	router.POST("/login", apiHandler.LoginUserHandler)
+
+	login := func(remoteAddr, forwardedFor string) int {
+		w := httptest.NewRecorder()
+		jsonBody, _ := json.Marshal(map[string]string{"email": "nobody@example.com", "password": "wrong"})
+		req, _ := http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(jsonBody))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		req.RemoteAddr = remoteAddr
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// A client talking to the service directly cannot pose as someone new every time.
+	for i, spoofed := range []string{"198.51.100.1", "198.51.100.2", "198.51.100.3"} {
+		if code := login("203.0.113.7:40000", spoofed); code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected status %d; got %d", i+1, http.StatusUnauthorized, code)
+		}
+	}
+	if code := login("203.0.113.7:40000", "198.51.100.4"); code != http.StatusTooManyRequests {
+		t.Errorf("expected the client IP to be locked out; got status %d", code)
+	}
+
+	t.Run("Through the gateway", func(t *testing.T) {
+		// The gateway's header is believed, so other clients behind it are not locked out.
+		if code := login("10.0.0.2:50000", "198.51.100.5"); code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, code)
+		}
+		if code := login("10.0.0.2:50000", "203.0.113.7"); code != http.StatusTooManyRequests {
+			t.Errorf("expected the locked-out client to stay locked out behind the gateway; got status %d", code)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// enable2FAForTest turns on 2FA for the user and returns the issued recovery codes.
+func enable2FAForTest(t *testing.T, apiHandler *API, userStore *MockUserStore, userID int64) []string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/2fa/enable", nil)
+
+	apiHandler.Enable2FAHandler(c)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("enable 2FA: expected status %d; got %d", http.StatusOK, w.Code)
+	}
+	var resp struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Failed to decode response body: %v", err)
+	}
+	userStore.Activate2FA(context.Background(), userID)
+	return resp.RecoveryCodes
+}
+
+// tempTokenForTest runs the first login step for a 2FA user and returns the temporary token.
+func tempTokenForTest(t *testing.T, apiHandler *API, email, password string) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	jsonBody, _ := json.Marshal(map[string]string{"email": email, "password": password})
+	c.Request, _ = http.NewRequest(http.MethodPost, "/login", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.LoginUserHandler(c)
+
+	var resp struct {
+		TempToken string `json:"temp_token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.TempToken == "" {
+		t.Fatalf("expected a 2FA temp token; got status %d body %s", w.Code, w.Body.String())
+	}
+	return resp.TempToken
+}
+
+func login2FAForTest(apiHandler *API, body map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	jsonBody, _ := json.Marshal(body)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/login/2fa", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	apiHandler.Login2FAHandler(c)
+	return w
+}
+
+func TestLogin2FAWithRecoveryCode(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	codes := enable2FAForTest(t, apiHandler, userStore, user.ID)
+
+	for _, hash := range userStore.users[user.ID].TwoFactorRecoveryCodes {
+		for _, code := range codes {
+			if hash == code {
+				t.Fatal("expected recovery codes to be stored hashed")
+			}
+		}
+	}
+
+	t.Run("Recovery code logs in once", func(t *testing.T) {
+		tempToken := tempTokenForTest(t, apiHandler, "test@example.com", "password")
+		// Users often type codes back in lower case and with separators.
+		typed := strings.ToLower(codes[0][:4] + "-" + codes[0][4:])
+		w := login2FAForTest(apiHandler, map[string]string{"temp_token": tempToken, "recovery_code": typed})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+
+		tempToken = tempTokenForTest(t, apiHandler, "test@example.com", "password")
+		w = login2FAForTest(apiHandler, map[string]string{"temp_token": tempToken, "recovery_code": codes[0]})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected burned code to be rejected with %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Neither token nor recovery code", func(t *testing.T) {
+		tempToken := tempTokenForTest(t, apiHandler, "test@example.com", "password")
+		w := login2FAForTest(apiHandler, map[string]string{"temp_token": tempToken})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Remaining count and regeneration", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Request, _ = http.NewRequest(http.MethodGet, "/2fa/recovery-codes", nil)
+		apiHandler.GetRecoveryCodesStatusHandler(c)
+
+		var status struct {
+			Remaining int `json:"remaining"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &status)
+		if status.Remaining != len(codes)-1 {
+			t.Errorf("expected %d codes remaining; got %d", len(codes)-1, status.Remaining)
+		}
+
+		w = httptest.NewRecorder()
+		c, _ = gin.CreateTestContext(w)
+		c.Set("userID", user.ID)
+		c.Request, _ = http.NewRequest(http.MethodPost, "/2fa/recovery-codes", nil)
+		apiHandler.RegenerateRecoveryCodesHandler(c)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+
+		// Codes from the old set no longer work.
+		tempToken := tempTokenForTest(t, apiHandler, "test@example.com", "password")
+		w = login2FAForTest(apiHandler, map[string]string{"temp_token": tempToken, "recovery_code": codes[1]})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected old code to be rejected with %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+}
+
+func TestEnable2FAWhileEnabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+	codes := enable2FAForTest(t, apiHandler, userStore, user.ID)
+	secret := userStore.users[user.ID].TwoFactorSecret
+
+	// An access token alone must not be enough to replace the second factor.
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", user.ID)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/2fa/enable", nil)
+	apiHandler.Enable2FAHandler(c)
+
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected status %d; got %d", http.StatusConflict, w.Code)
+	}
+	if userStore.users[user.ID].TwoFactorSecret != secret {
+		t.Error("expected the TOTP secret to be kept")
+	}
+	if len(userStore.users[user.ID].TwoFactorRecoveryCodes) != len(codes) {
+		t.Error("expected the recovery codes to be kept")
+	}
+}
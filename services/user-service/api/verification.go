@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+)
+
+// EmailVerificationTokenTTL is how long a verification link stays valid.
+const EmailVerificationTokenTTL = 24 * time.Hour
+
+// UnverifiedLoginPolicy controls whether accounts that have not verified their
+// email address may log in with a password.
+type UnverifiedLoginPolicy struct {
+	// Block refuses password logins from unverified accounts.
+	Block bool
+	// GracePeriod lets unverified accounts keep logging in for this long after
+	// registering, even when Block is set.
+	GracePeriod time.Duration
+}
+
+// allowsLogin reports whether the user may log in under the policy.
+func (p UnverifiedLoginPolicy) allowsLogin(user *model.User) bool {
+	if user.EmailVerifiedAt != nil || !p.Block {
+		return true
+	}
+	return time.Since(user.CreatedAt) < p.GracePeriod
+}
+
+// sendVerificationEmail creates a verification token for the user and publishes
+// eventType, events.TypeUserRegistered or events.TypeEmailVerificationRequested,
+// to the notifications service with the link to follow.
+func (a *API) sendVerificationEmail(ctx context.Context, user *model.User, eventType string) error {
+	token, err := auth.GenerateSecureToken(32)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(EmailVerificationTokenTTL)
+	if err := a.UserStore.CreateEmailVerificationToken(ctx, user.ID, token, expiresAt); err != nil {
+		return err
+	}
+
+	verificationLink := fmt.Sprintf("%s/verify-email?token=%s", a.FrontendBaseURL, token)
+	email := events.VerificationEmail{
+		Email:            user.Email,
+		Name:             user.FirstName,
+		VerificationLink: verificationLink,
+	}
+	var payload events.Payload = &events.EmailVerificationRequested{VerificationEmail: email}
+	if eventType == events.TypeUserRegistered {
+		payload = &events.UserRegistered{VerificationEmail: email}
+	}
+	return a.MessageBroker.Publish(ctx, "notifications_events", payload)
+}
+
+// VerifyEmailHandler marks the user's email address as verified.
+// It expects the token from the verification link; all of the user's
+// outstanding verification tokens are invalidated on success.
+func (a *API) VerifyEmailHandler(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	userID, err := a.UserStore.VerifyEmailWithToken(c.Request.Context(), req.Token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token."})
+		return
+	}
+
+	activity := &model.UserActivity{UserID: userID, ActivityType: "email_verified"}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording email verification for user %d: %v", userID, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email address verified successfully."})
+}
+
+// ResendVerificationEmailHandler sends a new verification link to an unverified account.
+// To prevent user enumeration, it always returns a 200 OK response, unless the client
+// IP has requested too many emails. An account that was sent a link recently is not
+// sent another one until its cooldown has passed; the response does not say so.
+func (a *API) ResendVerificationEmailHandler(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required,email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	const message = "If an unverified account with that email exists, a verification link has been sent."
+
+	ctx := c.Request.Context()
+	if !a.checkEmailThrottle(c) {
+		return
+	}
+
+	user, err := a.UserStore.GetUserByEmail(ctx, req.Email)
+	if err != nil || user == nil || user.EmailVerifiedAt != nil || !a.emailCooledDown(c, user.ID) {
+		a.recordEmailRequest(c, 0)
+		c.JSON(http.StatusOK, gin.H{"message": message})
+		return
+	}
+
+	if err := a.sendVerificationEmail(ctx, user, events.TypeEmailVerificationRequested); err != nil {
+		log.Printf("Error resending verification email to user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process request."})
+		return
+	}
+	a.recordEmailRequest(c, user.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+func postJSONForTest(handler gin.HandlerFunc, path string, body interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	jsonBody, _ := json.Marshal(body)
+	c.Request, _ = http.NewRequest(http.MethodPost, path, bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	handler(c)
+	return w
+}
+
+// verificationTokenFromEvent extracts the token from the verification link of a published event.
+func verificationTokenFromEvent(t *testing.T, event PublishedEvent) string {
+	t.Helper()
+	var link *url.URL
+	var err error
+	switch payload := event.Payload.(type) {
+	case *events.UserRegistered:
+		link, err = url.Parse(payload.VerificationLink)
+	case *events.EmailVerificationRequested:
+		link, err = url.Parse(payload.VerificationLink)
+	default:
+		t.Fatalf("expected a verification email; got %s", event.EventType)
+	}
+	if err != nil {
+		t.Fatalf("invalid verification link: %v", err)
+	}
+	return link.Query().Get("token")
+}
+
+func TestEmailVerification(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "https://example.com", "", "", nil)
+
+	w := postJSONForTest(apiHandler.RegisterUserHandler, "/register", model.RegistrationRequest{
+		Email: "test@example.com", Password: "password123", FirstName: "Test", LastName: "User",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("register: expected status %d; got %d", http.StatusCreated, w.Code)
+	}
+
+	events := mockMessageBroker.EventsOfType("user_registered")
+	if len(events) != 1 || events[0].QueueName != "notifications_events" {
+		t.Fatalf("expected one user_registered notification; got %v", events)
+	}
+	token := verificationTokenFromEvent(t, events[0])
+
+	t.Run("Resend issues a new link", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.ResendVerificationEmailHandler, "/email/resend", map[string]string{"email": "test@example.com"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		if len(mockMessageBroker.EventsOfType("email_verification_requested")) != 1 {
+			t.Error("expected an email_verification_requested notification")
+		}
+	})
+
+	t.Run("Resend for unknown email", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.ResendVerificationEmailHandler, "/email/resend", map[string]string{"email": "nobody@example.com"})
+		if w.Code != http.StatusOK {
+			t.Errorf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+	})
+
+	t.Run("Verify", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.VerifyEmailHandler, "/email/verify", map[string]string{"token": token})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d; got %d", http.StatusOK, w.Code)
+		}
+		user, _ := userStore.GetUserByEmail(context.Background(), "test@example.com")
+		if user.EmailVerifiedAt == nil {
+			t.Error("expected the email to be marked as verified")
+		}
+	})
+
+	t.Run("Tokens are single-use", func(t *testing.T) {
+		w := postJSONForTest(apiHandler.VerifyEmailHandler, "/email/verify", map[string]string{"token": token})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("No resend once verified", func(t *testing.T) {
+		postJSONForTest(apiHandler.ResendVerificationEmailHandler, "/email/resend", map[string]string{"email": "test@example.com"})
+		if len(mockMessageBroker.EventsOfType("email_verification_requested")) != 1 {
+			t.Error("expected no further verification emails for a verified account")
+		}
+	})
+}
+
+func TestResendVerificationEmailThrottle(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password123"})
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "https://example.com", "", "", nil)
+	apiHandler.EmailThrottle = auth.NewThrottle("email", auth.NewMemoryAttemptStore(), auth.ThrottlePolicy{
+		BaseDelay: 50 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Window:    time.Hour,
+	}, auth.ThrottlePolicy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Minute,
+		Window:       time.Hour,
+	})
+	resend := func(email string) *httptest.ResponseRecorder {
+		return postJSONForTest(apiHandler.ResendVerificationEmailHandler, "/email/resend", map[string]string{"email": email})
+	}
+
+	if w := resend("test@example.com"); w.Code != http.StatusOK || len(mockMessageBroker.EventsOfType("email_verification_requested")) != 1 {
+		t.Fatalf("expected a verification email; got %d", w.Code)
+	}
+
+	// A resend within the cooldown looks the same to the client but sends nothing.
+	if w := resend("test@example.com"); w.Code != http.StatusOK || len(mockMessageBroker.EventsOfType("email_verification_requested")) != 1 {
+		t.Errorf("expected no email during the cooldown; got %d", w.Code)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if w := resend("test@example.com"); w.Code != http.StatusOK || len(mockMessageBroker.EventsOfType("email_verification_requested")) != 2 {
+		t.Errorf("expected another verification email after the cooldown; got %d", w.Code)
+	}
+
+	// Every request counts against the client IP, whether or not the account exists.
+	resend("nobody@example.com")
+	w := resend("nobody-else@example.com")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected status %d with a Retry-After header; got %d", http.StatusTooManyRequests, w.Code)
+	}
+}
+
+func TestUnverifiedLoginPolicy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	user.CreatedAt = time.Now().Add(-48 * time.Hour)
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "", "", "", nil)
+
+	tests := []struct {
+		name         string
+		policy       UnverifiedLoginPolicy
+		verified     bool
+		expectedCode int
+	}{
+		{"Allowed by default", UnverifiedLoginPolicy{}, false, http.StatusOK},
+		{"Blocked", UnverifiedLoginPolicy{Block: true}, false, http.StatusForbidden},
+		{"Within grace period", UnverifiedLoginPolicy{Block: true, GracePeriod: 72 * time.Hour}, false, http.StatusOK},
+		{"After grace period", UnverifiedLoginPolicy{Block: true, GracePeriod: 24 * time.Hour}, false, http.StatusForbidden},
+		{"Verified", UnverifiedLoginPolicy{Block: true}, true, http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			apiHandler.UnverifiedLogin = tc.policy
+			user.EmailVerifiedAt = nil
+			if tc.verified {
+				now := time.Now()
+				user.EmailVerifiedAt = &now
+			}
+
+			w := loginAttemptForTest(apiHandler, "test@example.com", "password")
+			if w.Code != tc.expectedCode {
+				t.Errorf("expected status %d; got %d", tc.expectedCode, w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,596 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/free-education/events"
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/passkey"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// WebAuthnSessionTTL is how long the client has to answer a WebAuthn challenge.
+const WebAuthnSessionTTL = 5 * time.Minute
+
+// defaultPasskeys configures passkeys for the front end's own origin. It returns
+// nil, disabling passkeys, if frontendBaseURL is not an absolute URL.
+func defaultPasskeys(frontendBaseURL string) *passkey.Service {
+	u, err := url.Parse(frontendBaseURL)
+	if err != nil || u.Hostname() == "" {
+		return nil
+	}
+	service, err := passkey.New(passkey.Config{
+		RPID:          u.Hostname(),
+		RPDisplayName: "OpenMind Academy",
+		RPOrigins:     []string{u.Scheme + "://" + u.Host},
+	})
+	if err != nil {
+		log.Printf("Passkeys disabled: %v", err)
+		return nil
+	}
+	return service
+}
+
+// checkPasskeysEnabled writes a 404 response and returns false if passkeys are not configured.
+func (a *API) checkPasskeysEnabled(c *gin.Context) bool {
+	if a.Passkeys == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkeys are not enabled."})
+		return false
+	}
+	return true
+}
+
+// passkeyUser loads a user's registered credentials for a ceremony.
+func (a *API) passkeyUser(ctx context.Context, user *model.User) (*passkey.User, error) {
+	credentials, err := a.UserStore.GetWebAuthnCredentials(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &passkey.User{
+		ID:          user.ID,
+		Name:        user.Email,
+		DisplayName: user.FirstName,
+		Credentials: credentials,
+	}, nil
+}
+
+// startWebAuthnSession stores a ceremony's state and returns the ID the client
+// has to send back with the authenticator's response.
+func (a *API) startWebAuthnSession(ctx context.Context, userID int64, purpose string, data []byte) (string, error) {
+	id, err := auth.GenerateSecureToken(32)
+	if err != nil {
+		return "", err
+	}
+	err = a.UserStore.CreateWebAuthnSession(ctx, &model.WebAuthnSession{
+		ID:        id,
+		UserID:    userID,
+		Purpose:   purpose,
+		Data:      data,
+		ExpiresAt: time.Now().Add(WebAuthnSessionTTL),
+	})
+	return id, err
+}
+
+// consumeWebAuthnSession fetches and burns a ceremony's state. It writes a 400
+// response and returns nil unless the session exists, has not expired and was
+// started for the same purpose and user.
+func (a *API) consumeWebAuthnSession(c *gin.Context, id, purpose string, userID int64) *model.WebAuthnSession {
+	session, err := a.UserStore.ConsumeWebAuthnSession(c.Request.Context(), id)
+	if err != nil || session.Purpose != purpose || session.UserID != userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired WebAuthn session."})
+		return nil
+	}
+	return session
+}
+
+// recordPasskeyUse stores a credential's new signature counter after a successful assertion.
+func (a *API) recordPasskeyUse(ctx context.Context, credential *model.WebAuthnCredential) {
+	if err := a.UserStore.UpdateWebAuthnCredentialUsage(ctx, credential); err != nil {
+		log.Printf("Error updating WebAuthn credential %d: %v", credential.ID, err)
+	}
+}
+
+// --- Credential management ---
+
+// BeginWebAuthnRegistrationHandler starts registering a passkey or security key for
+// the authenticated user. The returned options are passed to navigator.credentials.create().
+func (a *API) BeginWebAuthnRegistrationHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+	userID := c.MustGet("userID").(int64)
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	pkUser, err := a.passkeyUser(c.Request.Context(), user)
+	if err != nil {
+		log.Printf("Error getting WebAuthn credentials for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration."})
+		return
+	}
+
+	options, data, err := a.Passkeys.BeginRegistration(pkUser)
+	if err != nil {
+		log.Printf("Error starting WebAuthn registration for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration."})
+		return
+	}
+	sessionID, err := a.startWebAuthnSession(c.Request.Context(), userID, "registration", data)
+	if err != nil {
+		log.Printf("Error storing WebAuthn session for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey registration."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "options": options})
+}
+
+// FinishWebAuthnRegistrationHandler verifies the authenticator's response and stores the new credential.
+func (a *API) FinishWebAuthnRegistrationHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+	userID := c.MustGet("userID").(int64)
+
+	var req model.FinishWebAuthnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	session := a.consumeWebAuthnSession(c, req.SessionID, "registration", userID)
+	if session == nil {
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	pkUser, err := a.passkeyUser(c.Request.Context(), user)
+	if err != nil {
+		log.Printf("Error getting WebAuthn credentials for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register passkey."})
+		return
+	}
+
+	credential, err := a.Passkeys.FinishRegistration(pkUser, session.Data, req.Credential)
+	if err != nil {
+		log.Printf("WebAuthn registration failed for user %d: %v", userID, err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey verification failed."})
+		return
+	}
+	credential.Name = req.Name
+	if credential.Name == "" {
+		credential.Name = "Passkey"
+	}
+
+	if err := a.UserStore.CreateWebAuthnCredential(c.Request.Context(), credential); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			c.JSON(http.StatusConflict, gin.H{"error": "This passkey is already registered."})
+			return
+		}
+		log.Printf("Error storing WebAuthn credential for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register passkey."})
+		return
+	}
+
+	activity := &model.UserActivity{UserID: userID, ActivityType: "passkey_added", Metadata: map[string]interface{}{"name": credential.Name}}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording new passkey for user %d: %v", userID, err)
+	}
+	payload := &events.PasskeyAdded{
+		Email:       user.Email,
+		Name:        user.FirstName,
+		PasskeyName: credential.Name,
+	}
+	if err := a.MessageBroker.Publish(c.Request.Context(), "notifications_events", payload); err != nil {
+		log.Printf("Error publishing new passkey notice for user %d: %v", userID, err)
+	}
+
+	c.JSON(http.StatusCreated, credential)
+}
+
+// ListWebAuthnCredentialsHandler lists the authenticated user's passkeys and security keys.
+func (a *API) ListWebAuthnCredentialsHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	credentials, err := a.UserStore.GetWebAuthnCredentials(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing WebAuthn credentials for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve passkeys."})
+		return
+	}
+	if credentials == nil {
+		credentials = []*model.WebAuthnCredential{}
+	}
+
+	c.JSON(http.StatusOK, credentials)
+}
+
+// RenameWebAuthnCredentialHandler renames one of the authenticated user's passkeys.
+func (a *API) RenameWebAuthnCredentialHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	credentialID, err := strconv.ParseInt(c.Param("credentialId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential ID"})
+		return
+	}
+	var req model.RenameWebAuthnCredentialRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+
+	if err := a.UserStore.RenameWebAuthnCredential(c.Request.Context(), userID, credentialID, req.Name); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+			return
+		}
+		log.Printf("Error renaming WebAuthn credential %d for user %d: %v", credentialID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename passkey."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Passkey renamed."})
+}
+
+// DeleteWebAuthnCredentialHandler removes one of the authenticated user's passkeys.
+// The last way to sign in cannot be removed.
+func (a *API) DeleteWebAuthnCredentialHandler(c *gin.Context) {
+	userID := c.MustGet("userID").(int64)
+
+	credentialID, err := strconv.ParseInt(c.Param("credentialId"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential ID"})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	credentials, err := a.UserStore.GetWebAuthnCredentials(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("Error listing WebAuthn credentials for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove passkey."})
+		return
+	}
+	var credential *model.WebAuthnCredential
+	for _, cred := range credentials {
+		if cred.ID == credentialID {
+			credential = cred
+		}
+	}
+	if credential == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+		return
+	}
+	if user.PasswordHash == "" && len(credentials) == 1 {
+		identities, err := a.UserStore.GetUserIdentities(c.Request.Context(), userID)
+		if err != nil {
+			log.Printf("Error listing identities for user %d: %v", userID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove passkey."})
+			return
+		}
+		if len(identities) == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "This is your only way to sign in. Set a password or add another passkey first."})
+			return
+		}
+	}
+
+	if err := a.UserStore.DeleteWebAuthnCredential(c.Request.Context(), userID, credentialID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			// Another sign-in method went away since the check above.
+			c.JSON(http.StatusConflict, gin.H{"error": "This is your only way to sign in. Set a password or add another passkey first."})
+			return
+		}
+		log.Printf("Error deleting WebAuthn credential %d for user %d: %v", credentialID, userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove passkey."})
+		return
+	}
+
+	activity := &model.UserActivity{UserID: userID, ActivityType: "passkey_removed", Metadata: map[string]interface{}{"name": credential.Name}}
+	if err := a.UserStore.CreateUserActivity(c.Request.Context(), activity); err != nil {
+		log.Printf("Error recording removed passkey for user %d: %v", userID, err)
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// --- Passwordless login ---
+
+// BeginWebAuthnLoginHandler starts a passwordless login. No email is needed: the
+// browser offers the passkeys it has for this site and the chosen one names the user.
+func (a *API) BeginWebAuthnLoginHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+
+	options, data, err := a.Passkeys.BeginDiscoverableLogin()
+	if err != nil {
+		log.Printf("Error starting WebAuthn login: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey login."})
+		return
+	}
+	sessionID, err := a.startWebAuthnSession(c.Request.Context(), 0, "login", data)
+	if err != nil {
+		log.Printf("Error storing WebAuthn session: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey login."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "options": options})
+}
+
+// FinishWebAuthnLoginHandler verifies a passwordless login and starts a session.
+// A passkey checks both possession and the user's PIN or biometrics, so no
+// further factor is asked for.
+func (a *API) FinishWebAuthnLoginHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+
+	var req model.FinishWebAuthnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	session := a.consumeWebAuthnSession(c, req.SessionID, "login", 0)
+	if session == nil {
+		return
+	}
+
+	var user *model.User
+	lookup := func(userID int64) (*passkey.User, error) {
+		var err error
+		user, err = a.UserStore.GetUserByID(c.Request.Context(), userID)
+		if err != nil {
+			return nil, err
+		}
+		return a.passkeyUser(c.Request.Context(), user)
+	}
+	_, credential, err := a.Passkeys.FinishDiscoverableLogin(session.Data, req.Credential, lookup)
+	if err != nil {
+		log.Printf("WebAuthn login failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey verification failed."})
+		return
+	}
+
+	if !a.UnverifiedLogin.allowsLogin(user) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":                       "Please verify your email address before logging in.",
+			"email_verification_required": true,
+		})
+		return
+	}
+
+	a.recordPasskeyUse(c.Request.Context(), credential)
+	a.recordLoginSuccess(c, user.ID)
+	if !a.checkAccountActive(c, user) {
+		return
+	}
+	resp, err := a.issueSession(c, user)
+	if err != nil {
+		log.Printf("Error issuing session for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token."})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// --- Second factor ---
+
+// BeginWebAuthnSecondFactorHandler starts a passkey check in place of a TOTP code,
+// for the temporary token returned by LoginUserHandler.
+func (a *API) BeginWebAuthnSecondFactorHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+
+	var req model.BeginWebAuthnSecondFactorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	claims, err := auth.ValidateToken(req.TempToken)
+	if err != nil || claims.Type != "2fa_temp" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired temporary token."})
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired temporary token."})
+		return
+	}
+	pkUser, err := a.passkeyUser(c.Request.Context(), user)
+	if err != nil {
+		log.Printf("Error getting WebAuthn credentials for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey check."})
+		return
+	}
+	if len(pkUser.Credentials) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No passkeys are registered for this account."})
+		return
+	}
+
+	options, data, err := a.Passkeys.BeginLogin(pkUser)
+	if err != nil {
+		log.Printf("Error starting WebAuthn assertion for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey check."})
+		return
+	}
+	sessionID, err := a.startWebAuthnSession(c.Request.Context(), user.ID, "second_factor", data)
+	if err != nil {
+		log.Printf("Error storing WebAuthn session for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey check."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "options": options})
+}
+
+// FinishWebAuthnSecondFactorHandler completes a login's second step with a passkey.
+func (a *API) FinishWebAuthnSecondFactorHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+
+	var req model.FinishWebAuthnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	claims, err := auth.ValidateToken(req.TempToken)
+	if err != nil || claims.Type != "2fa_temp" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired temporary token."})
+		return
+	}
+	session := a.consumeWebAuthnSession(c, req.SessionID, "second_factor", claims.UserID)
+	if session == nil {
+		return
+	}
+
+	if !a.checkLoginThrottle(c, claims.UserID) {
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), claims.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve user details."})
+		return
+	}
+	pkUser, err := a.passkeyUser(c.Request.Context(), user)
+	if err != nil {
+		log.Printf("Error getting WebAuthn credentials for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to process login."})
+		return
+	}
+
+	credential, err := a.Passkeys.FinishLogin(pkUser, session.Data, req.Credential)
+	if err != nil {
+		log.Printf("WebAuthn second factor failed for user %d: %v", user.ID, err)
+		a.recordLoginFailure(c, user.ID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey verification failed."})
+		return
+	}
+
+	a.recordPasskeyUse(c.Request.Context(), credential)
+	a.recordLoginSuccess(c, user.ID)
+	if !a.checkAccountActive(c, user) {
+		return
+	}
+	resp, err := a.issueSession(c, user)
+	if err != nil {
+		log.Printf("Error issuing session for user %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token."})
+		return
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// --- Reauthentication ---
+
+// BeginWebAuthnReauthHandler starts a passkey check that confirms it is still the
+// authenticated user before a sensitive action, e.g. for accounts without a password.
+func (a *API) BeginWebAuthnReauthHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+	userID := c.MustGet("userID").(int64)
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	pkUser, err := a.passkeyUser(c.Request.Context(), user)
+	if err != nil {
+		log.Printf("Error getting WebAuthn credentials for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey check."})
+		return
+	}
+	if len(pkUser.Credentials) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No passkeys are registered for this account."})
+		return
+	}
+
+	options, data, err := a.Passkeys.BeginLogin(pkUser)
+	if err != nil {
+		log.Printf("Error starting WebAuthn assertion for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey check."})
+		return
+	}
+	sessionID, err := a.startWebAuthnSession(c.Request.Context(), userID, "reauth", data)
+	if err != nil {
+		log.Printf("Error storing WebAuthn session for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start passkey check."})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"session_id": sessionID, "options": options})
+}
+
+// FinishWebAuthnReauthHandler verifies the passkey check and returns a reauth token,
+// like ReauthHandler.
+func (a *API) FinishWebAuthnReauthHandler(c *gin.Context) {
+	if !a.checkPasskeysEnabled(c) {
+		return
+	}
+	userID := c.MustGet("userID").(int64)
+
+	var req model.FinishWebAuthnRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request payload: " + err.Error()})
+		return
+	}
+	session := a.consumeWebAuthnSession(c, req.SessionID, "reauth", userID)
+	if session == nil {
+		return
+	}
+
+	if !a.checkLoginThrottle(c, userID) {
+		return
+	}
+
+	user, err := a.UserStore.GetUserByID(c.Request.Context(), userID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	pkUser, err := a.passkeyUser(c.Request.Context(), user)
+	if err != nil {
+		log.Printf("Error getting WebAuthn credentials for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify credentials."})
+		return
+	}
+
+	credential, err := a.Passkeys.FinishLogin(pkUser, session.Data, req.Credential)
+	if err != nil {
+		log.Printf("WebAuthn reauthentication failed for user %d: %v", userID, err)
+		a.recordLoginFailure(c, userID)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey verification failed."})
+		return
+	}
+
+	a.recordPasskeyUse(c.Request.Context(), credential)
+	a.issueReauthToken(c, userID)
+}
@@ -0,0 +1,252 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/passkey/passkeytest"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/context"
+)
+
+// webauthnRequestForTest calls a WebAuthn handler with a JSON body, as userID if it is non-zero.
+func webauthnRequestForTest(handler gin.HandlerFunc, userID int64, body interface{}) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	if userID != 0 {
+		c.Set("userID", userID)
+	}
+	jsonBody, _ := json.Marshal(body)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/webauthn", bytes.NewBuffer(jsonBody))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	handler(c)
+	return w
+}
+
+// ceremonyForTest decodes a begin handler's response into its session ID and options.
+func ceremonyForTest(t *testing.T, w *httptest.ResponseRecorder) (string, json.RawMessage) {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp struct {
+		SessionID string          `json:"session_id"`
+		Options   json.RawMessage `json:"options"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return resp.SessionID, resp.Options
+}
+
+// registerPasskeyForTest registers a passkey from the authenticator for the user.
+func registerPasskeyForTest(t *testing.T, apiHandler *API, authenticator *passkeytest.Authenticator, userID int64) *httptest.ResponseRecorder {
+	t.Helper()
+	sessionID, options := ceremonyForTest(t, webauthnRequestForTest(apiHandler.BeginWebAuthnRegistrationHandler, userID, nil))
+	credential, err := authenticator.Register(options)
+	if err != nil {
+		t.Fatalf("authenticator failed to register: %v", err)
+	}
+	return webauthnRequestForTest(apiHandler.FinishWebAuthnRegistrationHandler, userID, map[string]interface{}{
+		"session_id": sessionID,
+		"credential": json.RawMessage(credential),
+		"name":       "School Chromebook",
+	})
+}
+
+// deletePasskeyForTest returns the response status; a 204 is never flushed to the recorder.
+func deletePasskeyForTest(apiHandler *API, userID, credentialID int64) int {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Set("userID", userID)
+	c.Params = gin.Params{{Key: "credentialId", Value: strconv.FormatInt(credentialID, 10)}}
+	c.Request, _ = http.NewRequest(http.MethodDelete, "/webauthn/credentials/"+strconv.FormatInt(credentialID, 10), nil)
+
+	apiHandler.DeleteWebAuthnCredentialHandler(c)
+	return c.Writer.Status()
+}
+
+func TestPasskeySecondFactor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	user, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "test@example.com", Password: "password"})
+	user.TwoFactorSecret = "JBSWY3DPEHPK3PXP"
+	user.TwoFactorEnabled = true
+	mockMessageBroker := &MockMessageBroker{}
+	apiHandler := NewAPI(userStore, mockMessageBroker, "https://example.com", "", "", nil)
+	authenticator := passkeytest.NewAuthenticator("https://example.com")
+
+	w := registerPasskeyForTest(t, apiHandler, authenticator, user.ID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+	if len(userStore.webauthnCredentials) != 1 || userStore.webauthnCredentials[0].Name != "School Chromebook" {
+		t.Fatalf("expected the named passkey to be stored; got %+v", userStore.webauthnCredentials)
+	}
+	if notices := mockMessageBroker.EventsOfType("passkey_added"); len(notices) != 1 {
+		t.Errorf("expected 1 passkey_added event; got %d", len(notices))
+	}
+
+	w = webauthnRequestForTest(apiHandler.LoginUserHandler, 0, map[string]string{"email": "test@example.com", "password": "password"})
+	var login struct {
+		TempToken        string   `json:"temp_token"`
+		TwoFactorMethods []string `json:"two_factor_methods"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if login.TempToken == "" || len(login.TwoFactorMethods) != 2 || login.TwoFactorMethods[1] != "webauthn" {
+		t.Fatalf("expected a 2FA challenge offering passkeys; got %s", w.Body.String())
+	}
+
+	sessionID, options := ceremonyForTest(t, webauthnRequestForTest(apiHandler.BeginWebAuthnSecondFactorHandler, 0, map[string]string{"temp_token": login.TempToken}))
+	assertion, err := authenticator.Login(options)
+	if err != nil {
+		t.Fatalf("authenticator failed to sign: %v", err)
+	}
+	finish := map[string]interface{}{"temp_token": login.TempToken, "session_id": sessionID, "credential": json.RawMessage(assertion)}
+	w = webauthnRequestForTest(apiHandler.FinishWebAuthnSecondFactorHandler, 0, finish)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if stored := userStore.webauthnCredentials[0]; stored.SignCount != 1 || stored.LastUsedAt == nil {
+		t.Errorf("expected the credential's usage to be recorded; got %+v", stored)
+	}
+
+	t.Run("Replayed assertion", func(t *testing.T) {
+		w := webauthnRequestForTest(apiHandler.FinishWebAuthnSecondFactorHandler, 0, finish)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("Registered passkeys are excluded", func(t *testing.T) {
+		_, options := ceremonyForTest(t, webauthnRequestForTest(apiHandler.BeginWebAuthnRegistrationHandler, user.ID, nil))
+		var creation struct {
+			PublicKey struct {
+				ExcludeCredentials []interface{} `json:"excludeCredentials"`
+			} `json:"publicKey"`
+		}
+		json.Unmarshal(options, &creation)
+		if len(creation.PublicKey.ExcludeCredentials) != 1 {
+			t.Errorf("expected the registered passkey to be excluded; got %d", len(creation.PublicKey.ExcludeCredentials))
+		}
+	})
+}
+
+func TestPasswordlessPasskeyLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	// An account without a password, e.g. one created through a social login.
+	user, _ := userStore.CreateOAuthUser(context.Background(), &model.User{Email: "oauth@example.com", OAuthProvider: "test", OAuthProviderID: "subject-1"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "https://example.com", "", "", nil)
+	authenticator := passkeytest.NewAuthenticator("https://example.com")
+
+	if w := registerPasskeyForTest(t, apiHandler, authenticator, user.ID); w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	sessionID, options := ceremonyForTest(t, webauthnRequestForTest(apiHandler.BeginWebAuthnLoginHandler, 0, nil))
+	assertion, err := authenticator.Login(options)
+	if err != nil {
+		t.Fatalf("authenticator failed to sign: %v", err)
+	}
+	w := webauthnRequestForTest(apiHandler.FinishWebAuthnLoginHandler, 0, map[string]interface{}{"session_id": sessionID, "credential": json.RawMessage(assertion)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp model.LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if claims, err := auth.ValidateToken(resp.Token); err != nil || claims.UserID != user.ID {
+		t.Errorf("expected a session for the passkey's owner; got %s", w.Body.String())
+	}
+
+	t.Run("Wrong origin", func(t *testing.T) {
+		// The same authenticator, answering a challenge relayed by a phishing site.
+		authenticator.Origin = "https://example.com.evil.example"
+		defer func() { authenticator.Origin = "https://example.com" }()
+
+		sessionID, options := ceremonyForTest(t, webauthnRequestForTest(apiHandler.BeginWebAuthnLoginHandler, 0, nil))
+		assertion, _ := authenticator.Login(options)
+		w := webauthnRequestForTest(apiHandler.FinishWebAuthnLoginHandler, 0, map[string]interface{}{"session_id": sessionID, "credential": json.RawMessage(assertion)})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected status %d; got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	credentialID := userStore.webauthnCredentials[0].ID
+	t.Run("Unlink the social login", func(t *testing.T) {
+		// The passkey is still a way to sign in.
+		if status := unlinkIdentityForTest(apiHandler, user.ID, userStore.identities[0].ID); status != http.StatusNoContent {
+			t.Errorf("expected status %d; got %d", http.StatusNoContent, status)
+		}
+	})
+
+	t.Run("Remove the only sign-in method", func(t *testing.T) {
+		if status := deletePasskeyForTest(apiHandler, user.ID, credentialID); status != http.StatusConflict {
+			t.Errorf("expected status %d; got %d", http.StatusConflict, status)
+		}
+	})
+
+	t.Run("Remove another user's passkey", func(t *testing.T) {
+		other, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "other@example.com", Password: "password"})
+		if status := deletePasskeyForTest(apiHandler, other.ID, credentialID); status != http.StatusNotFound {
+			t.Errorf("expected status %d; got %d", http.StatusNotFound, status)
+		}
+	})
+}
+
+func TestPasskeyReauth(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	setupTestKey(t)
+
+	userStore := NewMockUserStore()
+	// An account without a password, e.g. one created through a social login.
+	user, _ := userStore.CreateOAuthUser(context.Background(), &model.User{Email: "oauth@example.com", OAuthProvider: "test", OAuthProviderID: "subject-1"})
+	apiHandler := NewAPI(userStore, &MockMessageBroker{}, "https://example.com", "", "", nil)
+	authenticator := passkeytest.NewAuthenticator("https://example.com")
+
+	t.Run("No passkey registered", func(t *testing.T) {
+		if w := webauthnRequestForTest(apiHandler.BeginWebAuthnReauthHandler, user.ID, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	if w := registerPasskeyForTest(t, apiHandler, authenticator, user.ID); w.Code != http.StatusCreated {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusCreated, w.Code, w.Body.String())
+	}
+
+	sessionID, options := ceremonyForTest(t, webauthnRequestForTest(apiHandler.BeginWebAuthnReauthHandler, user.ID, nil))
+	assertion, err := authenticator.Login(options)
+	if err != nil {
+		t.Fatalf("authenticator failed to sign in: %v", err)
+	}
+	w := webauthnRequestForTest(apiHandler.FinishWebAuthnReauthHandler, user.ID, map[string]interface{}{"session_id": sessionID, "credential": json.RawMessage(assertion)})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d; got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	var resp struct {
+		ReauthToken string `json:"reauth_token"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if claims, err := auth.ValidateToken(resp.ReauthToken); err != nil || claims.Type != "reauth" || claims.UserID != user.ID {
+		t.Errorf("expected a reauth token for the user; got %s", w.Body.String())
+	}
+
+	t.Run("Session of another user", func(t *testing.T) {
+		other, _ := userStore.CreateUser(context.Background(), &model.RegistrationRequest{Email: "other@example.com", Password: "password"})
+		sessionID, options := ceremonyForTest(t, webauthnRequestForTest(apiHandler.BeginWebAuthnReauthHandler, user.ID, nil))
+		assertion, _ := authenticator.Login(options)
+		w := webauthnRequestForTest(apiHandler.FinishWebAuthnReauthHandler, other.ID, map[string]interface{}{"session_id": sessionID, "credential": json.RawMessage(assertion)})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d; got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+}
@@ -1,7 +1,6 @@
 package auth
 
 import (
-	"crypto/rsa"
 	"fmt"
 	"io/ioutil"
 	"time"
@@ -10,62 +9,130 @@ import (
 )
 
 var (
-	signKey *rsa.PrivateKey
+	// keyRing holds the signing key and every key still accepted for verification.
+	keyRing = NewKeyRing()
 )
 
-// LoadPrivateKey loads the RSA private key from a file.
+const (
+	// AccessTokenTTL is the lifetime of a full-access JWT. It is kept short because
+	// clients can obtain a new one with their refresh token.
+	AccessTokenTTL = 15 * time.Minute
+	// RefreshTokenTTL is how long a session's refresh token remains usable without being rotated.
+	RefreshTokenTTL = 30 * 24 * time.Hour
+	// ReauthTokenTTL is how long a user's re-authentication counts as "recent" for sensitive actions.
+	ReauthTokenTTL = 5 * time.Minute
+	// ImpersonationTokenTTL is the lifetime of a token an admin uses to act as another user.
+	ImpersonationTokenTTL = 15 * time.Minute
+	// ReactivationTokenTTL is how long a user who logged in to a deactivated account has to confirm its reactivation.
+	ReactivationTokenTTL = 10 * time.Minute
+)
+
+// LoadPrivateKey loads an RSA private key from a file and makes it the signing key.
+// Its key ID is the key's JWK thumbprint.
 func LoadPrivateKey(path string) error {
 	keyBytes, err := ioutil.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("error reading private key: %w", err)
 	}
 
-	signKey, err = jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
+	key, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
 	if err != nil {
 		return fmt.Errorf("error parsing private key: %w", err)
 	}
-	return nil
+
+	kid := KeyID(&key.PublicKey)
+	if err := keyRing.AddKey(kid, key); err != nil {
+		return err
+	}
+	return keyRing.Promote(kid)
+}
+
+// LoadKeyDir replaces the loaded keys with the contents of a key directory.
+// See KeyRing.LoadDir for the expected layout. It can be called again at any
+// time to pick up added, promoted or retired keys.
+func LoadKeyDir(dir string) error {
+	return keyRing.LoadDir(dir)
+}
+
+// Keys returns the key ring used to sign and verify tokens.
+func Keys() *KeyRing {
+	return keyRing
+}
+
+// signClaims signs claims with the active key, recording its ID in the `kid` header.
+func signClaims(claims *AuthClaims) (string, error) {
+	kid, key, err := keyRing.signingKey()
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	return token.SignedString(key)
 }
 
 // AuthClaims defines the structure of the JWT claims for authentication.
 type AuthClaims struct {
-	UserID int64  `json:"user_id"`
-	Role   string `json:"role,omitempty"`
-	Type   string `json:"type"` // e.g., "full_auth", "2fa_temp"
+	UserID    int64  `json:"user_id"`
+	Role      string `json:"role,omitempty"`
+	Type      string `json:"type"`          // e.g., "full_auth", "2fa_temp", "reauth", "reactivation"
+	SessionID int64  `json:"sid,omitempty"` // The server-side session this token belongs to.
+	// ImpersonatorID is the admin acting as UserID, for tokens from GenerateImpersonationToken.
+	ImpersonatorID int64 `json:"impersonator_id,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// GenerateToken generates a new, full-access JWT for a given user ID and role.
-func GenerateToken(userID int64, role string) (string, error) {
-	// Token expires in 24 hours
-	expirationTime := time.Now().Add(24 * time.Hour)
+// GenerateToken generates a new, short-lived full-access JWT for a given user ID and role.
+// The session ID ties the token to the server-side session it was issued for.
+func GenerateToken(userID int64, role string, sessionID int64) (string, error) {
+	expirationTime := time.Now().Add(AccessTokenTTL)
 
 	claims := &AuthClaims{
-		UserID: userID,
-		Role:   role,
-		Type:   "full_auth",
+		UserID:    userID,
+		Role:      role,
+		Type:      "full_auth",
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			IssuedAt:  jwt.NewNumericDate(issuedAt(userID)),
 			Issuer:    "user-service",
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(signKey)
-	if err != nil {
-		return "", err
+	return signClaims(claims)
+}
+
+// GenerateImpersonationToken generates a full-access JWT that lets an admin act as
+// another user for support. It belongs to no session, so it cannot be refreshed and
+// does not show up in the user's session list, and it names the admin so that
+// downstream services can tell it apart from the user's own tokens.
+func GenerateImpersonationToken(userID int64, role string, impersonatorID int64) (string, error) {
+	expirationTime := time.Now().Add(ImpersonationTokenTTL)
+
+	claims := &AuthClaims{
+		UserID:         userID,
+		Role:           role,
+		Type:           "full_auth",
+		ImpersonatorID: impersonatorID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(issuedAt(userID)),
+			Issuer:    "user-service",
+		},
 	}
-	return tokenString, nil
+
+	return signClaims(claims)
 }
 
 // ValidateToken parses and validates a JWT string, returning the claims if valid.
+// Tokens issued before the user's last security event are rejected with ErrTokenRevoked.
 func ValidateToken(tokenString string) (*AuthClaims, error) {
 	claims := &AuthClaims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		// Since we're using RSA, we need to provide the public key for verification.
-		return &signKey.PublicKey, nil
-	})
+		// The `kid` header selects which key in the ring signed the token.
+		kid, _ := token.Header["kid"].(string)
+		return keyRing.verificationKey(kid)
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}))
 
 	if err != nil {
 		return nil, err
@@ -75,6 +142,10 @@ func ValidateToken(tokenString string) (*AuthClaims, error) {
 		return nil, fmt.Errorf("token is invalid")
 	}
 
+	if err := checkRevocation(claims); err != nil {
+		return nil, err
+	}
+
 	return claims, nil
 }
 
@@ -88,15 +159,47 @@ func Generate2FATempToken(userID int64) (string, error) {
 		Type:   "2fa_temp",
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			IssuedAt:  jwt.NewNumericDate(issuedAt(userID)),
 			Issuer:    "user-service",
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	tokenString, err := token.SignedString(signKey)
-	if err != nil {
-		return "", err
+	return signClaims(claims)
+}
+
+// GenerateReauthToken generates a short-lived token proving the user re-entered a
+// credential just now. Sensitive endpoints require it on top of the normal session.
+func GenerateReauthToken(userID int64) (string, error) {
+	expirationTime := time.Now().Add(ReauthTokenTTL)
+
+	claims := &AuthClaims{
+		UserID: userID,
+		Type:   "reauth",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(issuedAt(userID)),
+			Issuer:    "user-service",
+		},
 	}
-	return tokenString, nil
+
+	return signClaims(claims)
+}
+
+// GenerateReactivationToken generates a short-lived token issued when a user fully
+// logs in to an account they deactivated. It lets them confirm the reactivation
+// but grants no other access.
+func GenerateReactivationToken(userID int64) (string, error) {
+	expirationTime := time.Now().Add(ReactivationTokenTTL)
+
+	claims := &AuthClaims{
+		UserID: userID,
+		Type:   "reactivation",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(issuedAt(userID)),
+			Issuer:    "user-service",
+		},
+	}
+
+	return signClaims(claims)
 }
@@ -0,0 +1,203 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// activeKeyFile is the name of the file in a key directory that holds the ID of the signing key.
+const activeKeyFile = "active"
+
+// KeyRing holds the RSA keys used to sign and verify tokens. Exactly one key is
+// active and used for signing; every key in the ring is accepted for verification
+// and published in the JWKS document.
+//
+// Rotating keys without downtime is a three-step process:
+//  1. AddKey the new key. It is published, so other services start trusting it.
+//  2. Promote it once consumers have refreshed their JWKS. New tokens are signed with it.
+//  3. Retire the old key once every token it signed has expired.
+type KeyRing struct {
+	mu        sync.RWMutex
+	keys      map[string]*rsa.PrivateKey
+	activeKID string
+}
+
+// NewKeyRing creates an empty KeyRing.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{keys: make(map[string]*rsa.PrivateKey)}
+}
+
+// AddKey adds a key to the ring for verification. It does not change the signing key,
+// unless the ring was empty.
+func (k *KeyRing) AddKey(kid string, key *rsa.PrivateKey) error {
+	if kid == "" {
+		return fmt.Errorf("key ID must not be empty")
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[kid] = key
+	if k.activeKID == "" {
+		k.activeKID = kid
+	}
+	return nil
+}
+
+// Promote makes a key that is already in the ring the signing key.
+func (k *KeyRing) Promote(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[kid]; !ok {
+		return fmt.Errorf("unknown key ID %q", kid)
+	}
+	k.activeKID = kid
+	return nil
+}
+
+// Retire removes a key from the ring. Tokens signed with it no longer validate.
+// The active key cannot be retired; promote another key first.
+func (k *KeyRing) Retire(kid string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if kid == k.activeKID {
+		return fmt.Errorf("cannot retire the active key %q", kid)
+	}
+	if _, ok := k.keys[kid]; !ok {
+		return fmt.Errorf("unknown key ID %q", kid)
+	}
+	delete(k.keys, kid)
+	return nil
+}
+
+// ActiveKeyID returns the ID of the current signing key.
+func (k *KeyRing) ActiveKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.activeKID
+}
+
+// signingKey returns the active key and its ID.
+func (k *KeyRing) signingKey() (string, *rsa.PrivateKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[k.activeKID]
+	if !ok {
+		return "", nil, fmt.Errorf("no signing key loaded")
+	}
+	return k.activeKID, key, nil
+}
+
+// verificationKey returns the public key for a key ID. Tokens issued before key IDs
+// were introduced carry no `kid` header; those are checked against the active key.
+func (k *KeyRing) verificationKey(kid string) (*rsa.PublicKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if kid == "" {
+		kid = k.activeKID
+	}
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key ID %q", kid)
+	}
+	return &key.PublicKey, nil
+}
+
+// LoadDir synchronizes the ring with a directory of PEM-encoded RSA private keys.
+// Each `<kid>.pem` file is a key; the `active` file holds the ID of the signing key.
+// Keys whose files were removed are retired. The ring is only changed if the whole
+// directory loads successfully.
+func (k *KeyRing) LoadDir(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]*rsa.PrivateKey, len(paths))
+	for _, path := range paths {
+		keyBytes, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading key %s: %w", path, err)
+		}
+		key, err := jwt.ParseRSAPrivateKeyFromPEM(keyBytes)
+		if err != nil {
+			return fmt.Errorf("error parsing key %s: %w", path, err)
+		}
+		keys[strings.TrimSuffix(filepath.Base(path), ".pem")] = key
+	}
+
+	activeBytes, err := os.ReadFile(filepath.Join(dir, activeKeyFile))
+	if err != nil {
+		return fmt.Errorf("error reading active key ID: %w", err)
+	}
+	activeKID := strings.TrimSpace(string(activeBytes))
+	if _, ok := keys[activeKID]; !ok {
+		return fmt.Errorf("active key %q not found in %s", activeKID, dir)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keys
+	k.activeKID = activeKID
+	return nil
+}
+
+// JWK is the JSON Web Key representation of an RSA public key (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set document, as served from /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public halves of every key in the ring, sorted by key ID.
+func (k *KeyRing) JWKS() JWKS {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	set := JWKS{Keys: make([]JWK, 0, len(k.keys))}
+	for kid, key := range k.keys {
+		set.Keys = append(set.Keys, JWK{
+			Kty: "RSA",
+			Use: "sig",
+			Alg: jwt.SigningMethodRS256.Alg(),
+			Kid: kid,
+			N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		})
+	}
+	sort.Slice(set.Keys, func(i, j int) bool { return set.Keys[i].Kid < set.Keys[j].Kid })
+	return set
+}
+
+// KeyID derives a stable key ID from a public key using its JWK thumbprint (RFC 7638).
+func KeyID(key *rsa.PublicKey) string {
+	// The thumbprint input is the JSON of the required members in lexicographic order.
+	thumbprintInput, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+	})
+	sum := sha256.Sum256(thumbprintInput)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func tokenKeyID(t *testing.T, tokenString string) string {
+	t.Helper()
+	token, _, err := jwt.NewParser().ParseUnverified(tokenString, &AuthClaims{})
+	if err != nil {
+		t.Fatalf("Failed to parse token: %v", err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return kid
+}
+
+func TestKeyRotation(t *testing.T) {
+	keyRing = NewKeyRing()
+	keyRing.AddKey("old", generateTestKey(t))
+
+	oldToken, err := GenerateToken(1, "user", 1)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	if kid := tokenKeyID(t, oldToken); kid != "old" {
+		t.Errorf("expected kid %q; got %q", "old", kid)
+	}
+
+	// Step 1: bring in the new key. It is published but not used for signing yet.
+	keyRing.AddKey("new", generateTestKey(t))
+	if len(keyRing.JWKS().Keys) != 2 {
+		t.Errorf("expected both keys to be published; got %d", len(keyRing.JWKS().Keys))
+	}
+	if token, _ := GenerateToken(1, "user", 1); tokenKeyID(t, token) != "old" {
+		t.Error("expected tokens to be signed with the old key until promotion")
+	}
+
+	// Step 2: promote it. Tokens signed with either key validate.
+	if err := keyRing.Promote("new"); err != nil {
+		t.Fatalf("Failed to promote key: %v", err)
+	}
+	newToken, _ := Generate2FATempToken(1)
+	if kid := tokenKeyID(t, newToken); kid != "new" {
+		t.Errorf("expected kid %q; got %q", "new", kid)
+	}
+	if _, err := ValidateToken(oldToken); err != nil {
+		t.Errorf("expected old token to validate before retirement; got %v", err)
+	}
+	if _, err := ValidateToken(newToken); err != nil {
+		t.Errorf("expected new token to validate; got %v", err)
+	}
+
+	// Step 3: retire the old key. Its tokens stop validating.
+	if err := keyRing.Retire("new"); err == nil {
+		t.Error("expected retiring the active key to fail")
+	}
+	if err := keyRing.Retire("old"); err != nil {
+		t.Fatalf("Failed to retire key: %v", err)
+	}
+	if _, err := ValidateToken(oldToken); err == nil {
+		t.Error("expected token signed with a retired key to be rejected")
+	}
+	if _, err := ValidateToken(newToken); err != nil {
+		t.Errorf("expected new token to still validate; got %v", err)
+	}
+}
+
+func writeTestKey(t *testing.T, dir, kid string, key *rsa.PrivateKey) {
+	t.Helper()
+	pemData := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := os.WriteFile(filepath.Join(dir, kid+".pem"), pemData, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+func TestLoadKeyDir(t *testing.T) {
+	keyRing = NewKeyRing()
+	dir := t.TempDir()
+	writeTestKey(t, dir, "2024-01", generateTestKey(t))
+	writeTestKey(t, dir, "2024-07", generateTestKey(t))
+	os.WriteFile(filepath.Join(dir, activeKeyFile), []byte("2024-01\n"), 0600)
+
+	if err := LoadKeyDir(dir); err != nil {
+		t.Fatalf("Failed to load key dir: %v", err)
+	}
+	if kid := keyRing.ActiveKeyID(); kid != "2024-01" {
+		t.Errorf("expected active key %q; got %q", "2024-01", kid)
+	}
+
+	// Promote by rewriting the active file, retire by deleting the old key.
+	os.WriteFile(filepath.Join(dir, activeKeyFile), []byte("2024-07"), 0600)
+	os.Remove(filepath.Join(dir, "2024-01.pem"))
+	if err := LoadKeyDir(dir); err != nil {
+		t.Fatalf("Failed to reload key dir: %v", err)
+	}
+	set := keyRing.JWKS()
+	if len(set.Keys) != 1 || set.Keys[0].Kid != "2024-07" {
+		t.Errorf("expected only key 2024-07 to remain; got %+v", set.Keys)
+	}
+
+	// A broken directory must leave the loaded keys untouched.
+	os.WriteFile(filepath.Join(dir, activeKeyFile), []byte("missing"), 0600)
+	if err := LoadKeyDir(dir); err == nil {
+		t.Error("expected an error for an unknown active key")
+	}
+	if kid := keyRing.ActiveKeyID(); kid != "2024-07" {
+		t.Errorf("expected active key to stay %q; got %q", "2024-07", kid)
+	}
+}
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Errors returned by PasswordPolicy checks. Their messages are safe to show to users.
+var (
+	ErrPasswordTooShort     = errors.New("password is too short")
+	ErrPasswordTooLong      = errors.New("password is too long")
+	ErrPasswordBanned       = errors.New("password is too common; please choose another one")
+	ErrPasswordIsEmail      = errors.New("password must not be the same as your email address")
+	ErrPasswordRecentlyUsed = errors.New("password was used recently; please choose another one")
+)
+
+// maxPasswordBytes is the longest password bcrypt accepts.
+const maxPasswordBytes = 72
+
+// PasswordPolicy describes the rules every new password must satisfy.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// HistorySize is how many of the user's previous passwords, including the
+	// current one, may not be reused.
+	HistorySize int
+	// banned holds lower-cased passwords that are never accepted.
+	banned map[string]struct{}
+}
+
+// DefaultPasswordPolicy returns the policy used when nothing else is configured.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{MinLength: 8, HistorySize: 5}
+}
+
+// LoadBannedPasswords reads a banned-password list, one password per line.
+// Blank lines and lines starting with '#' are ignored; matching is case-insensitive.
+func (p *PasswordPolicy) LoadBannedPasswords(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening banned password list: %w", err)
+	}
+	defer file.Close()
+
+	banned := make(map[string]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		banned[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading banned password list: %w", err)
+	}
+	p.banned = banned
+	return nil
+}
+
+// Validate checks a new password for the account with the given email address.
+func (p *PasswordPolicy) Validate(password, email string) error {
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Errorf("%w: it must be at least %d characters", ErrPasswordTooShort, p.MinLength)
+	}
+	if len(password) > maxPasswordBytes {
+		return fmt.Errorf("%w: it must be at most %d bytes", ErrPasswordTooLong, maxPasswordBytes)
+	}
+	if email != "" && strings.EqualFold(password, email) {
+		return ErrPasswordIsEmail
+	}
+	if _, ok := p.banned[strings.ToLower(password)]; ok {
+		return ErrPasswordBanned
+	}
+	return nil
+}
+
+// CheckHistory rejects a password that matches any of the given bcrypt hashes of
+// the user's previous passwords. Only the first HistorySize hashes are checked.
+func (p *PasswordPolicy) CheckHistory(password string, previousHashes []string) error {
+	for i, hash := range previousHashes {
+		if i >= p.HistorySize {
+			break
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil {
+			return ErrPasswordRecentlyUsed
+		}
+	}
+	return nil
+}
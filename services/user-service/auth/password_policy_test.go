@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := DefaultPasswordPolicy()
+	bannedFile := filepath.Join(t.TempDir(), "banned.txt")
+	os.WriteFile(bannedFile, []byte("# common passwords\npassword123\n\nQwertyuiop\n"), 0644)
+	if err := policy.LoadBannedPasswords(bannedFile); err != nil {
+		t.Fatalf("Failed to load banned passwords: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		expected error
+	}{
+		{"Valid", "correct horse battery", nil},
+		{"Too short", "short", ErrPasswordTooShort},
+		{"Too long", strings.Repeat("a", 73), ErrPasswordTooLong},
+		{"Banned", "PASSWORD123", ErrPasswordBanned},
+		{"Banned, case-insensitive", "qwertyuiop", ErrPasswordBanned},
+		{"Equal to email", "Test@Example.com", ErrPasswordIsEmail},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := policy.Validate(tc.password, "test@example.com")
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v; got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyCheckHistory(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 8, HistorySize: 2}
+	hash := func(password string) string {
+		h, _ := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		return string(h)
+	}
+	history := []string{hash("current-password"), hash("previous-password"), hash("ancient-password")}
+
+	if err := policy.CheckHistory("current-password", history); !errors.Is(err, ErrPasswordRecentlyUsed) {
+		t.Errorf("expected the current password to be rejected; got %v", err)
+	}
+	if err := policy.CheckHistory("previous-password", history); !errors.Is(err, ErrPasswordRecentlyUsed) {
+		t.Errorf("expected the previous password to be rejected; got %v", err)
+	}
+	if err := policy.CheckHistory("ancient-password", history); err != nil {
+		t.Errorf("expected a password older than the history size to be accepted; got %v", err)
+	}
+}
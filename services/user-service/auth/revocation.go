@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrTokenRevoked is returned by ValidateToken for a token issued before the
+// user's most recent security event (password reset, deactivation, ...).
+var ErrTokenRevoked = errors.New("token has been revoked")
+
+// revocationCacheTTL bounds how long a looked-up revocation time is trusted before
+// asking the store again. Revocations made by this instance take effect immediately;
+// revocations made by other instances take effect within this window.
+const revocationCacheTTL = 30 * time.Second
+
+// RevocationStore persists the time of each user's most recent security event.
+// Every token issued to the user before that time is considered revoked.
+type RevocationStore interface {
+	// RevokeUserTokens records a security event for the user and returns its time.
+	RevokeUserTokens(ctx context.Context, userID int64) (time.Time, error)
+	// GetTokensRevokedAt returns the time of the user's last security event,
+	// or the zero time if there has never been one.
+	GetTokensRevokedAt(ctx context.Context, userID int64) (time.Time, error)
+}
+
+type cachedRevocation struct {
+	revokedAt time.Time
+	fetchedAt time.Time
+}
+
+var (
+	revocationStore RevocationStore
+	revocationMu    sync.RWMutex
+	revocationCache = make(map[int64]cachedRevocation)
+	// revocationSweptAt is when stale entries were last removed from revocationCache.
+	revocationSweptAt time.Time
+)
+
+// SetRevocationStore configures where revocation times are persisted. Without a
+// store, revocations are only kept in memory for the lifetime of the process.
+func SetRevocationStore(store RevocationStore) {
+	revocationMu.Lock()
+	defer revocationMu.Unlock()
+	revocationStore = store
+	revocationCache = make(map[int64]cachedRevocation)
+	revocationSweptAt = time.Now()
+}
+
+// RevokeUserTokens invalidates every token issued to the user up to now.
+func RevokeUserTokens(ctx context.Context, userID int64) (time.Time, error) {
+	revocationMu.RLock()
+	store := revocationStore
+	revocationMu.RUnlock()
+
+	revokedAt := time.Now()
+	if store != nil {
+		var err error
+		revokedAt, err = store.RevokeUserTokens(ctx, userID)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	cacheRevocation(userID, revokedAt)
+	return revokedAt, nil
+}
+
+// tokensRevokedAt returns the user's revocation time, consulting the cache first.
+func tokensRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	revocationMu.RLock()
+	cached, ok := revocationCache[userID]
+	store := revocationStore
+	revocationMu.RUnlock()
+
+	if ok && (store == nil || time.Since(cached.fetchedAt) < revocationCacheTTL) {
+		return cached.revokedAt, nil
+	}
+	if store == nil {
+		return time.Time{}, nil
+	}
+
+	revokedAt, err := store.GetTokensRevokedAt(ctx, userID)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	cacheRevocation(userID, revokedAt)
+	return revokedAt, nil
+}
+
+// cacheRevocation caches the user's revocation time. With a store, entries older
+// than revocationCacheTTL are read from the store again anyway, so they are removed
+// at most once per revocationCacheTTL to keep the cache from growing with every
+// user who has ever been seen. Without a store the cache is the only record of
+// revocations, so nothing is removed.
+func cacheRevocation(userID int64, revokedAt time.Time) {
+	revocationMu.Lock()
+	defer revocationMu.Unlock()
+
+	now := time.Now()
+	if revocationStore != nil && now.Sub(revocationSweptAt) >= revocationCacheTTL {
+		for id, cached := range revocationCache {
+			if now.Sub(cached.fetchedAt) >= revocationCacheTTL {
+				delete(revocationCache, id)
+			}
+		}
+		revocationSweptAt = now
+	}
+	revocationCache[userID] = cachedRevocation{revokedAt: revokedAt, fetchedAt: now}
+}
+
+// checkRevocation rejects claims issued before the user's last security event.
+// JWT timestamps only have second precision, so a token issued within the same
+// second as the revocation is rejected too: it may have been issued before it.
+// Tokens this instance issues right after a revocation get a later issue time
+// from issuedAt, so they are not rejected with it.
+//
+// Only this service checks revocation. The gateway and the other services verify
+// the signature and expiry alone, so a revoked access token is accepted there
+// until it expires, at most AccessTokenTTL later; its refresh token is not.
+func checkRevocation(claims *AuthClaims) error {
+	if claims.IssuedAt == nil {
+		return ErrTokenRevoked
+	}
+	revokedAt, err := tokensRevokedAt(context.Background(), claims.UserID)
+	if err != nil {
+		// Fail closed: a token we cannot check (e.g. the user was deleted) is not trusted.
+		return ErrTokenRevoked
+	}
+	if !claims.IssuedAt.Time.After(revokedAt.Truncate(time.Second)) {
+		return ErrTokenRevoked
+	}
+	return nil
+}
+
+// issuedAt returns the issue time of a new token for the user: now, or the start of
+// the next second if this instance revoked the user's tokens within the current
+// second, so that checkRevocation does not reject the new token along with them.
+func issuedAt(userID int64) time.Time {
+	revocationMu.RLock()
+	cached, ok := revocationCache[userID]
+	revocationMu.RUnlock()
+
+	now := time.Now()
+	if revokedAt := cached.revokedAt.Truncate(time.Second); ok && !now.Truncate(time.Second).After(revokedAt) {
+		return revokedAt.Add(time.Second)
+	}
+	return now
+}
@@ -0,0 +1,131 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeRevocationStore is an in-memory RevocationStore.
+type fakeRevocationStore struct {
+	revokedAt map[int64]time.Time
+}
+
+func (f *fakeRevocationStore) RevokeUserTokens(ctx context.Context, userID int64) (time.Time, error) {
+	// Pretend the security event happened well after any token issued so far.
+	f.revokedAt[userID] = time.Now().Add(2 * time.Second)
+	return f.revokedAt[userID], nil
+}
+
+func (f *fakeRevocationStore) GetTokensRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	return f.revokedAt[userID], nil
+}
+
+func setupTestSignKey(t *testing.T) {
+	t.Helper()
+	keyRing = NewKeyRing()
+	keyRing.AddKey("test", generateTestKey(t))
+}
+
+func generateTestKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate private key: %v", err)
+	}
+	return key
+}
+
+func TestRevokeUserTokens(t *testing.T) {
+	setupTestSignKey(t)
+	store := &fakeRevocationStore{revokedAt: make(map[int64]time.Time)}
+	SetRevocationStore(store)
+	defer SetRevocationStore(nil)
+
+	token, err := GenerateToken(1, "user", 1)
+	if err != nil {
+		t.Fatalf("Failed to generate token: %v", err)
+	}
+	otherToken, _ := GenerateToken(2, "user", 2)
+
+	if _, err := ValidateToken(token); err != nil {
+		t.Fatalf("expected token to be valid before revocation; got %v", err)
+	}
+
+	if _, err := RevokeUserTokens(context.Background(), 1); err != nil {
+		t.Fatalf("Failed to revoke tokens: %v", err)
+	}
+
+	if _, err := ValidateToken(token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked; got %v", err)
+	}
+	if _, err := ValidateToken(otherToken); err != nil {
+		t.Errorf("expected other user's token to stay valid; got %v", err)
+	}
+}
+
+func TestRevocationWithinTheSameSecond(t *testing.T) {
+	setupTestSignKey(t)
+	SetRevocationStore(nil)
+
+	// JWT issue times are whole seconds, so a token issued in the second of the
+	// revocation cannot be told apart from one issued after it.
+	token, _ := GenerateToken(1, "user", 1)
+	revokedAt, err := RevokeUserTokens(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Failed to revoke tokens: %v", err)
+	}
+	if _, err := ValidateToken(token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected a token issued before the revocation to be revoked; got %v", err)
+	}
+
+	newToken, _ := GenerateToken(1, "user", 2)
+	claims, err := ValidateToken(newToken)
+	if err != nil {
+		t.Fatalf("expected a token issued after the revocation to be valid; got %v", err)
+	}
+	if !claims.IssuedAt.After(revokedAt) || claims.IssuedAt.After(revokedAt.Add(time.Second)) {
+		t.Errorf("expected the new token to be issued within a second after %v; got %v", revokedAt, claims.IssuedAt)
+	}
+}
+
+func TestRevocationSurvivesCacheExpiry(t *testing.T) {
+	setupTestSignKey(t)
+	store := &fakeRevocationStore{revokedAt: map[int64]time.Time{1: time.Now().Add(time.Minute)}}
+	SetRevocationStore(store)
+	defer SetRevocationStore(nil)
+
+	// Nothing is cached yet, so the revocation must be read from the store.
+	token, _ := GenerateToken(1, "user", 1)
+	if _, err := ValidateToken(token); !errors.Is(err, ErrTokenRevoked) {
+		t.Errorf("expected ErrTokenRevoked from stored revocation; got %v", err)
+	}
+}
+
+func TestRevocationCacheDropsStaleEntries(t *testing.T) {
+	store := &fakeRevocationStore{revokedAt: make(map[int64]time.Time)}
+	SetRevocationStore(store)
+	defer SetRevocationStore(nil)
+
+	for userID := int64(1); userID <= 3; userID++ {
+		tokensRevokedAt(context.Background(), userID)
+	}
+	// Pretend the entries were fetched long ago.
+	revocationMu.Lock()
+	for userID, cached := range revocationCache {
+		cached.fetchedAt = time.Now().Add(-2 * revocationCacheTTL)
+		revocationCache[userID] = cached
+	}
+	revocationSweptAt = time.Now().Add(-2 * revocationCacheTTL)
+	revocationMu.Unlock()
+
+	tokensRevokedAt(context.Background(), 4)
+	revocationMu.RLock()
+	defer revocationMu.RUnlock()
+	if _, ok := revocationCache[4]; len(revocationCache) != 1 || !ok {
+		t.Errorf("expected only the fresh entry to be kept; got %v", revocationCache)
+	}
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AttemptRecord is the failed-attempt history of a single throttling key.
+type AttemptRecord struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+// AttemptStore persists failed login attempts per key (an account or a client IP).
+// Implementations must be safe for concurrent use.
+type AttemptStore interface {
+	// GetAttempts returns the record for key, or a zero record if there is none.
+	GetAttempts(ctx context.Context, key string) (AttemptRecord, error)
+	// RecordFailure adds a failed attempt to key and returns the updated record.
+	// If the previous failure is older than window, counting starts over at one.
+	RecordFailure(ctx context.Context, key string, window time.Duration) (AttemptRecord, error)
+	// ClearAttempts forgets every failed attempt recorded for key.
+	ClearAttempts(ctx context.Context, key string) error
+}
+
+// ThrottlePolicy describes how failed attempts on a key are slowed down.
+type ThrottlePolicy struct {
+	// FreeAttempts is the number of failures allowed before any delay is imposed.
+	FreeAttempts int
+	// BaseDelay is the delay after the first failure past FreeAttempts. It doubles
+	// with every further failure, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter is the number of failures that locks the key for LockoutDuration.
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Window is how long failures are remembered after the most recent one.
+	Window time.Duration
+}
+
+var (
+	// DefaultAccountPolicy guards a single account against password and 2FA code guessing.
+	DefaultAccountPolicy = ThrottlePolicy{
+		FreeAttempts:    3,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    10,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	// DefaultIPPolicy guards against a single client spraying guesses across many
+	// accounts. It is looser than the account policy as clients may share an IP.
+	DefaultIPPolicy = ThrottlePolicy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: 15 * time.Minute,
+		Window:          time.Hour,
+	}
+	// DefaultEmailPolicy spaces out the emails an account is sent on request, such
+	// as verification links: each one must wait a minute after the previous one,
+	// doubling with every further email up to an hour.
+	DefaultEmailPolicy = ThrottlePolicy{
+		BaseDelay: time.Minute,
+		MaxDelay:  time.Hour,
+		Window:    24 * time.Hour,
+	}
+	// DefaultEmailIPPolicy guards against a single client requesting emails for
+	// many accounts.
+	DefaultEmailIPPolicy = ThrottlePolicy{
+		FreeAttempts: 10,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		Window:       time.Hour,
+	}
+)
+
+// retryAt returns when the next attempt on a key with the given record is allowed,
+// and whether that is because the key is locked out.
+func (p ThrottlePolicy) retryAt(record AttemptRecord) (time.Time, bool) {
+	if p.LockoutAfter > 0 && record.Failures >= p.LockoutAfter {
+		return record.LastFailure.Add(p.LockoutDuration), true
+	}
+	if record.Failures <= p.FreeAttempts {
+		return time.Time{}, false
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < record.Failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return record.LastFailure.Add(delay), false
+}
+
+// LoginThrottle applies exponential backoff and temporary lockouts to failed
+// logins, tracked both per account and per client IP.
+type LoginThrottle struct {
+	store   AttemptStore
+	prefix  string
+	account ThrottlePolicy
+	ip      ThrottlePolicy
+	now     func() time.Time
+}
+
+// NewLoginThrottle creates a LoginThrottle that keeps its counters in store.
+func NewLoginThrottle(store AttemptStore, accountPolicy, ipPolicy ThrottlePolicy) *LoginThrottle {
+	return &LoginThrottle{store: store, account: accountPolicy, ip: ipPolicy, now: time.Now}
+}
+
+// NewThrottle creates a LoginThrottle for requests other than logins, such as
+// sending emails. Its counters are kept in store under keys prefixed with name, so
+// they can share a store with the login counters.
+func NewThrottle(name string, store AttemptStore, accountPolicy, ipPolicy ThrottlePolicy) *LoginThrottle {
+	return &LoginThrottle{store: store, prefix: name + ":", account: accountPolicy, ip: ipPolicy, now: time.Now}
+}
+
+func (t *LoginThrottle) accountKey(userID int64) string {
+	return fmt.Sprintf("%saccount:%d", t.prefix, userID)
+}
+
+func (t *LoginThrottle) ipKey(ip string) string {
+	return t.prefix + "ip:" + ip
+}
+
+// RetryAfter returns how long the caller must wait before another login attempt
+// for the account and IP is accepted, or zero if it may proceed now. A userID of
+// zero checks the IP only, for attempts on accounts that do not exist.
+func (t *LoginThrottle) RetryAfter(ctx context.Context, userID int64, ip string) (time.Duration, error) {
+	wait, err := t.retryAfter(ctx, t.ipKey(ip), t.ip)
+	if err != nil || userID == 0 {
+		return wait, err
+	}
+	accountWait, err := t.retryAfter(ctx, t.accountKey(userID), t.account)
+	if accountWait > wait {
+		wait = accountWait
+	}
+	return wait, err
+}
+
+func (t *LoginThrottle) retryAfter(ctx context.Context, key string, policy ThrottlePolicy) (time.Duration, error) {
+	record, err := t.store.GetAttempts(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	now := t.now()
+	if record.Failures == 0 || now.Sub(record.LastFailure) > policy.Window {
+		return 0, nil
+	}
+	retryAt, _ := policy.retryAt(record)
+	if wait := retryAt.Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// RecordFailure counts a failed login for the account and IP. If the failure
+// locks the account, it returns the time the lockout ends; otherwise it returns
+// the zero time. A userID of zero records the failure against the IP only.
+func (t *LoginThrottle) RecordFailure(ctx context.Context, userID int64, ip string) (time.Time, error) {
+	if _, err := t.store.RecordFailure(ctx, t.ipKey(ip), t.ip.Window); err != nil {
+		return time.Time{}, err
+	}
+	if userID == 0 {
+		return time.Time{}, nil
+	}
+	record, err := t.store.RecordFailure(ctx, t.accountKey(userID), t.account.Window)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if lockedUntil, locked := t.account.retryAt(record); locked {
+		return lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+// RecordSuccess clears the account's failure count after a successful login.
+// The IP's count is left alone so that one valid account cannot be used to
+// reset the throttle while guessing at others.
+func (t *LoginThrottle) RecordSuccess(ctx context.Context, userID int64) error {
+	return t.store.ClearAttempts(ctx, t.accountKey(userID))
+}
+
+// MemoryAttemptStore is an AttemptStore that keeps attempts in process memory.
+// Counters are not shared between instances and are lost on restart, so it is
+// meant for tests and single-instance deployments.
+type MemoryAttemptStore struct {
+	mu       sync.Mutex
+	attempts map[string]AttemptRecord
+	now      func() time.Time
+}
+
+// NewMemoryAttemptStore creates an empty MemoryAttemptStore.
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{attempts: make(map[string]AttemptRecord), now: time.Now}
+}
+
+// GetAttempts implements AttemptStore.
+func (s *MemoryAttemptStore) GetAttempts(ctx context.Context, key string) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.attempts[key], nil
+}
+
+// RecordFailure implements AttemptStore.
+func (s *MemoryAttemptStore) RecordFailure(ctx context.Context, key string, window time.Duration) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	record := s.attempts[key]
+	if now.Sub(record.LastFailure) > window {
+		record.Failures = 0
+	}
+	record.Failures++
+	record.LastFailure = now
+	s.attempts[key] = record
+	return record, nil
+}
+
+// ClearAttempts implements AttemptStore.
+func (s *MemoryAttemptStore) ClearAttempts(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.attempts, key)
+	return nil
+}
@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// newTestThrottle returns a throttle over an in-memory store whose clock is driven by *now.
+func newTestThrottle(now *time.Time) *LoginThrottle {
+	store := NewMemoryAttemptStore()
+	store.now = func() time.Time { return *now }
+	throttle := NewLoginThrottle(store, ThrottlePolicy{
+		FreeAttempts:    2,
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+		LockoutAfter:    6,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	}, DefaultIPPolicy)
+	throttle.now = func() time.Time { return *now }
+	return throttle
+}
+
+func TestLoginThrottleBackoff(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	throttle := newTestThrottle(&now)
+
+	// Each failure is made as soon as it is allowed; the waits double up to MaxDelay.
+	expectedWaits := []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second}
+	for i, expected := range expectedWaits {
+		if lockedUntil, _ := throttle.RecordFailure(ctx, 1, "10.0.0.1"); !lockedUntil.IsZero() {
+			t.Fatalf("failure %d: unexpected lockout", i+1)
+		}
+		wait, err := throttle.RetryAfter(ctx, 1, "10.0.0.1")
+		if err != nil {
+			t.Fatalf("RetryAfter: %v", err)
+		}
+		if wait != expected {
+			t.Errorf("after failure %d: expected wait %v; got %v", i+1, expected, wait)
+		}
+		now = now.Add(wait)
+	}
+
+	// Other accounts from another IP are unaffected.
+	if wait, _ := throttle.RetryAfter(ctx, 2, "10.0.0.2"); wait != 0 {
+		t.Errorf("expected no wait for another account; got %v", wait)
+	}
+}
+
+func TestLoginThrottleLockout(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	throttle := newTestThrottle(&now)
+
+	var lockedUntil time.Time
+	for i := 0; i < 6; i++ {
+		lockedUntil, _ = throttle.RecordFailure(ctx, 1, "10.0.0.1")
+	}
+	if !lockedUntil.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected lockout until %v; got %v", now.Add(time.Minute), lockedUntil)
+	}
+	if wait, _ := throttle.RetryAfter(ctx, 1, "10.0.0.1"); wait != time.Minute {
+		t.Errorf("expected to wait out the lockout; got %v", wait)
+	}
+
+	// A successful login clears the account's counter.
+	now = now.Add(time.Minute)
+	throttle.RecordSuccess(ctx, 1)
+	if lockedUntil, _ := throttle.RecordFailure(ctx, 1, "10.0.0.1"); !lockedUntil.IsZero() {
+		t.Error("expected the counter to start over after a successful login")
+	}
+}
+
+func TestLoginThrottleWindow(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	throttle := newTestThrottle(&now)
+
+	for i := 0; i < 5; i++ {
+		throttle.RecordFailure(ctx, 1, "10.0.0.1")
+	}
+	now = now.Add(2 * time.Hour)
+	if wait, _ := throttle.RetryAfter(ctx, 1, "10.0.0.1"); wait != 0 {
+		t.Errorf("expected old failures to be forgotten; got wait %v", wait)
+	}
+	throttle.RecordFailure(ctx, 1, "10.0.0.1")
+	if wait, _ := throttle.RetryAfter(ctx, 1, "10.0.0.1"); wait != 0 {
+		t.Errorf("expected counting to start over; got wait %v", wait)
+	}
+}
+
+func TestLoginThrottlePerIP(t *testing.T) {
+	ctx := context.Background()
+	throttle := NewLoginThrottle(NewMemoryAttemptStore(), DefaultAccountPolicy, ThrottlePolicy{
+		LockoutAfter:    3,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	})
+
+	// Failures against unknown accounts still count towards the IP.
+	for i := 0; i < 3; i++ {
+		throttle.RecordFailure(ctx, 0, "10.0.0.1")
+	}
+	if wait, _ := throttle.RetryAfter(ctx, 0, "10.0.0.1"); wait <= 0 {
+		t.Error("expected the IP to be locked out")
+	}
+	if wait, _ := throttle.RetryAfter(ctx, 0, "10.0.0.2"); wait != 0 {
+		t.Errorf("expected another IP to be unaffected; got %v", wait)
+	}
+}
+
+func TestNamedThrottlesShareAStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryAttemptStore()
+	policy := ThrottlePolicy{LockoutAfter: 1, LockoutDuration: time.Minute, Window: time.Hour}
+	login := NewLoginThrottle(store, policy, policy)
+	email := NewThrottle("email", store, policy, policy)
+
+	email.RecordFailure(ctx, 1, "10.0.0.1")
+	if wait, _ := email.RetryAfter(ctx, 1, "10.0.0.1"); wait <= 0 {
+		t.Error("expected the email throttle to apply")
+	}
+	if wait, _ := login.RetryAfter(ctx, 1, "10.0.0.1"); wait != 0 {
+		t.Errorf("expected logins to be unaffected; got %v", wait)
+	}
+}
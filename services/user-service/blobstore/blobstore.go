@@ -0,0 +1,44 @@
+// Package blobstore stores files, such as profile pictures, outside the database.
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// BlobStore stores blobs under slash-separated keys, e.g. "profile-pictures/1/ab12-64.jpg".
+type BlobStore interface {
+	// Put stores data under key, replacing any blob already stored there.
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Delete removes the blob stored under key. Deleting a blob that does not
+	// exist is not an error.
+	Delete(ctx context.Context, key string) error
+	// URL returns the public URL the blob stored under key is served from.
+	URL(key string) string
+}
+
+// ValidateKey rejects keys that could escape the store, such as "../secrets" or
+// "/etc/passwd". Keys consist of non-empty segments of letters, digits, '-', '_'
+// and '.', separated by slashes.
+func ValidateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("blobstore: empty key")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("blobstore: invalid key %q", key)
+		}
+		for _, r := range segment {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+				return fmt.Errorf("blobstore: invalid key %q", key)
+			}
+		}
+	}
+	return nil
+}
+
+// joinURL appends key to baseURL.
+func joinURL(baseURL, key string) string {
+	return strings.TrimSuffix(baseURL, "/") + "/" + key
+}
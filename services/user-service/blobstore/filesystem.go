@@ -0,0 +1,73 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// FileSystem stores blobs as files in a directory. The service (or a web server in
+// front of it) serves the directory at BaseURL.
+type FileSystem struct {
+	Dir     string
+	BaseURL string
+}
+
+// NewFileSystem returns a store that keeps blobs in dir and serves them from baseURL.
+func NewFileSystem(dir, baseURL string) *FileSystem {
+	return &FileSystem{Dir: dir, BaseURL: baseURL}
+}
+
+// Put writes the blob to a temporary file and renames it into place, so readers
+// never see a partially written blob.
+func (s *FileSystem) Put(ctx context.Context, key string, data []byte, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Delete removes the blob's file.
+func (s *FileSystem) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// URL returns BaseURL followed by the key.
+func (s *FileSystem) URL(key string) string {
+	return joinURL(s.BaseURL, key)
+}
+
+func (s *FileSystem) path(key string) (string, error) {
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
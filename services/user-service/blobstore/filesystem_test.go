@@ -0,0 +1,48 @@
+package blobstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSystem(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileSystem(dir, "/media/")
+	ctx := context.Background()
+
+	if err := store.Put(ctx, "profile-pictures/1/a-64.jpg", []byte("first"), "image/jpeg"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put(ctx, "profile-pictures/1/a-64.jpg", []byte("second"), "image/jpeg"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "profile-pictures", "1", "a-64.jpg"))
+	if err != nil || string(data) != "second" {
+		t.Errorf("expected the replaced blob on disk; got %q (%v)", data, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "profile-pictures", "1")); len(entries) != 1 {
+		t.Errorf("expected no temporary files to be left behind; got %d entries", len(entries))
+	}
+
+	if got := store.URL("profile-pictures/1/a-64.jpg"); got != "/media/profile-pictures/1/a-64.jpg" {
+		t.Errorf("unexpected URL %s", got)
+	}
+
+	if err := store.Delete(ctx, "profile-pictures/1/a-64.jpg"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "profile-pictures", "1", "a-64.jpg")); !os.IsNotExist(err) {
+		t.Errorf("expected the blob to be deleted; got %v", err)
+	}
+	if err := store.Delete(ctx, "profile-pictures/1/a-64.jpg"); err != nil {
+		t.Errorf("expected deleting a missing blob to succeed; got %v", err)
+	}
+
+	for _, key := range []string{"", "../outside.jpg", "/etc/passwd", "a//b", "a/./b", `a\b`} {
+		if err := store.Put(ctx, key, []byte("data"), "image/jpeg"); err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
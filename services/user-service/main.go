@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-
+	"github.com/free-education/authz"
+	"github.com/free-education/erasure"
 	"github.com/free-education/user-service/api"
+	"github.com/free-education/user-service/blobstore"
 	"github.com/free-education/user-service/messaging"
-	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/oauth"
+	"github.com/free-education/user-service/passkey"
 	"github.com/free-education/user-service/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v4/pgxpool"
@@ -21,14 +26,24 @@ import (
 
 func main() {
 	// --- Key Loading ---
-	privateKeyPath := os.Getenv("JWT_PRIVATE_KEY_PATH")
-	if privateKeyPath == "" {
-		privateKeyPath = "../secrets/jwtRS256.key"
-		log.Println("JWT_PRIVATE_KEY_PATH not set, using default value.")
-	}
-	if err := auth.LoadPrivateKey(privateKeyPath); err != nil {
-		log.Fatalf("Failed to load private key: %v", err)
+	// JWT_KEYS_DIR enables key rotation: it holds one <kid>.pem file per key and an
+	// `active` file naming the signing key. Send SIGHUP to reload it after a change.
+	if keysDir := os.Getenv("JWT_KEYS_DIR"); keysDir != "" {
+		if err := auth.LoadKeyDir(keysDir); err != nil {
+			log.Fatalf("Failed to load signing keys: %v", err)
+		}
+		go reloadKeysOnSignal(keysDir)
+	} else {
+		privateKeyPath := os.Getenv("JWT_PRIVATE_KEY_PATH")
+		if privateKeyPath == "" {
+			privateKeyPath = "../secrets/jwtRS256.key"
+			log.Println("JWT_PRIVATE_KEY_PATH not set, using default value.")
+		}
+		if err := auth.LoadPrivateKey(privateKeyPath); err != nil {
+			log.Fatalf("Failed to load private key: %v", err)
+		}
 	}
+	log.Printf("Signing tokens with key %s", auth.Keys().ActiveKeyID())
 
 	// --- Database Connection ---
 	databaseURL := os.Getenv("DATABASE_URL")
@@ -46,6 +61,12 @@ func main() {
 
 	// --- Dependency Injection ---
 	userStore := storage.NewUserStore(dbpool)
+	if n, err := userStore.BackfillIdentities(context.Background()); err != nil {
+		log.Fatalf("Failed to backfill user identities: %v", err)
+	} else if n > 0 {
+		log.Printf("Backfilled %d user identities", n)
+	}
+	auth.SetRevocationStore(userStore)
 
 	rabbitMQURL := os.Getenv("RABBITMQ_URL")
 	if rabbitMQURL == "" {
@@ -58,34 +79,9 @@ func main() {
 	}
 	defer messageBroker.Close()
 
-	// --- Start RabbitMQ Consumer for User Activities ---
-	activityHandler := func(body []byte) {
-		var event struct {
-			EventType string             `json:"eventType"`
-			Payload   model.UserActivity `json:"payload"`
-		}
-		if err := json.Unmarshal(body, &event); err != nil {
-			log.Printf("Error unmarshalling activity event: %v", err)
-			return
-		}
-
-		// We only care about the payload, which should be a UserActivity
-		if err := userStore.CreateUserActivity(context.Background(), &event.Payload); err != nil {
-			log.Printf("Error creating user activity: %v", err)
-		}
-	}
-	if err := messageBroker.Consume(context.Background(), "user_activity_events", activityHandler); err != nil {
-		log.Fatalf("Failed to start user activity consumer: %v", err)
-	}
-
-	// --- OAuth2 Config ---
-	googleOAuthConfig := &oauth2.Config{
-		RedirectURL:  "http://localhost:8080/api/users/login/google/callback",
-		ClientID:     os.Getenv("GOOGLE_OAUTH_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET"),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.email", "https://www.googleapis.com/auth/userinfo.profile"},
-		Endpoint:     google.Endpoint,
-	}
+	// --- OAuth Providers ---
+	oauthProviders := loadOAuthProviders()
+	log.Printf("OAuth login providers: %v", oauthProviders.Names())
 
 	frontendBaseURL := os.Getenv("FRONTEND_BASE_URL")
 	if frontendBaseURL == "" {
@@ -103,16 +99,189 @@ func main() {
 		log.Println("GAMIFICATION_SERVICE_URL not set, using default value.")
 	}
 
-	apiHandler := api.NewAPI(userStore, messageBroker, frontendBaseURL, contentServiceURL, gamificationServiceURL, googleOAuthConfig)
+	apiHandler := api.NewAPI(userStore, messageBroker, frontendBaseURL, contentServiceURL, gamificationServiceURL, oauthProviders)
+	// Keep failed-login and email counters in the database so they are shared by all instances.
+	apiHandler.LoginThrottle = auth.NewLoginThrottle(userStore, auth.DefaultAccountPolicy, auth.DefaultIPPolicy)
+	apiHandler.EmailThrottle = auth.NewThrottle("email", userStore, auth.DefaultEmailPolicy, auth.DefaultEmailIPPolicy)
+
+	// Password policy: PASSWORD_MIN_LENGTH, PASSWORD_HISTORY_SIZE and an optional
+	// PASSWORD_BANNED_LIST_FILE with one banned password per line.
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		n, err := strconv.Atoi(minLength)
+		if err != nil {
+			log.Fatalf("Invalid PASSWORD_MIN_LENGTH: %v", err)
+		}
+		apiHandler.PasswordPolicy.MinLength = n
+	}
+	if historySize := os.Getenv("PASSWORD_HISTORY_SIZE"); historySize != "" {
+		n, err := strconv.Atoi(historySize)
+		if err != nil {
+			log.Fatalf("Invalid PASSWORD_HISTORY_SIZE: %v", err)
+		}
+		// Only the newest storage.MaxPasswordHistory hashes are kept.
+		if n < 0 || n > storage.MaxPasswordHistory {
+			log.Fatalf("Invalid PASSWORD_HISTORY_SIZE %d: must be between 0 and %d", n, storage.MaxPasswordHistory)
+		}
+		apiHandler.PasswordPolicy.HistorySize = n
+	}
+	if bannedFile := os.Getenv("PASSWORD_BANNED_LIST_FILE"); bannedFile != "" {
+		if err := apiHandler.PasswordPolicy.LoadBannedPasswords(bannedFile); err != nil {
+			log.Fatalf("Failed to load banned passwords: %v", err)
+		}
+	}
+
+	// EMAIL_VERIFICATION_POLICY=block refuses logins from unverified accounts once
+	// EMAIL_VERIFICATION_GRACE_PERIOD (e.g. "72h") has passed since registration.
+	if os.Getenv("EMAIL_VERIFICATION_POLICY") == "block" {
+		apiHandler.UnverifiedLogin.Block = true
+		if gracePeriod := os.Getenv("EMAIL_VERIFICATION_GRACE_PERIOD"); gracePeriod != "" {
+			d, err := time.ParseDuration(gracePeriod)
+			if err != nil {
+				log.Fatalf("Invalid EMAIL_VERIFICATION_GRACE_PERIOD: %v", err)
+			}
+			apiHandler.UnverifiedLogin.GracePeriod = d
+		}
+	}
+
+	// ACCOUNT_DELETION_GRACE_PERIOD (e.g. "720h") is how long deleted accounts can be
+	// reactivated before they are purged. "0" deletes accounts immediately.
+	if gracePeriod := os.Getenv("ACCOUNT_DELETION_GRACE_PERIOD"); gracePeriod != "" {
+		d, err := time.ParseDuration(gracePeriod)
+		if err != nil {
+			log.Fatalf("Invalid ACCOUNT_DELETION_GRACE_PERIOD: %v", err)
+		}
+		apiHandler.DeletionGracePeriod = d
+	}
+	go purgeDeletedAccounts(apiHandler, time.Hour)
+
+	// When a user is deleted, each of USER_DELETION_SERVICES (comma-separated, e.g.
+	// "content,forum,gamification") is asked to erase the user's data until it
+	// confirms on the reply queue.
+	if services := os.Getenv("USER_DELETION_SERVICES"); services != "" {
+		apiHandler.ErasureServices = nil
+		for _, service := range strings.Split(services, ",") {
+			if service = strings.TrimSpace(service); service != "" {
+				apiHandler.ErasureServices = append(apiHandler.ErasureServices, service)
+			}
+		}
+	}
+	if err := messageBroker.Consume(context.Background(), erasure.RepliesQueue, apiHandler.HandleErasureReply); err != nil {
+		log.Fatalf("Failed to start erasure reply consumer: %v", err)
+	}
+	go sendErasureRequests(apiHandler, time.Minute)
+	go processDataExports(apiHandler, userStore, 10*time.Second)
+	go relayOutbox(apiHandler, userStore, 5*time.Second)
+
+	// User activities are kept for ACTIVITY_RETENTION (e.g. "4320h"), or as long as
+	// ACTIVITY_RETENTION_BY_TYPE (e.g. "password_changed=17520h,lesson_completed=0")
+	// says for their type. "0" keeps activities forever.
+	if retention := os.Getenv("ACTIVITY_RETENTION"); retention != "" {
+		d, err := time.ParseDuration(retention)
+		if err != nil {
+			log.Fatalf("Invalid ACTIVITY_RETENTION: %v", err)
+		}
+		apiHandler.ActivityRetention.Default = d
+	}
+	if retention := os.Getenv("ACTIVITY_RETENTION_BY_TYPE"); retention != "" {
+		for _, entry := range strings.Split(retention, ",") {
+			activityType, period, _ := strings.Cut(entry, "=")
+			d, err := time.ParseDuration(strings.TrimSpace(period))
+			if err != nil {
+				log.Fatalf("Invalid ACTIVITY_RETENTION_BY_TYPE entry %q: %v", entry, err)
+			}
+			apiHandler.ActivityRetention.ByType[strings.TrimSpace(activityType)] = d
+		}
+	}
+	// Other services report user activities on api.ActivityQueue.
+	if err := messageBroker.Consume(context.Background(), api.ActivityQueue, apiHandler.HandleActivityEvent); err != nil {
+		log.Fatalf("Failed to start user activity consumer: %v", err)
+	}
+	go pruneUserActivities(apiHandler, time.Hour)
+
+	// Profile pictures are stored in an S3-compatible bucket if BLOB_STORE is "s3",
+	// and otherwise in BLOB_STORE_DIR, which this service serves at api.MediaPath.
+	// BLOB_STORE_PUBLIC_URL is where the stored pictures can be fetched from.
+	mediaDir := ""
+	if os.Getenv("BLOB_STORE") == "s3" {
+		s3 := blobstore.NewS3(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_REGION"), os.Getenv("S3_BUCKET"),
+			os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"))
+		s3.BaseURL = os.Getenv("BLOB_STORE_PUBLIC_URL")
+		apiHandler.Blobs = s3
+	} else {
+		mediaDir = os.Getenv("BLOB_STORE_DIR")
+		if mediaDir == "" {
+			mediaDir = "data/blobs"
+		}
+		baseURL := os.Getenv("BLOB_STORE_PUBLIC_URL")
+		if baseURL == "" {
+			baseURL = api.DefaultBlobBaseURL
+		}
+		apiHandler.Blobs = blobstore.NewFileSystem(mediaDir, baseURL)
+	}
+
+	// Passkeys default to the front end's own origin. WEBAUTHN_RP_ID and the
+	// comma-separated WEBAUTHN_RP_ORIGINS override it, e.g. when the site is
+	// served from several subdomains of the same RP ID.
+	if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		rpName := os.Getenv("WEBAUTHN_RP_NAME")
+		if rpName == "" {
+			rpName = "OpenMind Academy"
+		}
+		origins := strings.Split(os.Getenv("WEBAUTHN_RP_ORIGINS"), ",")
+		if origins[0] == "" {
+			origins = []string{frontendBaseURL}
+		}
+		passkeys, err := passkey.New(passkey.Config{RPID: rpID, RPDisplayName: rpName, RPOrigins: origins})
+		if err != nil {
+			log.Fatalf("Failed to configure passkeys: %v", err)
+		}
+		apiHandler.Passkeys = passkeys
+	}
+
+	// Requests are authenticated with the access token the gateway verified or, if
+	// GATEWAY_SIGNING_SECRET is set, with the identity headers it signed. Bare
+	// identity headers are never trusted.
+	verifier := api.TokenVerifier()
+	if secret := os.Getenv("GATEWAY_SIGNING_SECRET"); secret != "" {
+		verifier = authz.Chain(verifier, authz.NewHeaderVerifier(secret))
+	}
 
 	// --- Router Setup ---
 	router := gin.Default()
 
-	// Health check
+	// The login throttle counts failures per client IP, so X-Forwarded-For is only
+	// believed from the gateway, which overwrites it. TRUSTED_PROXIES (comma-separated
+	// CIDRs, e.g. "10.8.0.0/14") names the gateway's networks.
+	trustedProxies := api.DefaultTrustedProxies
+	if proxies := os.Getenv("TRUSTED_PROXIES"); proxies != "" {
+		trustedProxies = nil
+		for _, proxy := range strings.Split(proxies, ",") {
+			if proxy = strings.TrimSpace(proxy); proxy != "" {
+				trustedProxies = append(trustedProxies, proxy)
+			}
+		}
+	}
+	if err := router.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
+	// Health check. The service is down while it is reconnecting to RabbitMQ.
 	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "UP"})
+		if err := messageBroker.Healthy(); err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "DOWN", "rabbitmq": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "UP", "rabbitmq": "UP"})
 	})
 
+	// Public keys for verifying the tokens this service issues
+	router.GET("/.well-known/jwks.json", apiHandler.JWKSHandler)
+
+	// Profile pictures kept in a filesystem blob store
+	if mediaDir != "" {
+		router.Static(api.MediaPath, mediaDir)
+	}
+
 	// API v1 routes
 	v1 := router.Group("/api/v1")
 	{
@@ -120,35 +289,110 @@ func main() {
 		v1.POST("/register", apiHandler.RegisterUserHandler)
 		v1.POST("/login", apiHandler.LoginUserHandler)
 		v1.POST("/login/2fa", apiHandler.Login2FAHandler)
-		v1.GET("/login/google", apiHandler.GoogleLoginHandler)
-		v1.GET("/login/google/callback", apiHandler.GoogleCallbackHandler)
+		v1.POST("/token/refresh", apiHandler.RefreshTokenHandler)
+		v1.GET("/login/:provider", apiHandler.OAuthLoginHandler)
+		v1.GET("/login/:provider/callback", apiHandler.OAuthCallbackHandler)
+		v1.POST("/login/exchange", apiHandler.ExchangeLoginCodeHandler)
+		v1.POST("/login/webauthn/begin", apiHandler.BeginWebAuthnLoginHandler)
+		v1.POST("/login/webauthn/finish", apiHandler.FinishWebAuthnLoginHandler)
+		v1.POST("/login/2fa/webauthn/begin", apiHandler.BeginWebAuthnSecondFactorHandler)
+		v1.POST("/login/2fa/webauthn/finish", apiHandler.FinishWebAuthnSecondFactorHandler)
 		v1.POST("/password/forgot", apiHandler.ForgotPasswordHandler)
 		v1.POST("/password/reset", apiHandler.ResetPasswordHandler)
+		v1.POST("/email/verify", apiHandler.VerifyEmailHandler)
+		v1.POST("/email/resend", apiHandler.ResendVerificationEmailHandler)
+		v1.POST("/email/change/confirm", apiHandler.ConfirmEmailChangeHandler)
+		v1.POST("/account/reactivate", apiHandler.ReactivateAccountHandler)
+		v1.GET("/account/exports/download", apiHandler.DownloadDataExportHandler) // Authenticated by a single-use token
+		v1.GET("/preferences/schema", apiHandler.GetPreferencesSchemaHandler)
 
-		// Authenticated routes are now protected by the API Gateway
+		// Authenticated routes
 		authenticated := v1.Group("/")
-		authenticated.Use(api.AuthMiddleware())
+		authenticated.Use(authz.Authenticate(verifier))
 		{
 			authenticated.GET("/profile", apiHandler.GetProfileHandler)
-			authenticated.DELETE("/profile", apiHandler.DeactivateUserHandler) // Kept for deactivation
-			authenticated.DELETE("/account", apiHandler.DeleteUserHandler)     // New route for permanent deletion
 			authenticated.POST("/profile/picture", apiHandler.UploadProfilePictureHandler)
+			authenticated.DELETE("/profile/picture", apiHandler.DeleteProfilePictureHandler)
+			authenticated.PUT("/password", apiHandler.ChangePasswordHandler)
+
+			// Step-up authentication for sensitive actions
+			authenticated.POST("/reauth", apiHandler.ReauthHandler)
+			authenticated.POST("/reauth/webauthn/begin", apiHandler.BeginWebAuthnReauthHandler)
+			authenticated.POST("/reauth/webauthn/finish", apiHandler.FinishWebAuthnReauthHandler)
+			authenticated.POST("/reauth/:provider", apiHandler.StartOAuthReauthHandler) // For accounts without a password
+			recentAuth := authenticated.Group("/")
+			recentAuth.Use(api.RequireRecentAuth())
+			{
+				recentAuth.DELETE("/profile", apiHandler.DeactivateUserHandler) // Kept for deactivation
+				recentAuth.DELETE("/account", apiHandler.DeleteUserHandler)     // Schedules deletion after the grace period
+				recentAuth.POST("/2fa/disable", apiHandler.Disable2FAHandler)
+				recentAuth.POST("/2fa/recovery-codes", apiHandler.RegenerateRecoveryCodesHandler)
+				recentAuth.POST("/profile/email", apiHandler.ChangeEmailHandler)
+				recentAuth.POST("/identities/:provider", apiHandler.StartIdentityLinkHandler)
+				recentAuth.DELETE("/identities/:identityId", apiHandler.UnlinkIdentityHandler)
+				recentAuth.POST("/webauthn/register/begin", apiHandler.BeginWebAuthnRegistrationHandler)
+				recentAuth.DELETE("/webauthn/credentials/:credentialId", apiHandler.DeleteWebAuthnCredentialHandler)
+			}
+
+			// Linked accounts at external providers
+			authenticated.GET("/identities", apiHandler.ListIdentitiesHandler)
+			authenticated.POST("/identities/confirm", apiHandler.ConfirmIdentityLinkHandler)
+
+			// Passkeys and security keys
+			authenticated.POST("/webauthn/register/finish", apiHandler.FinishWebAuthnRegistrationHandler)
+			authenticated.GET("/webauthn/credentials", apiHandler.ListWebAuthnCredentialsHandler)
+			authenticated.PATCH("/webauthn/credentials/:credentialId", apiHandler.RenameWebAuthnCredentialHandler)
+
+			// Personal data exports
+			authenticated.POST("/account/exports", apiHandler.RequestDataExportHandler)
+			authenticated.GET("/account/exports/:exportId", apiHandler.GetDataExportHandler)
+			authenticated.POST("/account/exports/:exportId/download-token", apiHandler.CreateExportDownloadTokenHandler)
+
+			// Session management
+			authenticated.GET("/sessions", apiHandler.ListSessionsHandler)
+			authenticated.DELETE("/sessions/:sessionId", apiHandler.RevokeSessionHandler)
 
 			// 2FA routes
 			authenticated.POST("/2fa/enable", apiHandler.Enable2FAHandler)
 			authenticated.POST("/2fa/verify", apiHandler.Verify2FAHandler)
-			authenticated.POST("/2fa/disable", apiHandler.Disable2FAHandler)
+			authenticated.GET("/2fa/recovery-codes", apiHandler.GetRecoveryCodesStatusHandler)
 
 			authenticated.GET("/preferences", apiHandler.GetUserPreferencesHandler)
-			authenticated.PUT("/preferences", apiHandler.UpdateUserPreferencesHandler)
+			authenticated.PATCH("/preferences", apiHandler.UpdateUserPreferencesHandler)
+			authenticated.PUT("/preferences", apiHandler.UpdateUserPreferencesHandler) // Deprecated: same merge semantics as PATCH
 			authenticated.GET("/users/:userId/progress", apiHandler.GetProgressHandler)
 			authenticated.POST("/users/:userId/progress", apiHandler.MarkLessonCompleteHandler)
 			authenticated.GET("/users/:userId/quiz-attempts", apiHandler.GetQuizAttemptsForUserHandler)
 			authenticated.GET("/users/:userId/activity", apiHandler.GetUserActivityHandler)
+			authenticated.GET("/users/:userId/activity/summary", apiHandler.GetUserActivitySummaryHandler)
 			authenticated.GET("/users/:userId/full-profile", apiHandler.GetFullProfileHandler)
 
 			// Authenticated routes - specific to the user
 			authenticated.POST("/quiz-attempts", apiHandler.CreateQuizAttemptHandler)
+
+			// User management for moderators and admins. Every action is written to the admin audit log.
+			admin := authenticated.Group("/admin")
+			admin.Use(authz.RequireRole(authz.RoleModerator, authz.RoleAdmin))
+			{
+				admin.GET("/users", apiHandler.ListUsersHandler)
+				admin.GET("/users/:userId", apiHandler.GetUserHandler)
+				admin.POST("/users/:userId/deactivate", apiHandler.AdminDeactivateUserHandler)
+				admin.POST("/users/:userId/reactivate", apiHandler.AdminReactivateUserHandler)
+
+				adminOnly := admin.Group("/")
+				adminOnly.Use(authz.RequireRole(authz.RoleAdmin))
+				{
+					adminOnly.GET("/audit-log", apiHandler.ListAdminAuditLogHandler)
+
+					adminRecentAuth := adminOnly.Group("/")
+					adminRecentAuth.Use(api.RequireRecentAuth())
+					{
+						adminRecentAuth.PUT("/users/:userId/role", apiHandler.ChangeUserRoleHandler)
+						adminRecentAuth.POST("/users/:userId/2fa/reset", apiHandler.AdminReset2FAHandler)
+						adminRecentAuth.POST("/users/:userId/impersonate", apiHandler.ImpersonateUserHandler)
+					}
+				}
+			}
 		}
 	}
 
@@ -163,4 +407,144 @@ func main() {
 	}
 }
 
+// reloadKeysOnSignal reloads the signing keys from dir whenever the process receives
+// SIGHUP, so keys can be added, promoted and retired without a restart. A failed
+// reload leaves the previously loaded keys in place.
+func reloadKeysOnSignal(dir string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := auth.LoadKeyDir(dir); err != nil {
+			log.Printf("Failed to reload signing keys, keeping current keys: %v", err)
+			continue
+		}
+		log.Printf("Reloaded signing keys, now signing with key %s", auth.Keys().ActiveKeyID())
+	}
+}
+
+// purgeDeletedAccounts permanently deletes accounts whose deletion grace period has
+// ended, checking every interval. Several instances can run it at the same time.
+func purgeDeletedAccounts(apiHandler *api.API, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		purged, err := apiHandler.PurgeScheduledDeletions(context.Background())
+		if err != nil {
+			log.Printf("Error purging deleted accounts: %v", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d deleted accounts", purged)
+		}
+	}
+}
+
+// sendErasureRequests asks services that have not yet confirmed erasing a deleted
+// user's data to do so, checking every interval.
+func sendErasureRequests(apiHandler *api.API, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		if _, err := apiHandler.SendErasureRequests(context.Background()); err != nil {
+			log.Printf("Error sending erasure requests: %v", err)
+		}
+	}
+}
 
+// processDataExports builds pending personal data exports and deletes expired ones,
+// checking every interval. Several instances can run it at the same time.
+func processDataExports(apiHandler *api.API, userStore *storage.PostgresUserStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		if _, err := apiHandler.ProcessDataExports(context.Background()); err != nil {
+			log.Printf("Error processing data exports: %v", err)
+		}
+		if _, err := userStore.DeleteExpiredDataExports(context.Background()); err != nil {
+			log.Printf("Error deleting expired data exports: %v", err)
+		}
+	}
+}
+
+// pruneUserActivities deletes user activities past their retention period,
+// checking every interval. Several instances can run it at the same time.
+func pruneUserActivities(apiHandler *api.API, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		pruned, err := apiHandler.PruneUserActivities(context.Background())
+		if err != nil {
+			log.Printf("Error pruning user activities: %v", err)
+		}
+		if pruned > 0 {
+			log.Printf("Pruned %d expired user activities", pruned)
+		}
+	}
+}
+
+// relayOutbox publishes the events waiting in the outbox and deletes old published
+// ones, checking every interval. Several instances can run it at the same time.
+func relayOutbox(apiHandler *api.API, userStore *storage.PostgresUserStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for ; true; <-ticker.C {
+		if _, err := apiHandler.RelayOutbox(context.Background()); err != nil {
+			log.Printf("Error relaying outbox events: %v", err)
+		}
+		if _, err := userStore.DeleteSentOutboxEvents(context.Background(), time.Now().Add(-api.OutboxRetention)); err != nil {
+			log.Printf("Error deleting sent outbox events: %v", err)
+		}
+	}
+}
+
+// loadOAuthProviders builds the external login providers from the environment.
+// GOOGLE_OAUTH_CLIENT_ID/SECRET keep enabling Google. OAUTH_PROVIDERS lists further
+// providers by name; each is configured with OAUTH_<NAME>_CLIENT_ID, _CLIENT_SECRET,
+// _ISSUER (for OpenID Connect providers), _SCOPES (comma-separated) or _TYPE=github.
+// A provider whose issuer cannot be discovered is skipped.
+func loadOAuthProviders() *oauth.Registry {
+	redirectBaseURL := os.Getenv("OAUTH_REDIRECT_BASE_URL")
+	if redirectBaseURL == "" {
+		redirectBaseURL = "http://localhost:8080/api/users/login"
+	}
+
+	registry := oauth.NewRegistry()
+	register := func(name, kind, issuer string, cfg oauth.Config) {
+		cfg.RedirectURL = redirectBaseURL + "/" + name + "/callback"
+		if kind == "github" {
+			registry.Register(name, oauth.NewGitHubProvider(cfg))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		provider, err := oauth.NewOIDCProvider(ctx, issuer, cfg)
+		if err != nil {
+			log.Printf("Skipping OAuth provider %s: %v", name, err)
+			return
+		}
+		registry.Register(name, provider)
+	}
+
+	if clientID := os.Getenv("GOOGLE_OAUTH_CLIENT_ID"); clientID != "" {
+		register("google", "oidc", "https://accounts.google.com", oauth.Config{
+			ClientID:     clientID,
+			ClientSecret: os.Getenv("GOOGLE_OAUTH_CLIENT_SECRET"),
+		})
+	}
+
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OAUTH_" + strings.ToUpper(name) + "_"
+		cfg := oauth.Config{
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+		}
+		if scopes := os.Getenv(prefix + "SCOPES"); scopes != "" {
+			cfg.Scopes = strings.Split(scopes, ",")
+		}
+		register(name, strings.ToLower(os.Getenv(prefix+"TYPE")), os.Getenv(prefix+"ISSUER"), cfg)
+	}
+	return registry
+}
@@ -1,14 +1,57 @@
 package messaging
 
-import "context"
+import (
+	"context"
+	"errors"
+
+	"github.com/free-education/events"
+)
+
+// Producer is the name this service signs the events it publishes with.
+const Producer = "user-service"
 
 // MessageHandler defines the function signature for handling consumed messages.
-type MessageHandler func(body []byte)
+// A message is acknowledged once its handler returns nil. If the handler returns an
+// error, the message is retried a bounded number of times and then moved to the
+// dead-letter queue; errors marked Permanent are dead-lettered right away.
+//
+// A message can be delivered more than once, so handlers must be idempotent, for
+// example by recording the IDs of the events they have handled.
+type MessageHandler func(body []byte) error
 
 // MessageBroker defines the interface for a message broker client.
 // This allows for easy mocking in tests.
 type MessageBroker interface {
-	Publish(ctx context.Context, queueName string, eventType string, payload interface{}) error
+	// Publish publishes payload in a new events.Envelope.
+	Publish(ctx context.Context, queueName string, payload events.Payload) error
+	// PublishEnvelope publishes an envelope as it is, so consumers recognise an
+	// event that is published again by its ID.
+	PublishEnvelope(ctx context.Context, queueName string, envelope *events.Envelope) error
 	Consume(ctx context.Context, queueName string, handler MessageHandler) error
 	Close()
 }
+
+// DeadLetterQueue returns the queue messages from queueName end up in when they
+// cannot be handled.
+func DeadLetterQueue(queueName string) string {
+	return queueName + ".dead"
+}
+
+// Permanent marks an error as one that retrying the message cannot fix, such as a
+// malformed message, so that it is dead-lettered without being retried.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
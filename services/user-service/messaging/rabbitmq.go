@@ -2,79 +2,346 @@ package messaging
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/free-education/events"
 	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-// RabbitMQClient handles the connection and publishing to RabbitMQ.
+const (
+	// DefaultMaxDeliveryAttempts is how often a message is handled before it is
+	// dead-lettered.
+	DefaultMaxDeliveryAttempts = 5
+	// DefaultRetryDelay is how long a message that could not be handled waits
+	// before it is handled again.
+	DefaultRetryDelay = 10 * time.Second
+	// prefetchCount is how many unacknowledged messages a consumer holds at once.
+	prefetchCount = 10
+	// attemptsHeader counts how often a message has been handled.
+	attemptsHeader = "x-delivery-attempts"
+	// confirmTimeout is how long publishing waits for the broker to confirm a message.
+	confirmTimeout = 10 * time.Second
+	// minReconnectDelay is how long the client waits before reconnecting after the
+	// connection is lost. The wait doubles with every failed attempt, up to
+	// maxReconnectDelay.
+	minReconnectDelay = time.Second
+	maxReconnectDelay = 30 * time.Second
+)
+
+var (
+	// ErrNotConnected is returned when publishing while the client is reconnecting.
+	ErrNotConnected = errors.New("not connected to RabbitMQ")
+	// ErrClosed is returned after the client has been closed.
+	ErrClosed = errors.New("RabbitMQ client closed")
+)
+
+// RabbitMQClient handles the connection and publishing to RabbitMQ. When the
+// connection is lost, for example because the broker restarts, it reconnects with
+// exponential backoff, declares the queues again and restarts its consumers.
 type RabbitMQClient struct {
-	conn    *amqp.Connection
-	channel *amqp.Channel
+	url string
+
+	mu sync.RWMutex
+	// conn and channel are nil while the client is disconnected. channel is in
+	// confirm mode and used for publishing; every consumer has its own channel.
+	conn      *amqp.Connection
+	channel   *amqp.Channel
+	consumers []consumer
+	// down is why the client is disconnected, and downSince since when.
+	down      error
+	downSince time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// MaxDeliveryAttempts is how often Consume hands a message to its handler
+	// before moving it to the dead-letter queue.
+	MaxDeliveryAttempts int
+	// RetryDelay is how long a failed message waits before it is retried. It is
+	// part of the declaration of each retry queue, so changing it requires
+	// deleting the retry queues.
+	RetryDelay time.Duration
 }
 
-// NewRabbitMQClient creates and returns a new RabbitMQClient.
+// consumer is a handler registered with Consume, restarted after every reconnect.
+type consumer struct {
+	queueName string
+	handler   MessageHandler
+}
+
+// NewRabbitMQClient connects to RabbitMQ and returns a new RabbitMQClient, which
+// keeps reconnecting until it is closed.
 func NewRabbitMQClient(url string) (*RabbitMQClient, error) {
-	conn, err := amqp.Dial(url)
+	c := &RabbitMQClient{
+		url:                 url,
+		closed:              make(chan struct{}),
+		MaxDeliveryAttempts: DefaultMaxDeliveryAttempts,
+		RetryDelay:          DefaultRetryDelay,
+	}
+	connClosed, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+	go c.maintain(connClosed)
+	return c, nil
+}
+
+// connect dials RabbitMQ, opens the publishing channel and starts the registered
+// consumers. It returns a channel that receives when the new connection closes.
+func (c *RabbitMQClient) connect() (<-chan *amqp.Error, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.closed:
+		return nil, ErrClosed
+	default:
+	}
+
+	conn, err := amqp.Dial(c.url)
 	if err != nil {
 		return nil, err
 	}
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
 
 	ch, err := conn.Channel()
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	if err := ch.Confirm(false); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	closeOnChannelError(conn, ch)
+
+	for _, consumer := range c.consumers {
+		if err := c.startConsumer(conn, consumer); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("restarting consumer of %s: %w", consumer.queueName, err)
+		}
+	}
+
+	c.conn, c.channel = conn, ch
+	c.down, c.downSince = nil, time.Time{}
+	return connClosed, nil
+}
+
+// maintain waits for the connection to close and reconnects, until the client is
+// closed.
+func (c *RabbitMQClient) maintain(connClosed <-chan *amqp.Error) {
+	for {
+		select {
+		case <-c.closed:
+			return
+		case amqpErr := <-connClosed:
+			select {
+			case <-c.closed:
+				return
+			default:
+			}
+			err := errors.New("connection closed")
+			if amqpErr != nil {
+				err = amqpErr
+			}
+			log.Printf("Lost connection to RabbitMQ, reconnecting: %v", err)
+			c.disconnected(err)
+		}
+
+		delay := minReconnectDelay
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-time.After(delay):
+			}
+			var err error
+			if connClosed, err = c.connect(); err == nil {
+				break
+			}
+			log.Printf("Error reconnecting to RabbitMQ, retrying in %s: %v", delay, err)
+			c.disconnected(err)
+			delay = nextReconnectDelay(delay)
+		}
+		log.Printf("Reconnected to RabbitMQ")
+	}
+}
+
+// disconnected records that the client has no connection, and why.
+func (c *RabbitMQClient) disconnected(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn, c.channel = nil, nil
+	if c.downSince.IsZero() {
+		c.downSince = time.Now()
+	}
+	c.down = err
+}
+
+// nextReconnectDelay doubles the wait between reconnection attempts, up to
+// maxReconnectDelay.
+func nextReconnectDelay(delay time.Duration) time.Duration {
+	if delay *= 2; delay > maxReconnectDelay {
+		return maxReconnectDelay
+	}
+	return delay
+}
+
+// closeOnChannelError closes conn when the broker closes ch, which it does on
+// errors, so the client reconnects instead of keeping a connection it cannot use.
+func closeOnChannelError(conn *amqp.Connection, ch *amqp.Channel) {
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		if err := <-chClosed; err != nil {
+			log.Printf("RabbitMQ closed a channel, reconnecting: %v", err)
+			conn.Close()
+		}
+	}()
+}
+
+// Healthy returns nil while the client is connected, and why it is not otherwise.
+func (c *RabbitMQClient) Healthy() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.channel != nil {
+		return nil
+	}
+	if c.down == nil {
+		return ErrNotConnected
+	}
+	return fmt.Errorf("disconnected since %s: %w", c.downSince.Format(time.RFC3339), c.down)
+}
 
-	return &RabbitMQClient{conn: conn, channel: ch}, nil
+// Publish sends an event to a specific queue, in a new envelope.
+func (c *RabbitMQClient) Publish(ctx context.Context, queueName string, payload events.Payload) error {
+	envelope, err := events.New(Producer, payload)
+	if err != nil {
+		return err
+	}
+	return c.PublishEnvelope(ctx, queueName, envelope)
 }
 
-// Publish sends a message to a specific queue.
-func (c *RabbitMQClient) Publish(ctx context.Context, queueName string, eventType string, payload interface{}) error {
-	body, err := json.Marshal(map[string]interface{}{
-		"eventType": eventType,
-		"payload":   payload,
+// PublishEnvelope sends an event to a specific queue. It returns once the broker
+// has confirmed the message.
+func (c *RabbitMQClient) PublishEnvelope(ctx context.Context, queueName string, envelope *events.Envelope) error {
+	body, err := events.Encode(envelope)
+	if err != nil {
+		return err
+	}
+
+	err = c.publish(ctx, queueName, amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    envelope.ID,
+		Type:         envelope.Type,
+		Timestamp:    envelope.OccurredAt,
+		Body:         body,
 	})
 	if err != nil {
 		return err
 	}
 
-	err = c.channel.Publish(
+	log.Printf(" [x] Sent %s", body)
+	return nil
+}
+
+// publish sends msg to a queue and waits for the broker to confirm it, for at most
+// confirmTimeout unless ctx has an earlier deadline.
+func (c *RabbitMQClient) publish(ctx context.Context, queueName string, msg amqp.Publishing) error {
+	c.mu.RLock()
+	ch := c.channel
+	c.mu.RUnlock()
+	if ch == nil {
+		return ErrNotConnected
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
 		"",        // exchange
 		queueName, // routing key
 		false,     // mandatory
 		false,     // immediate
-		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-		},
+		msg,
 	)
 	if err != nil {
 		return err
 	}
-
-	log.Printf(" [x] Sent %s", body)
+	// Messages still unconfirmed when the channel closes are nacked.
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for RabbitMQ to confirm message %s: %w", msg.MessageId, err)
+	}
+	if !acked {
+		return fmt.Errorf("RabbitMQ did not accept message %s", msg.MessageId)
+	}
 	return nil
 }
 
 // Consume starts consuming messages from a queue and passes them to the handler.
+// Messages the handler fails on wait in a retry queue for RetryDelay and are then
+// handled again, until MaxDeliveryAttempts is reached and they are moved to the
+// queue's DeadLetterQueue. The consumer is restarted whenever the client
+// reconnects; if the client is disconnected, it starts on the next reconnect.
 func (c *RabbitMQClient) Consume(ctx context.Context, queueName string, handler MessageHandler) error {
-	q, err := c.channel.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	consumer := consumer{queueName: queueName, handler: handler}
+	if c.conn != nil {
+		if err := c.startConsumer(c.conn, consumer); err != nil {
+			return err
+		}
+	}
+	c.consumers = append(c.consumers, consumer)
+	return nil
+}
+
+// startConsumer declares the queue of consumer and its retry and dead-letter
+// queues on conn, and hands the messages to its handler until conn closes.
+func (c *RabbitMQClient) startConsumer(conn *amqp.Connection, consumer consumer) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	closeOnChannelError(conn, ch)
+
+	q, err := ch.QueueDeclare(
+		consumer.queueName, // name
+		true,               // durable
+		false,              // delete when unused
+		false,              // exclusive
+		false,              // no-wait
+		nil,                // arguments
 	)
 	if err != nil {
 		return err
 	}
+	// Messages in the retry queue expire after RetryDelay and go back to the queue.
+	_, err = ch.QueueDeclare(retryQueue(q.Name), true, false, false, false, amqp.Table{
+		"x-message-ttl":             c.RetryDelay.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": q.Name,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := ch.QueueDeclare(DeadLetterQueue(q.Name), true, false, false, false, nil); err != nil {
+		return err
+	}
+	if err := ch.Qos(prefetchCount, 0, false); err != nil {
+		return err
+	}
 
-	msgs, err := c.channel.Consume(
+	msgs, err := ch.Consume(
 		q.Name, // queue
 		"",     // consumer
-		true,   // auto-ack
+		false,  // auto-ack
 		false,  // exclusive
 		false,  // no-local
 		false,  // no-wait
@@ -85,9 +352,11 @@ func (c *RabbitMQClient) Consume(ctx context.Context, queueName string, handler
 	}
 
 	go func() {
+		// msgs is closed when the connection is lost; the unacknowledged messages
+		// are redelivered to the consumer started after reconnecting.
 		for d := range msgs {
 			log.Printf("Received a message: %s", d.Body)
-			handler(d.Body)
+			settle(d, q.Name, c.MaxDeliveryAttempts, consumer.handler(d.Body), c.republish)
 		}
 	}()
 
@@ -95,12 +364,85 @@ func (c *RabbitMQClient) Consume(ctx context.Context, queueName string, handler
 	return nil
 }
 
-// Close closes the RabbitMQ connection and channel.
+// republish sends a copy of a consumed message to a queue.
+func (c *RabbitMQClient) republish(queueName string, msg amqp.Publishing) error {
+	return c.publish(context.Background(), queueName, msg)
+}
+
+// settle acknowledges a delivery its handler returned handlerErr for. A failed
+// message is republished to the retry queue, or to the dead-letter queue once it
+// has been attempted maxAttempts times, before the original is acknowledged. If
+// that fails, the message is requeued rather than lost.
+func settle(d amqp.Delivery, queueName string, maxAttempts int, handlerErr error, republish func(queueName string, msg amqp.Publishing) error) {
+	if handlerErr == nil {
+		d.Ack(false)
+		return
+	}
+
+	attempts := deliveryAttempts(d)
+	headers := amqp.Table{}
+	for key, value := range d.Headers {
+		headers[key] = value
+	}
+	headers[attemptsHeader] = int64(attempts + 1)
+
+	target := retryQueue(queueName)
+	if IsPermanent(handlerErr) || attempts >= maxAttempts {
+		target = DeadLetterQueue(queueName)
+		headers[attemptsHeader] = int64(attempts)
+		headers["x-last-error"] = handlerErr.Error()
+		log.Printf("Dead-lettering message %s from %s after %d attempt(s): %v", d.MessageId, queueName, attempts, handlerErr)
+	} else {
+		log.Printf("Error handling message %s from %s (attempt %d of %d), retrying: %v", d.MessageId, queueName, attempts, maxAttempts, handlerErr)
+	}
+
+	err := republish(target, amqp.Publishing{
+		Headers:      headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Timestamp:    d.Timestamp,
+		Body:         d.Body,
+	})
+	if err != nil {
+		log.Printf("Error moving message %s to %s, requeueing it: %v", d.MessageId, target, err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// deliveryAttempts returns which attempt at handling a message a delivery is.
+func deliveryAttempts(d amqp.Delivery) int {
+	switch n := d.Headers[attemptsHeader].(type) {
+	case int64:
+		return int(n)
+	case int32:
+		return int(n)
+	case int:
+		return n
+	}
+	return 1
+}
+
+// retryQueue returns the queue failed messages from queueName wait in before
+// they are retried.
+func retryQueue(queueName string) string {
+	return queueName + ".retry"
+}
+
+// Close stops reconnecting and closes the RabbitMQ connection and channels.
 func (c *RabbitMQClient) Close() {
+	c.closeOnce.Do(func() { close(c.closed) })
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.channel != nil {
 		c.channel.Close()
 	}
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	c.conn, c.channel = nil, nil
+	c.down, c.downSince = ErrClosed, time.Now()
 }
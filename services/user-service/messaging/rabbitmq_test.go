@@ -0,0 +1,128 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/free-education/events"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// acknowledgerForTest records how a delivery was settled.
+type acknowledgerForTest struct {
+	acked, nacked, requeued bool
+}
+
+func (a *acknowledgerForTest) Ack(tag uint64, multiple bool) error {
+	a.acked = true
+	return nil
+}
+
+func (a *acknowledgerForTest) Nack(tag uint64, multiple, requeue bool) error {
+	a.nacked, a.requeued = true, requeue
+	return nil
+}
+
+func (a *acknowledgerForTest) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+// republishedForTest is a message settle republished.
+type republishedForTest struct {
+	queueName string
+	msg       amqp.Publishing
+}
+
+func TestSettle(t *testing.T) {
+	deliver := func(attempts int, handlerErr error, republishErr error) (*acknowledgerForTest, []republishedForTest) {
+		acknowledger := &acknowledgerForTest{}
+		d := amqp.Delivery{Acknowledger: acknowledger, MessageId: "event-1", Body: []byte(`{}`)}
+		if attempts > 0 {
+			d.Headers = amqp.Table{attemptsHeader: int32(attempts)}
+		}
+		var republished []republishedForTest
+		settle(d, "events", 3, handlerErr, func(queueName string, msg amqp.Publishing) error {
+			republished = append(republished, republishedForTest{queueName, msg})
+			return republishErr
+		})
+		return acknowledger, republished
+	}
+
+	t.Run("Handled messages are acknowledged", func(t *testing.T) {
+		acknowledger, republished := deliver(0, nil, nil)
+		if !acknowledger.acked || len(republished) != 0 {
+			t.Errorf("expected the message to be acknowledged; got %+v, %v", acknowledger, republished)
+		}
+	})
+
+	t.Run("Failed messages are retried", func(t *testing.T) {
+		acknowledger, republished := deliver(0, errors.New("database unavailable"), nil)
+		if !acknowledger.acked || len(republished) != 1 || republished[0].queueName != "events.retry" {
+			t.Fatalf("expected the message to be moved to the retry queue; got %+v, %v", acknowledger, republished)
+		}
+		msg := republished[0].msg
+		if msg.Headers[attemptsHeader] != int64(2) || msg.MessageId != "event-1" || string(msg.Body) != `{}` {
+			t.Errorf("unexpected retry %+v", msg)
+		}
+	})
+
+	t.Run("Messages are dead-lettered after the last attempt", func(t *testing.T) {
+		acknowledger, republished := deliver(3, errors.New("database unavailable"), nil)
+		if !acknowledger.acked || len(republished) != 1 || republished[0].queueName != DeadLetterQueue("events") {
+			t.Fatalf("expected the message to be dead-lettered; got %+v, %v", acknowledger, republished)
+		}
+		if republished[0].msg.Headers["x-last-error"] != "database unavailable" {
+			t.Errorf("expected the error to be recorded; got %v", republished[0].msg.Headers)
+		}
+	})
+
+	t.Run("Permanent errors are not retried", func(t *testing.T) {
+		_, republished := deliver(0, Permanent(errors.New("malformed")), nil)
+		if len(republished) != 1 || republished[0].queueName != DeadLetterQueue("events") {
+			t.Errorf("expected the message to be dead-lettered; got %v", republished)
+		}
+	})
+
+	t.Run("Messages that cannot be moved are requeued", func(t *testing.T) {
+		acknowledger, _ := deliver(0, errors.New("database unavailable"), errors.New("channel closed"))
+		if acknowledger.acked || !acknowledger.nacked || !acknowledger.requeued {
+			t.Errorf("expected the message to be requeued; got %+v", acknowledger)
+		}
+	})
+}
+
+func TestDisconnectedClient(t *testing.T) {
+	c := &RabbitMQClient{closed: make(chan struct{})}
+	c.disconnected(errors.New("connection refused"))
+
+	if err := c.Healthy(); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("expected the client to be unhealthy; got %v", err)
+	}
+	if err := c.Publish(context.Background(), "events", &events.TwoFactorReset{Email: "test@example.com"}); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("expected ErrNotConnected; got %v", err)
+	}
+	if err := c.Consume(context.Background(), "events", func(body []byte) error { return nil }); err != nil || len(c.consumers) != 1 {
+		t.Errorf("expected the consumer to be registered for the next reconnect; got %v, %v", err, c.consumers)
+	}
+
+	c.Close()
+	if err := c.Healthy(); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed after closing; got %v", err)
+	}
+}
+
+func TestNextReconnectDelay(t *testing.T) {
+	delay := minReconnectDelay
+	for i := 0; i < 10; i++ {
+		delay = nextReconnectDelay(delay)
+	}
+	if delay != maxReconnectDelay {
+		t.Errorf("expected the delay to be capped at %s; got %s", maxReconnectDelay, delay)
+	}
+	if next := nextReconnectDelay(time.Second); next != 2*time.Second {
+		t.Errorf("expected the delay to double; got %s", next)
+	}
+}
@@ -0,0 +1,74 @@
+package model
+
+import "time"
+
+// Roles a user can have. They determine what the API gateway and the admin API allow.
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+// AdminAuditEntry is one record in the admin audit log. Entries are written together
+// with the action they describe and can never be changed or deleted.
+type AdminAuditEntry struct {
+	ID int64 `json:"id"`
+	// The moderator or admin who performed the action.
+	ActorID int64 `json:"actor_id"`
+	// What was done, e.g. 'role_changed', 'user_deactivated', 'impersonation_started'.
+	Action string `json:"action"`
+	// The user the action was performed on, if any.
+	TargetUserID *int64 `json:"target_user_id,omitempty"`
+	// The justification given by the actor, e.g. a support ticket number.
+	Reason string `json:"reason,omitempty"`
+	// Action-specific data, e.g. the previous and new role.
+	Details map[string]interface{} `json:"details,omitempty"`
+	// The IP address the action was requested from.
+	IPAddress string    `json:"ip_address,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UserSearch filters and pages the admin user list. Empty fields match everything.
+type UserSearch struct {
+	// Matched against the email address and first and last name, case-insensitively.
+	Query  string `form:"q"`
+	Role   string `form:"role" binding:"omitempty,oneof=user moderator admin"`
+	Status string `form:"status" binding:"omitempty,oneof=active deactivated"`
+	// Page is 1-based.
+	Page     int `form:"page" binding:"omitempty,min=1"`
+	PageSize int `form:"page_size" binding:"omitempty,min=1,max=100"`
+}
+
+// AdminAuditSearch filters and pages the admin audit log. Zero fields match everything.
+type AdminAuditSearch struct {
+	ActorID      int64  `form:"actor_id"`
+	TargetUserID int64  `form:"target_user_id"`
+	Action       string `form:"action"`
+	Page         int    `form:"page" binding:"omitempty,min=1"`
+	PageSize     int    `form:"page_size" binding:"omitempty,min=1,max=100"`
+}
+
+// ChangeRoleRequest represents the payload for changing a user's role.
+type ChangeRoleRequest struct {
+	Role   string `json:"role" binding:"required,oneof=user moderator admin"`
+	Reason string `json:"reason" binding:"max=500"`
+}
+
+// AdminActionRequest represents the payload for an admin action on a user account.
+// The reason is recorded in the audit log.
+type AdminActionRequest struct {
+	Reason string `json:"reason" binding:"max=500"`
+}
+
+// ImpersonateRequest represents the payload for starting to impersonate a user.
+// A reason, e.g. the support ticket being worked on, is required.
+type ImpersonateRequest struct {
+	Reason string `json:"reason" binding:"required,max=500"`
+}
+
+// ImpersonationResponse carries an access token that acts as another user.
+// There is no refresh token: once it expires, impersonation has to be restarted.
+type ImpersonationResponse struct {
+	Token     string `json:"token"`
+	ExpiresIn int64  `json:"expires_in"`
+}
@@ -0,0 +1,13 @@
+package model
+
+// ErasureRequest asks one service to erase the data it holds about a deleted user.
+// It is sent again until the service confirms with a `user_data_erased` event.
+type ErasureRequest struct {
+	// The user deletion the request belongs to.
+	DeletionID int64
+	UserID     int64
+	// The name of the service that has to erase the data, e.g. 'content'.
+	Service string
+	// How many times the service has been asked, including this time.
+	Attempts int
+}
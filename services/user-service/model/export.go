@@ -0,0 +1,35 @@
+package model
+
+import "time"
+
+// Statuses a data export goes through. Pending exports are picked up by a
+// background worker, which marks them ready or failed.
+const (
+	DataExportPending    = "pending"
+	DataExportProcessing = "processing"
+	DataExportReady      = "ready"
+	DataExportFailed     = "failed"
+)
+
+// DataExport is a user's request for a copy of their personal data. The archive
+// itself is only handed out through a single-use download token.
+type DataExport struct {
+	ID     int64  `json:"id"`
+	UserID int64  `json:"user_id"`
+	Status string `json:"status"`
+	// Why the export failed, if it did.
+	Error string `json:"error,omitempty"`
+	// The size of the zip archive in bytes, once it is ready.
+	SizeBytes   int64      `json:"size_bytes,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"-"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	// When the archive will be deleted.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// LessonProgress records when a user completed a lesson.
+type LessonProgress struct {
+	LessonID    int64     `json:"lesson_id"`
+	CompletedAt time.Time `json:"completed_at"`
+}
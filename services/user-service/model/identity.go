@@ -0,0 +1,54 @@
+package model
+
+import "time"
+
+// UserIdentity links a user to their account at an external identity provider.
+// A user can have several identities, one per provider account.
+type UserIdentity struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"user_id"`
+	// The name of the provider, e.g. 'google' or 'github'.
+	Provider string `json:"provider"`
+	// The user's stable ID at the provider. Never exposed to the client.
+	Subject string `json:"-"`
+	// The email the provider reported when the identity was linked.
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OAuthState is the server-side half of a login in progress with an external
+// provider. It is looked up by the `state` parameter when the provider redirects
+// back, and can be used only once.
+type OAuthState struct {
+	State        string
+	Provider     string
+	CodeVerifier string // PKCE secret; only its S256 challenge is sent to the provider.
+	Nonce        string
+	// UserID is set when a signed-in user is linking a new identity rather than logging in.
+	UserID int64
+	// Reauth is set, together with UserID, when a signed-in user is signing in at
+	// the provider again to confirm it is them before a sensitive action.
+	Reauth    bool
+	ExpiresAt time.Time
+}
+
+// ConfirmIdentityLinkRequest defines the structure for confirming that an identity
+// from an external provider may be linked to the signed-in user's account.
+type ConfirmIdentityLinkRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+// LoginCode is a short-lived, single-use code the OAuth callback hands to the
+// front end in place of tokens. Only hashes are stored: the code itself, and the
+// `oauthstate` cookie of the browser the code was issued to.
+type LoginCode struct {
+	CodeHash  string
+	UserID    int64
+	StateHash string
+	ExpiresAt time.Time
+}
+
+// ExchangeLoginCodeRequest defines the structure for trading a login code for tokens.
+type ExchangeLoginCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
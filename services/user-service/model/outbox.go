@@ -0,0 +1,22 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OutboxEvent is an event waiting in the outbox to be published. It is enqueued
+// together with the change it announces and published once that change is committed.
+type OutboxEvent struct {
+	ID int64
+	// EventID is published with the event. Publishing the event again keeps it.
+	EventID   string
+	Queue     string
+	EventType string
+	// EventVersion is the version of the payload's schema when it was enqueued.
+	EventVersion int
+	Payload      json.RawMessage
+	CreatedAt    time.Time
+	// How many times publishing the event has been attempted, including this time.
+	Attempts int
+}
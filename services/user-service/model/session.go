@@ -0,0 +1,32 @@
+package model
+
+import "time"
+
+// Session represents a server-side login session for one device.
+// Each session owns a single rotating refresh token; the token itself is
+// never stored, only its hash.
+type Session struct {
+	// The unique identifier for the session. Embedded in access tokens as the `sid` claim.
+	ID int64 `json:"id"`
+	// The ID of the user who owns the session.
+	UserID int64 `json:"user_id"`
+	// The User-Agent header of the client that started the session.
+	UserAgent string `json:"user_agent"`
+	// The IP address of the client that started the session.
+	IPAddress string `json:"ip_address"`
+	// Whether this is the session the current request was made with.
+	Current bool `json:"current"`
+	// The timestamp when the session was created (i.e. the user logged in).
+	CreatedAt time.Time `json:"created_at"`
+	// The timestamp when the refresh token was last rotated.
+	LastUsedAt time.Time `json:"last_used_at"`
+	// The timestamp after which the refresh token can no longer be used.
+	ExpiresAt time.Time `json:"expires_at"`
+	// The timestamp when the session was revoked. A null value means the session is active.
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// RefreshTokenRequest represents the payload for exchanging a refresh token.
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
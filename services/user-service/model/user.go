@@ -27,7 +27,7 @@ type User struct {
 	TwoFactorEnabled bool `json:"two_factor_enabled"`
 	// The secret key for TOTP. Never exposed to the client.
 	TwoFactorSecret string `json:"-"`
-	// Single-use codes for 2FA recovery. Never exposed to the client.
+	// Hashes of the single-use codes for 2FA recovery. Never exposed to the client.
 	TwoFactorRecoveryCodes []string `json:"-"`
 	// A flexible JSONB field for storing user-specific settings, like theme.
 	Preferences map[string]interface{} `json:"preferences"`
@@ -37,27 +37,61 @@ type User struct {
 	UpdatedAt time.Time `json:"updated_at"`
 	// The timestamp when the user was deactivated. A null value means the account is active.
 	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	// Whether the account was suspended by a moderator or admin. Only they can reactivate it.
+	DeactivatedByAdmin bool `json:"deactivated_by_admin,omitempty"`
+	// When the account will be permanently deleted, if the user has asked for deletion.
+	DeletionScheduledAt *time.Time `json:"deletion_scheduled_at,omitempty"`
+	// The timestamp when the user verified their email address. A null value means it is unverified.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
 }
 
 // RegistrationRequest represents the data required to register a new user.
 // The `binding` tags are used by Gin for request validation.
 type RegistrationRequest struct {
 	Email     string `json:"email" binding:"required,email"`
-	Password  string `json:"password" binding:"required,min=8"`
+	Password  string `json:"password" binding:"required"` // Checked against the password policy by the handler.
 	FirstName string `json:"first_name" binding:"required"`
 	LastName  string `json:"last_name" binding:"required"`
 }
 
+// ChangePasswordRequest represents the payload for changing the password of a logged-in user.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+// ChangeEmailRequest represents the payload for starting a change of the user's email address.
+type ChangeEmailRequest struct {
+	NewEmail string `json:"new_email" binding:"required,email"`
+}
+
+// EmailChange describes an email change that has been confirmed and applied.
+type EmailChange struct {
+	UserID   int64
+	OldEmail string
+	NewEmail string
+}
+
 // LoginRequest represents the data required for a user to log in.
 type LoginRequest struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
 }
 
+// ReactivateAccountRequest confirms the reactivation of a deactivated account with
+// the token a login to it returned.
+type ReactivateAccountRequest struct {
+	ReactivationToken string `json:"reactivation_token" binding:"required"`
+}
+
 // LoginResponse is the payload sent back to the client after a successful login.
 type LoginResponse struct {
-	// The JWT token used for authenticating subsequent requests.
+	// The short-lived JWT access token used for authenticating subsequent requests.
 	Token string `json:"token"`
+	// The opaque refresh token used to obtain a new access token. It is rotated on every use.
+	RefreshToken string `json:"refresh_token"`
+	// The lifetime of the access token in seconds.
+	ExpiresIn int64 `json:"expires_in"`
 }
 
 // --- Quiz Attempt Structs ---
@@ -93,5 +127,28 @@ type UserActivity struct {
 	UserID       int64                  `json:"user_id"`
 	ActivityType string                 `json:"activity_type"`
 	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+	EventID      string                 `json:"-"` // ID of the event the activity was recorded from, if any.
 	CreatedAt    time.Time              `json:"created_at"`
 }
+
+// UserActivitySearch filters and pages a user's activities, newest first. Zero
+// fields match everything.
+type UserActivitySearch struct {
+	UserID int64
+	// Types restricts the search to these activity types.
+	Types []string
+	// Since and Until restrict the search to activities created in [Since, Until).
+	Since time.Time
+	Until time.Time
+	// Cursor is the ID of the last activity of the previous page.
+	Cursor int64
+	Limit  int
+}
+
+// UserActivityDay counts a user's activities on one day, by type.
+type UserActivityDay struct {
+	// The day in the user's time zone, e.g. '2024-05-31'.
+	Date   string         `json:"date"`
+	Total  int            `json:"total"`
+	Counts map[string]int `json:"counts"`
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// WebAuthnCredential is a passkey or security key registered by a user. It can be
+// used to log in without a password and as a second factor alongside TOTP.
+type WebAuthnCredential struct {
+	ID     int64 `json:"id"`
+	UserID int64 `json:"user_id"`
+	// The credential ID chosen by the authenticator.
+	CredentialID []byte `json:"-"`
+	// The COSE-encoded public key used to verify the authenticator's signatures.
+	PublicKey       []byte   `json:"-"`
+	AttestationType string   `json:"-"`
+	Transports      []string `json:"transports,omitempty"`
+	AAGUID          []byte   `json:"-"`
+	// The authenticator's signature counter, used to detect cloned authenticators.
+	SignCount uint32 `json:"-"`
+	// Whether the credential can be synced between devices, and whether it has been.
+	BackupEligible bool `json:"backup_eligible"`
+	BackupState    bool `json:"backup_state"`
+	// A name the user gave the credential, e.g. 'School Chromebook'.
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnSession is the server-side state of a registration or assertion ceremony
+// in progress. It is looked up by ID when the client sends the authenticator's
+// response, and can be used only once.
+type WebAuthnSession struct {
+	ID string
+	// UserID is zero for a passwordless login, where the user is not known until
+	// the authenticator answers.
+	UserID int64
+	// Purpose is one of 'registration', 'login' or 'second_factor'.
+	Purpose   string
+	Data      []byte // The go-webauthn session data, as JSON.
+	ExpiresAt time.Time
+}
+
+// BeginWebAuthnSecondFactorRequest defines the structure for starting a passkey
+// check as the second step of a login.
+type BeginWebAuthnSecondFactorRequest struct {
+	TempToken string `json:"temp_token" binding:"required"`
+}
+
+// FinishWebAuthnRequest carries the authenticator's response to a ceremony,
+// exactly as returned by navigator.credentials.create() or .get().
+type FinishWebAuthnRequest struct {
+	SessionID  string          `json:"session_id" binding:"required"`
+	Credential json.RawMessage `json:"credential" binding:"required"`
+	// TempToken is required when the ceremony is a login's second factor.
+	TempToken string `json:"temp_token"`
+	// Name optionally names a newly registered credential.
+	Name string `json:"name" binding:"max=100"`
+}
+
+// RenameWebAuthnCredentialRequest defines the structure for renaming a passkey.
+type RenameWebAuthnCredentialRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
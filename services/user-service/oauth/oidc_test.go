@@ -0,0 +1,93 @@
+package oauth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/free-education/user-service/oauth/oauthtest"
+)
+
+// authorizeForTest follows the provider's authorization URL and returns the code it redirects back with.
+func authorizeForTest(t *testing.T, authURL string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("authorize request failed: %v", err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Query().Get("code") == "" {
+		t.Fatalf("expected a redirect with a code; got status %d location %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return location.Query().Get("code")
+}
+
+func TestOIDCProvider(t *testing.T) {
+	server := oauthtest.NewServer(oauthtest.User{Subject: "user-1", Email: "test@example.com", EmailVerified: true, Name: "Test User"})
+	defer server.Close()
+
+	ctx := context.Background()
+	provider, err := NewOIDCProvider(ctx, server.URL, Config{ClientID: "client", ClientSecret: "secret", RedirectURL: "http://localhost/callback"})
+	if err != nil {
+		t.Fatalf("Failed to create provider: %v", err)
+	}
+
+	t.Run("Successful sign-in", func(t *testing.T) {
+		code := authorizeForTest(t, provider.AuthCodeURL("state", "nonce-1", "verifier-0123456789-0123456789-0123456789"))
+		identity, err := provider.Exchange(ctx, code, "verifier-0123456789-0123456789-0123456789", "nonce-1")
+		if err != nil {
+			t.Fatalf("Exchange failed: %v", err)
+		}
+		if identity.Subject != "user-1" || identity.Email != "test@example.com" || !identity.EmailVerified || identity.Name != "Test User" {
+			t.Errorf("unexpected identity: %+v", identity)
+		}
+	})
+
+	t.Run("Nonce mismatch", func(t *testing.T) {
+		code := authorizeForTest(t, provider.AuthCodeURL("state", "nonce-1", "verifier-0123456789-0123456789-0123456789"))
+		if _, err := provider.Exchange(ctx, code, "verifier-0123456789-0123456789-0123456789", "other-nonce"); err == nil {
+			t.Error("expected a nonce mismatch to be rejected")
+		}
+	})
+
+	t.Run("Wrong PKCE verifier", func(t *testing.T) {
+		code := authorizeForTest(t, provider.AuthCodeURL("state", "nonce-1", "verifier-0123456789-0123456789-0123456789"))
+		if _, err := provider.Exchange(ctx, code, "another-verifier-0123456789-0123456789", "nonce-1"); err == nil {
+			t.Error("expected the code exchange to fail without the right verifier")
+		}
+	})
+
+	t.Run("Token from another issuer", func(t *testing.T) {
+		other := oauthtest.NewServer(oauthtest.User{Subject: "user-1"})
+		defer other.Close()
+		otherProvider, _ := NewOIDCProvider(ctx, other.URL, Config{ClientID: "client", RedirectURL: "http://localhost/callback"})
+		// Point the token endpoint at the other issuer while verifying against the first.
+		forged := *provider
+		forged.config.Endpoint = otherProvider.config.Endpoint
+
+		code := authorizeForTest(t, forged.AuthCodeURL("state", "nonce-1", "verifier-0123456789-0123456789-0123456789"))
+		if _, err := forged.Exchange(ctx, code, "verifier-0123456789-0123456789-0123456789", "nonce-1"); err == nil {
+			t.Error("expected an ID token signed by another issuer to be rejected")
+		}
+	})
+}
+
+func TestRegistry(t *testing.T) {
+	var nilRegistry *Registry
+	if _, ok := nilRegistry.Get("google"); ok {
+		t.Error("expected a nil registry to have no providers")
+	}
+
+	registry := NewRegistry()
+	registry.Register("keycloak", &GitHubProvider{})
+	registry.Register("github", &GitHubProvider{})
+	if _, ok := registry.Get("github"); !ok {
+		t.Error("expected github to be registered")
+	}
+	if names := registry.Names(); len(names) != 2 || names[0] != "github" || names[1] != "keycloak" {
+		t.Errorf("unexpected names: %v", names)
+	}
+}
@@ -0,0 +1,260 @@
+// Package passkey implements the WebAuthn registration and assertion ceremonies
+// used for passkeys and security keys, on top of go-webauthn. Ceremony state is
+// handed to the caller as opaque bytes so it can be stored server-side between
+// the two halves of a ceremony.
+package passkey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/free-education/user-service/model"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// ErrClonedAuthenticator is returned when an assertion's signature counter did not
+// increase, which suggests the credential's private key has been copied.
+var ErrClonedAuthenticator = errors.New("authenticator signature counter did not increase; the credential may have been cloned")
+
+// Config describes the relying party, i.e. the site the credentials are bound to.
+type Config struct {
+	// RPID is the domain credentials are scoped to, e.g. 'openmind.academy'.
+	RPID          string
+	RPDisplayName string
+	// RPOrigins are the fully qualified origins the ceremonies may run on.
+	RPOrigins []string
+}
+
+// User adapts a user and their registered credentials to webauthn.User.
+type User struct {
+	ID          int64
+	Name        string // Usually the email address.
+	DisplayName string
+	Credentials []*model.WebAuthnCredential
+}
+
+// UserHandle returns the WebAuthn user handle for a user ID.
+func UserHandle(userID int64) []byte {
+	return []byte(strconv.FormatInt(userID, 10))
+}
+
+// UserIDFromHandle returns the user ID encoded in a user handle.
+func UserIDFromHandle(handle []byte) (int64, error) {
+	return strconv.ParseInt(string(handle), 10, 64)
+}
+
+// WebAuthnID implements webauthn.User.
+func (u *User) WebAuthnID() []byte { return UserHandle(u.ID) }
+
+// WebAuthnName implements webauthn.User.
+func (u *User) WebAuthnName() string { return u.Name }
+
+// WebAuthnDisplayName implements webauthn.User.
+func (u *User) WebAuthnDisplayName() string {
+	if u.DisplayName == "" {
+		return u.Name
+	}
+	return u.DisplayName
+}
+
+// WebAuthnIcon implements webauthn.User.
+func (u *User) WebAuthnIcon() string { return "" }
+
+// WebAuthnCredentials implements webauthn.User.
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.Credentials))
+	for _, c := range u.Credentials {
+		credentials = append(credentials, toWebAuthn(c))
+	}
+	return credentials
+}
+
+// Service runs the ceremonies for one relying party.
+type Service struct {
+	rp *webauthn.WebAuthn
+}
+
+// New creates a Service for the relying party.
+func New(cfg Config) (*Service, error) {
+	rp, err := webauthn.New(&webauthn.Config{
+		RPID:          cfg.RPID,
+		RPDisplayName: cfg.RPDisplayName,
+		RPOrigins:     cfg.RPOrigins,
+		// Passkeys must be discoverable so they can be used without typing an email.
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebAuthn configuration: %w", err)
+	}
+	return &Service{rp: rp}, nil
+}
+
+// BeginRegistration starts registering a new credential for the user. Credentials
+// the user already has are excluded, so the same authenticator is not added twice.
+func (s *Service) BeginRegistration(user *User) (*protocol.CredentialCreation, []byte, error) {
+	exclude := make([]protocol.CredentialDescriptor, 0, len(user.Credentials))
+	for _, c := range user.WebAuthnCredentials() {
+		exclude = append(exclude, c.Descriptor())
+	}
+
+	options, session, err := s.rp.BeginRegistration(user, webauthn.WithExclusions(exclude))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(session)
+	return options, data, err
+}
+
+// FinishRegistration verifies the authenticator's response to BeginRegistration and
+// returns the new credential, ready to be stored.
+func (s *Service) FinishRegistration(user *User, session, response []byte) (*model.WebAuthnCredential, error) {
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal(session, &sessionData); err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.rp.CreateCredential(user, sessionData, parsed)
+	if err != nil {
+		return nil, err
+	}
+	return fromWebAuthn(user.ID, credential), nil
+}
+
+// BeginLogin starts an assertion with one of the user's credentials, for use as a second factor.
+func (s *Service) BeginLogin(user *User) (*protocol.CredentialAssertion, []byte, error) {
+	options, session, err := s.rp.BeginLogin(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(session)
+	return options, data, err
+}
+
+// BeginDiscoverableLogin starts a passwordless login, where the authenticator
+// chooses the credential and thereby tells us who the user is.
+func (s *Service) BeginDiscoverableLogin() (*protocol.CredentialAssertion, []byte, error) {
+	options, session, err := s.rp.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := json.Marshal(session)
+	return options, data, err
+}
+
+// FinishLogin verifies the authenticator's response to BeginLogin. It returns the
+// credential that was used, with its signature counter updated.
+func (s *Service) FinishLogin(user *User, session, response []byte) (*model.WebAuthnCredential, error) {
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal(session, &sessionData); err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, err
+	}
+
+	credential, err := s.rp.ValidateLogin(user, sessionData, parsed)
+	if err != nil {
+		return nil, err
+	}
+	return used(user, credential)
+}
+
+// FinishDiscoverableLogin verifies the authenticator's response to
+// BeginDiscoverableLogin. lookup loads the user named by the authenticator
+// together with their credentials. It returns that user and the credential used.
+func (s *Service) FinishDiscoverableLogin(session, response []byte, lookup func(userID int64) (*User, error)) (*User, *model.WebAuthnCredential, error) {
+	var sessionData webauthn.SessionData
+	if err := json.Unmarshal(session, &sessionData); err != nil {
+		return nil, nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var user *User
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := UserIDFromHandle(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		user, err = lookup(userID)
+		if err != nil {
+			return nil, err
+		}
+		return user, nil
+	}
+	credential, err := s.rp.ValidateDiscoverableLogin(handler, sessionData, parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+	stored, err := used(user, credential)
+	return user, stored, err
+}
+
+// used maps a credential verified by go-webauthn back to the user's stored
+// credential and applies the new counter and backup state to it.
+func used(user *User, credential *webauthn.Credential) (*model.WebAuthnCredential, error) {
+	if credential.Authenticator.CloneWarning {
+		return nil, ErrClonedAuthenticator
+	}
+	for _, c := range user.Credentials {
+		if bytes.Equal(c.CredentialID, credential.ID) {
+			c.SignCount = credential.Authenticator.SignCount
+			c.BackupState = credential.Flags.BackupState
+			return c, nil
+		}
+	}
+	return nil, errors.New("credential not found")
+}
+
+func toWebAuthn(c *model.WebAuthnCredential) webauthn.Credential {
+	transports := make([]protocol.AuthenticatorTransport, 0, len(c.Transports))
+	for _, t := range c.Transports {
+		transports = append(transports, protocol.AuthenticatorTransport(t))
+	}
+	return webauthn.Credential{
+		ID:              c.CredentialID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Flags: webauthn.CredentialFlags{
+			BackupEligible: c.BackupEligible,
+			BackupState:    c.BackupState,
+		},
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    c.AAGUID,
+			SignCount: c.SignCount,
+		},
+	}
+}
+
+func fromWebAuthn(userID int64, c *webauthn.Credential) *model.WebAuthnCredential {
+	transports := make([]string, 0, len(c.Transport))
+	for _, t := range c.Transport {
+		transports = append(transports, string(t))
+	}
+	return &model.WebAuthnCredential{
+		UserID:          userID,
+		CredentialID:    c.ID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transports:      transports,
+		AAGUID:          c.Authenticator.AAGUID,
+		SignCount:       c.Authenticator.SignCount,
+		BackupEligible:  c.Flags.BackupEligible,
+		BackupState:     c.Flags.BackupState,
+	}
+}
@@ -0,0 +1,125 @@
+package passkey
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/free-education/user-service/model"
+	"github.com/free-education/user-service/passkey/passkeytest"
+)
+
+func newServiceForTest(t *testing.T) *Service {
+	t.Helper()
+	service, err := New(Config{RPID: "localhost", RPDisplayName: "OpenMind Academy", RPOrigins: []string{"http://localhost:3001"}})
+	if err != nil {
+		t.Fatalf("Failed to create service: %v", err)
+	}
+	return service
+}
+
+// registerForTest registers a credential from the authenticator and adds it to the user.
+func registerForTest(t *testing.T, service *Service, authenticator *passkeytest.Authenticator, user *User) *model.WebAuthnCredential {
+	t.Helper()
+	options, session, err := service.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("BeginRegistration failed: %v", err)
+	}
+	optionsJSON, _ := json.Marshal(options)
+	response, err := authenticator.Register(optionsJSON)
+	if err != nil {
+		t.Fatalf("authenticator failed to register: %v", err)
+	}
+	credential, err := service.FinishRegistration(user, session, response)
+	if err != nil {
+		t.Fatalf("FinishRegistration failed: %v", err)
+	}
+	user.Credentials = append(user.Credentials, credential)
+	return credential
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	service := newServiceForTest(t)
+	authenticator := passkeytest.NewAuthenticator("http://localhost:3001")
+	user := &User{ID: 42, Name: "test@example.com"}
+
+	credential := registerForTest(t, service, authenticator, user)
+	if credential.UserID != 42 || len(credential.CredentialID) == 0 || len(credential.PublicKey) == 0 {
+		t.Fatalf("unexpected credential: %+v", credential)
+	}
+
+	t.Run("Second factor", func(t *testing.T) {
+		options, session, err := service.BeginLogin(user)
+		if err != nil {
+			t.Fatalf("BeginLogin failed: %v", err)
+		}
+		optionsJSON, _ := json.Marshal(options)
+		response, err := authenticator.Login(optionsJSON)
+		if err != nil {
+			t.Fatalf("authenticator failed to sign: %v", err)
+		}
+		used, err := service.FinishLogin(user, session, response)
+		if err != nil {
+			t.Fatalf("FinishLogin failed: %v", err)
+		}
+		if used != credential || used.SignCount != 1 {
+			t.Errorf("expected the registered credential with counter 1; got %+v", used)
+		}
+	})
+
+	t.Run("Passwordless", func(t *testing.T) {
+		options, session, err := service.BeginDiscoverableLogin()
+		if err != nil {
+			t.Fatalf("BeginDiscoverableLogin failed: %v", err)
+		}
+		optionsJSON, _ := json.Marshal(options)
+		response, _ := authenticator.Login(optionsJSON)
+
+		found, used, err := service.FinishDiscoverableLogin(session, response, func(userID int64) (*User, error) {
+			if userID != user.ID {
+				return nil, errors.New("user not found")
+			}
+			return user, nil
+		})
+		if err != nil {
+			t.Fatalf("FinishDiscoverableLogin failed: %v", err)
+		}
+		if found != user || used != credential {
+			t.Errorf("expected the user and their credential; got %+v, %+v", found, used)
+		}
+	})
+
+	t.Run("Replayed response", func(t *testing.T) {
+		options, session, _ := service.BeginLogin(user)
+		optionsJSON, _ := json.Marshal(options)
+		response, _ := authenticator.Login(optionsJSON)
+		if _, err := service.FinishLogin(user, session, response); err != nil {
+			t.Fatalf("FinishLogin failed: %v", err)
+		}
+
+		_, otherSession, _ := service.BeginLogin(user)
+		if _, err := service.FinishLogin(user, otherSession, response); err == nil {
+			t.Error("expected a response to another challenge to be rejected")
+		}
+	})
+
+	t.Run("Cloned authenticator", func(t *testing.T) {
+		authenticator.ResetCounters()
+		options, session, _ := service.BeginLogin(user)
+		optionsJSON, _ := json.Marshal(options)
+		response, _ := authenticator.Login(optionsJSON)
+		if _, err := service.FinishLogin(user, session, response); !errors.Is(err, ErrClonedAuthenticator) {
+			t.Errorf("expected ErrClonedAuthenticator; got %v", err)
+		}
+	})
+
+	t.Run("Wrong origin", func(t *testing.T) {
+		phishing := passkeytest.NewAuthenticator("http://evil.example")
+		options, session, _ := service.BeginRegistration(&User{ID: 43, Name: "other@example.com"})
+		optionsJSON, _ := json.Marshal(options)
+		response, _ := phishing.Register(optionsJSON)
+		if _, err := service.FinishRegistration(&User{ID: 43, Name: "other@example.com"}, session, response); err == nil {
+			t.Error("expected a response from another origin to be rejected")
+		}
+	})
+}
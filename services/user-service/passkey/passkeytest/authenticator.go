@@ -0,0 +1,227 @@
+// Package passkeytest provides a software WebAuthn authenticator for tests.
+package passkeytest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+)
+
+// Authenticator flags, see https://www.w3.org/TR/webauthn-2/#flags.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+type credential struct {
+	id         []byte
+	rpID       string
+	userHandle []byte
+	key        *ecdsa.PrivateKey
+	signCount  uint32
+}
+
+// Authenticator is a platform authenticator that keeps discoverable ES256
+// credentials in memory. It answers the options produced by a relying party's
+// begin-registration and begin-login calls with the JSON a browser's
+// navigator.credentials.create() and .get() would return, using "none" attestation
+// and always reporting user presence and verification.
+type Authenticator struct {
+	// Origin is the origin the simulated browser reports in the client data.
+	Origin string
+
+	mu          sync.Mutex
+	credentials []*credential
+}
+
+// NewAuthenticator creates an authenticator without credentials, running in a browser at origin.
+func NewAuthenticator(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// Register creates a credential for the given creation options, which may be either
+// the `publicKey` object or the object wrapping it. It returns the registration response.
+func (a *Authenticator) Register(options []byte) ([]byte, error) {
+	var opts struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	if err := unmarshalOptions(options, &opts); err != nil {
+		return nil, err
+	}
+	userHandle, err := base64.RawURLEncoding.DecodeString(opts.User.ID)
+	if err != nil {
+		return nil, errors.New("passkeytest: user.id is not base64url")
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cred := &credential{id: make([]byte, 16), rpID: opts.RP.ID, userHandle: userHandle, key: key}
+	if _, err := rand.Read(cred.id); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var authData bytes.Buffer
+	authData.Write(authDataHeader(cred.rpID, flagUserPresent|flagUserVerified|flagAttested, cred.signCount))
+	authData.Write(make([]byte, 16)) // AAGUID
+	binary.Write(&authData, binary.BigEndian, uint16(len(cred.id)))
+	authData.Write(cred.id)
+	authData.Write(publicKey)
+
+	attestationObject, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	a.credentials = append(a.credentials, cred)
+	a.mu.Unlock()
+
+	return json.Marshal(map[string]interface{}{
+		"id":    encode(cred.id),
+		"rawId": encode(cred.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    encode(a.clientData("webauthn.create", opts.Challenge)),
+			"attestationObject": encode(attestationObject),
+			"transports":        []string{"internal"},
+		},
+	})
+}
+
+// Login signs the challenge in the given request options with a matching
+// credential: one listed in allowCredentials or, if none are listed, the first
+// credential registered for the relying party. It returns the assertion response.
+func (a *Authenticator) Login(options []byte) ([]byte, error) {
+	var opts struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		AllowCredentials []struct {
+			ID string `json:"id"`
+		} `json:"allowCredentials"`
+	}
+	if err := unmarshalOptions(options, &opts); err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cred := a.find(opts.RPID, opts.AllowCredentials)
+	if cred == nil {
+		return nil, errors.New("passkeytest: no matching credential")
+	}
+	cred.signCount++
+
+	authData := authDataHeader(cred.rpID, flagUserPresent|flagUserVerified, cred.signCount)
+	clientData := a.clientData("webauthn.get", opts.Challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":    encode(cred.id),
+		"rawId": encode(cred.id),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    encode(clientData),
+			"authenticatorData": encode(authData),
+			"signature":         encode(signature),
+			"userHandle":        encode(cred.userHandle),
+		},
+	})
+}
+
+// ResetCounters sets the signature counter of every credential back to zero, as a
+// cloned authenticator would report.
+func (a *Authenticator) ResetCounters() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, cred := range a.credentials {
+		cred.signCount = 0
+	}
+}
+
+func (a *Authenticator) find(rpID string, allow []struct {
+	ID string `json:"id"`
+}) *credential {
+	for _, cred := range a.credentials {
+		if cred.rpID != rpID {
+			continue
+		}
+		if len(allow) == 0 {
+			return cred
+		}
+		for _, allowed := range allow {
+			if allowed.ID == encode(cred.id) {
+				return cred
+			}
+		}
+	}
+	return nil
+}
+
+func (a *Authenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return data
+}
+
+func authDataHeader(rpID string, flags byte, signCount uint32) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	header := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(header, signCount)
+}
+
+// unmarshalOptions decodes options given either as the `publicKey` object or wrapped in one.
+func unmarshalOptions(options []byte, v interface{}) error {
+	var wrapped struct {
+		PublicKey json.RawMessage `json:"publicKey"`
+	}
+	if err := json.Unmarshal(options, &wrapped); err == nil && len(wrapped.PublicKey) > 0 {
+		options = wrapped.PublicKey
+	}
+	return json.Unmarshal(options, v)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,191 @@
+// Package picture turns uploaded images into profile pictures.
+package picture
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+)
+
+// ContentType is the type of every processed picture.
+const ContentType = "image/jpeg"
+
+// MaxPixels bounds the dimensions of an upload, so that a small file that
+// decompresses into a huge image cannot exhaust the service's memory.
+const MaxPixels = 40_000_000
+
+var (
+	// ErrUnsupportedFormat is returned for uploads that are not JPEG, PNG or GIF images,
+	// whatever their file name or declared content type.
+	ErrUnsupportedFormat = errors.New("picture: unsupported image format")
+	// ErrTooManyPixels is returned for images larger than MaxPixels.
+	ErrTooManyPixels = errors.New("picture: image dimensions too large")
+)
+
+// Size is one of the sizes a profile picture is stored in.
+type Size struct {
+	Name string
+	// Pixels is the width and height of the square picture.
+	Pixels int
+}
+
+// Sizes are the sizes every profile picture is stored in, from smallest to largest.
+var Sizes = []Size{
+	{Name: "small", Pixels: 64},
+	{Name: "medium", Pixels: 256},
+	{Name: "large", Pixels: 512},
+}
+
+// Variant is a profile picture in one of the Sizes.
+type Variant struct {
+	Size Size
+	Data []byte
+}
+
+// decoders decode the formats accepted for upload, keyed by the content type
+// http.DetectContentType finds in their magic bytes.
+var decoders = map[string]func([]byte) (image.Image, error){
+	"image/jpeg": func(data []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(data)) },
+	"image/png":  func(data []byte) (image.Image, error) { return png.Decode(bytes.NewReader(data)) },
+	"image/gif":  func(data []byte) (image.Image, error) { return gif.Decode(bytes.NewReader(data)) },
+}
+
+// Process decodes an uploaded image and returns it in each of the Sizes: rotated
+// upright according to its EXIF orientation, cropped to a centered square, and
+// re-encoded as a JPEG without any of the upload's metadata. Images smaller than a
+// size are not enlarged.
+func Process(data []byte) ([]Variant, error) {
+	contentType := http.DetectContentType(data)
+	decode, ok := decoders[contentType]
+	if !ok {
+		return nil, ErrUnsupportedFormat
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return nil, ErrTooManyPixels
+	}
+	img, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnsupportedFormat, err)
+	}
+
+	upright := flatten(img)
+	if contentType == "image/jpeg" {
+		upright = orient(upright, exifOrientation(data))
+	}
+	square := cropSquare(upright)
+
+	variants := make([]Variant, 0, len(Sizes))
+	for _, size := range Sizes {
+		pixels := size.Pixels
+		if side := square.Bounds().Dx(); side < pixels {
+			pixels = side
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, resize(square, pixels), &jpeg.Options{Quality: 85}); err != nil {
+			return nil, err
+		}
+		variants = append(variants, Variant{Size: size, Data: buf.Bytes()})
+	}
+	return variants, nil
+}
+
+// flatten draws img onto a white background, since JPEG has no transparency.
+func flatten(img image.Image) *image.RGBA {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
+
+// cropSquare returns the largest square centered in img.
+func cropSquare(img *image.RGBA) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	side := w
+	if h < side {
+		side = h
+	}
+	x, y := (w-side)/2, (h-side)/2
+	return img.SubImage(image.Rect(x, y, x+side, y+side)).(*image.RGBA)
+}
+
+// contribution is the weight of one source pixel in a resized pixel.
+type contribution struct {
+	index  int
+	weight float64
+}
+
+// boxWeights returns, for each of dstLen pixels, the source pixels it covers when
+// srcLen pixels are scaled to dstLen, weighted by how much of each is covered.
+func boxWeights(srcLen, dstLen int) [][]contribution {
+	scale := float64(srcLen) / float64(dstLen)
+	weights := make([][]contribution, dstLen)
+	for i := range weights {
+		start, end := float64(i)*scale, float64(i+1)*scale
+		var total float64
+		for j := int(start); j < srcLen && float64(j) < end; j++ {
+			overlap := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+			if overlap > 0 {
+				weights[i] = append(weights[i], contribution{index: j, weight: overlap})
+				total += overlap
+			}
+		}
+		for k := range weights[i] {
+			weights[i][k].weight /= total
+		}
+	}
+	return weights
+}
+
+// resize scales a square image to side×side pixels by averaging the source
+// pixels each destination pixel covers, first horizontally, then vertically.
+func resize(src *image.RGBA, side int) *image.RGBA {
+	bounds := src.Bounds()
+	srcSide := bounds.Dx()
+
+	weights := boxWeights(srcSide, side)
+	horizontal := image.NewRGBA(image.Rect(0, 0, side, srcSide))
+	for y := 0; y < srcSide; y++ {
+		for x, contributions := range weights {
+			var r, g, b float64
+			for _, c := range contributions {
+				offset := src.PixOffset(bounds.Min.X+c.index, bounds.Min.Y+y)
+				r += float64(src.Pix[offset]) * c.weight
+				g += float64(src.Pix[offset+1]) * c.weight
+				b += float64(src.Pix[offset+2]) * c.weight
+			}
+			horizontal.SetRGBA(x, y, color.RGBA{R: round(r), G: round(g), B: round(b), A: 255})
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	for y, contributions := range weights {
+		for x := 0; x < side; x++ {
+			var r, g, b float64
+			for _, c := range contributions {
+				offset := horizontal.PixOffset(x, c.index)
+				r += float64(horizontal.Pix[offset]) * c.weight
+				g += float64(horizontal.Pix[offset+1]) * c.weight
+				b += float64(horizontal.Pix[offset+2]) * c.weight
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: round(r), G: round(g), B: round(b), A: 255})
+		}
+	}
+	return dst
+}
+
+func round(v float64) uint8 {
+	return uint8(math.Min(255, math.Round(v)))
+}
@@ -0,0 +1,200 @@
+package picture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// twoColorImage returns a w×h image whose top half is top and bottom half is bottom.
+func twoColorImage(w, h int, top, bottom color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if y < h/2 {
+				img.Set(x, y, top)
+			} else {
+				img.Set(x, y, bottom)
+			}
+		}
+	}
+	return img
+}
+
+// withExifOrientation inserts an EXIF segment with the given orientation, and a
+// camera serial number that must not survive processing, into a JPEG file.
+func withExifOrientation(jpegData []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1) // One IFD entry
+	tiff = binary.BigEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // Value padding, no next IFD
+	tiff = append(tiff, []byte("SERIAL-123456")...)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{}, jpegData[:2]...)
+	out = append(out, app1...)
+	return append(out, jpegData[2:]...)
+}
+
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xC000 && g < 0x4000 && b < 0x4000
+}
+
+func isBlue(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return b > 0xC000 && r < 0x4000 && g < 0x4000
+}
+
+func TestProcess(t *testing.T) {
+	t.Run("Pictures are cropped, resized and re-encoded as JPEG", func(t *testing.T) {
+		var upload bytes.Buffer
+		png.Encode(&upload, twoColorImage(900, 600, color.Transparent, color.NRGBA{B: 255, A: 255}))
+
+		variants, err := Process(upload.Bytes())
+		if err != nil {
+			t.Fatalf("Process failed: %v", err)
+		}
+		if len(variants) != len(Sizes) {
+			t.Fatalf("expected %d variants; got %d", len(Sizes), len(variants))
+		}
+		for _, variant := range variants {
+			img, err := jpeg.Decode(bytes.NewReader(variant.Data))
+			if err != nil {
+				t.Fatalf("%s: expected a JPEG: %v", variant.Size.Name, err)
+			}
+			side := variant.Size.Pixels
+			if img.Bounds().Dx() != side || img.Bounds().Dy() != side {
+				t.Errorf("%s: expected %dx%d; got %v", variant.Size.Name, side, side, img.Bounds())
+			}
+			// Transparency becomes white.
+			if r, g, b, _ := img.At(side/2, side/8).RGBA(); r < 0xF000 || g < 0xF000 || b < 0xF000 {
+				t.Errorf("%s: expected the transparent half to be white", variant.Size.Name)
+			}
+			if !isBlue(img.At(side/2, side-side/8)) {
+				t.Errorf("%s: expected the bottom half to be blue", variant.Size.Name)
+			}
+		}
+	})
+
+	t.Run("Small pictures are not enlarged", func(t *testing.T) {
+		var upload bytes.Buffer
+		png.Encode(&upload, twoColorImage(100, 120, color.White, color.Black))
+
+		variants, err := Process(upload.Bytes())
+		if err != nil {
+			t.Fatalf("Process failed: %v", err)
+		}
+		for _, variant := range variants {
+			config, err := jpeg.DecodeConfig(bytes.NewReader(variant.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := variant.Size.Pixels
+			if want > 100 {
+				want = 100
+			}
+			if config.Width != want || config.Height != want {
+				t.Errorf("%s: expected %dx%d; got %dx%d", variant.Size.Name, want, want, config.Width, config.Height)
+			}
+		}
+	})
+
+	t.Run("Photos are turned upright and their EXIF data is dropped", func(t *testing.T) {
+		var photo bytes.Buffer
+		jpeg.Encode(&photo, twoColorImage(80, 40, color.NRGBA{R: 255, A: 255}, color.NRGBA{B: 255, A: 255}), &jpeg.Options{Quality: 95})
+		// Orientation 6: the photo must be rotated clockwise, which turns its top into
+		// its right side.
+		upload := withExifOrientation(photo.Bytes(), 6)
+		if exifOrientation(upload) != 6 {
+			t.Fatalf("expected orientation 6; got %d", exifOrientation(upload))
+		}
+
+		variants, err := Process(upload)
+		if err != nil {
+			t.Fatalf("Process failed: %v", err)
+		}
+		small := variants[0]
+		if bytes.Contains(small.Data, []byte("Exif")) || bytes.Contains(small.Data, []byte("SERIAL-123456")) {
+			t.Error("expected the EXIF data to be stripped")
+		}
+		img, err := jpeg.Decode(bytes.NewReader(small.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if img.Bounds().Dx() != 40 {
+			t.Fatalf("expected a 40 pixel picture; got %v", img.Bounds())
+		}
+		if !isBlue(img.At(5, 20)) || !isRed(img.At(35, 20)) {
+			t.Errorf("expected blue on the left and red on the right; got %v and %v", img.At(5, 20), img.At(35, 20))
+		}
+	})
+
+	t.Run("Files that are not images are rejected", func(t *testing.T) {
+		for name, data := range map[string][]byte{
+			"text":      []byte("fake image data"),
+			"html":      []byte("<html><script>alert(1)</script></html>"),
+			"truncated": {0xFF, 0xD8, 0xFF, 0xE0},
+		} {
+			if _, err := Process(data); !errors.Is(err, ErrUnsupportedFormat) {
+				t.Errorf("%s: expected ErrUnsupportedFormat; got %v", name, err)
+			}
+		}
+	})
+
+	t.Run("Images with huge dimensions are rejected before decoding", func(t *testing.T) {
+		// A PNG header claiming 20000x20000 pixels, without any image data.
+		ihdr := []byte("IHDR")
+		ihdr = binary.BigEndian.AppendUint32(ihdr, 20000)
+		ihdr = binary.BigEndian.AppendUint32(ihdr, 20000)
+		ihdr = append(ihdr, 8, 2, 0, 0, 0) // 8-bit RGB
+		upload := []byte("\x89PNG\r\n\x1a\n")
+		upload = binary.BigEndian.AppendUint32(upload, uint32(len(ihdr)-4))
+		upload = append(upload, ihdr...)
+		upload = binary.BigEndian.AppendUint32(upload, crc32.ChecksumIEEE(ihdr))
+
+		if _, err := Process(upload); !errors.Is(err, ErrTooManyPixels) {
+			t.Errorf("expected ErrTooManyPixels; got %v", err)
+		}
+	})
+}
+
+func TestOrient(t *testing.T) {
+	// A 3x2 image whose pixels are numbered row by row.
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i := 0; i < 6; i++ {
+		src.SetRGBA(i%3, i/3, color.RGBA{R: uint8(i), A: 255})
+	}
+	tests := map[int][]uint8{
+		1: {0, 1, 2, 3, 4, 5},
+		2: {2, 1, 0, 5, 4, 3},
+		3: {5, 4, 3, 2, 1, 0},
+		4: {3, 4, 5, 0, 1, 2},
+		5: {0, 3, 1, 4, 2, 5},
+		6: {3, 0, 4, 1, 5, 2},
+		7: {5, 2, 4, 1, 3, 0},
+		8: {2, 5, 1, 4, 0, 3},
+	}
+	for orientation, want := range tests {
+		dst := orient(src, orientation)
+		w := dst.Bounds().Dx()
+		for i, value := range want {
+			if got := dst.RGBAAt(i%w, i/w).R; got != value {
+				t.Errorf("orientation %d: expected pixel %d to be %d; got %d", orientation, i, value, got)
+			}
+		}
+	}
+}
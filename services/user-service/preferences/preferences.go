@@ -0,0 +1,118 @@
+// Package preferences defines the schema of user preferences and applies updates to them.
+//
+// Preferences are stored sparsely: only the values a user has set, together with
+// the schema version they follow. Everything else takes the default from the
+// schema, so defaults can change without touching stored preferences.
+package preferences
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+)
+
+// Version is the version of the preferences schema. It is increased, with a
+// migration in Normalize, whenever a change would invalidate stored preferences.
+const Version = 1
+
+// Schema is the JSON Schema of the preferences.
+//
+//go:embed schema.json
+var Schema []byte
+
+// schema is Schema decoded.
+var schema map[string]interface{}
+
+func init() {
+	if err := json.Unmarshal(Schema, &schema); err != nil {
+		panic(fmt.Sprintf("preferences: invalid schema: %v", err))
+	}
+}
+
+// Preferences are a user's preferences, with defaults filled in.
+type Preferences struct {
+	Version       int           `json:"version"`
+	Theme         string        `json:"theme"`
+	Language      string        `json:"language"`
+	Timezone      string        `json:"timezone"`
+	PlaybackSpeed float64       `json:"playback_speed"`
+	Notifications Notifications `json:"notifications"`
+}
+
+// Notifications are the opt-ins to optional notifications, per channel and event type.
+type Notifications struct {
+	Email map[string]bool `json:"email"`
+	Push  map[string]bool `json:"push"`
+}
+
+// Resolve returns stored preferences with defaults filled in.
+func Resolve(stored map[string]interface{}) Preferences {
+	var prefs Preferences
+	data, _ := json.Marshal(MergePatch(defaults(schema), Normalize(stored)))
+	json.Unmarshal(data, &prefs)
+	return prefs
+}
+
+// Normalize returns stored preferences migrated to the current Version. Values
+// the schema does not allow, such as the arbitrary keys clients could store
+// before preferences had a schema, are dropped.
+func Normalize(stored map[string]interface{}) map[string]interface{} {
+	normalized, ok := prune(schema, stored).(map[string]interface{})
+	if !ok {
+		normalized = map[string]interface{}{}
+	}
+	normalized["version"] = Version
+	return normalized
+}
+
+// Apply applies a JSON Merge Patch (RFC 7396) to stored preferences and returns the
+// result to store. Setting a preference to null removes it, restoring its default.
+// The patch is rejected with a *ValidationError if the result does not match the
+// schema, or if the patch was written for another version of it.
+func Apply(stored map[string]interface{}, patch map[string]interface{}) (map[string]interface{}, error) {
+	if version, ok := patch["version"]; ok && version != nil {
+		if v, ok := number(version); !ok || v != Version {
+			return nil, &ValidationError{Problems: []string{fmt.Sprintf("/version: the patch is for version %v of the preferences, but the current version is %d", version, Version)}}
+		}
+	}
+
+	patched := MergePatch(Normalize(stored), patch).(map[string]interface{})
+	patched["version"] = Version
+	var problems []string
+	validate(schema, patched, "", &problems)
+	if len(problems) > 0 {
+		return nil, &ValidationError{Problems: problems}
+	}
+	return patched, nil
+}
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to target without modifying it.
+func MergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, _ := target.(map[string]interface{})
+	result := make(map[string]interface{}, len(targetObject)+len(patchObject))
+	for key, value := range targetObject {
+		result[key] = value
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(result, key)
+		} else {
+			result[key] = MergePatch(result[key], value)
+		}
+	}
+	return result
+}
+
+// ValidationError lists why preferences do not match the schema.
+type ValidationError struct {
+	// Problems are of the form "<JSON pointer>: <problem>".
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("preferences: %d invalid value(s): %v", len(e.Problems), e.Problems)
+}
@@ -0,0 +1,179 @@
+package preferences
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// decodeForTest decodes a JSON object the way the API and the database driver do.
+func decodeForTest(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(s), &object); err != nil {
+		t.Fatal(err)
+	}
+	return object
+}
+
+func TestResolve(t *testing.T) {
+	t.Run("Missing preferences take their defaults", func(t *testing.T) {
+		prefs := Resolve(nil)
+		want := Preferences{
+			Version:       Version,
+			Theme:         "light",
+			Language:      "en",
+			Timezone:      "UTC",
+			PlaybackSpeed: 1,
+			Notifications: Notifications{
+				Email: map[string]bool{"content_approved": true, "content_rejected": true},
+				Push:  map[string]bool{"content_approved": true, "content_rejected": true},
+			},
+		}
+		if !reflect.DeepEqual(prefs, want) {
+			t.Errorf("expected %+v; got %+v", want, prefs)
+		}
+	})
+
+	t.Run("Stored preferences override the defaults", func(t *testing.T) {
+		prefs := Resolve(decodeForTest(t, `{"version": 1, "theme": "dark", "notifications": {"email": {"content_rejected": false}}}`))
+		if prefs.Theme != "dark" || prefs.Notifications.Email["content_rejected"] || !prefs.Notifications.Email["content_approved"] {
+			t.Errorf("unexpected preferences %+v", prefs)
+		}
+	})
+
+	t.Run("Legacy junk is ignored", func(t *testing.T) {
+		prefs := Resolve(decodeForTest(t, `{"theme": "neon", "favourite_color": "green", "playback_speed": 1.5}`))
+		if prefs.Theme != "light" || prefs.PlaybackSpeed != 1.5 {
+			t.Errorf("unexpected preferences %+v", prefs)
+		}
+	})
+
+	t.Run("The typed preferences cover the whole schema", func(t *testing.T) {
+		data, _ := json.Marshal(Resolve(nil))
+		var resolved map[string]interface{}
+		json.Unmarshal(data, &resolved)
+		if !reflect.DeepEqual(resolved, defaults(schema)) {
+			t.Errorf("expected Preferences to match the schema's defaults\n%v\ngot\n%v", defaults(schema), resolved)
+		}
+	})
+}
+
+func TestApply(t *testing.T) {
+	stored := decodeForTest(t, `{"version": 1, "theme": "dark", "language": "de", "notifications": {"email": {"content_approved": false}}}`)
+
+	t.Run("A merge patch updates, adds and removes preferences", func(t *testing.T) {
+		patch := decodeForTest(t, `{"theme": "system", "language": null, "timezone": "Europe/Berlin", "notifications": {"email": {"content_approved": null}, "push": {"content_rejected": false}}}`)
+		patched, err := Apply(stored, patch)
+		if err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+		want := decodeForTest(t, `{"version": 1, "theme": "system", "timezone": "Europe/Berlin", "notifications": {"email": {}, "push": {"content_rejected": false}}}`)
+		if !equalJSONForTest(patched, want) {
+			t.Errorf("expected %v; got %v", want, patched)
+		}
+		if stored["theme"] != "dark" {
+			t.Error("expected the stored preferences to be left unmodified")
+		}
+	})
+
+	t.Run("Invalid values are rejected with every problem", func(t *testing.T) {
+		patch := decodeForTest(t, `{"theme": "neon", "playback_speed": 3, "timezone": "Mars/Olympus_Mons", "language": "English", "favourite_color": "green", "notifications": {"sms": {}, "email": {"content_approved": "yes"}}}`)
+		_, err := Apply(stored, patch)
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("expected a ValidationError; got %v", err)
+		}
+		var paths []string
+		for _, problem := range validationErr.Problems {
+			paths = append(paths, problem[:strings.Index(problem, ":")])
+		}
+		sort.Strings(paths)
+		want := []string{"/favourite_color", "/language", "/notifications/email/content_approved", "/notifications/sms", "/playback_speed", "/theme", "/timezone"}
+		if !reflect.DeepEqual(paths, want) {
+			t.Errorf("expected problems with %v; got %v", want, validationErr.Problems)
+		}
+	})
+
+	t.Run("Playback speeds must be a multiple of a quarter", func(t *testing.T) {
+		if _, err := Apply(stored, decodeForTest(t, `{"playback_speed": 1.25}`)); err != nil {
+			t.Errorf("expected 1.25 to be accepted; got %v", err)
+		}
+		if _, err := Apply(stored, decodeForTest(t, `{"playback_speed": 1.3}`)); err == nil {
+			t.Error("expected 1.3 to be rejected")
+		}
+	})
+
+	t.Run("Patches for another schema version are rejected", func(t *testing.T) {
+		if _, err := Apply(stored, decodeForTest(t, `{"version": 2, "theme": "dark"}`)); err == nil {
+			t.Error("expected a patch for version 2 to be rejected")
+		}
+		if _, err := Apply(stored, decodeForTest(t, `{"version": 1, "theme": "dark"}`)); err != nil {
+			t.Errorf("expected a patch for the current version to be accepted; got %v", err)
+		}
+	})
+
+	t.Run("Legacy junk is dropped when preferences are updated", func(t *testing.T) {
+		patched, err := Apply(decodeForTest(t, `{"theme": "light", "favourite_color": "green"}`), decodeForTest(t, `{"theme": "dark"}`))
+		if err != nil {
+			t.Fatalf("Apply failed: %v", err)
+		}
+		if _, ok := patched["favourite_color"]; ok || patched["version"] != Version {
+			t.Errorf("expected legacy keys to be dropped and the version set; got %v", patched)
+		}
+	})
+}
+
+func TestMergePatch(t *testing.T) {
+	// Examples from appendix A of RFC 7396.
+	tests := []struct{ target, patch, want string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		var target, patch, want interface{}
+		json.Unmarshal([]byte(test.target), &target)
+		json.Unmarshal([]byte(test.patch), &patch)
+		json.Unmarshal([]byte(test.want), &want)
+		if got := MergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("merging %s into %s: expected %s; got %v", test.patch, test.target, test.want, got)
+		}
+	}
+}
+
+func TestSchema(t *testing.T) {
+	if schema["$id"] != "/api/v1/preferences/schema" {
+		t.Errorf("unexpected schema id %v", schema["$id"])
+	}
+	version := schema["properties"].(map[string]interface{})["version"].(map[string]interface{})
+	if version["const"] != float64(Version) {
+		t.Errorf("expected the schema to be version %d; got %v", Version, version["const"])
+	}
+}
+
+// equalJSONForTest compares two JSON objects after a round trip through JSON, so
+// that the Go types of their numbers do not matter.
+func equalJSONForTest(a, b map[string]interface{}) bool {
+	var x, y interface{}
+	dataA, _ := json.Marshal(a)
+	dataB, _ := json.Marshal(b)
+	json.Unmarshal(dataA, &x)
+	json.Unmarshal(dataB, &y)
+	return reflect.DeepEqual(x, y)
+}
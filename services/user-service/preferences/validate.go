@@ -0,0 +1,185 @@
+package preferences
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	// The service runs in images without a time zone database.
+	_ "time/tzdata"
+)
+
+// validate appends to problems every way in which value does not match the
+// schema s. It understands the subset of JSON Schema schema.json uses.
+func validate(s map[string]interface{}, value interface{}, path string, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		pointer := path
+		if pointer == "" {
+			pointer = "/"
+		}
+		*problems = append(*problems, pointer+": "+fmt.Sprintf(format, args...))
+	}
+
+	switch s["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			fail("must be an object")
+			return
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			propertyPath := path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+			property, ok := properties[key].(map[string]interface{})
+			if !ok {
+				if s["additionalProperties"] == false {
+					*problems = append(*problems, propertyPath+": unknown preference")
+				}
+				continue
+			}
+			validate(property, object[key], propertyPath, problems)
+		}
+		return
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			fail("must be a string")
+			return
+		}
+		if pattern, ok := s["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(str) {
+			fail("%q is not valid", str)
+			return
+		}
+		if s["format"] == "iana-time-zone" {
+			if _, err := time.LoadLocation(str); err != nil || str == "" || str == "Local" {
+				fail("%q is not an IANA time zone such as \"Europe/Berlin\"", str)
+				return
+			}
+		}
+
+	case "number", "integer":
+		n, ok := number(value)
+		if !ok {
+			fail("must be a number")
+			return
+		}
+		if s["type"] == "integer" && n != math.Trunc(n) {
+			fail("must be an integer")
+			return
+		}
+		if minimum, ok := number(s["minimum"]); ok && n < minimum {
+			fail("must be at least %v", minimum)
+			return
+		}
+		if maximum, ok := number(s["maximum"]); ok && n > maximum {
+			fail("must be at most %v", maximum)
+			return
+		}
+		if step, ok := number(s["multipleOf"]); ok && math.Abs(n/step-math.Round(n/step)) > 1e-9 {
+			fail("must be a multiple of %v", step)
+			return
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail("must be true or false")
+			return
+		}
+	}
+
+	if constant, ok := s["const"]; ok && !equal(value, constant) {
+		fail("must be %v", constant)
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		for _, allowed := range enum {
+			if equal(value, allowed) {
+				return
+			}
+		}
+		quoted := make([]string, len(enum))
+		for i, allowed := range enum {
+			quoted[i] = fmt.Sprintf("%q", allowed)
+		}
+		fail("must be one of %s", strings.Join(quoted, ", "))
+	}
+}
+
+// prune returns value without whatever does not match the schema s, or nil if
+// nothing of it does.
+func prune(s map[string]interface{}, value interface{}) interface{} {
+	if s["type"] == "object" {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		pruned := make(map[string]interface{}, len(object))
+		for key, propertyValue := range object {
+			if property, ok := properties[key].(map[string]interface{}); ok {
+				if kept := prune(property, propertyValue); kept != nil {
+					pruned[key] = kept
+				}
+			}
+		}
+		return pruned
+	}
+
+	var problems []string
+	validate(s, value, "", &problems)
+	if len(problems) > 0 {
+		return nil
+	}
+	return value
+}
+
+// defaults returns the default value the schema s describes.
+func defaults(s map[string]interface{}) interface{} {
+	if value, ok := s["default"]; ok {
+		return value
+	}
+	if s["type"] != "object" {
+		return nil
+	}
+	properties, _ := s["properties"].(map[string]interface{})
+	object := make(map[string]interface{}, len(properties))
+	for key, property := range properties {
+		if value := defaults(property.(map[string]interface{})); value != nil {
+			object[key] = value
+		}
+	}
+	return object
+}
+
+// number returns value as a float64 if it is a number.
+func number(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case json.Number:
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// equal compares two JSON values, treating numbers of different Go types alike.
+func equal(a, b interface{}) bool {
+	if x, ok := number(a); ok {
+		y, ok := number(b)
+		return ok && x == y
+	}
+	return a == b
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// ScheduleUserDeletion deactivates a user's account and schedules its permanent
+// deletion for deleteAt. Until then, ReactivateUser cancels it.
+func (s *PostgresUserStore) ScheduleUserDeletion(ctx context.Context, userID int64, deleteAt time.Time) error {
+	query := `
+		UPDATE users
+		SET deactivated_at = COALESCE(deactivated_at, NOW()), deletion_scheduled_at = $2, updated_at = NOW()
+		WHERE id = $1
+	`
+	_, err := s.db.Exec(ctx, query, userID, deleteAt)
+	return err
+}
+
+// ReactivateUser reactivates an account the user deactivated or scheduled for
+// deletion themselves, cancelling the deletion. Accounts suspended by staff are
+// left alone. It returns pgx.ErrNoRows if there was nothing to reactivate.
+func (s *PostgresUserStore) ReactivateUser(ctx context.Context, userID int64) error {
+	query := `
+		UPDATE users
+		SET deactivated_at = NULL, deletion_scheduled_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND deactivated_at IS NOT NULL AND NOT deactivated_by_admin
+		RETURNING id
+	`
+	var id int64
+	return s.db.QueryRow(ctx, query, userID).Scan(&id)
+}
+
+// PurgeScheduledDeletions permanently deletes up to limit users whose scheduled
+// deletion time has passed, together with their data, and returns their IDs and
+// the keys of their profile pictures, whose blobs the caller must delete. Like
+// DeleteUser, it records a user deletion for services to confirm for each of them.
+// Rows being purged by another instance are skipped.
+func (s *PostgresUserStore) PurgeScheduledDeletions(ctx context.Context, limit int, services []string) ([]int64, []string, error) {
+	query := `
+		WITH deleted AS (
+			DELETE FROM users
+			WHERE id IN (
+				SELECT id FROM users
+				WHERE deletion_scheduled_at <= NOW()
+				ORDER BY deletion_scheduled_at
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, profile_picture_key
+		),
+		` + userDeletionInsert + `
+		SELECT id, COALESCE(profile_picture_key, '') FROM deleted
+	`
+	rows, err := s.db.Query(ctx, query, limit, services)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []int64
+	var profilePictureKeys []string
+	for rows.Next() {
+		var id int64
+		var profilePictureKey string
+		if err := rows.Scan(&id, &profilePictureKey); err != nil {
+			return nil, nil, err
+		}
+		userIDs = append(userIDs, id)
+		if profilePictureKey != "" {
+			profilePictureKeys = append(profilePictureKeys, profilePictureKey)
+		}
+	}
+	return userIDs, profilePictureKeys, rows.Err()
+}
@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/free-education/user-service/model"
+)
+
+// --- User Activity Storage Functions ---
+
+// CreateUserActivity creates a new user activity record in the database. An
+// activity with the EventID of one already recorded is ignored.
+func (s *PostgresUserStore) CreateUserActivity(ctx context.Context, activity *model.UserActivity) error {
+	query := `
+		INSERT INTO user_activities (user_id, activity_type, metadata, event_id)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		ON CONFLICT (event_id) DO NOTHING
+	`
+	_, err := s.db.Exec(ctx, query, activity.UserID, activity.ActivityType, activity.Metadata, activity.EventID)
+	return err
+}
+
+// GetUserActivities retrieves all activity records for a given user.
+func (s *PostgresUserStore) GetUserActivities(ctx context.Context, userID int64) ([]*model.UserActivity, error) {
+	query := `
+		SELECT id, user_id, activity_type, metadata, created_at
+		FROM user_activities
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activities []*model.UserActivity
+	for rows.Next() {
+		var activity model.UserActivity
+		if err := rows.Scan(&activity.ID, &activity.UserID, &activity.ActivityType, &activity.Metadata, &activity.CreatedAt); err != nil {
+			return nil, err
+		}
+		activities = append(activities, &activity)
+	}
+	return activities, nil
+}
+
+// SearchUserActivities returns up to search.Limit of a user's activities matching
+// the search, newest first, starting after the activity with ID search.Cursor.
+func (s *PostgresUserStore) SearchUserActivities(ctx context.Context, search model.UserActivitySearch) ([]*model.UserActivity, error) {
+	query := `
+		SELECT id, user_id, activity_type, metadata, created_at
+		FROM user_activities
+		WHERE user_id = $1
+		  AND ($2::bigint = 0 OR id < $2)
+		  AND (cardinality($3::text[]) = 0 OR activity_type = ANY($3))
+		  AND ($4::timestamptz IS NULL OR created_at >= $4)
+		  AND ($5::timestamptz IS NULL OR created_at < $5)
+		ORDER BY id DESC
+		LIMIT $6
+	`
+	types := search.Types
+	if types == nil {
+		types = []string{}
+	}
+	var since, until *time.Time
+	if !search.Since.IsZero() {
+		since = &search.Since
+	}
+	if !search.Until.IsZero() {
+		until = &search.Until
+	}
+
+	rows, err := s.db.Query(ctx, query, search.UserID, search.Cursor, types, since, until, search.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activities []*model.UserActivity
+	for rows.Next() {
+		var activity model.UserActivity
+		if err := rows.Scan(&activity.ID, &activity.UserID, &activity.ActivityType, &activity.Metadata, &activity.CreatedAt); err != nil {
+			return nil, err
+		}
+		activities = append(activities, &activity)
+	}
+	return activities, rows.Err()
+}
+
+// GetUserActivityDays counts a user's activities since the given time per day and
+// type, oldest day first. Days are calendar days in the given IANA time zone; days
+// without activities are left out.
+func (s *PostgresUserStore) GetUserActivityDays(ctx context.Context, userID int64, since time.Time, timezone string) ([]*model.UserActivityDay, error) {
+	query := `
+		SELECT to_char(created_at AT TIME ZONE $3, 'YYYY-MM-DD') AS day, activity_type, COUNT(*)
+		FROM user_activities
+		WHERE user_id = $1 AND created_at >= $2
+		GROUP BY day, activity_type
+		ORDER BY day
+	`
+	rows, err := s.db.Query(ctx, query, userID, since, timezone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []*model.UserActivityDay
+	for rows.Next() {
+		var date, activityType string
+		var count int
+		if err := rows.Scan(&date, &activityType, &count); err != nil {
+			return nil, err
+		}
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			days = append(days, &model.UserActivityDay{Date: date, Counts: map[string]int{}})
+		}
+		day := days[len(days)-1]
+		day.Counts[activityType] = count
+		day.Total += count
+	}
+	return days, rows.Err()
+}
+
+// DeleteExpiredUserActivities deletes up to limit activities older than the
+// retention period of their type, or defaultRetention for types not in
+// retention, and returns how many it deleted. A retention period of zero keeps
+// activities forever. Rows being deleted by another instance are skipped.
+func (s *PostgresUserStore) DeleteExpiredUserActivities(ctx context.Context, defaultRetention time.Duration, retention map[string]time.Duration, limit int) (int64, error) {
+	query := `
+		DELETE FROM user_activities
+		WHERE id IN (
+			SELECT a.id
+			FROM user_activities a
+			LEFT JOIN unnest($1::text[], $2::float8[]) AS r(activity_type, seconds) ON r.activity_type = a.activity_type
+			WHERE COALESCE(r.seconds, $3) > 0
+			  AND a.created_at < NOW() - make_interval(secs => COALESCE(r.seconds, $3))
+			LIMIT $4
+			FOR UPDATE OF a SKIP LOCKED
+		)
+	`
+	types := make([]string, 0, len(retention))
+	seconds := make([]float64, 0, len(retention))
+	for activityType, period := range retention {
+		types = append(types, activityType)
+		seconds = append(seconds, period.Seconds())
+	}
+
+	tag, err := s.db.Exec(ctx, query, types, seconds, defaultRetention.Seconds(), limit)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,186 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/free-education/user-service/model"
+)
+
+// --- Admin Storage Functions ---
+
+// auditInsert writes an admin_audit_log entry for every row of the `updated` CTE.
+// Parameters $2 to $6 are the actor, action, reason, details and IP address; the
+// target is the updated user.
+const auditInsert = `
+	audit AS (
+		INSERT INTO admin_audit_log (actor_id, action, target_user_id, reason, details, ip_address)
+		SELECT $2, $3, id, $4, COALESCE($5::jsonb, '{}'), $6 FROM updated
+	)
+`
+
+func auditArgs(userID int64, entry *model.AdminAuditEntry) []interface{} {
+	return []interface{}{userID, entry.ActorID, entry.Action, entry.Reason, entry.Details, entry.IPAddress}
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// SearchUsers returns one page of the users matching the search, ordered by ID,
+// and the total number of matches.
+func (s *PostgresUserStore) SearchUsers(ctx context.Context, search model.UserSearch) ([]*model.User, int64, error) {
+	where := `
+		WHERE ($1 = '' OR email ILIKE $1 OR first_name ILIKE $1 OR last_name ILIKE $1 OR first_name || ' ' || last_name ILIKE $1)
+		  AND ($2 = '' OR role = $2)
+		  AND ($3 = '' OR ($3 = 'deactivated') = (deactivated_at IS NOT NULL))
+	`
+	pattern := ""
+	if search.Query != "" {
+		pattern = "%" + escapeLike(search.Query) + "%"
+	}
+
+	var total int64
+	if err := s.db.QueryRow(ctx, `SELECT COUNT(*) FROM users`+where, pattern, search.Role, search.Status).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, email, first_name, last_name, role, two_factor_enabled, created_at, updated_at, deactivated_at, email_verified_at,
+		       deactivated_by_admin, deletion_scheduled_at
+		FROM users` + where + `
+		ORDER BY id
+		LIMIT $4 OFFSET $5
+	`
+	rows, err := s.db.Query(ctx, query, pattern, search.Role, search.Status, search.PageSize, (search.Page-1)*search.PageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var users []*model.User
+	for rows.Next() {
+		var u model.User
+		if err := rows.Scan(&u.ID, &u.Email, &u.FirstName, &u.LastName, &u.Role, &u.TwoFactorEnabled,
+			&u.CreatedAt, &u.UpdatedAt, &u.DeactivatedAt, &u.EmailVerifiedAt, &u.DeactivatedByAdmin, &u.DeletionScheduledAt); err != nil {
+			return nil, 0, err
+		}
+		users = append(users, &u)
+	}
+	return users, total, rows.Err()
+}
+
+// SetUserRole changes a user's role and records the change, with the previous and
+// new role, in the audit log in the same statement. It returns the previous role,
+// or pgx.ErrNoRows if the user does not exist.
+func (s *PostgresUserStore) SetUserRole(ctx context.Context, userID int64, role string, entry *model.AdminAuditEntry) (string, error) {
+	query := `
+		WITH previous AS (
+			SELECT id, role FROM users WHERE id = $1 FOR UPDATE
+		),
+		updated AS (
+			UPDATE users u SET role = $7, updated_at = NOW()
+			FROM previous
+			WHERE u.id = previous.id
+			RETURNING u.id, previous.role AS previous_role
+		),
+		audit AS (
+			INSERT INTO admin_audit_log (actor_id, action, target_user_id, reason, details, ip_address)
+			SELECT $2, $3, id, $4, COALESCE($5::jsonb, '{}') || jsonb_build_object('previous_role', previous_role, 'new_role', $7::text), $6
+			FROM updated
+		)
+		SELECT previous_role FROM updated
+	`
+	var previousRole string
+	err := s.db.QueryRow(ctx, query, append(auditArgs(userID, entry), role)...).Scan(&previousRole)
+	return previousRole, err
+}
+
+// SetUserDeactivated deactivates or reactivates a user and records it in the audit
+// log in the same statement. Deactivating an already deactivated user keeps the
+// original deactivation time, but from then on only staff can reactivate the account.
+// Reactivating also cancels a scheduled deletion. It returns pgx.ErrNoRows if the
+// user does not exist.
+func (s *PostgresUserStore) SetUserDeactivated(ctx context.Context, userID int64, deactivated bool, entry *model.AdminAuditEntry) error {
+	query := `
+		WITH updated AS (
+			UPDATE users
+			SET deactivated_at = CASE WHEN $7 THEN COALESCE(deactivated_at, NOW()) END,
+			    deactivated_by_admin = $7,
+			    deletion_scheduled_at = CASE WHEN $7 THEN deletion_scheduled_at END,
+			    updated_at = NOW()
+			WHERE id = $1
+			RETURNING id
+		),` + auditInsert + `
+		SELECT id FROM updated
+	`
+	var id int64
+	return s.db.QueryRow(ctx, query, append(auditArgs(userID, entry), deactivated)...).Scan(&id)
+}
+
+// Reset2FA turns off two-factor authentication for a user who lost their device,
+// removing the TOTP secret and recovery codes, and records it in the audit log in
+// the same statement. It returns pgx.ErrNoRows if the user does not exist.
+func (s *PostgresUserStore) Reset2FA(ctx context.Context, userID int64, entry *model.AdminAuditEntry) error {
+	query := `
+		WITH updated AS (
+			UPDATE users
+			SET two_factor_enabled = false, two_factor_secret = NULL, two_factor_recovery_codes = NULL, updated_at = NOW()
+			WHERE id = $1
+			RETURNING id
+		),` + auditInsert + `
+		SELECT id FROM updated
+	`
+	var id int64
+	return s.db.QueryRow(ctx, query, auditArgs(userID, entry)...).Scan(&id)
+}
+
+// CreateAdminAuditEntry records an action that does not change a user, e.g. a
+// search or the start of an impersonation, and fills in the entry's ID and time.
+func (s *PostgresUserStore) CreateAdminAuditEntry(ctx context.Context, entry *model.AdminAuditEntry) error {
+	query := `
+		INSERT INTO admin_audit_log (actor_id, action, target_user_id, reason, details, ip_address)
+		VALUES ($1, $2, $3, $4, COALESCE($5::jsonb, '{}'), $6)
+		RETURNING id, created_at
+	`
+	return s.db.QueryRow(ctx, query, entry.ActorID, entry.Action, entry.TargetUserID, entry.Reason, entry.Details, entry.IPAddress).
+		Scan(&entry.ID, &entry.CreatedAt)
+}
+
+// GetAdminAuditLog returns one page of the audit log entries matching the search,
+// newest first, and the total number of matches.
+func (s *PostgresUserStore) GetAdminAuditLog(ctx context.Context, search model.AdminAuditSearch) ([]*model.AdminAuditEntry, int64, error) {
+	where := `
+		WHERE ($1 = 0 OR actor_id = $1)
+		  AND ($2 = 0 OR target_user_id = $2)
+		  AND ($3 = '' OR action = $3)
+	`
+
+	var total int64
+	if err := s.db.QueryRow(ctx, `SELECT COUNT(*) FROM admin_audit_log`+where, search.ActorID, search.TargetUserID, search.Action).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := `
+		SELECT id, actor_id, action, target_user_id, reason, details, COALESCE(ip_address, ''), created_at
+		FROM admin_audit_log` + where + `
+		ORDER BY id DESC
+		LIMIT $4 OFFSET $5
+	`
+	rows, err := s.db.Query(ctx, query, search.ActorID, search.TargetUserID, search.Action, search.PageSize, (search.Page-1)*search.PageSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []*model.AdminAuditEntry
+	for rows.Next() {
+		var e model.AdminAuditEntry
+		if err := rows.Scan(&e.ID, &e.ActorID, &e.Action, &e.TargetUserID, &e.Reason, &e.Details, &e.IPAddress, &e.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		entries = append(entries, &e)
+	}
+	return entries, total, rows.Err()
+}
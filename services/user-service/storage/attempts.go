@@ -0,0 +1,50 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/free-education/user-service/auth"
+	"github.com/jackc/pgx/v4"
+)
+
+// --- Login Attempt Storage Functions ---
+
+// GetAttempts returns the failed login attempts recorded for a throttling key.
+// It implements auth.AttemptStore.
+func (s *PostgresUserStore) GetAttempts(ctx context.Context, key string) (auth.AttemptRecord, error) {
+	query := `SELECT failures, last_failure_at FROM login_attempts WHERE key = $1`
+	var record auth.AttemptRecord
+	err := s.db.QueryRow(ctx, query, key).Scan(&record.Failures, &record.LastFailure)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return auth.AttemptRecord{}, nil
+	}
+	return record, err
+}
+
+// RecordFailure adds a failed login attempt to a throttling key in a single statement,
+// so concurrent failures are all counted. It implements auth.AttemptStore.
+func (s *PostgresUserStore) RecordFailure(ctx context.Context, key string, window time.Duration) (auth.AttemptRecord, error) {
+	query := `
+		INSERT INTO login_attempts (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN login_attempts.last_failure_at < NOW() - $2 * INTERVAL '1 second' THEN 1
+				ELSE login_attempts.failures + 1
+			END,
+			last_failure_at = NOW()
+		RETURNING failures, last_failure_at
+	`
+	var record auth.AttemptRecord
+	err := s.db.QueryRow(ctx, query, key, int64(window.Seconds())).Scan(&record.Failures, &record.LastFailure)
+	return record, err
+}
+
+// ClearAttempts deletes the failed login attempts of a throttling key.
+// It implements auth.AttemptStore.
+func (s *PostgresUserStore) ClearAttempts(ctx context.Context, key string) error {
+	_, err := s.db.Exec(ctx, `DELETE FROM login_attempts WHERE key = $1`, key)
+	return err
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/free-education/user-service/model"
+)
+
+// --- User Deletion Storage Functions ---
+
+// userDeletionInsert records a user deletion, with a confirmation for every service
+// in $2, for each row of the `deleted` CTE.
+const userDeletionInsert = `
+	deletion AS (
+		INSERT INTO user_deletions (user_id)
+		SELECT id FROM deleted
+		RETURNING id
+	),
+	confirmations AS (
+		INSERT INTO user_deletion_confirmations (deletion_id, service)
+		SELECT deletion.id, service FROM deletion, unnest($2::text[]) AS service
+	)
+`
+
+// ClaimErasureRequests returns up to limit erasure requests that are due to be sent,
+// and counts the attempt. A service that has been asked but has not confirmed is
+// asked again after retryAfter, doubling with every attempt up to maxRetryAfter.
+// Each request is returned to only one caller.
+func (s *PostgresUserStore) ClaimErasureRequests(ctx context.Context, retryAfter, maxRetryAfter time.Duration, limit int) ([]*model.ErasureRequest, error) {
+	query := `
+		UPDATE user_deletion_confirmations c
+		SET attempts = c.attempts + 1, last_attempt_at = NOW()
+		FROM user_deletions d
+		WHERE d.id = c.deletion_id
+		  AND (c.deletion_id, c.service) IN (
+			SELECT deletion_id, service FROM user_deletion_confirmations
+			WHERE confirmed_at IS NULL
+			  AND (last_attempt_at IS NULL OR last_attempt_at < NOW() - LEAST($1 * POWER(2, attempts - 1), $2) * INTERVAL '1 second')
+			ORDER BY last_attempt_at NULLS FIRST
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		  )
+		RETURNING c.deletion_id, d.user_id, c.service, c.attempts
+	`
+	rows, err := s.db.Query(ctx, query, retryAfter.Seconds(), maxRetryAfter.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []*model.ErasureRequest
+	for rows.Next() {
+		var request model.ErasureRequest
+		if err := rows.Scan(&request.DeletionID, &request.UserID, &request.Service, &request.Attempts); err != nil {
+			return nil, err
+		}
+		requests = append(requests, &request)
+	}
+	return requests, rows.Err()
+}
+
+// ConfirmUserDataErased records that a service has erased the data of a deleted
+// user. completed is true if it was the last service to confirm. Repeated
+// confirmations are ignored.
+func (s *PostgresUserStore) ConfirmUserDataErased(ctx context.Context, deletionID int64, service string) (bool, error) {
+	query := `
+		WITH confirmed AS (
+			UPDATE user_deletion_confirmations
+			SET confirmed_at = NOW()
+			WHERE deletion_id = $1 AND service = $2 AND confirmed_at IS NULL
+			RETURNING deletion_id
+		),
+		completed AS (
+			UPDATE user_deletions
+			SET completed_at = NOW()
+			WHERE id IN (SELECT deletion_id FROM confirmed)
+			  AND NOT EXISTS (
+				SELECT 1 FROM user_deletion_confirmations
+				WHERE deletion_id = $1 AND service <> $2 AND confirmed_at IS NULL
+			  )
+			RETURNING id
+		)
+		SELECT EXISTS (SELECT 1 FROM completed)
+	`
+	var completed bool
+	err := s.db.QueryRow(ctx, query, deletionID, service).Scan(&completed)
+	return completed, err
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/free-education/user-service/model"
+	"github.com/jackc/pgx/v4"
+)
+
+// --- Data Export Storage Functions ---
+
+const dataExportColumns = `id, user_id, status, error, COALESCE(octet_length(archive), 0), created_at, started_at, completed_at, expires_at`
+
+func scanDataExport(row pgx.Row) (*model.DataExport, error) {
+	var export model.DataExport
+	err := row.Scan(&export.ID, &export.UserID, &export.Status, &export.Error, &export.SizeBytes,
+		&export.CreatedAt, &export.StartedAt, &export.CompletedAt, &export.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// CreateDataExport queues a new data export for a user. If the user already has
+// one in progress, it returns that one instead and created is false.
+func (s *PostgresUserStore) CreateDataExport(ctx context.Context, userID int64) (*model.DataExport, bool, error) {
+	query := `
+		INSERT INTO data_exports (user_id) VALUES ($1)
+		ON CONFLICT (user_id) WHERE status IN ('pending', 'processing') DO NOTHING
+		RETURNING ` + dataExportColumns
+	export, err := scanDataExport(s.db.QueryRow(ctx, query, userID))
+	if err == nil {
+		return export, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, err
+	}
+
+	query = `SELECT ` + dataExportColumns + ` FROM data_exports WHERE user_id = $1 AND status IN ('pending', 'processing')`
+	export, err = scanDataExport(s.db.QueryRow(ctx, query, userID))
+	return export, false, err
+}
+
+// GetDataExport returns one of a user's data exports. It returns pgx.ErrNoRows if
+// the export does not exist or belongs to someone else.
+func (s *PostgresUserStore) GetDataExport(ctx context.Context, userID, exportID int64) (*model.DataExport, error) {
+	query := `SELECT ` + dataExportColumns + ` FROM data_exports WHERE id = $1 AND user_id = $2`
+	return scanDataExport(s.db.QueryRow(ctx, query, exportID, userID))
+}
+
+// ClaimDataExport marks the oldest pending export as processing and returns it.
+// Exports that have been processing for longer than staleAfter are claimed again,
+// so an export is not lost when the instance building it dies. It returns
+// pgx.ErrNoRows if there is nothing to do.
+func (s *PostgresUserStore) ClaimDataExport(ctx context.Context, staleAfter time.Duration) (*model.DataExport, error) {
+	query := `
+		UPDATE data_exports
+		SET status = 'processing', started_at = NOW()
+		WHERE id = (
+			SELECT id FROM data_exports
+			WHERE status = 'pending' OR (status = 'processing' AND started_at < $1)
+			ORDER BY created_at
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + dataExportColumns
+	return scanDataExport(s.db.QueryRow(ctx, query, time.Now().Add(-staleAfter)))
+}
+
+// CompleteDataExport stores the finished archive of an export and marks it ready
+// until expiresAt.
+func (s *PostgresUserStore) CompleteDataExport(ctx context.Context, exportID int64, archive []byte, expiresAt time.Time) error {
+	query := `
+		UPDATE data_exports
+		SET status = 'ready', archive = $2, completed_at = NOW(), expires_at = $3
+		WHERE id = $1
+	`
+	_, err := s.db.Exec(ctx, query, exportID, archive, expiresAt)
+	return err
+}
+
+// FailDataExport marks an export as failed with the given reason. It is kept
+// until expiresAt so the user can see what happened.
+func (s *PostgresUserStore) FailDataExport(ctx context.Context, exportID int64, reason string, expiresAt time.Time) error {
+	query := `
+		UPDATE data_exports
+		SET status = 'failed', error = $2, completed_at = NOW(), expires_at = $3
+		WHERE id = $1
+	`
+	_, err := s.db.Exec(ctx, query, exportID, reason, expiresAt)
+	return err
+}
+
+// SetDataExportDownloadToken replaces the download token of a user's ready export.
+// It returns pgx.ErrNoRows if the export does not exist, belongs to someone else,
+// or is not ready.
+func (s *PostgresUserStore) SetDataExportDownloadToken(ctx context.Context, userID, exportID int64, tokenHash string, expiresAt time.Time) error {
+	query := `
+		UPDATE data_exports
+		SET download_token_hash = $3, download_token_expires_at = $4
+		WHERE id = $1 AND user_id = $2 AND status = 'ready' AND expires_at > NOW()
+		RETURNING id
+	`
+	var id int64
+	return s.db.QueryRow(ctx, query, exportID, userID, tokenHash, expiresAt).Scan(&id)
+}
+
+// ConsumeDataExportDownloadToken looks up the export a download token is for and
+// clears the token in one step, so each token can be used at most once. It returns
+// the export and its archive, or pgx.ErrNoRows if the token is unknown or expired.
+func (s *PostgresUserStore) ConsumeDataExportDownloadToken(ctx context.Context, tokenHash string) (*model.DataExport, []byte, error) {
+	query := `
+		UPDATE data_exports
+		SET download_token_hash = NULL, download_token_expires_at = NULL
+		WHERE download_token_hash = $1 AND download_token_expires_at > NOW() AND status = 'ready' AND expires_at > NOW()
+		RETURNING ` + dataExportColumns + `, archive`
+	var export model.DataExport
+	var archive []byte
+	err := s.db.QueryRow(ctx, query, tokenHash).Scan(&export.ID, &export.UserID, &export.Status, &export.Error, &export.SizeBytes,
+		&export.CreatedAt, &export.StartedAt, &export.CompletedAt, &export.ExpiresAt, &archive)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &export, archive, nil
+}
+
+// DeleteExpiredDataExports deletes exports past their expiry, together with their
+// archives, and returns how many there were.
+func (s *PostgresUserStore) DeleteExpiredDataExports(ctx context.Context) (int64, error) {
+	tag, err := s.db.Exec(ctx, `DELETE FROM data_exports WHERE expires_at <= NOW()`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetLessonProgressForUser returns the lessons a user has completed and when,
+// oldest first.
+func (s *PostgresUserStore) GetLessonProgressForUser(ctx context.Context, userID int64) ([]model.LessonProgress, error) {
+	query := `
+		SELECT lesson_id, completed_at
+		FROM user_lesson_progress
+		WHERE user_id = $1
+		ORDER BY completed_at, lesson_id
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var progress []model.LessonProgress
+	for rows.Next() {
+		var p model.LessonProgress
+		if err := rows.Scan(&p.LessonID, &p.CompletedAt); err != nil {
+			return nil, err
+		}
+		progress = append(progress, p)
+	}
+	return progress, rows.Err()
+}
@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/free-education/user-service/model"
+	"github.com/jackc/pgx/v4"
+)
+
+// --- External Identity Storage Functions ---
+
+// CreateOAuthState stores the server-side state of a login started with an external provider.
+func (s *PostgresUserStore) CreateOAuthState(ctx context.Context, state *model.OAuthState) error {
+	query := `
+		INSERT INTO oauth_states (state, provider, code_verifier, nonce, user_id, reauth, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7)
+	`
+	_, err := s.db.Exec(ctx, query, state.State, state.Provider, state.CodeVerifier, state.Nonce, state.UserID, state.Reauth, state.ExpiresAt)
+	return err
+}
+
+// ConsumeOAuthState looks up and deletes a login state in one step, so each state
+// can be used at most once. It returns pgx.ErrNoRows if the state does not exist
+// or has expired. Expired states of other logins are cleaned up along the way.
+func (s *PostgresUserStore) ConsumeOAuthState(ctx context.Context, state string) (*model.OAuthState, error) {
+	query := `
+		DELETE FROM oauth_states
+		WHERE state = $1 OR expires_at <= NOW()
+		RETURNING state, provider, code_verifier, nonce, COALESCE(user_id, 0), reauth, expires_at
+	`
+	rows, err := s.db.Query(ctx, query, state)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found *model.OAuthState
+	for rows.Next() {
+		var st model.OAuthState
+		if err := rows.Scan(&st.State, &st.Provider, &st.CodeVerifier, &st.Nonce, &st.UserID, &st.Reauth, &st.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if st.State == state && st.ExpiresAt.After(time.Now()) {
+			found = &st
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, pgx.ErrNoRows
+	}
+	return found, nil
+}
+
+// CreateLoginCode stores a login code issued by the OAuth callback.
+func (s *PostgresUserStore) CreateLoginCode(ctx context.Context, code *model.LoginCode) error {
+	query := `
+		INSERT INTO login_codes (code_hash, user_id, state_hash, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := s.db.Exec(ctx, query, code.CodeHash, code.UserID, code.StateHash, code.ExpiresAt)
+	return err
+}
+
+// ConsumeLoginCode looks up and deletes a login code in one step, so each code can
+// be exchanged at most once. It returns pgx.ErrNoRows if the code does not exist
+// or has expired. Expired codes are cleaned up along the way.
+func (s *PostgresUserStore) ConsumeLoginCode(ctx context.Context, codeHash string) (*model.LoginCode, error) {
+	query := `
+		DELETE FROM login_codes
+		WHERE code_hash = $1 OR expires_at <= NOW()
+		RETURNING code_hash, user_id, state_hash, expires_at
+	`
+	rows, err := s.db.Query(ctx, query, codeHash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found *model.LoginCode
+	for rows.Next() {
+		var code model.LoginCode
+		if err := rows.Scan(&code.CodeHash, &code.UserID, &code.StateHash, &code.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if code.CodeHash == codeHash && code.ExpiresAt.After(time.Now()) {
+			found = &code
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, pgx.ErrNoRows
+	}
+	return found, nil
+}
+
+// GetUserIdentities returns the external identities linked to a user, oldest first.
+func (s *PostgresUserStore) GetUserIdentities(ctx context.Context, userID int64) ([]*model.UserIdentity, error) {
+	query := `
+		SELECT id, user_id, provider, subject, COALESCE(email, ''), created_at
+		FROM user_identities
+		WHERE user_id = $1
+		ORDER BY created_at, id
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []*model.UserIdentity
+	for rows.Next() {
+		var identity model.UserIdentity
+		if err := rows.Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, &identity)
+	}
+	return identities, rows.Err()
+}
+
+// LinkIdentity links an external identity to identity.UserID and fills in its ID
+// and creation time. It returns a unique violation if the identity is already
+// linked to an account.
+func (s *PostgresUserStore) LinkIdentity(ctx context.Context, identity *model.UserIdentity) error {
+	query := `
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		VALUES ($1, $2, $3, NULLIF($4, ''))
+		RETURNING id, created_at
+	`
+	return s.db.QueryRow(ctx, query, identity.UserID, identity.Provider, identity.Subject, identity.Email).Scan(&identity.ID, &identity.CreatedAt)
+}
+
+// UnlinkIdentity removes one of a user's external identities, unless it is the
+// user's last way to sign in, i.e. the user has no password, passkey or other identity.
+// It returns pgx.ErrNoRows if the identity does not exist, belongs to someone else
+// or is the last sign-in method.
+func (s *PostgresUserStore) UnlinkIdentity(ctx context.Context, userID, identityID int64) error {
+	query := `
+		DELETE FROM user_identities
+		WHERE id = $1 AND user_id = $2
+		  AND (
+			EXISTS (SELECT 1 FROM users WHERE id = $2 AND password_hash IS NOT NULL)
+			OR EXISTS (SELECT 1 FROM webauthn_credentials WHERE user_id = $2)
+			OR (SELECT COUNT(*) FROM user_identities WHERE user_id = $2) > 1
+		  )
+	`
+	tag, err := s.db.Exec(ctx, query, identityID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// BackfillIdentities creates the user_identities rows of accounts created through
+// Google before user_identities existed, which only have users.oauth_provider set.
+// It runs once, so that identities users unlink later do not come back when the
+// service restarts. It returns how many identities were created.
+func (s *PostgresUserStore) BackfillIdentities(ctx context.Context) (int64, error) {
+	query := `
+		WITH migration AS (
+			INSERT INTO schema_migrations (name) VALUES ('backfill_user_identities')
+			ON CONFLICT DO NOTHING
+			RETURNING name
+		)
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		SELECT u.id, u.oauth_provider, u.oauth_provider_id, u.email
+		FROM users u, migration
+		WHERE u.oauth_provider IS NOT NULL AND u.oauth_provider_id IS NOT NULL
+		ON CONFLICT DO NOTHING
+	`
+	tag, err := s.db.Exec(ctx, query)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// CreatePendingIdentityLink stores an identity that may be linked to identity.UserID
+// once the account owner confirms it with the token.
+func (s *PostgresUserStore) CreatePendingIdentityLink(ctx context.Context, token string, identity *model.UserIdentity, expiresAt time.Time) error {
+	query := `
+		INSERT INTO pending_identity_links (token, user_id, provider, subject, email, expires_at)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+	`
+	_, err := s.db.Exec(ctx, query, token, identity.UserID, identity.Provider, identity.Subject, identity.Email, expiresAt)
+	return err
+}
+
+// ConfirmPendingIdentityLink links the pending identity for a token to userID and
+// deletes the pending link. It returns pgx.ErrNoRows if the token does not exist,
+// has expired or was issued for another user, and a unique violation if the
+// identity has been linked to an account since.
+func (s *PostgresUserStore) ConfirmPendingIdentityLink(ctx context.Context, token string, userID int64) (*model.UserIdentity, error) {
+	query := `
+		WITH link AS (
+			DELETE FROM pending_identity_links
+			WHERE token = $1 AND user_id = $2 AND expires_at > NOW()
+			RETURNING user_id, provider, subject, email
+		)
+		INSERT INTO user_identities (user_id, provider, subject, email)
+		SELECT user_id, provider, subject, email FROM link
+		RETURNING id, user_id, provider, subject, COALESCE(email, ''), created_at
+	`
+	var identity model.UserIdentity
+	err := s.db.QueryRow(ctx, query, token, userID).Scan(&identity.ID, &identity.UserID, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
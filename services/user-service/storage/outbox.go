@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/free-education/user-service/model"
+)
+
+// --- Transaction and Outbox Storage Functions ---
+
+// InTx runs fn with a store whose changes are committed together if fn returns nil,
+// and rolled back otherwise. Events fn enqueues are only published if the changes
+// are committed.
+func (s *PostgresUserStore) InTx(ctx context.Context, fn func(store UserStore) error) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	// Rolling back a committed transaction does nothing.
+	defer tx.Rollback(ctx)
+
+	if err := fn(&PostgresUserStore{db: tx}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// EnqueueEvent adds an event to the outbox, to be published by the outbox relay.
+func (s *PostgresUserStore) EnqueueEvent(ctx context.Context, event *model.OutboxEvent) error {
+	query := `
+		INSERT INTO outbox_events (event_id, queue, event_type, event_version, payload)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	return s.db.QueryRow(ctx, query, event.EventID, event.Queue, event.EventType, event.EventVersion, string(event.Payload)).Scan(&event.ID, &event.CreatedAt)
+}
+
+// ClaimOutboxEvents returns up to limit unsent events that are due to be published,
+// oldest first, and counts the attempt. An event that could not be published is
+// retried after retryAfter, doubling with every attempt up to maxRetryAfter. Each
+// event is returned to only one caller.
+func (s *PostgresUserStore) ClaimOutboxEvents(ctx context.Context, retryAfter, maxRetryAfter time.Duration, limit int) ([]*model.OutboxEvent, error) {
+	query := `
+		UPDATE outbox_events
+		SET attempts = attempts + 1, last_attempt_at = NOW()
+		WHERE id IN (
+			SELECT id FROM outbox_events
+			WHERE sent_at IS NULL
+			  AND (last_attempt_at IS NULL OR last_attempt_at < NOW() - LEAST($1 * POWER(2, attempts - 1), $2) * INTERVAL '1 second')
+			ORDER BY id
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, event_id, queue, event_type, event_version, payload, created_at, attempts
+	`
+	rows, err := s.db.Query(ctx, query, retryAfter.Seconds(), maxRetryAfter.Seconds(), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*model.OutboxEvent
+	for rows.Next() {
+		var event model.OutboxEvent
+		var payload []byte
+		if err := rows.Scan(&event.ID, &event.EventID, &event.Queue, &event.EventType, &event.EventVersion, &payload, &event.CreatedAt, &event.Attempts); err != nil {
+			return nil, err
+		}
+		event.Payload = payload
+		events = append(events, &event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// UPDATE ... RETURNING does not keep the order of the subquery.
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+	return events, nil
+}
+
+// MarkOutboxEventSent records that an event has been published.
+func (s *PostgresUserStore) MarkOutboxEventSent(ctx context.Context, id int64) error {
+	query := `UPDATE outbox_events SET sent_at = NOW() WHERE id = $1`
+	_, err := s.db.Exec(ctx, query, id)
+	return err
+}
+
+// DeleteSentOutboxEvents deletes the events published before the given time and
+// returns how many it deleted.
+func (s *PostgresUserStore) DeleteSentOutboxEvents(ctx context.Context, sentBefore time.Time) (int64, error) {
+	tag, err := s.db.Exec(ctx, `DELETE FROM outbox_events WHERE sent_at < $1`, sentBefore)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
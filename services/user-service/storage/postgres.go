@@ -2,10 +2,16 @@ package storage
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/free-education/user-service/model"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -20,17 +26,25 @@ CREATE TABLE IF NOT EXISTS users (
     first_name VARCHAR(100),
     last_name VARCHAR(100),
     profile_picture_url TEXT,
+    profile_picture_key TEXT, -- Blob store key the picture's sizes are stored under, followed by '-<size>.jpg'.
     role VARCHAR(50) NOT NULL DEFAULT 'user', -- 'user', 'moderator', 'admin'
-    oauth_provider TEXT,
+    oauth_provider TEXT, -- Deprecated: the provider the account was created with. See user_identities.
     oauth_provider_id TEXT,
     two_factor_enabled BOOLEAN NOT NULL DEFAULT false,
     two_factor_secret TEXT,
-    two_factor_recovery_codes TEXT[],
+    two_factor_recovery_codes TEXT[], -- Lookup key and bcrypt hash of each unused recovery code; see hashRecoveryCodes.
     preferences JSONB DEFAULT '{}',
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
-    deactivated_at TIMESTAMPTZ
+    deactivated_at TIMESTAMPTZ,
+    deactivated_by_admin BOOLEAN NOT NULL DEFAULT false, -- Suspended by staff; only staff can reactivate it.
+    deletion_scheduled_at TIMESTAMPTZ, -- When the deactivated account will be permanently deleted.
+    tokens_revoked_at TIMESTAMPTZ, -- Tokens issued before this time are rejected.
+    email_verified_at TIMESTAMPTZ -- NULL until the user follows the verification link.
 );
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_at ON users(deletion_scheduled_at) WHERE deletion_scheduled_at IS NOT NULL;
+-- Accounts that existed before email verification was introduced are treated as verified:
+-- UPDATE users SET email_verified_at = created_at WHERE email_verified_at IS NULL;
 
 CREATE TABLE IF NOT EXISTS user_lesson_progress (
     user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
@@ -45,6 +59,100 @@ CREATE TABLE IF NOT EXISTS password_reset_tokens (
     expires_at TIMESTAMPTZ NOT NULL
 );
 
+CREATE TABLE IF NOT EXISTS email_verification_tokens (
+    token TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS email_change_tokens (
+    token TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    new_email VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS password_history (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    password_hash VARCHAR(255) NOT NULL, -- A previous bcrypt hash, kept to prevent reuse.
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_password_history_user_id ON password_history(user_id);
+
+CREATE TABLE IF NOT EXISTS user_identities (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL, -- 'google', 'github', ...
+    subject TEXT NOT NULL, -- The user's stable ID at the provider.
+    email VARCHAR(255),
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (provider, subject)
+);
+CREATE INDEX IF NOT EXISTS idx_user_identities_user_id ON user_identities(user_id);
+-- Accounts created through Google before user_identities existed are given their
+-- identity by BackfillIdentities when the service starts.
+
+-- Data migrations that have run, so that each runs only once.
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    name TEXT PRIMARY KEY,
+    applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS oauth_states (
+    state TEXT PRIMARY KEY,
+    provider VARCHAR(50) NOT NULL,
+    code_verifier TEXT NOT NULL,
+    nonce TEXT NOT NULL,
+    user_id BIGINT REFERENCES users(id) ON DELETE CASCADE, -- Set when a signed-in user is linking an identity.
+    reauth BOOLEAN NOT NULL DEFAULT false, -- Set when the signed-in user is reauthenticating instead.
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL, -- COSE-encoded
+    attestation_type TEXT NOT NULL DEFAULT '',
+    transports TEXT[],
+    aaguid BYTEA,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    backup_eligible BOOLEAN NOT NULL DEFAULT false,
+    backup_state BOOLEAN NOT NULL DEFAULT false,
+    name VARCHAR(100) NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+
+CREATE TABLE IF NOT EXISTS webauthn_sessions (
+    id TEXT PRIMARY KEY,
+    user_id BIGINT REFERENCES users(id) ON DELETE CASCADE, -- NULL for a passwordless login
+    purpose VARCHAR(20) NOT NULL, -- 'registration', 'login', 'second_factor', 'reauth'
+    data JSONB NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Single-use codes the OAuth callback redirects with instead of tokens.
+CREATE TABLE IF NOT EXISTS login_codes (
+    code_hash TEXT PRIMARY KEY, -- SHA-256 of the code; the code itself is never stored.
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    state_hash TEXT NOT NULL, -- SHA-256 of the oauthstate cookie the code is bound to.
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
+-- Identities whose verified email matches an existing account. They are linked only
+-- once the account owner signs in and confirms.
+CREATE TABLE IF NOT EXISTS pending_identity_links (
+    token TEXT PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    subject TEXT NOT NULL,
+    email VARCHAR(255),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS quiz_attempts (
     id BIGSERIAL PRIMARY KEY,
     user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
@@ -59,14 +167,132 @@ CREATE TABLE IF NOT EXISTS user_activities (
     user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     activity_type VARCHAR(255) NOT NULL,
     metadata JSONB,
+    event_id TEXT UNIQUE, -- ID of the event the activity was recorded from, so redelivered events are recorded once.
     created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
 );
+-- Activity feeds are paged by ID; the retention pruner scans by age.
+CREATE INDEX IF NOT EXISTS idx_user_activities_user_id_id ON user_activities(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_user_activities_created_at ON user_activities(created_at);
+
+CREATE TABLE IF NOT EXISTS user_sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    refresh_token_hash TEXT UNIQUE NOT NULL, -- SHA-256 of the current refresh token
+    user_agent TEXT,
+    ip_address TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_user_sessions_user_id ON user_sessions(user_id);
+
+-- Deleted users whose data other services still have to erase. There are no foreign
+-- keys to users: the user is gone by the time the other services are asked.
+CREATE TABLE IF NOT EXISTS user_deletions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL,
+    requested_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    completed_at TIMESTAMPTZ -- Set once every service has confirmed the erasure.
+);
+CREATE TABLE IF NOT EXISTS user_deletion_confirmations (
+    deletion_id BIGINT NOT NULL REFERENCES user_deletions(id) ON DELETE CASCADE,
+    service VARCHAR(50) NOT NULL, -- 'content', 'forum', 'gamification', ...
+    attempts INT NOT NULL DEFAULT 0, -- How many times the service has been asked.
+    last_attempt_at TIMESTAMPTZ,
+    confirmed_at TIMESTAMPTZ,
+    PRIMARY KEY (deletion_id, service)
+);
+CREATE INDEX IF NOT EXISTS idx_user_deletion_confirmations_unconfirmed ON user_deletion_confirmations(last_attempt_at) WHERE confirmed_at IS NULL;
+
+-- Archives of a user's personal data, built in the background on request.
+CREATE TABLE IF NOT EXISTS data_exports (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- 'pending', 'processing', 'ready', 'failed'
+    error TEXT NOT NULL DEFAULT '',
+    archive BYTEA, -- The zip file, once ready.
+    download_token_hash TEXT UNIQUE, -- SHA-256 of the current single-use download token.
+    download_token_expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    started_at TIMESTAMPTZ,
+    completed_at TIMESTAMPTZ,
+    expires_at TIMESTAMPTZ -- When the export is deleted.
+);
+CREATE INDEX IF NOT EXISTS idx_data_exports_user_id ON data_exports(user_id);
+-- A user has at most one export in progress.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_data_exports_unfinished ON data_exports(user_id) WHERE status IN ('pending', 'processing');
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+    key VARCHAR(255) PRIMARY KEY, -- "account:<user id>" or "ip:<address>", prefixed with "<name>:" for throttles other than the login one
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- Append-only record of every moderator and admin action. There are no foreign keys,
+-- so entries outlive the accounts they mention.
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    actor_id BIGINT NOT NULL,
+    action VARCHAR(50) NOT NULL, -- 'role_changed', 'user_deactivated', 'impersonation_started', ...
+    target_user_id BIGINT,
+    reason TEXT NOT NULL DEFAULT '',
+    details JSONB NOT NULL DEFAULT '{}',
+    ip_address TEXT,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_actor_id ON admin_audit_log(actor_id);
+CREATE INDEX IF NOT EXISTS idx_admin_audit_log_target_user_id ON admin_audit_log(target_user_id);
+CREATE OR REPLACE FUNCTION reject_admin_audit_log_change() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'admin_audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+DROP TRIGGER IF EXISTS admin_audit_log_no_update_or_delete ON admin_audit_log;
+CREATE TRIGGER admin_audit_log_no_update_or_delete
+    BEFORE UPDATE OR DELETE ON admin_audit_log
+    FOR EACH ROW EXECUTE FUNCTION reject_admin_audit_log_change();
+DROP TRIGGER IF EXISTS admin_audit_log_no_truncate ON admin_audit_log;
+CREATE TRIGGER admin_audit_log_no_truncate
+    BEFORE TRUNCATE ON admin_audit_log
+    FOR EACH STATEMENT EXECUTE FUNCTION reject_admin_audit_log_change();
+-- The service's database role should additionally be limited to INSERT and SELECT:
+-- REVOKE UPDATE, DELETE, TRUNCATE ON admin_audit_log FROM PUBLIC;
+
+-- Events written in the same transaction as the change they announce. The outbox
+-- relay publishes them to RabbitMQ and marks them sent.
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id BIGSERIAL PRIMARY KEY,
+    event_id TEXT UNIQUE NOT NULL, -- Published with the event, so consumers can ignore duplicates.
+    queue VARCHAR(255) NOT NULL,
+    event_type VARCHAR(255) NOT NULL,
+    event_version INT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(), -- Published as the time the event occurred.
+    attempts INT NOT NULL DEFAULT 0, -- How many times the relay has tried to publish the event.
+    last_attempt_at TIMESTAMPTZ,
+    sent_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_outbox_events_unsent ON outbox_events(id) WHERE sent_at IS NULL;
 
 */
 
+// MaxPasswordHistory is how many previous password hashes are kept per user.
+// It bounds the history size a PasswordPolicy can enforce.
+const MaxPasswordHistory = 24
+
 // PostgresUserStore handles database operations for users.
 type PostgresUserStore struct {
-	db *pgxpool.Pool
+	db database
+}
+
+// database runs the store's queries: the connection pool, or a transaction in
+// the store InTx passes on.
+type database interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
 }
 
 // NewUserStore creates a new UserStore.
@@ -110,19 +336,26 @@ func (s *PostgresUserStore) CreateUser(ctx context.Context, userReq *model.Regis
 	return &newUser, nil
 }
 
-// CreateOAuthUser creates a new user from an OAuth provider.
-// It does not require a password.
+// CreateOAuthUser creates a new user from an OAuth provider, together with the
+// user_identities row linking it to user.OAuthProvider and user.OAuthProviderID.
+// It does not require a password. The email counts as verified if user.EmailVerifiedAt is set.
 func (s *PostgresUserStore) CreateOAuthUser(ctx context.Context, user *model.User) (*model.User, error) {
 	query := `
-		INSERT INTO users (email, first_name, last_name, oauth_provider, oauth_provider_id, preferences)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, email, first_name, last_name, role, preferences, created_at, updated_at
+		WITH new_user AS (
+			INSERT INTO users (email, first_name, last_name, oauth_provider, oauth_provider_id, preferences, email_verified_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id, email, first_name, last_name, role, preferences, created_at, updated_at, email_verified_at
+		), identity AS (
+			INSERT INTO user_identities (user_id, provider, subject, email)
+			SELECT id, $4, $5, email FROM new_user
+		)
+		SELECT id, email, first_name, last_name, role, preferences, created_at, updated_at, email_verified_at FROM new_user
 	`
 
 	defaultPrefs := map[string]interface{}{"theme": "light"}
 
 	var newUser model.User
-	err := s.db.QueryRow(ctx, query, user.Email, user.FirstName, user.LastName, user.OAuthProvider, user.OAuthProviderID, defaultPrefs).Scan(
+	err := s.db.QueryRow(ctx, query, user.Email, user.FirstName, user.LastName, user.OAuthProvider, user.OAuthProviderID, defaultPrefs, user.EmailVerifiedAt).Scan(
 		&newUser.ID,
 		&newUser.Email,
 		&newUser.FirstName,
@@ -131,6 +364,7 @@ func (s *PostgresUserStore) CreateOAuthUser(ctx context.Context, user *model.Use
 		&newUser.Preferences,
 		&newUser.CreatedAt,
 		&newUser.UpdatedAt,
+		&newUser.EmailVerifiedAt,
 	)
 
 	if err != nil {
@@ -144,7 +378,8 @@ func (s *PostgresUserStore) CreateOAuthUser(ctx context.Context, user *model.Use
 // GetUserByEmail retrieves a user by their email address.
 func (s *PostgresUserStore) GetUserByEmail(ctx context.Context, email string) (*model.User, error) {
 	query := `
-		SELECT id, email, password_hash, first_name, last_name, role, preferences, created_at, updated_at
+		SELECT id, email, COALESCE(password_hash, ''), first_name, last_name, role, preferences, created_at, updated_at, email_verified_at,
+		       deactivated_at, deactivated_by_admin, deletion_scheduled_at
 		FROM users WHERE email = $1
 	`
 	var user model.User
@@ -158,6 +393,10 @@ func (s *PostgresUserStore) GetUserByEmail(ctx context.Context, email string) (*
 		&user.Preferences,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.EmailVerifiedAt,
+		&user.DeactivatedAt,
+		&user.DeactivatedByAdmin,
+		&user.DeletionScheduledAt,
 	)
 
 	if err != nil {
@@ -169,11 +408,14 @@ func (s *PostgresUserStore) GetUserByEmail(ctx context.Context, email string) (*
 	return &user, nil
 }
 
-// GetUserByOAuthID retrieves a user by their OAuth provider and provider-specific ID.
+// GetUserByOAuthID retrieves a user by one of their linked identities.
 func (s *PostgresUserStore) GetUserByOAuthID(ctx context.Context, provider string, providerID string) (*model.User, error) {
 	query := `
-		SELECT id, email, password_hash, first_name, last_name, role, preferences, created_at, updated_at
-		FROM users WHERE oauth_provider = $1 AND oauth_provider_id = $2
+		SELECT u.id, u.email, COALESCE(u.password_hash, ''), u.first_name, u.last_name, u.role, u.preferences, u.created_at, u.updated_at, u.email_verified_at,
+		       u.deactivated_at, u.deactivated_by_admin, u.deletion_scheduled_at
+		FROM users u
+		INNER JOIN user_identities i ON u.id = i.user_id
+		WHERE i.provider = $1 AND i.subject = $2
 	`
 	var user model.User
 	err := s.db.QueryRow(ctx, query, provider, providerID).Scan(
@@ -186,6 +428,10 @@ func (s *PostgresUserStore) GetUserByOAuthID(ctx context.Context, provider strin
 		&user.Preferences,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.EmailVerifiedAt,
+		&user.DeactivatedAt,
+		&user.DeactivatedByAdmin,
+		&user.DeletionScheduledAt,
 	)
 	return &user, err
 }
@@ -195,7 +441,8 @@ func (s *PostgresUserStore) GetUserByOAuthID(ctx context.Context, provider strin
 // you might have a separate function or a different model for public user profiles.
 func (s *PostgresUserStore) GetUserByID(ctx context.Context, userID int64) (*model.User, error) {
 	query := `
-		SELECT id, email, password_hash, first_name, last_name, role, preferences, created_at, updated_at
+		SELECT id, email, COALESCE(password_hash, ''), first_name, last_name, COALESCE(profile_picture_url, ''), role, preferences, created_at, updated_at, email_verified_at,
+		       deactivated_at, deactivated_by_admin, deletion_scheduled_at
 		FROM users WHERE id = $1
 	`
 	var user model.User
@@ -205,10 +452,15 @@ func (s *PostgresUserStore) GetUserByID(ctx context.Context, userID int64) (*mod
 		&user.PasswordHash,
 		&user.FirstName,
 		&user.LastName,
+		&user.ProfilePictureURL,
 		&user.Role,
 		&user.Preferences,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.EmailVerifiedAt,
+		&user.DeactivatedAt,
+		&user.DeactivatedByAdmin,
+		&user.DeletionScheduledAt,
 	)
 
 	if err != nil {
@@ -257,40 +509,154 @@ func (s *PostgresUserStore) GetCompletedLessonsForUser(ctx context.Context, user
 	return completedLessonIDs, nil
 }
 
-// UpdateUserPreferences updates the preferences for a given user.
-func (s *PostgresUserStore) UpdateUserPreferences(ctx context.Context, userID int64, prefs map[string]interface{}) error {
+// ReplaceUserPreferences replaces a user's preferences if they are still previous,
+// and reports whether they were. Callers read, modify and write the preferences;
+// this makes the write fail instead of losing a concurrent change.
+func (s *PostgresUserStore) ReplaceUserPreferences(ctx context.Context, userID int64, previous, prefs map[string]interface{}) (bool, error) {
 	query := `
 		UPDATE users
-		SET preferences = preferences || $1, updated_at = NOW()
-		WHERE id = $2
+		SET preferences = $1, updated_at = NOW()
+		WHERE id = $2 AND preferences IS NOT DISTINCT FROM $3
 	`
-	_, err := s.db.Exec(ctx, query, prefs, userID)
-	return err
+	tag, err := s.db.Exec(ctx, query, prefs, userID, previous)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
 }
 
-// UpdateProfilePictureURL updates the profile_picture_url for a given user.
-func (s *PostgresUserStore) UpdateProfilePictureURL(ctx context.Context, userID int64, url string) error {
+// SetProfilePicture sets the user's profile picture, or removes it if key is empty,
+// and returns the key of the picture it replaces, if any.
+func (s *PostgresUserStore) SetProfilePicture(ctx context.Context, userID int64, key, url string) (string, error) {
 	query := `
-		UPDATE users
-		SET profile_picture_url = $1, updated_at = NOW()
-		WHERE id = $2
+		UPDATE users u
+		SET profile_picture_key = NULLIF($1, ''), profile_picture_url = NULLIF($2, ''), updated_at = NOW()
+		FROM (SELECT id, profile_picture_key FROM users WHERE id = $3 FOR UPDATE) previous
+		WHERE u.id = previous.id
+		RETURNING COALESCE(previous.profile_picture_key, '')
 	`
-	_, err := s.db.Exec(ctx, query, url, userID)
-	return err
+	var previousKey string
+	err := s.db.QueryRow(ctx, query, key, url, userID).Scan(&previousKey)
+	return previousKey, err
+}
+
+// recoveryCodeLookup returns the lookup key stored in front of a recovery code's
+// hash: the start of the code's SHA-256. It picks out the one hash a code can match,
+// so a login attempt costs a single bcrypt comparison, while revealing too little of
+// the code to help guess it.
+func recoveryCodeLookup(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:4]) + ":"
 }
 
-// Store2FASecrets stores the 2FA secret and recovery codes for a user.
+// hashRecoveryCodes hashes 2FA recovery codes the same way passwords are hashed,
+// so the stored codes are useless to anyone who reads the database. Each hash is
+// prefixed with the code's recoveryCodeLookup.
+func hashRecoveryCodes(recoveryCodes []string) ([]string, error) {
+	hashes := make([]string, len(recoveryCodes))
+	for i, code := range recoveryCodes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		hashes[i] = recoveryCodeLookup(code) + string(hash)
+	}
+	return hashes, nil
+}
+
+// matchRecoveryCode returns the stored hash in hashes that code matches, if any.
+// Only hashes with the code's lookup key are compared, and hashes stored before
+// lookup keys were added, which have none.
+func matchRecoveryCode(hashes []string, code string) (string, bool) {
+	lookup := recoveryCodeLookup(code)
+	for _, stored := range hashes {
+		hash, ok := strings.CutPrefix(stored, lookup)
+		if !ok {
+			if strings.Contains(stored, ":") {
+				continue
+			}
+			hash = stored
+		}
+		if CheckPassword(hash, code) {
+			return stored, true
+		}
+	}
+	return "", false
+}
+
+// Store2FASecrets stores the 2FA secret and hashed recovery codes for a user. It
+// returns pgx.ErrNoRows if 2FA is already enabled: replacing the secret then would
+// let anyone holding an access token take over the second factor.
 // It does not enable 2FA, it only prepares it.
 func (s *PostgresUserStore) Store2FASecrets(ctx context.Context, userID int64, secret string, recoveryCodes []string) error {
+	hashes, err := hashRecoveryCodes(recoveryCodes)
+	if err != nil {
+		return err
+	}
 	query := `
 		UPDATE users
 		SET two_factor_secret = $1, two_factor_recovery_codes = $2, updated_at = NOW()
-		WHERE id = $3
+		WHERE id = $3 AND NOT two_factor_enabled
 	`
-	_, err := s.db.Exec(ctx, query, secret, recoveryCodes, userID)
+	tag, err := s.db.Exec(ctx, query, secret, hashes, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// ReplaceRecoveryCodes discards a user's remaining recovery codes and stores a new, hashed set.
+func (s *PostgresUserStore) ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryCodes []string) error {
+	hashes, err := hashRecoveryCodes(recoveryCodes)
+	if err != nil {
+		return err
+	}
+	query := `
+		UPDATE users
+		SET two_factor_recovery_codes = $1, updated_at = NOW()
+		WHERE id = $2
+	`
+	_, err = s.db.Exec(ctx, query, hashes, userID)
 	return err
 }
 
+// ConsumeRecoveryCode checks a recovery code against the user's stored hashes and,
+// if it matches, removes it so it can never be used again. The removal only succeeds
+// if the hash is still present, so two concurrent logins cannot both use the same code.
+func (s *PostgresUserStore) ConsumeRecoveryCode(ctx context.Context, userID int64, code string) (bool, error) {
+	var hashes []string
+	query := `SELECT COALESCE(two_factor_recovery_codes, '{}') FROM users WHERE id = $1`
+	if err := s.db.QueryRow(ctx, query, userID).Scan(&hashes); err != nil {
+		return false, err
+	}
+
+	hash, ok := matchRecoveryCode(hashes, code)
+	if !ok {
+		return false, nil
+	}
+	burn := `
+		UPDATE users
+		SET two_factor_recovery_codes = array_remove(two_factor_recovery_codes, $2), updated_at = NOW()
+		WHERE id = $1 AND $2 = ANY(two_factor_recovery_codes)
+	`
+	tag, err := s.db.Exec(ctx, burn, userID, hash)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left.
+func (s *PostgresUserStore) CountRecoveryCodes(ctx context.Context, userID int64) (int, error) {
+	var count int
+	query := `SELECT COALESCE(cardinality(two_factor_recovery_codes), 0) FROM users WHERE id = $1`
+	err := s.db.QueryRow(ctx, query, userID).Scan(&count)
+	return count, err
+}
+
 // Activate2FA marks 2FA as enabled for a user.
 func (s *PostgresUserStore) Activate2FA(ctx context.Context, userID int64) error {
 	query := `
@@ -303,11 +669,24 @@ func (s *PostgresUserStore) Activate2FA(ctx context.Context, userID int64) error
 }
 
 // DeleteUser permanently removes a user and all their associated data from the database.
-// The ON DELETE CASCADE constraint on foreign keys will handle related data.
-func (s *PostgresUserStore) DeleteUser(ctx context.Context, userID int64) error {
-	query := `DELETE FROM users WHERE id = $1`
-	_, err := s.db.Exec(ctx, query, userID)
-	return err
+// The ON DELETE CASCADE constraint on foreign keys will handle related data. In the same
+// statement it records a user deletion that each of services must confirm it has erased
+// the user's data for. It returns the key of the user's profile picture, if any, whose
+// blobs the caller must delete.
+func (s *PostgresUserStore) DeleteUser(ctx context.Context, userID int64, services []string) (string, error) {
+	query := `
+		WITH deleted AS (
+			DELETE FROM users WHERE id = $1 RETURNING id, profile_picture_key
+		),
+		` + userDeletionInsert + `
+		SELECT COALESCE(profile_picture_key, '') FROM deleted
+	`
+	var profilePictureKey string
+	err := s.db.QueryRow(ctx, query, userID, services).Scan(&profilePictureKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return profilePictureKey, err
 }
 
 // Disable2FA marks 2FA as disabled for a user and clears the secret.
@@ -321,7 +700,8 @@ func (s *PostgresUserStore) Disable2FA(ctx context.Context, userID int64) error
 	return err
 }
 
-// DeactivateUser sets the deactivated_at timestamp for a user.
+// DeactivateUser sets the deactivated_at timestamp for a user. The user can
+// undo it with ReactivateUser.
 func (s *PostgresUserStore) DeactivateUser(ctx context.Context, userID int64) error {
 	query := `
 		UPDATE users
@@ -354,7 +734,8 @@ func (s *PostgresUserStore) CreatePasswordResetToken(ctx context.Context, userID
 // GetUserByPasswordResetToken retrieves a user by a password reset token.
 func (s *PostgresUserStore) GetUserByPasswordResetToken(ctx context.Context, token string) (*model.User, error) {
 	query := `
-		SELECT u.id, u.email, u.password_hash, u.first_name, u.last_name, u.role, u.preferences, u.created_at, u.updated_at
+		SELECT u.id, u.email, COALESCE(u.password_hash, ''), u.first_name, u.last_name, u.role, u.preferences, u.created_at, u.updated_at, u.email_verified_at,
+		       u.deactivated_at, u.deactivated_by_admin, u.deletion_scheduled_at
 		FROM users u
 		INNER JOIN password_reset_tokens prt ON u.id = prt.user_id
 		WHERE prt.token = $1 AND prt.expires_at > NOW()
@@ -370,6 +751,10 @@ func (s *PostgresUserStore) GetUserByPasswordResetToken(ctx context.Context, tok
 		&user.Preferences,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.EmailVerifiedAt,
+		&user.DeactivatedAt,
+		&user.DeactivatedByAdmin,
+		&user.DeletionScheduledAt,
 	)
 	return &user, err
 }
@@ -381,17 +766,131 @@ func (s *PostgresUserStore) DeletePasswordResetToken(ctx context.Context, token
 	return err
 }
 
+// CreateEmailVerificationToken creates a new email verification token.
+func (s *PostgresUserStore) CreateEmailVerificationToken(ctx context.Context, userID int64, token string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO email_verification_tokens (user_id, token, expires_at)
+		VALUES ($1, $2, $3)
+	`
+	_, err := s.db.Exec(ctx, query, userID, token, expiresAt)
+	return err
+}
+
+// VerifyEmailWithToken marks the email of the token's user as verified and deletes
+// all of that user's verification tokens. It returns pgx.ErrNoRows if the token
+// does not exist or has expired.
+func (s *PostgresUserStore) VerifyEmailWithToken(ctx context.Context, token string) (int64, error) {
+	query := `
+		WITH verified AS (
+			DELETE FROM email_verification_tokens
+			WHERE user_id = (SELECT user_id FROM email_verification_tokens WHERE token = $1 AND expires_at > NOW())
+			RETURNING user_id
+		)
+		UPDATE users
+		SET email_verified_at = COALESCE(email_verified_at, NOW()), updated_at = NOW()
+		WHERE id = (SELECT DISTINCT user_id FROM verified)
+		RETURNING id
+	`
+	var userID int64
+	err := s.db.QueryRow(ctx, query, token).Scan(&userID)
+	return userID, err
+}
+
+// CreateEmailChangeToken stores a pending change of a user's email address to newEmail.
+func (s *PostgresUserStore) CreateEmailChangeToken(ctx context.Context, userID int64, newEmail string, token string, expiresAt time.Time) error {
+	query := `
+		INSERT INTO email_change_tokens (user_id, new_email, token, expires_at)
+		VALUES ($1, $2, $3, $4)
+	`
+	_, err := s.db.Exec(ctx, query, userID, newEmail, token, expiresAt)
+	return err
+}
+
+// ConfirmEmailChange applies the pending email change for a token and deletes all
+// of the user's pending changes. The new address counts as verified, since the
+// token was delivered to it. It returns pgx.ErrNoRows if the token does not exist
+// or has expired, and a unique violation if the new address has been taken since.
+func (s *PostgresUserStore) ConfirmEmailChange(ctx context.Context, token string) (*model.EmailChange, error) {
+	query := `
+		WITH pending AS (
+			DELETE FROM email_change_tokens
+			WHERE user_id = (SELECT user_id FROM email_change_tokens WHERE token = $1 AND expires_at > NOW())
+			RETURNING user_id, token, new_email
+		), previous AS (
+			SELECT id, email FROM users WHERE id = (SELECT user_id FROM pending WHERE token = $1)
+		)
+		UPDATE users u
+		SET email = p.new_email, email_verified_at = NOW(), updated_at = NOW()
+		FROM pending p, previous o
+		WHERE p.token = $1 AND u.id = p.user_id AND o.id = u.id
+		RETURNING u.id, o.email, u.email
+	`
+	var change model.EmailChange
+	err := s.db.QueryRow(ctx, query, token).Scan(&change.UserID, &change.OldEmail, &change.NewEmail)
+	if err != nil {
+		return nil, err
+	}
+	return &change, nil
+}
+
 // UpdatePassword updates a user's password.
+// The previous hash is moved to password_history, which is trimmed to the
+// newest MaxPasswordHistory entries.
 func (s *PostgresUserStore) UpdatePassword(ctx context.Context, userID int64, newPassword string) error {
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
-	query := `UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2`
-	_, err = s.db.Exec(ctx, query, string(hashedPassword), userID)
+	query := `
+		WITH archived AS (
+			INSERT INTO password_history (user_id, password_hash)
+			SELECT id, password_hash FROM users WHERE id = $2 AND password_hash IS NOT NULL
+		)
+		UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2
+	`
+	if _, err = s.db.Exec(ctx, query, string(hashedPassword), userID); err != nil {
+		return err
+	}
+
+	trimQuery := `
+		DELETE FROM password_history
+		WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2
+		)
+	`
+	_, err = s.db.Exec(ctx, trimQuery, userID, MaxPasswordHistory)
 	return err
 }
 
+// GetPasswordHistory returns the bcrypt hashes of the user's current password and
+// up to limit-1 previous ones, newest first.
+func (s *PostgresUserStore) GetPasswordHistory(ctx context.Context, userID int64, limit int) ([]string, error) {
+	query := `
+		SELECT password_hash FROM (
+			SELECT password_hash, 0 AS position, 0 AS id FROM users WHERE id = $1 AND password_hash IS NOT NULL
+			UNION ALL
+			SELECT password_hash, 1, id FROM password_history WHERE user_id = $1
+		) h
+		ORDER BY position, id DESC
+		LIMIT $2
+	`
+	rows, err := s.db.Query(ctx, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes, rows.Err()
+}
+
 // --- Quiz Attempt Storage Functions ---
 
 // CreateQuizAttempt creates a new quiz attempt in the database.
@@ -437,40 +936,3 @@ func (s *PostgresUserStore) GetQuizAttemptsForUser(ctx context.Context, userID i
 	}
 	return attempts, nil
 }
-
-// --- User Activity Storage Functions ---
-
-// CreateUserActivity creates a new user activity record in the database.
-func (s *PostgresUserStore) CreateUserActivity(ctx context.Context, activity *model.UserActivity) error {
-	query := `
-		INSERT INTO user_activities (user_id, activity_type, metadata)
-		VALUES ($1, $2, $3)
-	`
-	_, err := s.db.Exec(ctx, query, activity.UserID, activity.ActivityType, activity.Metadata)
-	return err
-}
-
-// GetUserActivities retrieves all activity records for a given user.
-func (s *PostgresUserStore) GetUserActivities(ctx context.Context, userID int64) ([]*model.UserActivity, error) {
-	query := `
-		SELECT id, user_id, activity_type, metadata, created_at
-		FROM user_activities
-		WHERE user_id = $1
-		ORDER BY created_at DESC
-	`
-	rows, err := s.db.Query(ctx, query, userID)
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-
-	var activities []*model.UserActivity
-	for rows.Next() {
-		var activity model.UserActivity
-		if err := rows.Scan(&activity.ID, &activity.UserID, &activity.ActivityType, &activity.Metadata, &activity.CreatedAt); err != nil {
-			return nil, err
-		}
-		activities = append(activities, &activity)
-	}
-	return activities, nil
-}
@@ -22,3 +22,23 @@ func TestCheckPassword(t *testing.T) {
 		t.Errorf("CheckPassword failed: expected false for incorrect password, got true")
 	}
 }
+
+func TestMatchRecoveryCode(t *testing.T) {
+	codes := []string{"AAAAAAAAAAAAAAAA", "BBBBBBBBBBBBBBBB"}
+	hashes, err := hashRecoveryCodes(codes)
+	if err != nil {
+		t.Fatalf("Failed to hash recovery codes: %v", err)
+	}
+	// Codes stored before lookup keys were added are plain bcrypt hashes.
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("CCCCCCCCCCCCCCCC"), bcrypt.MinCost)
+	hashes = append(hashes, string(legacy))
+
+	for i, code := range append(codes, "CCCCCCCCCCCCCCCC") {
+		if hash, ok := matchRecoveryCode(hashes, code); !ok || hash != hashes[i] {
+			t.Errorf("expected %s to match stored hash %d; got %q, %v", code, i, hash, ok)
+		}
+	}
+	if _, ok := matchRecoveryCode(hashes, "DDDDDDDDDDDDDDDD"); ok {
+		t.Error("expected an unknown code not to match")
+	}
+}
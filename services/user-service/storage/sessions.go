@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/free-education/user-service/model"
+	"github.com/jackc/pgx/v4"
+)
+
+// --- Session Storage Functions ---
+
+// CreateSession starts a new session for a user, storing only the hash of its refresh token.
+func (s *PostgresUserStore) CreateSession(ctx context.Context, session *model.Session, refreshTokenHash string) (*model.Session, error) {
+	query := `
+		INSERT INTO user_sessions (user_id, refresh_token_hash, user_agent, ip_address, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at
+	`
+	var newSession model.Session
+	err := s.db.QueryRow(ctx, query, session.UserID, refreshTokenHash, session.UserAgent, session.IPAddress, session.ExpiresAt).Scan(
+		&newSession.ID,
+		&newSession.UserID,
+		&newSession.UserAgent,
+		&newSession.IPAddress,
+		&newSession.CreatedAt,
+		&newSession.LastUsedAt,
+		&newSession.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &newSession, nil
+}
+
+// RotateSessionRefreshToken replaces a session's refresh token hash and extends its expiry.
+// The update only matches an active, unexpired session holding oldHash, so a refresh token
+// can be exchanged at most once. It returns pgx.ErrNoRows if no such session exists.
+func (s *PostgresUserStore) RotateSessionRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*model.Session, error) {
+	query := `
+		UPDATE user_sessions
+		SET refresh_token_hash = $2, expires_at = $3, last_used_at = NOW()
+		WHERE refresh_token_hash = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		RETURNING id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at
+	`
+	var session model.Session
+	err := s.db.QueryRow(ctx, query, oldHash, newHash, expiresAt).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.UserAgent,
+		&session.IPAddress,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetActiveSessionsForUser retrieves all unrevoked, unexpired sessions for a user, most recently used first.
+func (s *PostgresUserStore) GetActiveSessionsForUser(ctx context.Context, userID int64) ([]*model.Session, error) {
+	query := `
+		SELECT id, user_id, user_agent, ip_address, created_at, last_used_at, expires_at
+		FROM user_sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*model.Session
+	for rows.Next() {
+		var session model.Session
+		if err := rows.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &session.LastUsedAt, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes one of a user's sessions. It returns pgx.ErrNoRows if the
+// session does not exist, belongs to another user, or is already revoked.
+func (s *PostgresUserStore) RevokeSession(ctx context.Context, userID int64, sessionID int64) error {
+	query := `
+		UPDATE user_sessions
+		SET revoked_at = NOW()
+		WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL
+	`
+	tag, err := s.db.Exec(ctx, query, sessionID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeAllSessionsForUser revokes every active session of a user.
+func (s *PostgresUserStore) RevokeAllSessionsForUser(ctx context.Context, userID int64) error {
+	query := `
+		UPDATE user_sessions
+		SET revoked_at = NOW()
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`
+	_, err := s.db.Exec(ctx, query, userID)
+	return err
+}
+
+// RevokeUserTokens records a security event for a user and returns its time.
+// It implements auth.RevocationStore.
+func (s *PostgresUserStore) RevokeUserTokens(ctx context.Context, userID int64) (time.Time, error) {
+	query := `
+		UPDATE users
+		SET tokens_revoked_at = NOW()
+		WHERE id = $1
+		RETURNING tokens_revoked_at
+	`
+	var revokedAt time.Time
+	err := s.db.QueryRow(ctx, query, userID).Scan(&revokedAt)
+	return revokedAt, err
+}
+
+// GetTokensRevokedAt returns the time of a user's last security event, or the zero
+// time if there has never been one. It implements auth.RevocationStore.
+func (s *PostgresUserStore) GetTokensRevokedAt(ctx context.Context, userID int64) (time.Time, error) {
+	query := `SELECT tokens_revoked_at FROM users WHERE id = $1`
+	var revokedAt *time.Time
+	if err := s.db.QueryRow(ctx, query, userID).Scan(&revokedAt); err != nil {
+		return time.Time{}, err
+	}
+	if revokedAt == nil {
+		return time.Time{}, nil
+	}
+	return *revokedAt, nil
+}
@@ -14,24 +14,96 @@ type UserStore interface {
 	GetUserByEmail(ctx context.Context, email string) (*model.User, error)
 	GetUserByOAuthID(ctx context.Context, provider string, providerID string) (*model.User, error)
 	GetUserByID(ctx context.Context, userID int64) (*model.User, error)
-	UpdateUserPreferences(ctx context.Context, userID int64, prefs map[string]interface{}) error
-	UpdateProfilePictureURL(ctx context.Context, userID int64, url string) error
+	ReplaceUserPreferences(ctx context.Context, userID int64, previous, prefs map[string]interface{}) (replaced bool, err error)
+	SetProfilePicture(ctx context.Context, userID int64, key, url string) (previousKey string, err error)
 	Store2FASecrets(ctx context.Context, userID int64, secret string, recoveryCodes []string) error
 	Activate2FA(ctx context.Context, userID int64) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int64, recoveryCodes []string) error
+	ConsumeRecoveryCode(ctx context.Context, userID int64, code string) (bool, error)
+	CountRecoveryCodes(ctx context.Context, userID int64) (int, error)
 	Disable2FA(ctx context.Context, userID int64) error
 	DeactivateUser(ctx context.Context, userID int64) error
-	DeleteUser(ctx context.Context, userID int64) error
+	DeleteUser(ctx context.Context, userID int64, services []string) (profilePictureKey string, err error)
+	ScheduleUserDeletion(ctx context.Context, userID int64, deleteAt time.Time) error
+	ReactivateUser(ctx context.Context, userID int64) error
+	PurgeScheduledDeletions(ctx context.Context, limit int, services []string) (userIDs []int64, profilePictureKeys []string, err error)
 	Get2FAData(ctx context.Context, userID int64) (secret string, enabled bool, err error)
 	CreatePasswordResetToken(ctx context.Context, userID int64, token string, expiresAt time.Time) error
 	GetUserByPasswordResetToken(ctx context.Context, token string) (*model.User, error)
 	DeletePasswordResetToken(ctx context.Context, token string) error
+	CreateEmailVerificationToken(ctx context.Context, userID int64, token string, expiresAt time.Time) error
+	VerifyEmailWithToken(ctx context.Context, token string) (userID int64, err error)
+	CreateEmailChangeToken(ctx context.Context, userID int64, newEmail string, token string, expiresAt time.Time) error
+	ConfirmEmailChange(ctx context.Context, token string) (*model.EmailChange, error)
 	UpdatePassword(ctx context.Context, userID int64, newPassword string) error
+	GetPasswordHistory(ctx context.Context, userID int64, limit int) ([]string, error)
 	GetCompletedLessonsForUser(ctx context.Context, userID int64) ([]int64, error)
 	MarkLessonAsComplete(ctx context.Context, userID int64, lessonID int64) error
 	CreateQuizAttempt(ctx context.Context, attempt *model.CreateQuizAttemptRequest, userID int64) (*model.QuizAttempt, error)
 	GetQuizAttemptsForUser(ctx context.Context, userID int64) ([]model.QuizAttempt, error)
+	GetLessonProgressForUser(ctx context.Context, userID int64) ([]model.LessonProgress, error)
+
+	// Personal data exports
+	CreateDataExport(ctx context.Context, userID int64) (export *model.DataExport, created bool, err error)
+	GetDataExport(ctx context.Context, userID, exportID int64) (*model.DataExport, error)
+	ClaimDataExport(ctx context.Context, staleAfter time.Duration) (*model.DataExport, error)
+	CompleteDataExport(ctx context.Context, exportID int64, archive []byte, expiresAt time.Time) error
+	FailDataExport(ctx context.Context, exportID int64, reason string, expiresAt time.Time) error
+	SetDataExportDownloadToken(ctx context.Context, userID, exportID int64, tokenHash string, expiresAt time.Time) error
+	ConsumeDataExportDownloadToken(ctx context.Context, tokenHash string) (*model.DataExport, []byte, error)
+	DeleteExpiredDataExports(ctx context.Context) (int64, error)
+
+	// Erasure of deleted users' data in other services
+	ClaimErasureRequests(ctx context.Context, retryAfter, maxRetryAfter time.Duration, limit int) ([]*model.ErasureRequest, error)
+	ConfirmUserDataErased(ctx context.Context, deletionID int64, service string) (completed bool, err error)
+
+	// External identities
+	CreateOAuthState(ctx context.Context, state *model.OAuthState) error
+	ConsumeOAuthState(ctx context.Context, state string) (*model.OAuthState, error)
+	CreateLoginCode(ctx context.Context, code *model.LoginCode) error
+	ConsumeLoginCode(ctx context.Context, codeHash string) (*model.LoginCode, error)
+	GetUserIdentities(ctx context.Context, userID int64) ([]*model.UserIdentity, error)
+	LinkIdentity(ctx context.Context, identity *model.UserIdentity) error
+	UnlinkIdentity(ctx context.Context, userID, identityID int64) error
+	BackfillIdentities(ctx context.Context) (int64, error)
+	CreatePendingIdentityLink(ctx context.Context, token string, identity *model.UserIdentity, expiresAt time.Time) error
+	ConfirmPendingIdentityLink(ctx context.Context, token string, userID int64) (*model.UserIdentity, error)
+
+	// WebAuthn credentials
+	CreateWebAuthnCredential(ctx context.Context, credential *model.WebAuthnCredential) error
+	GetWebAuthnCredentials(ctx context.Context, userID int64) ([]*model.WebAuthnCredential, error)
+	UpdateWebAuthnCredentialUsage(ctx context.Context, credential *model.WebAuthnCredential) error
+	RenameWebAuthnCredential(ctx context.Context, userID, credentialID int64, name string) error
+	DeleteWebAuthnCredential(ctx context.Context, userID, credentialID int64) error
+	CreateWebAuthnSession(ctx context.Context, session *model.WebAuthnSession) error
+	ConsumeWebAuthnSession(ctx context.Context, id string) (*model.WebAuthnSession, error)
+
+	// Admin
+	SearchUsers(ctx context.Context, search model.UserSearch) (users []*model.User, total int64, err error)
+	SetUserRole(ctx context.Context, userID int64, role string, entry *model.AdminAuditEntry) (previousRole string, err error)
+	SetUserDeactivated(ctx context.Context, userID int64, deactivated bool, entry *model.AdminAuditEntry) error
+	Reset2FA(ctx context.Context, userID int64, entry *model.AdminAuditEntry) error
+	CreateAdminAuditEntry(ctx context.Context, entry *model.AdminAuditEntry) error
+	GetAdminAuditLog(ctx context.Context, search model.AdminAuditSearch) (entries []*model.AdminAuditEntry, total int64, err error)
 
 	// User Activity
 	CreateUserActivity(ctx context.Context, activity *model.UserActivity) error
 	GetUserActivities(ctx context.Context, userID int64) ([]*model.UserActivity, error)
+	SearchUserActivities(ctx context.Context, search model.UserActivitySearch) ([]*model.UserActivity, error)
+	GetUserActivityDays(ctx context.Context, userID int64, since time.Time, timezone string) ([]*model.UserActivityDay, error)
+	DeleteExpiredUserActivities(ctx context.Context, defaultRetention time.Duration, retention map[string]time.Duration, limit int) (int64, error)
+
+	// Transactions and the outbox
+	InTx(ctx context.Context, fn func(store UserStore) error) error
+	EnqueueEvent(ctx context.Context, event *model.OutboxEvent) error
+	ClaimOutboxEvents(ctx context.Context, retryAfter, maxRetryAfter time.Duration, limit int) ([]*model.OutboxEvent, error)
+	MarkOutboxEventSent(ctx context.Context, id int64) error
+	DeleteSentOutboxEvents(ctx context.Context, sentBefore time.Time) (int64, error)
+
+	// Sessions
+	CreateSession(ctx context.Context, session *model.Session, refreshTokenHash string) (*model.Session, error)
+	RotateSessionRefreshToken(ctx context.Context, oldHash, newHash string, expiresAt time.Time) (*model.Session, error)
+	GetActiveSessionsForUser(ctx context.Context, userID int64) ([]*model.Session, error)
+	RevokeSession(ctx context.Context, userID int64, sessionID int64) error
+	RevokeAllSessionsForUser(ctx context.Context, userID int64) error
 }
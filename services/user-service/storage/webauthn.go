@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/free-education/user-service/model"
+	"github.com/jackc/pgx/v4"
+)
+
+// --- WebAuthn Storage Functions ---
+
+// CreateWebAuthnCredential stores a newly registered credential and fills in its ID
+// and creation time. It returns a unique violation if the credential is already registered.
+func (s *PostgresUserStore) CreateWebAuthnCredential(ctx context.Context, credential *model.WebAuthnCredential) error {
+	query := `
+		INSERT INTO webauthn_credentials (user_id, credential_id, public_key, attestation_type, transports, aaguid, sign_count, backup_eligible, backup_state, name)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at
+	`
+	return s.db.QueryRow(ctx, query,
+		credential.UserID,
+		credential.CredentialID,
+		credential.PublicKey,
+		credential.AttestationType,
+		credential.Transports,
+		credential.AAGUID,
+		int64(credential.SignCount),
+		credential.BackupEligible,
+		credential.BackupState,
+		credential.Name,
+	).Scan(&credential.ID, &credential.CreatedAt)
+}
+
+// GetWebAuthnCredentials returns the credentials a user has registered, oldest first.
+func (s *PostgresUserStore) GetWebAuthnCredentials(ctx context.Context, userID int64) ([]*model.WebAuthnCredential, error) {
+	query := `
+		SELECT id, user_id, credential_id, public_key, attestation_type, COALESCE(transports, '{}'), aaguid,
+		       sign_count, backup_eligible, backup_state, name, created_at, last_used_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at, id
+	`
+	rows, err := s.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var credentials []*model.WebAuthnCredential
+	for rows.Next() {
+		var c model.WebAuthnCredential
+		var signCount int64
+		if err := rows.Scan(&c.ID, &c.UserID, &c.CredentialID, &c.PublicKey, &c.AttestationType, &c.Transports, &c.AAGUID,
+			&signCount, &c.BackupEligible, &c.BackupState, &c.Name, &c.CreatedAt, &c.LastUsedAt); err != nil {
+			return nil, err
+		}
+		c.SignCount = uint32(signCount)
+		credentials = append(credentials, &c)
+	}
+	return credentials, rows.Err()
+}
+
+// UpdateWebAuthnCredentialUsage records that a credential was used to sign in,
+// storing its new signature counter and backup state.
+func (s *PostgresUserStore) UpdateWebAuthnCredentialUsage(ctx context.Context, credential *model.WebAuthnCredential) error {
+	query := `
+		UPDATE webauthn_credentials
+		SET sign_count = $1, backup_state = $2, last_used_at = NOW()
+		WHERE id = $3
+	`
+	_, err := s.db.Exec(ctx, query, int64(credential.SignCount), credential.BackupState, credential.ID)
+	return err
+}
+
+// RenameWebAuthnCredential renames one of a user's credentials. It returns
+// pgx.ErrNoRows if the credential does not exist or belongs to someone else.
+func (s *PostgresUserStore) RenameWebAuthnCredential(ctx context.Context, userID, credentialID int64, name string) error {
+	query := `UPDATE webauthn_credentials SET name = $1 WHERE id = $2 AND user_id = $3`
+	tag, err := s.db.Exec(ctx, query, name, credentialID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteWebAuthnCredential removes one of a user's credentials, unless it is the
+// user's last way to sign in, i.e. the user has no password, linked identity or
+// other credential. It returns pgx.ErrNoRows if the credential does not exist,
+// belongs to someone else or is the last sign-in method.
+func (s *PostgresUserStore) DeleteWebAuthnCredential(ctx context.Context, userID, credentialID int64) error {
+	query := `
+		DELETE FROM webauthn_credentials
+		WHERE id = $1 AND user_id = $2
+		  AND (
+			EXISTS (SELECT 1 FROM users WHERE id = $2 AND password_hash IS NOT NULL)
+			OR EXISTS (SELECT 1 FROM user_identities WHERE user_id = $2)
+			OR (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $2) > 1
+		  )
+	`
+	tag, err := s.db.Exec(ctx, query, credentialID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// CreateWebAuthnSession stores the state of a ceremony until the client answers it.
+func (s *PostgresUserStore) CreateWebAuthnSession(ctx context.Context, session *model.WebAuthnSession) error {
+	query := `
+		INSERT INTO webauthn_sessions (id, user_id, purpose, data, expires_at)
+		VALUES ($1, NULLIF($2, 0), $3, $4, $5)
+	`
+	_, err := s.db.Exec(ctx, query, session.ID, session.UserID, session.Purpose, session.Data, session.ExpiresAt)
+	return err
+}
+
+// ConsumeWebAuthnSession looks up and deletes a ceremony's state in one step, so
+// each challenge can be answered at most once. It returns pgx.ErrNoRows if the
+// session does not exist or has expired. Expired sessions are cleaned up along the way.
+func (s *PostgresUserStore) ConsumeWebAuthnSession(ctx context.Context, id string) (*model.WebAuthnSession, error) {
+	query := `
+		DELETE FROM webauthn_sessions
+		WHERE id = $1 OR expires_at <= NOW()
+		RETURNING id, COALESCE(user_id, 0), purpose, data, expires_at
+	`
+	rows, err := s.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found *model.WebAuthnSession
+	for rows.Next() {
+		var session model.WebAuthnSession
+		if err := rows.Scan(&session.ID, &session.UserID, &session.Purpose, &session.Data, &session.ExpiresAt); err != nil {
+			return nil, err
+		}
+		if session.ID == id && session.ExpiresAt.After(time.Now()) {
+			found = &session
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, pgx.ErrNoRows
+	}
+	return found, nil
+}